@@ -0,0 +1,232 @@
+// Package client is the Go API of macpine. It manages the same instances as the alpine command, in the
+// data directory (~/.macpine, $MACPINE_HOME or host.SetDataDir), and reports every failure as an error
+// rather than exiting. Long running calls take a context, cancelling it stops waiting and undoes what
+// the call started where that is possible.
+//
+// Instances are described by qemu.MachineConfig, the contents of their config.yaml.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// GracefulStopTimeout bounds a graceful Stop whose context has no deadline
+var GracefulStopTimeout = time.Minute
+
+// Instance is an instance as reported by List
+type Instance struct {
+	Name string
+	// Status is Running, Stopped, Paused or Broken
+	Status string
+	// PID is the qemu process of a running or paused instance
+	PID int
+	// Config is empty for broken instances
+	Config qemu.MachineConfig
+	// Err tells why the configuration of a broken instance cannot be loaded
+	Err error
+}
+
+// List returns every instance, including broken ones
+func List() ([]Instance, error) {
+	if _, err := host.DataDir(); err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	for _, vmName := range host.ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			instances = append(instances, Instance{Name: vmName, Status: host.StatusBroken, Err: err})
+			continue
+		}
+		status, pid := host.Status(machineConfig)
+		instances = append(instances, Instance{Name: vmName, Status: status, PID: pid, Config: machineConfig})
+	}
+	return instances, nil
+}
+
+// Get returns the configuration of an instance
+func Get(name string) (qemu.MachineConfig, error) {
+	if err := exists(name); err != nil {
+		return qemu.MachineConfig{}, err
+	}
+	return qemu.GetMachineConfig(name)
+}
+
+// Launch creates an instance from config and boots it. Alias and Image, such as
+// alpine_3.20.3-aarch64.qcow2, are required. Location defaults to the data directory and unset
+// resources, network, SSH and MAC settings get the defaults of `alpine launch`. If the launch fails or
+// ctx is cancelled, the instance is removed.
+func Launch(ctx context.Context, config qemu.MachineConfig) error {
+	if config.Image == "" {
+		return errors.New("an image is required")
+	}
+	if err := utils.ValidateName(config.Alias); err != nil {
+		return err
+	}
+	if config.Location == "" {
+		dataDir, err := host.DataDir()
+		if err != nil {
+			return err
+		}
+		config.Location = filepath.Join(dataDir, config.Alias)
+	}
+	if config.Arch == "" {
+		arch, err := utils.HostArch()
+		if err != nil {
+			return err
+		}
+		config.Arch = arch
+	}
+	if config.CPU == "" {
+		config.CPU = "2"
+	}
+	if config.Memory == "" {
+		config.Memory = "2048"
+	}
+	if config.Disk == "" {
+		config.Disk = "5G"
+	}
+	if config.Network == "" {
+		config.Network = qemu.NetworkUser
+	}
+	if config.MachineIP == "" {
+		config.MachineIP = "localhost"
+	}
+	if config.SSHPort == "" {
+		config.SSHPort = "22"
+	}
+	if config.SSHUser == "" {
+		config.SSHUser = "root"
+	}
+	if config.SSHPassword == "" {
+		config.SSHPassword = utils.RawCredential("root")
+	}
+	if config.MACAddress == "" {
+		mac, err := utils.GenerateMACAddress()
+		if err != nil {
+			return err
+		}
+		config.MACAddress = mac
+	}
+
+	lock, err := config.Reserve()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	err = host.LaunchWithContext(ctx, config)
+	if err != nil {
+		// Stop checks that the PID is still this instance's qemu before killing it
+		config.Stop()
+		os.RemoveAll(config.Location)
+		return err
+	}
+	return nil
+}
+
+// Start boots a stopped instance, with its restart policy supervisor and reverse port forwarder if
+// it has them, and its clock watcher
+func Start(ctx context.Context, name string) error {
+	if err := exists(name); err != nil {
+		return err
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(name)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if status, _ := machineConfig.Status(); status != "Stopped" {
+		return errors.New(name + " is already running")
+	}
+
+	err = host.Start(ctx, machineConfig)
+	if err != nil {
+		host.Stop(machineConfig)
+		return err
+	}
+	if err := host.StartSupervisor(machineConfig); err != nil {
+		return err
+	}
+	if err := host.StartForwarder(machineConfig); err != nil {
+		return err
+	}
+	return host.StartClockWatcher(machineConfig)
+}
+
+// Stop stops an instance. A graceful stop powers the guest off over SSH and waits for qemu to exit,
+// killing it once ctx is done or GracefulStopTimeout has passed. Stopping a stopped instance is not
+// an error.
+func Stop(ctx context.Context, name string, graceful bool) error {
+	if err := exists(name); err != nil {
+		return err
+	}
+	machineConfig, lock, err := qemu.LockMachineConfigForStop(name)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	status, _ := machineConfig.Status()
+	if status == "Stopped" {
+		return nil
+	}
+	if status == "Paused" {
+		host.Resume(machineConfig)
+	}
+
+	if graceful && machineConfig.HasNetwork() {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, GracefulStopTimeout)
+			defer cancel()
+		}
+		return host.Shutdown(ctx, machineConfig)
+	}
+	return host.Stop(machineConfig)
+}
+
+// Delete stops an instance and removes it with its disks
+func Delete(ctx context.Context, name string) error {
+	if err := exists(name); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return host.Delete(name)
+}
+
+// Exec runs command on a running instance as its SSH user, connecting the given streams, any of
+// which may be nil. A command that exits with a non-zero status returns an *ssh.ExitError.
+func Exec(ctx context.Context, name string, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if err := exists(name); err != nil {
+		return err
+	}
+	machineConfig, err := qemu.GetMachineConfig(name)
+	if err != nil {
+		return err
+	}
+	if status, _ := machineConfig.Status(); status != "Running" {
+		return errors.New(name + " is not running")
+	}
+	return machineConfig.Run(ctx, command, false, stdin, stdout, stderr)
+}
+
+func exists(name string) error {
+	if !utils.StringSliceContains(host.ListVMNames(), name) {
+		return errors.New("unknown instance " + name)
+	}
+	return nil
+}
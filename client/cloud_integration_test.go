@@ -0,0 +1,108 @@
+//go:build integration
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// TestLaunchCloudImage boots an Ubuntu cloud image, or the image named by MACPINE_TEST_CLOUD_IMAGE
+// such as debian_12, and runs a command on it over SSH. It downloads the image and needs qemu and
+// sudo, so it only runs with
+//
+//	go test -tags integration -timeout 30m ./client
+func TestLaunchCloudImage(t *testing.T) {
+	image := os.Getenv("MACPINE_TEST_CLOUD_IMAGE")
+	if image == "" {
+		image = "ubuntu_24.04"
+	}
+	arch, err := utils.HostArch()
+	if err != nil {
+		t.Skip(err)
+	}
+	if _, err := exec.LookPath("qemu-system-" + arch); err != nil {
+		t.Skip("qemu-system-" + arch + " is not installed")
+	}
+
+	// the instance and the downloaded image go to a directory of their own, MACPINE_IMAGE_DIR can
+	// hold the image to save the download. t.TempDir is too deep for the QMP socket path on macOS.
+	dataDir, err := os.MkdirTemp("", "macpine-integration-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dataDir) })
+	t.Setenv(utils.DataDirEnv, dataDir)
+
+	firmware := qemu.DefaultFirmware(arch)
+	cloudImage, err := qemu.ResolveCloudImage(image, arch, firmware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloudImage.Distro == qemu.DistroAlpine {
+		t.Fatal(image + " is an Alpine image, the test boots other distros")
+	}
+
+	config := qemu.MachineConfig{
+		Alias:        "integration",
+		Image:        cloudImage.File,
+		ImageURL:     cloudImage.URL,
+		Distro:       cloudImage.Distro,
+		Arch:         arch,
+		Memory:       "2048",
+		Disk:         "10G",
+		SSHPort:      freePort(t),
+		SSHUser:      cloudImage.Distro,
+		SSHPassword:  utils.RawCredential("root"),
+		RootUsername: cloudImage.Distro,
+		Firmware:     firmware,
+		CloudInit:    "inline",
+		UserData: []byte("#cloud-config\nssh_pwauth: true\nchpasswd:\n  expire: false\n  users:\n" +
+			"    - name: " + cloudImage.Distro + "\n      password: root\n      type: text\n"),
+	}
+	if err := config.RenewInstanceID(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Minute)
+	defer cancel()
+	if err := Launch(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := Delete(context.Background(), config.Alias); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	execCtx, cancelExec := context.WithTimeout(ctx, time.Minute)
+	defer cancelExec()
+	var stdout, stderr bytes.Buffer
+	if err := Exec(execCtx, config.Alias, "cat /etc/os-release", nil, &stdout, &stderr); err != nil {
+		t.Fatal(err.Error() + ": " + stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "ID="+cloudImage.Distro+"\n") {
+		t.Errorf("%s booted\n%s\nwant ID=%s", image, stdout.String(), cloudImage.Distro)
+	}
+}
+
+// freePort returns a host port nothing listens on, for the SSH forward of the instance
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// autostartCmd groups commands managing instances started at login
+var autostartCmd = &cobra.Command{
+	Use:   "autostart",
+	Short: "Start instances at login via launchd.",
+}
+
+// autostartEnableCmd installs a launchd agent for instances
+var autostartEnableCmd = &cobra.Command{
+	Use:   "enable <instance> [<instance>...]",
+	Short: "Start instances at login.",
+	Run:   autostartEnable,
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+// autostartDisableCmd removes the launchd agent of instances
+var autostartDisableCmd = &cobra.Command{
+	Use:   "disable <instance> [<instance>...]",
+	Short: "Stop starting instances at login.",
+	Run:   autostartDisable,
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+// autostartListCmd shows the autostart state of all instances
+var autostartListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "Show which instances start at login.",
+	Run:     autostartList,
+	Aliases: []string{"ls"},
+
+	DisableFlagsInUseLine: true,
+}
+
+// enableCmd is a shortcut for autostart enable
+var enableCmd = &cobra.Command{
+	Use:   "enable <instance> [<instance>...]",
+	Short: "Start instances at login. Same as `alpine autostart enable`.",
+	Run:   autostartEnable,
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+// disableCmd is a shortcut for autostart disable
+var disableCmd = &cobra.Command{
+	Use:   "disable <instance> [<instance>...]",
+	Short: "Stop starting instances at login. Same as `alpine autostart disable`.",
+	Run:   autostartDisable,
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	autostartCmd.AddCommand(autostartEnableCmd)
+	autostartCmd.AddCommand(autostartDisableCmd)
+	autostartCmd.AddCommand(autostartListCmd)
+}
+
+func autostartEnable(cmd *cobra.Command, args []string) {
+	setAutostart(args, true)
+}
+
+func autostartDisable(cmd *cobra.Command, args []string) {
+	setAutostart(args, false)
+}
+
+func setAutostart(args []string, enable bool) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	args, err := host.ExpandTagArguments(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	vmList := host.ListVMNames()
+	errs := make([]utils.CmdResult, len(args))
+	for i, vmName := range args {
+		if utils.StringSliceContains(args[:i], vmName) {
+			continue
+		}
+		if !utils.StringSliceContains(vmList, vmName) {
+			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
+			continue
+		}
+
+		machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+
+		if enable {
+			err = host.EnableAutostart(machineConfig)
+		} else {
+			err = host.DisableAutostart(vmName)
+		}
+		if err != nil {
+			lock.Unlock()
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+
+		machineConfig.Autostart = enable
+		err = qemu.SaveMachineConfig(machineConfig)
+		lock.Unlock()
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+
+		if enable {
+			log.Printf("%s will start at login\n", vmName)
+		} else {
+			log.Printf("%s will no longer start at login\n", vmName)
+		}
+	}
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Errorf("failed to update autostart for %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln("error updating autostart")
+	}
+}
+
+func autostartList(cmd *cobra.Command, args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tAUTOSTART\tAGENT\t")
+	for _, vmName := range host.ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		state := "disabled"
+		if machineConfig.Autostart {
+			state = "enabled"
+		}
+
+		agent := "-"
+		installed := host.AutostartInstalled(vmName)
+		if installed {
+			agent = host.AutostartLabel(vmName)
+		}
+		// the flag and the plist can drift apart when either is edited by hand
+		if installed != machineConfig.Autostart {
+			state += " (out of sync, run autostart enable or disable)"
+		}
+
+		fmt.Fprintln(w, vmName+"    \t"+state+"    \t"+agent+"    \t")
+	}
+	w.Flush()
+}
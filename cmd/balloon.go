@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// balloonCmd reads or changes the memory of a running instance through its balloon device
+var balloonCmd = &cobra.Command{
+	Use:   "balloon <instance> [size]",
+	Short: "Show or change the memory of a running instance.",
+	Long: `Inflate or deflate the memory balloon of a running instance, handing memory back to the host
+or returning it to the guest. size is in MB, or has an M or G suffix, and cannot exceed the memory
+the instance was launched with. Without size, print the memory the guest currently has.
+The instance needs the balloon device: launch it with --balloon or run ` + "`alpine set <instance> --balloon`" + ` and restart it.`,
+	Run: balloonMemory,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func balloonMemory(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if len(args) > 1 {
+		size, err := parseMemorySize(args[1])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = machineConfig.SetBalloonSize(size)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("requested " + strconv.FormatInt(size, 10) + "M for " + vmName)
+		return
+	}
+
+	size, err := machineConfig.BalloonSize()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%dM of %sM\n", size, machineConfig.Memory)
+}
+
+// parseMemorySize converts 512, 512M or 2G to MB
+func parseMemorySize(size string) (int64, error) {
+	s := strings.ToUpper(size)
+	multiplier := int64(1)
+	if strings.HasSuffix(s, "G") {
+		multiplier = 1024
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(s, "MG"), 10, 64)
+	if err != nil || n <= 0 || strings.Count(s, "M")+strings.Count(s, "G") > 1 {
+		return 0, errors.New("invalid memory size " + size + ", expected MB or a size such as 512M or 2G")
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// cloudInitCmd groups cloud-init seed management commands
+var cloudInitCmd = &cobra.Command{
+	Use:   "cloud-init",
+	Short: "Manage the cloud-init seed of instances.",
+}
+
+// cloudInitRegenCmd rebuilds the cloud-init seed of an instance
+var cloudInitRegenCmd = &cobra.Command{
+	Use:   "regen <instance> [<instance>...]",
+	Short: "Rebuild the cloud-init seed from the files stored in the instance directory.",
+	Run:   cloudInitRegen,
+
+	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	cloudInitCmd.AddCommand(cloudInitRegenCmd)
+}
+
+func cloudInitRegen(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	args, err := host.ExpandTagArguments(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	vmList := host.ListVMNames()
+	errs := make([]utils.CmdResult, len(args))
+	for i, vmName := range args {
+		if utils.StringSliceContains(args[:i], vmName) {
+			continue
+		}
+		if !utils.StringSliceContains(vmList, vmName) {
+			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
+			continue
+		}
+
+		machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+		err = rebuildSeed(&machineConfig)
+		lock.Unlock()
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
+		}
+		log.Printf("%s seed rebuilt (instance-id %s), restart the instance for changes to take effect\n", vmName, machineConfig.InstanceID)
+	}
+	wasErr := false
+	for _, res := range errs {
+		if res.Err != nil {
+			log.Errorf("failed to rebuild seed for %s: %v\n", res.Name, res.Err)
+			wasErr = true
+		}
+	}
+	if wasErr {
+		log.Fatalln("error rebuilding cloud-init seed(s)")
+	}
+}
+
+// rebuildSeed renews the instance-id of a cloud-init instance and regenerates its seed
+func rebuildSeed(machineConfig *qemu.MachineConfig) error {
+	if machineConfig.CloudInit == "" {
+		return errors.New("not a cloud-init instance")
+	}
+	if err := machineConfig.RenewInstanceID(); err != nil {
+		return err
+	}
+	if err := machineConfig.WriteCloudInitSeed(); err != nil {
+		return err
+	}
+	return qemu.SaveMachineConfig(*machineConfig)
+}
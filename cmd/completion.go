@@ -2,10 +2,10 @@ package cmd
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"strings"
 
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/spf13/cobra"
 )
 
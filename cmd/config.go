@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/spf13/cobra"
+)
+
+// configCmd groups commands inspecting the global configuration. It used to be an alias of edit,
+// so instance names are still handed to edit.
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the global configuration. `alpine config <instance>` is `alpine edit <instance>`.",
+	Run:   config,
+
+	ValidArgsFunction: host.AutoCompleteVMNamesOrTags,
+}
+
+// configDefaultsCmd prints the effective launch defaults
+var configDefaultsCmd = &cobra.Command{
+	Use:   "defaults",
+	Short: "Show the defaults used for new instances and where each comes from.",
+	Long: `Show the defaults used for new instances and where each comes from.
+
+Launch defaults are read from ~/.macpine/defaults.yaml, then from the defaults section of
+~/.macpine/config.yaml, which overrides it key by key, then from MACPINE_* environment variables.
+Flags given on the command line take precedence over all of them.`,
+	Run: configDefaults,
+
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	configCmd.AddCommand(configDefaultsCmd)
+}
+
+func config(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		cmd.Help()
+		return
+	}
+	edit(cmd, args)
+}
+
+func configDefaults(cmd *cobra.Command, args []string) {
+	globalConfig, err := host.GetGlobalConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	launchDefaults, err := host.GetLaunchDefaults(globalConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE\t")
+	for _, key := range host.LaunchDefaultKeys {
+		d, ok := launchDefaults[key]
+		if !ok {
+			d = builtinLaunchDefault(key)
+		}
+
+		value := d.Value
+		if value == "" {
+			value = "-"
+		}
+		source := d.Source
+		if d.Origin != "" {
+			source += " (" + d.Origin + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", key, value, source)
+	}
+	w.Flush()
+}
+
+// builtinLaunchDefault is the value a new instance gets when nothing overrides it
+func builtinLaunchDefault(key string) host.LaunchDefault {
+	d := host.LaunchDefault{Key: key, Source: host.DefaultSourceBuiltin}
+	switch key {
+	case "sshuser":
+		d.Value = "root, alpine for launch-cloud"
+	case "arch":
+		d.Value = "host architecture"
+	case "tags":
+	default:
+		d.Value = launchCmd.Flags().Lookup(launchDefaultFlags[key]).DefValue
+	}
+	return d
+}
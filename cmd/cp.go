@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// cpCmd copies files between the host and an instance
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copy files between the host and an instance.",
+	Long: `Copy files between the host and an instance over SFTP, using the SSH credentials of the instance.
+Paths inside an instance are given as <instance>:<path>.
+
+  alpine cp ./app.conf vm01:/etc/app.conf
+  alpine cp -r vm01:/var/log ./logs`,
+	Run: cp,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var cpRecursive bool
+
+func init() {
+	cpCmd.Flags().BoolVarP(&cpRecursive, "recursive", "r", false, "Copy directories recursively.")
+}
+
+// splitInstancePath splits <instance>:<path>, reporting false for host paths
+func splitInstancePath(arg string, vmList []string) (string, string, bool) {
+	name, p, found := strings.Cut(arg, ":")
+	if !found || !utils.StringSliceContains(vmList, name) {
+		return "", arg, false
+	}
+	return name, p, true
+}
+
+func cp(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatal("cp requires a source and a destination")
+	}
+
+	vmList := host.ListVMNames()
+	srcName, src, srcRemote := splitInstancePath(args[0], vmList)
+	dstName, dst, dstRemote := splitInstancePath(args[1], vmList)
+
+	if srcRemote == dstRemote {
+		log.Fatal("exactly one of source and destination must be an instance path (<instance>:<path>)")
+	}
+
+	vmName := srcName
+	if dstRemote {
+		vmName = dstName
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if status, _ := machineConfig.Status(); status != "Running" {
+		log.Fatalf("%s is not running", machineConfig.Alias)
+	}
+
+	if dstRemote {
+		err = machineConfig.CopyTo(src, dst, cpRecursive)
+	} else {
+		err = machineConfig.CopyFrom(src, dst, cpRecursive)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/beringresearch/macpine/host"
+	"github.com/spf13/cobra"
+)
+
+// flags that identify a single instance or select a preset, and so cannot be given a default
+var nonDefaultableFlags = []string{"name", "help", "profile"}
+
+// launchDefaultFlags maps the launch defaults that have a flag to its name, sshuser and tags do not
+var launchDefaultFlags = map[string]string{
+	"image": "image", "arch": "arch", "cpu": "cpu", "memory": "memory", "disk": "disk", "mount": "mount",
+}
+
+// applyGlobalDefaults sets the flags of a launch command that were not given on the command line
+// from the global config, so that flag > profile > MACPINE_* > global defaults > defaults.yaml >
+// built-in default. The launch defaults are returned for the settings that have no flag.
+func applyGlobalDefaults(cmd *cobra.Command, profile string) (map[string]host.LaunchDefault, error) {
+	globalConfig, err := host.GetGlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	launchDefaults, err := host.GetLaunchDefaults(globalConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]bool)
+	if profile != "" {
+		values, ok := globalConfig.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q. available profiles: %s", profile, strings.Join(profileNames(globalConfig), ", "))
+		}
+		if err := applyDefaults(cmd, values, "profiles."+profile, applied); err != nil {
+			return nil, err
+		}
+		for _, key := range []string{"sshuser", "tags"} {
+			if value, ok := values[key]; ok {
+				launchDefaults[key] = host.LaunchDefault{Key: key, Value: value, Source: host.DefaultSourceProfile, Origin: "profiles." + profile}
+			}
+		}
+	}
+	// MACPINE_* variables take precedence over the defaults section and defaults.yaml, which
+	// GetLaunchDefaults has merged
+	for key, d := range launchDefaults {
+		name, ok := launchDefaultFlags[key]
+		if !ok {
+			continue
+		}
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed || applied[name] {
+			continue
+		}
+		if err := flag.Value.Set(d.Value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", d.Value, d.Origin, err)
+		}
+		applied[name] = true
+	}
+	return launchDefaults, applyDefaults(cmd, globalConfig.Defaults, "defaults", applied)
+}
+
+// defaultSSHUser returns the SSH user of a new instance, builtin unless a launch default sets one
+func defaultSSHUser(launchDefaults map[string]host.LaunchDefault, builtin string) string {
+	if d, ok := launchDefaults["sshuser"]; ok {
+		return d.Value
+	}
+	return builtin
+}
+
+// defaultTags returns the tags a new instance starts with, sorted
+func defaultTags(launchDefaults map[string]host.LaunchDefault) []string {
+	tags := []string{}
+	if d, ok := launchDefaults["tags"]; ok {
+		for _, tag := range strings.Split(d.Value, ",") {
+			tags = mergeTags(tags, []string{strings.TrimSpace(tag)})
+		}
+	}
+	return tags
+}
+
+func applyDefaults(cmd *cobra.Command, values map[string]string, section string, applied map[string]bool) error {
+	for name, value := range values {
+		if err := validateDefaultKey(cmd.Root(), name, section); err != nil {
+			return err
+		}
+
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed || applied[name] {
+			// not applicable to this launch command, or set by a higher precedence source
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid value %q for %s.%s in global config: %v", value, section, name, err)
+		}
+		applied[name] = true
+	}
+	return nil
+}
+
+// validateDefaultKey checks that a global config key names a flag of one of the launch commands, or a
+// launch default without a flag
+func validateDefaultKey(root *cobra.Command, name string, section string) error {
+	if name == "sshuser" || name == "tags" {
+		return nil
+	}
+	for _, reserved := range nonDefaultableFlags {
+		if name == reserved {
+			return fmt.Errorf("%s.%s in global config: --%s cannot have a default", section, name, name)
+		}
+	}
+	for _, c := range root.Commands() {
+		if (c.Name() == "launch" || c.Name() == "launch-cloud") && c.Flags().Lookup(name) != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s.%s in global config: unknown launch flag --%s", section, name, name)
+}
+
+func profileNames(globalConfig host.GlobalConfig) []string {
+	names := []string{}
+	for name := range globalConfig.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// autoCompleteProfiles completes --profile with the profiles defined in the global config
+func autoCompleteProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	globalConfig, err := host.GetGlobalConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return profileNames(globalConfig), cobra.ShellCompDirectiveNoFileComp
+}
@@ -1,19 +1,28 @@
 package cmd
 
 import (
+	"context"
 	"errors"
-	"log"
 	"os"
+	"strings"
 
+	"github.com/beringresearch/macpine/client"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var deleteCmd = &cobra.Command{
-	Use:     "delete <instance> [<instance>...]",
-	Short:   "Delete instances.",
+	Use:   "delete <instance> [<instance>...]",
+	Short: "Delete instances.",
+	Long: `Delete instances with their disks. This cannot be undone.
+
+The instances are listed with the size of their disks and the deletion is confirmed first. --yes skips
+the question, and is required when standard input is not a terminal. --force skips it as well and
+deletes running instances, which are otherwise refused, powering them off first.`,
 	Run:     delete,
 	Aliases: []string{"del", "rm", "remove"},
 
@@ -21,19 +30,37 @@ var deleteCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
-func delete(cmd *cobra.Command, args []string) {
+var deleteForce bool
+var deleteYes bool
+var deleteAll bool
+var deleteTags, deleteLabels []string
 
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
-	}
+func init() {
+	deleteCmd.Flags().BoolVarP(&deleteForce, "force", "f", false, "Do not ask for confirmation, and delete running instances too, powering them off first.")
+	deleteCmd.Flags().BoolVarP(&deleteYes, "yes", "y", false, "Do not ask for confirmation, as required when standard input is not a terminal.")
+	deleteCmd.Flags().BoolVar(&deleteAll, "all", false, "Delete every instance.")
+	deleteCmd.Flags().StringArrayVar(&deleteTags, "tag", []string{}, "Only delete instances with this tag. Repeat to require several tags.")
+	deleteCmd.RegisterFlagCompletionFunc("tag", host.AutoCompleteTags)
+	deleteCmd.Flags().StringArrayVar(&deleteLabels, "label-filter", []string{}, "Only delete instances with this key=value label. Repeat to require several labels.")
+	deleteCmd.Flags().BoolVar(&host.SkipHooks, "no-hooks", false, "Do not run the lifecycle hooks of the instances.")
+}
 
-	args, err := host.ExpandTagArguments(args)
+func delete(cmd *cobra.Command, args []string) {
+	labels, err := qemu.ParseLabels(deleteLabels)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	args, err = host.SelectInstances(args, deleteAll, deleteTags, labels)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	vmList := host.ListVMNames()
 	errs := make([]utils.CmdResult, len(args))
+	// indices of the instances to delete, after the checks
+	selected := []int{}
+	summaries := []string{}
+	running := map[string]bool{}
 	for i, vmName := range args {
 		if utils.StringSliceContains(args[:i], vmName) {
 			continue
@@ -43,20 +70,50 @@ func delete(cmd *cobra.Command, args []string) {
 			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
 			continue
 		}
-
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+		status := "Stopped"
+		if machineConfig, err := qemu.GetMachineConfigForStop(vmName); err == nil {
+			status, _ = machineConfig.Status()
+		}
+		// a qemu the pidfile does not lead to, as with a broken instance, is found by its command line
+		if processes, err := host.InstanceProcesses(vmName); status == "Stopped" && err == nil && len(processes) > 0 {
+			status = "Running"
 		}
+		if status != "Stopped" {
+			if !deleteForce {
+				errs[i] = utils.CmdResult{Name: vmName, Err: errors.New(vmName + " is " + strings.ToLower(status) + ", stop it first or use --force")}
+				continue
+			}
+			running[vmName] = true
+		}
+		selected = append(selected, i)
+		summaries = append(summaries, deleteSummary(vmName))
+	}
 
-		err = host.Stop(machineConfig)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+	if len(selected) > 0 && !deleteYes && !deleteForce {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			log.Fatalln("standard input is not a terminal, pass --yes to delete " + strings.Join(summaries, ", ") + " without confirmation")
+		}
+		if !utils.Confirm("delete "+strings.Join(summaries, ", ")+"? this cannot be undone", false) {
+			log.Fatalln("nothing deleted")
 		}
+	}
 
-		err = os.RemoveAll(machineConfig.Location)
+	for _, i := range selected {
+		vmName := args[i]
+		if running[vmName] {
+			log.Println("stopping " + vmName)
+			if !host.IsBroken(vmName) {
+				if err := client.Stop(context.Background(), vmName, true); err != nil {
+					errs[i] = utils.CmdResult{Name: vmName, Err: err}
+					continue
+				}
+			}
+			if err := host.KillInstanceProcesses(vmName); err != nil {
+				errs[i] = utils.CmdResult{Name: vmName, Err: err}
+				continue
+			}
+		}
+		err = client.Delete(context.Background(), vmName)
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
 			continue
@@ -66,7 +123,7 @@ func delete(cmd *cobra.Command, args []string) {
 	wasErr := false
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("failed to delete %s: %v\n", res.Name, res.Err)
+			log.Errorf("failed to delete %s: %v\n", res.Name, res.Err)
 			wasErr = true
 		}
 	}
@@ -74,3 +131,17 @@ func delete(cmd *cobra.Command, args []string) {
 		log.Fatalln("error deleting instance(s)")
 	}
 }
+
+// deleteSummary names an instance with the space its disk takes on the host, e.g. dev (1.2G disk)
+func deleteSummary(vmName string) string {
+	machineConfig, err := qemu.GetMachineConfigForStop(vmName)
+	if err != nil {
+		return vmName + " (broken)"
+	}
+	// the virtual size is not needed, only the space the disk takes
+	actual, _, err := machineConfig.DiskUsage()
+	if err != nil && actual == 0 {
+		return vmName
+	}
+	return vmName + " (" + utils.FormatBytes(actual) + " disk)"
+}
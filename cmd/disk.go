@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// diskCmd groups commands managing the data disks of an instance
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage additional data disks of instances.",
+}
+
+// diskAddCmd creates and attaches a data disk
+var diskAddCmd = &cobra.Command{
+	Use:   "add <instance> <size[:format]>",
+	Short: "Attach a new empty disk to a stopped instance.",
+	Run:   diskAdd,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+// diskRmCmd detaches and deletes a data disk
+var diskRmCmd = &cobra.Command{
+	Use:     "rm <instance> <disk>",
+	Short:   "Detach and delete a disk from a stopped instance.",
+	Run:     diskRm,
+	Aliases: []string{"remove"},
+
+	ValidArgsFunction:     autoCompleteDataDisks,
+	DisableFlagsInUseLine: true,
+}
+
+// diskListCmd lists the data disks of an instance
+var diskListCmd = &cobra.Command{
+	Use:     "list <instance>",
+	Short:   "List the data disks of an instance.",
+	Run:     diskList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	diskCmd.AddCommand(diskAddCmd)
+	diskCmd.AddCommand(diskRmCmd)
+	diskCmd.AddCommand(diskListCmd)
+}
+
+// stoppedMachineConfig locks and loads an instance that must not be running
+func stoppedMachineConfig(vmName string) (qemu.MachineConfig, *qemu.InstanceLock) {
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if status, _ := machineConfig.Status(); status != "Stopped" {
+		log.Fatalln(vmName + " is " + status + ", stop it first")
+	}
+	return machineConfig, lock
+}
+
+func diskAdd(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalln("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatalln("missing disk size")
+	}
+
+	d, err := qemu.ParseDataDisk(args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	machineConfig, lock := stoppedMachineConfig(args[0])
+	defer lock.Unlock()
+	d, err = machineConfig.AddDataDisk(d)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = qemu.SaveMachineConfig(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("added %s (%s %s) to %s\n", d.Name, d.Size, d.Format, machineConfig.Alias)
+}
+
+func diskRm(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalln("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatalln("missing disk name")
+	}
+
+	machineConfig, lock := stoppedMachineConfig(args[0])
+	defer lock.Unlock()
+	err := machineConfig.RemoveDataDisk(args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = qemu.SaveMachineConfig(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("removed %s from %s\n", args[1], machineConfig.Alias)
+}
+
+func diskList(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalln("missing instance name")
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tFORMAT\tFILE\t")
+	for _, d := range machineConfig.DataDisks {
+		fmt.Fprintln(w, d.Name+"    \t"+d.Size+"    \t"+d.Format+"    \t"+machineConfig.DataDiskPath(d)+"    \t")
+	}
+	w.Flush()
+}
+
+// autoCompleteDataDisks completes the instance name, then its data disks
+func autoCompleteDataDisks(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return host.AutoCompleteVMNames(cmd, args, toComplete)
+	}
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, d := range machineConfig.DataDisks {
+		names = append(names, d.Name)
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// dockerContextCmd groups commands managing docker contexts of instances
+var dockerContextCmd = &cobra.Command{
+	Use:   "docker-context",
+	Short: "Use instances as Docker hosts.",
+	Long: `Use instances as Docker hosts: the docker CLI of the host runs containers in the dockerd of an
+instance, over ssh. The context of an instance is named macpine-<instance> and is removed when the
+instance is deleted.`,
+}
+
+// dockerContextCreateCmd creates the docker context of an instance
+var dockerContextCreateCmd = &cobra.Command{
+	Use:   "create <instance>",
+	Short: "Create a docker context for a running instance.",
+	Long: `Create a docker context for a running instance, or update it if it exists.
+
+The docker CLI connects with ssh and a key rather than a password: the SSH key of the user, or --ssh-key,
+is authorized in the instance and the host key of the instance is added to ~/.ssh/known_hosts.`,
+	Example: `  alpine docker-context create dev --install
+  docker context use macpine-dev`,
+	Run: dockerContextCreate,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+// dockerContextRemoveCmd removes the docker context of an instance
+var dockerContextRemoveCmd = &cobra.Command{
+	Use:     "remove <instance>",
+	Short:   "Remove the docker context of an instance.",
+	Run:     dockerContextRemove,
+	Aliases: []string{"rm"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+var dockerInstall bool
+var dockerSSHKey string
+
+func init() {
+	dockerContextCreateCmd.Flags().BoolVar(&dockerInstall, "install", false, "Install docker in the instance and start it at boot if it is missing.")
+	dockerContextCreateCmd.Flags().StringVar(&dockerSSHKey, "ssh-key", "", "Public key to authorize in the instance. Defaults to ~/.ssh/id_ed25519.pub, id_ecdsa.pub or id_rsa.pub.")
+
+	dockerContextCmd.AddCommand(dockerContextCreateCmd)
+	dockerContextCmd.AddCommand(dockerContextRemoveCmd)
+}
+
+func dockerContextCreate(cmd *cobra.Command, args []string) {
+	machineConfig := dockerContextInstance(args)
+
+	name, err := host.CreateDockerContext(machineConfig, dockerInstall, dockerSSHKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Noticeln("docker context " + name + " points at " + machineConfig.Alias)
+	log.Println("switch to it with: docker context use " + name)
+}
+
+func dockerContextRemove(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	// the context of an instance deleted by hand is removed all the same
+	machineConfig := qemu.MachineConfig{Alias: vmName}
+	if utils.StringSliceContains(host.ListVMNames(), vmName) {
+		machineConfig = dockerContextInstance(args)
+	}
+
+	removed, err := host.RemoveDockerContext(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !removed {
+		log.Fatalln(vmName + " has no docker context")
+	}
+	log.Println("removed docker context " + host.DockerContextName(vmName))
+}
+
+// dockerContextInstance returns the configuration of the instance named by args
+func dockerContextInstance(args []string) qemu.MachineConfig {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return machineConfig
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd diagnoses the host environment
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the host environment for problems.",
+	Run:   doctor,
+
+	DisableFlagsInUseLine: true,
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	checks := host.Doctor()
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	failed := false
+	for _, check := range checks {
+		fmt.Fprintf(w, "[%s]\t%s\t%s\n", check.Status, check.Name, check.Detail)
+		if check.Status == host.CheckFail {
+			failed = true
+		}
+	}
+	w.Flush()
+
+	if failed {
+		log.Fatalln("one or more required checks failed")
+	}
+}
@@ -1,119 +1,210 @@
 package cmd
 
 import (
+	"bytes"
 	"errors"
-	"log"
 	"os"
 	run "os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
-// editCmd lists Alpine instances
+// editCmd edits instance configurations
 var editCmd = &cobra.Command{
-	Use:     "edit <instance> [<instance>...]",
-	Short:   "Edit instance configurations.",
+	Use:   "edit <instance> [<instance>...]",
+	Short: "Edit instance configurations.",
+	Long: `Open a copy of each instance configuration in $EDITOR (vi if unset). The copy is validated when
+the editor exits and only then written back, so a typo cannot break the instance. If the copy is invalid,
+you can edit it again. Use ` + "`alpine rename`" + ` to change the name of an instance.`,
 	Run:     edit,
-	Aliases: []string{"conf", "config", "configure"},
+	Aliases: []string{"conf", "configure"},
 
 	ValidArgsFunction:     host.AutoCompleteVMNamesOrTags,
 	DisableFlagsInUseLine: true,
 }
 
 func edit(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
 
-	userHomeDir, err := os.UserHomeDir()
+	args, err := host.ExpandTagArguments(args)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalln(err)
 	}
 
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
+	vmList := host.ListVMNames()
+	for _, vmName := range args {
+		if !utils.StringSliceContains(vmList, vmName) {
+			log.Fatalln("unknown instance " + vmName)
+		}
 	}
 
-	args, err = host.ExpandTagArguments(args)
+	editor, err := findEditor()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	vmList := host.ListVMNames()
+	wasErr := false
 	for i, vmName := range args {
 		if utils.StringSliceContains(args[:i], vmName) {
 			continue
 		}
-		exists := utils.StringSliceContains(vmList, vmName)
-		if !exists {
-			log.Fatalln("unknown instance " + vmName)
+		running := false
+		if machineConfig, err := qemu.GetMachineConfig(vmName); err == nil {
+			status, _ := machineConfig.Status()
+			running = status == "Running" || status == "Paused"
+		}
+		if running {
+			log.Println(vmName + " is running, changes take effect when it is restarted")
+		}
+		saved, err := editConfig(vmName, editor)
+		if err != nil {
+			log.Errorf("error editing %s configuration: %v\n", vmName, err)
+			wasErr = true
+			continue
+		}
+		if saved && running {
+			log.Println(vmName + " configuration saved, restart it with `alpine restart " + vmName + "` for changes to take effect")
+		} else if saved {
+			log.Println(vmName + " configuration saved")
+		} else {
+			log.Println(vmName + " configuration unchanged")
 		}
 	}
+	if wasErr {
+		log.Fatalln("error editing instance configuration(s)")
+	}
+}
 
-	targetFiles := make([]string, len(args))
-	for i, name := range args {
-		targetFiles[i] = filepath.Join(userHomeDir, ".macpine", name, "config.yaml")
+// findEditor returns the command line of $EDITOR, falling back to vi and nano
+func findEditor() ([]string, error) {
+	if editor := strings.Fields(os.Getenv("EDITOR")); len(editor) > 0 {
+		if utils.CommandExists(editor[0]) {
+			return editor, nil
+		}
+		log.Println("edit: $EDITOR set but not found in $PATH.")
 	}
+	for _, editor := range []string{"vi", "nano"} {
+		if utils.CommandExists(editor) {
+			return []string{editor}, nil
+		}
+	}
+	return nil, errors.New("no basic editor found in $PATH (tried vi, nano). set $EDITOR")
+}
 
-	oldConfigs := make([]qemu.MachineConfig, len(args))
-	for i, vmName := range args {
-		oldConfig, err := qemu.GetMachineConfig(vmName)
+// editConfig edits a copy of the configuration of vmName and writes it back once it is valid. It reports
+// whether the configuration changed. The instance is only locked while the copy is written back, so that
+// other commands are not held up while the editor is open.
+func editConfig(vmName string, editor []string) (bool, error) {
+	oldConfig, err := qemu.GetMachineConfig(vmName)
+	var invalid *qemu.ConfigError
+	if errors.As(err, &invalid) {
+		// an invalid configuration is opened as it is, so that it can be fixed. Its name and location
+		// are those of the instance directory, as alpine repair assumes.
+		log.Errorln(err)
+		var dataDir string
+		dataDir, err = host.DataDir()
 		if err != nil {
-			log.Fatalf("error reading existing configuration for %s\n", vmName)
+			return false, err
 		}
-		oldConfigs[i] = oldConfig
+		oldConfig.Alias, oldConfig.Location = vmName, filepath.Join(dataDir, vmName)
+	}
+	if err != nil {
+		return false, err
 	}
 
-	editor, found := os.LookupEnv("EDITOR")
-	if !found || !utils.CommandExists(editor) {
-		if !found {
-			log.Println("edit: No $EDITOR set.")
-		} else {
-			log.Println("edit: $EDITOR set but not found in $PATH.")
-		}
-		if utils.CommandExists("vim") {
-			log.Println("defaulting to \"vim\"")
-			editor = "vim"
-		} else if utils.CommandExists("nano") {
-			log.Println("defaulting to \"nano\"")
-			editor = "nano"
-		} else {
-			log.Fatal("no basic editor found in $PATH (tried vim, nano). You can still edit the config manually in ~/.macpine")
-		}
+	configPath := filepath.Join(oldConfig.Location, "config.yaml")
+	original, err := os.ReadFile(configPath)
+	if err != nil {
+		return false, err
 	}
 
-	edit := run.Command(editor, targetFiles...)
+	tmp, err := os.CreateTemp("", vmName+"-config-*.yaml")
+	if err != nil {
+		return false, err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(original)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	for {
+		editCmd := run.Command(editor[0], append(editor[1:], tmpPath)...)
+		editCmd.Stdin = os.Stdin
+		editCmd.Stdout = os.Stdout
+		editCmd.Stderr = os.Stderr
+		if err := editCmd.Run(); err != nil {
+			return false, errors.New("editor failed, your changes are kept in " + tmpPath + ": " + err.Error())
+		}
+
+		edited, err := os.ReadFile(tmpPath)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(edited, original) {
+			os.Remove(tmpPath)
+			return false, nil
+		}
+
+		err = validateEditedConfig(oldConfig, edited)
+		if err == nil {
+			if err := saveEditedConfig(oldConfig, original, edited); err != nil {
+				return false, errors.New("unable to save, your changes are kept in " + tmpPath + ": " + err.Error())
+			}
+			os.Remove(tmpPath)
+			return true, nil
+		}
 
-	edit.Stdin = os.Stdin
-	edit.Stdout = os.Stdout
-	edit.Stderr = os.Stderr
+		log.Errorf("invalid %s configuration: %v\n", vmName, err)
+		if !utils.Confirm("edit again?", true) {
+			return false, errors.New("configuration not saved, your changes are kept in " + tmpPath)
+		}
+	}
+}
 
-	err = edit.Start()
+// saveEditedConfig replaces the configuration with an edited copy, unless another command changed it
+// since original was read
+func saveEditedConfig(oldConfig qemu.MachineConfig, original []byte, edited []byte) error {
+	lock, err := qemu.LockInstance(oldConfig.Alias, oldConfig.Location)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer lock.Unlock()
 
-	err = edit.Wait()
+	configPath := filepath.Join(oldConfig.Location, "config.yaml")
+	current, err := os.ReadFile(configPath)
 	if err != nil {
-		log.Fatalf("error while editing: %v\n", err)
+		return err
 	}
+	if !bytes.Equal(current, original) {
+		return errors.New(oldConfig.Alias + " configuration was changed by another command while it was being edited")
+	}
+	return utils.WriteFileAtomic(configPath, edited, 0644)
+}
 
-	errs := validateConfig(args)
-	wasErr := false
-	for i, res := range errs {
-		if res.Err != nil {
-			log.Printf("error in %s configuration: %v\n", res.Name, res.Err)
-			log.Printf("reverting %s configuration file\n", res.Name)
-			qemu.SaveMachineConfig(oldConfigs[i])
-			wasErr = true
-		}
+// validateEditedConfig checks an edited configuration before it replaces the current one
+func validateEditedConfig(oldConfig qemu.MachineConfig, edited []byte) error {
+	machineConfig, err := qemu.ParseMachineConfig(edited)
+	if err != nil {
+		return err
 	}
-	log.Println("configuration(s) saved, restart instance(s) for changes to take effect")
-	if wasErr {
-		log.Fatalln("error editing instance configuration(s)")
+	if machineConfig.Alias != oldConfig.Alias {
+		return errors.New("alias cannot be changed here, use `alpine rename " + oldConfig.Alias + " <name>`")
+	}
+	if machineConfig.Location != oldConfig.Location {
+		return errors.New("location cannot be changed here, use `alpine rename` or --data-dir to move instances")
 	}
+	return validateMachineConfig(machineConfig)
 }
 
 func validateConfig(args []string) []utils.CmdResult {
@@ -126,26 +217,49 @@ func validateConfig(args []string) []utils.CmdResult {
 			continue
 		}
 
-		err = ValidateName(machineConfig.Alias)
+		// instances named before names were restricted keep working, only a changed name must be valid
+		if machineConfig.Alias != vmName {
+			err = utils.ValidateName(machineConfig.Alias)
+		}
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
 			continue
 		}
-		image := strings.TrimSuffix(machineConfig.Image, "-"+machineConfig.Arch+".qcow2")
-		err = CorrectArguments(image, machineConfig.Arch, machineConfig.CPU,
-			machineConfig.Memory, machineConfig.Disk, machineConfig.SSHPort,
-			machineConfig.Port)
+		err = validateMachineConfig(machineConfig)
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
-		}
-		if loc, err := os.Stat(machineConfig.Location); os.IsNotExist(err) {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("location directory does not exist")}
-			continue
-		} else if !loc.IsDir() {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("location file is not a directory")}
-			continue
 		}
 	}
 	return errs
 }
+
+// validateMachineConfig checks the values of a configuration the way launch checks its flags
+func validateMachineConfig(machineConfig qemu.MachineConfig) error {
+	if err := machineConfig.Validate(); err != nil {
+		return err
+	}
+	// images with a recorded URL can be downloaded again whether or not the catalog still lists them
+	image := ""
+	if machineConfig.ImageURL == "" {
+		image = strings.TrimSuffix(machineConfig.Image, "-"+machineConfig.Arch+".qcow2")
+	}
+	err := CorrectArguments(image, machineConfig.Arch, machineConfig.CPU,
+		machineConfig.Memory, machineConfig.Disk, machineConfig.SSHPort,
+		machineConfig.Port, machineConfig.Mount)
+	if err != nil {
+		return err
+	}
+	err = utils.ValidateCredential(machineConfig.SSHPassword)
+	if err == nil && machineConfig.RootPassword != nil {
+		err = utils.ValidateCredential(*machineConfig.RootPassword)
+	}
+	if err != nil {
+		return err
+	}
+	if loc, err := os.Stat(machineConfig.Location); os.IsNotExist(err) {
+		return errors.New("location directory does not exist")
+	} else if err == nil && !loc.IsDir() {
+		return errors.New("location file is not a directory")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// launchEvents returns the receiver for launch events, printing each as a line of JSON on
+// stdout when --json-events is given
+func launchEvents(enabled bool) qemu.EventFunc {
+	if !enabled {
+		return nil
+	}
+	return func(event qemu.Event) {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		fmt.Println(string(line))
+	}
+}
+
+// emitValidating reports the validating phase, before an instance config exists
+func emitValidating(events qemu.EventFunc, vmName string) {
+	if events != nil {
+		events(qemu.Event{Time: time.Now().UTC(), Phase: qemu.PhaseValidating, Instance: vmName})
+	}
+}
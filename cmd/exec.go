@@ -1,19 +1,32 @@
 package cmd
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
+	"os"
 	"strings"
 
+	"github.com/beringresearch/macpine/client"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 // execCmd executes command on alpine vm
 var execCmd = &cobra.Command{
-	Use:     "exec <instance> <command>",
-	Short:   "execute a command on an instance over ssh.",
+	Use:   "exec <instance> <command>",
+	Short: "execute a command on an instance over ssh.",
+	Long: `Execute a command on an instance over ssh.
+
+With --agent the command runs through qemu-guest-agent instead, which needs no network or SSH
+credentials and starts faster. Its output is printed once the command exits. Instances without a
+guest agent fall back to ssh. Flags go before the instance name, everything after it is the command.`,
+	Example: `  alpine exec myvm ls -la /etc
+  alpine exec --agent myvm cat /etc/os-release`,
 	Run:     exec,
 	Aliases: []string{"x", "execute", "cmd", "command"},
 
@@ -21,6 +34,14 @@ var execCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+var execAgent bool
+
+func init() {
+	execCmd.Flags().BoolVar(&execAgent, "agent", false, "Run the command through qemu-guest-agent instead of ssh.")
+	// flags of the command, such as ls -la, are not flags of exec
+	execCmd.Flags().SetInterspersed(false)
+}
+
 func exec(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		log.Fatal("missing instance name")
@@ -35,13 +56,67 @@ func exec(cmd *cobra.Command, args []string) {
 	vmName := args[0]
 	cmdArgs := strings.Join(args[1:], " ")
 
+	// shells get an interactive terminal, other commands stream their output
+	if cmdArgs == "ash" || cmdArgs == "bash" {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := host.Exec(machineConfig, cmdArgs); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if execAgent {
+		if execWithAgent(vmName, cmdArgs) {
+			return
+		}
+	}
+
+	err := client.Exec(context.Background(), vmName, cmdArgs, os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// execWithAgent runs command through the guest agent and exits with its status. It returns false
+// when the instance has no guest agent, so that the command runs over ssh instead.
+func execWithAgent(vmName string, command string) bool {
 	machineConfig, err := qemu.GetMachineConfig(vmName)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	agent, err := host.ConnectAgent(machineConfig)
+	if errors.Is(err, host.ErrNoGuestAgent) {
+		log.Println(vmName + ": " + err.Error() + ", using ssh")
+		return false
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer agent.Close()
 
-	err = host.Exec(machineConfig, cmdArgs)
+	var stdin []byte
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		stdin, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			agent.Close()
+			log.Fatalln(err)
+		}
+	}
+
+	stdout, stderr, exitCode, err := agent.Exec(interruptContext(), command, stdin)
 	if err != nil {
+		agent.Close()
+		exitIfInterrupted(err)
 		log.Fatalln(err)
 	}
+	os.Stdout.Write(stdout)
+	os.Stderr.Write(stderr)
+	if exitCode != 0 {
+		agent.Close()
+		os.Exit(exitCode)
+	}
+	return true
 }
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/spf13/cobra"
+)
+
+// forwardCmd runs the reverse port forwarder of an instance, forked by start
+var forwardCmd = &cobra.Command{
+	Use:    "forward <instance>",
+	Short:  "Forward the reverse ports of an instance to the host.",
+	Run:    forward,
+	Hidden: true,
+
+	DisableFlagsInUseLine: true,
+}
+
+func forward(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if err := host.Forward(args[0]); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/spf13/cobra"
+)
+
+// gcCmd finds qemu processes left behind by deleted or broken instances
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "List, and optionally kill, orphaned qemu processes.",
+	Long: `List, and optionally kill, orphaned qemu processes: qemu-system processes running a disk under the
+macpine directory that no instance accounts for. gc also removes the pidfiles and sockets that instances whose
+qemu process died left behind.`,
+	Run: gc,
+}
+
+var gcKill bool
+
+func init() {
+	gcCmd.Flags().BoolVar(&gcKill, "kill", false, "Kill the orphaned processes.")
+}
+
+func gc(cmd *cobra.Command, args []string) {
+	for _, vmName := range host.CleanStaleRuntimeFiles() {
+		log.Println("removed the stale pidfile of " + vmName)
+	}
+
+	orphans, err := host.FindOrphans()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(orphans) == 0 {
+		log.Println("no orphaned qemu processes")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "PID\tINSTANCE\tDISK\tREASON\t")
+	for _, o := range orphans {
+		fmt.Fprintln(w, strconv.Itoa(o.PID)+"\t"+o.Instance+"\t"+o.Disk+"\t"+o.Reason+"\t")
+	}
+	w.Flush()
+
+	if !gcKill {
+		log.Println("run with --kill to terminate them")
+		return
+	}
+
+	wasErr := false
+	for _, o := range orphans {
+		if err := host.KillOrphan(o); err != nil {
+			log.Errorln(err)
+			wasErr = true
+			continue
+		}
+		log.Printf("killed %d (%s)\n", o.PID, o.Instance)
+	}
+	if wasErr {
+		log.Fatalln("error killing orphaned process(es)")
+	}
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// imagesCmd groups the commands about base images
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Show the images instances can be launched from.",
+}
+
+// imagesAvailableCmd prints the image catalog
+var imagesAvailableCmd = &cobra.Command{
+	Use:   "available",
+	Short: "List the images in the image catalog.",
+	Long: `List the images in the image catalog, which alpine launch --image accepts.
+
+The catalog is built into alpine. A local catalog.yaml in the data directory, or the file or URL in
+MACPINE_CATALOG, replaces it, e.g. to launch from a mirror. A catalog fetched from a URL is cached for a day.`,
+	Example: `  alpine images available
+  alpine images available --arch aarch64`,
+	Run: imagesAvailable,
+
+	DisableFlagsInUseLine: true,
+}
+
+var imagesArch string
+
+func init() {
+	imagesAvailableCmd.Flags().StringVarP(&imagesArch, "arch", "a", "", "Only list images for this architecture, aarch64 or x86_64.")
+	imagesAvailableCmd.RegisterFlagCompletionFunc("arch", host.AutoCompleteArch)
+
+	imagesCmd.AddCommand(imagesAvailableCmd)
+}
+
+func imagesAvailable(cmd *cobra.Command, args []string) {
+	if imagesArch != "" && imagesArch != "aarch64" && imagesArch != "x86_64" {
+		log.Fatalln("unsupported architecture " + imagesArch + ". use x86_64 or aarch64")
+	}
+	c, err := imageCatalog()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Debugln("image catalog: " + c.Source)
+
+	cached := host.CachedImages()
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tARCH\tCACHED\tSHA256\tURL\t")
+	for _, image := range c.Images {
+		if imagesArch != "" && image.Arch != imagesArch {
+			continue
+		}
+		isCached := "no"
+		if utils.StringSliceContains(cached, image.Name+"-"+image.Arch+".qcow2") {
+			isCached = "yes"
+		}
+		digest := "-"
+		if image.SHA256 != "" {
+			digest = image.SHA256[:12]
+		}
+		fmt.Fprintln(w, image.Name+"\t"+image.Version+"\t"+image.Arch+"\t"+isCached+"\t"+digest+"\t"+image.URL+"\t")
+	}
+	w.Flush()
+}
@@ -1,15 +1,17 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 
 	"filippo.io/age"
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -31,23 +33,22 @@ func importMachine(cmd *cobra.Command, args []string) {
 		log.Fatal("missing archive filename")
 	}
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := host.DataDir()
 	if err != nil {
 		log.Fatal("unable to import: " + err.Error())
 	}
 
-	macpineHomeDir := filepath.Join(userHomeDir, ".macpine")
-	if _, err := os.Stat(macpineHomeDir); os.IsNotExist(err) {
-		err := os.Mkdir(macpineHomeDir, 0700)
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		err := os.MkdirAll(dataDir, 0700)
 		if err != nil {
-			log.Fatal("$HOME/.macpine directory does not exist and unable to create it: " + err.Error())
+			log.Fatal(dataDir + " does not exist and unable to create it: " + err.Error())
 		}
 	}
 
 	archive := args[0]
 
 	if strings.HasPrefix(archive, "http") {
-		//cachePath := filepath.Join(userHomeDir, ".macpine", "cache")
+		//cachePath := filepath.Join(dataDir, "cache")
 		archiveString := path.Base(archive)
 
 		// Handle a specific case for a Dropbox URL
@@ -82,22 +83,26 @@ func importMachine(cmd *cobra.Command, args []string) {
 	}
 
 	importName := strings.TrimSuffix(filepath.Base(archive), ".tar.gz")
-	tempArchive := filepath.Join(userHomeDir, ".macpine", filepath.Base(archive))
+	if err := utils.ValidateName(importName); err != nil {
+		log.Fatal("unable to import: " + err.Error() + ". rename the archive to NAME.tar.gz")
+	}
+	tempArchive := filepath.Join(dataDir, filepath.Base(archive))
 
 	targetDir := strings.TrimSuffix(tempArchive, ".tar.gz")
 
-	exists, err := utils.DirExists(targetDir)
+	// holding the new directory locked keeps a concurrent import or launch from taking the same name
+	lock, err := qemu.ReserveInstance(importName, targetDir)
+	if errors.Is(err, qemu.ErrInstanceExists) {
+		log.Fatalf("unable to import: instance %s already exists\n", importName)
+	}
 	if err != nil {
-		os.RemoveAll(tempArchive)
 		log.Fatal("unable to import: " + err.Error())
 	}
-	if exists {
-		os.RemoveAll(tempArchive)
-		log.Fatalf("unable to import: instance %s already exists\n", importName)
-	}
+	defer lock.Unlock()
 
 	_, err = utils.CopyFile(archive, tempArchive)
 	if err != nil {
+		os.RemoveAll(targetDir)
 		os.RemoveAll(tempArchive)
 		log.Fatal("unable to import: " + err.Error())
 	}
@@ -119,6 +124,7 @@ func importMachine(cmd *cobra.Command, args []string) {
 
 	machineConfig.Alias = importName
 	machineConfig.Location = targetDir
+	machineConfig.SetLock(lock)
 	machineConfig.MachineIP = "localhost"
 	machineConfig.MACAddress = ""
 
@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/utils"
 )
 
@@ -18,22 +21,58 @@ var infoCmd = &cobra.Command{
 	Run:     macpineInfo,
 	Aliases: []string{"i", "show"},
 
-	ValidArgsFunction:     host.AutoCompleteVMNames,
-	DisableFlagsInUseLine: true,
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var infoOutput string
+var infoWatch, infoJSON, infoFull bool
+
+func init() {
+	infoCmd.Flags().StringVarP(&infoOutput, "output", "o", "text", "Output format: text, json or yaml.")
+	infoCmd.Flags().BoolVarP(&infoWatch, "watch", "w", false, "Refresh the information every two seconds.")
+	infoCmd.Flags().BoolVar(&infoJSON, "json", false, "Shorthand for --output json.")
+	infoCmd.Flags().BoolVarP(&infoFull, "full", "f", false, "Also list every field of the instance configuration. JSON and YAML output always include it.")
 }
 
 func macpineInfo(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		log.Fatal("missing instance name")
 	}
+	if infoJSON {
+		infoOutput = "json"
+	}
+	if infoOutput != "text" && infoOutput != "json" && infoOutput != "yaml" {
+		log.Fatalln("unsupported output format " + infoOutput + ". use text, json or yaml")
+	}
 
 	args, err := host.ExpandTagArguments(args)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	if !infoWatch {
+		if !printInfo(args) {
+			log.Fatalln("error showing instance(s) info")
+		}
+		return
+	}
+
+	for {
+		if infoOutput == "text" {
+			// clear the terminal and move to the top left, like watch(1)
+			fmt.Print("\033[H\033[2J")
+			fmt.Println("Every 2s: alpine info, " + time.Now().Format(time.RFC1123) + "\n")
+		}
+		printInfo(args)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// printInfo prints the info of each instance in the selected format, reporting whether all succeeded
+func printInfo(args []string) bool {
 	vmList := host.ListVMNames()
 	errs := make([]utils.CmdResult, len(args))
+	infos := []host.InstanceInfo{}
 	for i, vmName := range args {
 		if utils.StringSliceContains(args[:i], vmName) {
 			continue
@@ -43,24 +82,50 @@ func macpineInfo(cmd *cobra.Command, args []string) {
 			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
 			continue
 		}
-		info, err := host.Info(vmName)
+		info, err := host.GetInfo(vmName)
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
 			continue
 		}
-		fmt.Print(info)
-		if i < len(args)-1 {
-			fmt.Println()
+		infos = append(infos, info)
+	}
+
+	switch infoOutput {
+	case "json":
+		var out []byte
+		if len(infos) == 1 {
+			out, _ = json.MarshalIndent(infos[0], "", "  ")
+		} else {
+			out, _ = json.MarshalIndent(infos, "", "  ")
+		}
+		fmt.Println(string(out))
+	case "yaml":
+		var out []byte
+		if len(infos) == 1 {
+			out, _ = yaml.Marshal(infos[0])
+		} else {
+			out, _ = yaml.Marshal(infos)
+		}
+		fmt.Print(string(out))
+	default:
+		for i, info := range infos {
+			if infoFull {
+				fmt.Print(info.FullString())
+			} else {
+				fmt.Print(info)
+			}
+			if i < len(infos)-1 {
+				fmt.Println()
+			}
 		}
 	}
-	wasErr := false
+
+	ok := true
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("error for %s: %v\n", res.Name, res.Err)
-			wasErr = true
+			log.Errorf("error for %s: %v\n", res.Name, res.Err)
+			ok = false
 		}
 	}
-	if wasErr {
-		log.Fatalln("error showing instance(s) info")
-	}
+	return ok
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// ipCmd prints the address of an instance
+var ipCmd = &cobra.Command{
+	Use:   "ip <instance>",
+	Short: "Print the IP address of an instance.",
+	Long: `Print the IP address of a running instance, as reported by qemu-guest-agent in the guest.
+
+Instances without a guest agent fall back to the address macpine connects to, which is localhost for
+user mode networking. Launch with --guest-agent to install the agent.`,
+	Run: ip,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var ipAll bool
+
+func init() {
+	ipCmd.Flags().BoolVarP(&ipAll, "all", "a", false, "Print every interface and address reported by the guest agent.")
+}
+
+func ip(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	agent, err := host.ConnectAgent(machineConfig)
+	if errors.Is(err, host.ErrNoGuestAgent) {
+		if ipAll {
+			log.Fatalln(vmName + ": " + err.Error())
+		}
+		log.Debugln(vmName + ": " + err.Error())
+		address, err := machineConfig.IPAddress()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(address)
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer agent.Close()
+
+	interfaces, err := agent.Interfaces()
+	if err != nil {
+		agent.Close()
+		log.Fatalln(err)
+	}
+
+	if ipAll {
+		for _, iface := range interfaces {
+			for _, address := range iface.IPAddresses {
+				fmt.Printf("%s\t%s\t%s/%d\n", iface.Name, address.Type, address.Address, address.Prefix)
+			}
+		}
+		return
+	}
+	for _, iface := range interfaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		for _, address := range iface.IPAddresses {
+			if address.Type == "ipv4" {
+				fmt.Println(address.Address)
+				return
+			}
+		}
+	}
+	agent.Close()
+	log.Fatalln(vmName + " has no IPv4 address yet")
+}
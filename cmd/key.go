@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// keyCmd groups commands managing the SSH host keys of instances
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the SSH host keys of instances.",
+	Long: `Manage the SSH host keys of instances.
+
+macpine records the host keys of an instance the first time it connects, in known_hosts in the instance
+directory, and refuses to connect if they change. alpine ssh and the configuration printed by alpine ssh-config
+check the keys against the same file.`,
+}
+
+// keyRotateCmd regenerates the host keys of an instance
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate <instance>",
+	Short: "Regenerate the SSH host keys of a running instance and trust the new ones.",
+	Run:   keyRotate,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+// keyListCmd prints the recorded host keys of an instance
+var keyListCmd = &cobra.Command{
+	Use:     "list <instance>",
+	Short:   "Print the fingerprints of the SSH host keys recorded for an instance.",
+	Run:     keyList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	keyCmd.AddCommand(keyRotateCmd)
+	keyCmd.AddCommand(keyListCmd)
+}
+
+// keyInstance returns the configuration of the instance named by args
+func keyInstance(args []string) qemu.MachineConfig {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if !utils.StringSliceContains(host.ListVMNames(), args[0]) {
+		log.Fatalln("unknown instance " + args[0])
+	}
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return machineConfig
+}
+
+func keyRotate(cmd *cobra.Command, args []string) {
+	machineConfig := keyInstance(args)
+
+	if err := host.RotateHostKeys(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	fingerprints, err := machineConfig.HostKeyFingerprints()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Noticeln("regenerated the host keys of " + machineConfig.Alias)
+	for _, f := range fingerprints {
+		fmt.Println(f)
+	}
+}
+
+func keyList(cmd *cobra.Command, args []string) {
+	machineConfig := keyInstance(args)
+
+	fingerprints, err := machineConfig.HostKeyFingerprints()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(fingerprints) == 0 {
+		log.Println("no host key recorded for " + machineConfig.Alias + " yet, it is recorded on the first connection")
+		return
+	}
+	for _, f := range fingerprints {
+		fmt.Println(f)
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// labelCmd sets or removes key=value labels of an instance
+var labelCmd = &cobra.Command{
+	Use:   "label <instance> [<key=value>|<key->...]",
+	Short: "Set or remove labels of an instance, or show them.",
+	Long: `Set key=value labels of an instance, or remove them with key-. Without labels, print the labels
+of the instance, one key=value per line.
+
+Labels select instances with --label-filter key=value in list, start, stop and delete.`,
+	Example: `  alpine label dev owner=anna project=billing
+  alpine label dev project-
+  alpine list --label-filter owner=anna`,
+	Run: label,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func label(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	if len(args) == 1 {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, l := range machineConfig.LabelStrings() {
+			fmt.Println(l)
+		}
+		return
+	}
+
+	set := map[string]string{}
+	removed := []string{}
+	for _, spec := range args[1:] {
+		if key, ok := strings.CutSuffix(spec, "-"); ok && !strings.Contains(spec, "=") {
+			removed = append(removed, key)
+			continue
+		}
+		key, value, err := qemu.ParseLabel(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		set[key] = value
+	}
+
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
+	for _, key := range removed {
+		if _, ok := machineConfig.Labels[key]; !ok {
+			log.Fatalln(vmName + " has no label " + key)
+		}
+	}
+	// the delete builtin is shadowed by the delete command in this package
+	labels := map[string]string{}
+	for key, value := range machineConfig.Labels {
+		if !utils.StringSliceContains(removed, key) {
+			labels[key] = value
+		}
+	}
+	for key, value := range set {
+		labels[key] = value
+	}
+	machineConfig.Labels = nil
+	if len(labels) > 0 {
+		machineConfig.Labels = labels
+	}
+
+	err = qemu.SaveMachineConfig(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("%s labels: %s", vmName, strings.Join(machineConfig.LabelStrings(), ", "))
+}
@@ -3,15 +3,18 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -28,36 +31,132 @@ var launchCloudCmd = &cobra.Command{
 }
 
 var machineArchCloud, imageVersionCloud, machineCPUCloud, machineMemoryCloud, machineDiskCloud, machinePortCloud, sshPortCloud, machineNameCloud, machineMountCloud string
+var namePrefixCloud string
+var fillGapsCloud bool
+var replaceCloud, replaceForceCloud, recreateCloud bool
+var noStartCloud bool
+var ifNotExistsCloud, startExistingCloud bool
+var profileCloud string
+var diskFormatCloud, diskInterfaceCloud string
+var imageURLCloud, imageSHA256Cloud string
+var descriptionCloud string
+var labelsCloud []string
+var tagsCloud []string
+var networkModeCloud, bridgeInterfaceCloud, networkIDCloud string
+var macAddressCloud string
 var vmnetCloud bool
 
-var cloudInitCloud string
+var cloudInitCloud, cloudInitInlineCloud, cloudMetaDataCloud, cloudVendorDataCloud string
+var networkConfigCloud, staticIPCloud, gatewayCloud string
+var rmOnFailCloud bool
+var copyFilesCloud, addDisksCloud, reversePortsCloud []string
+var writeHostsCloud bool
+var balloonCloud bool
+var guestAgentCloud, hostAliasCloud bool
+var tpmCloud bool
+var noRNGCloud bool
+var audioCloud bool
+var timezoneCloud string
+var firmwareCloud string
+var usbDevicesCloud []string
+var restartPolicyCloud string
+var qemuArgsCloud []string
+var jsonEventsCloud bool
+var launchTimeoutCloud time.Duration
 
 func init() {
 	includeLaunchCloudFlags(launchCloudCmd)
 }
 
 func includeLaunchCloudFlags(cmd *cobra.Command) {
-	cmd.Flags().StringVarP(&imageVersionCloud, "image", "i", "alpine_3.20.3", "Image to be launchClouded.")
+	cmd.Flags().StringVarP(&imageVersionCloud, "image", "i", "alpine_3.20.3", "Cloud image to be launched: alpine_<version>, ubuntu_<release> (e.g. ubuntu_24.04) or debian_<release> (e.g. debian_12).")
+	cmd.Flags().StringVar(&imageURLCloud, "image-url", "", "Download a custom qcow2 image from an http(s) URL into the cache and launch it instead of --image.")
+	cmd.Flags().StringVar(&imageSHA256Cloud, "image-sha256", "", "Expected sha256 of the --image-url download, verified before it is used.")
 	cmd.Flags().StringVarP(&machineArchCloud, "arch", "a", "", "Machine architecture. Defaults to host architecture.")
 	cmd.Flags().StringVarP(&machineCPUCloud, "cpu", "c", "2", "Number of CPUs to allocate.")
 	cmd.Flags().StringVarP(&machineMemoryCloud, "memory", "m", "2048", "Amount of memory (in kB) to allocate.")
 	cmd.Flags().StringVarP(&machineDiskCloud, "disk", "d", "5G", "Disk space (in bytes) to allocate. K, M, G suffixes are supported.")
+	cmd.Flags().StringVar(&diskInterfaceCloud, "disk-interface", "virtio", "Disk interface: virtio (/dev/vda in the guest) or nvme (/dev/nvme0n1).")
+	cmd.Flags().StringVar(&diskFormatCloud, "disk-format", "qcow2", "Disk image format: qcow2, or raw for better I/O performance.")
 	cmd.Flags().StringVar(&machineMountCloud, "mount", "", "Path to a host directory to be shared with the instance.")
 	cmd.Flags().StringVarP(&sshPortCloud, "ssh", "s", "22", "Host port to forward for SSH (required).")
 	cmd.Flags().StringVarP(&machinePortCloud, "port", "p", "", "Forward additional host ports. Multiple ports can be separated by `,`.")
+	cmd.Flags().StringArrayVar(&reversePortsCloud, "reverse-port", []string{}, "Forward a guest port to the host over SSH as guestport:host:hostport, e.g. 5432:localhost:5432. Repeat for several ports.")
 	cmd.Flags().StringVarP(&machineNameCloud, "name", "n", "", "Instance name for use in `alpine` commands.")
-	cmd.Flags().BoolVarP(&vmnetCloud, "shared", "v", false, "Toggle whether to use mac's native vmnet-shared mode.")
-	cmd.Flags().StringVar(&cloudInitCloud, "cloud-init", "", "Path to a cloud-init yaml file to be used for the instance.")
+	cmd.Flags().StringVar(&descriptionCloud, "description", "", "Free-text description of the instance, shown by `alpine info`.")
+	cmd.Flags().StringArrayVar(&labelsCloud, "label", []string{}, "Attach a key=value label, e.g. owner=anna. Repeat for several labels.")
+	cmd.Flags().StringArrayVar(&tagsCloud, "tag", []string{}, "Tag the instance, for `alpine list` and `alpine <command> +tag`. Repeat for several tags.")
+	cmd.Flags().StringVar(&namePrefixCloud, "name-prefix", "", "Name the instance PREFIX-N, with the next index after the existing PREFIX-N instances.")
+	cmd.Flags().BoolVar(&fillGapsCloud, "fill-gaps", false, "With --name-prefix, use the lowest free index rather than the next after the highest.")
+	cmd.Flags().BoolVar(&replaceCloud, "replace", false, "Stop and delete an existing instance with the same name first.")
+	cmd.Flags().BoolVarP(&replaceForceCloud, "force", "f", false, "With --replace, do not ask for confirmation.")
+	cmd.Flags().BoolVar(&recreateCloud, "recreate", false, "Delete an existing instance with the same name without asking, same as --replace --force.")
+	cmd.Flags().BoolVar(&ifNotExistsCloud, "if-not-exists", false, "Do nothing and exit successfully when an instance with the same name exists.")
+	cmd.Flags().BoolVar(&startExistingCloud, "start-existing", false, "With --if-not-exists, start the existing instance if it is stopped.")
+	cmd.Flags().BoolVar(&noStartCloud, "no-start", false, "Create the instance without booting it. The first `alpine start` completes the launch.")
+	cmd.Flags().BoolVarP(&vmnetCloud, "shared", "v", false, "Toggle whether to use mac's native vmnet-shared mode. Shorthand for --network shared.")
+	cmd.Flags().StringVar(&networkModeCloud, "network", "user", "Network mode: user, gvproxy, shared, bridged[:<iface>], host-only, or none.")
+	cmd.Flags().StringVar(&bridgeInterfaceCloud, "bridge-interface", "", "Host interface for bridged networking. Defaults to the interface of the default route.")
+	cmd.Flags().StringVar(&macAddressCloud, "mac", "", "MAC address of the instance, e.g. for a DHCP reservation. Must be locally administered. Generated by default.")
+	cmd.Flags().StringVar(&networkIDCloud, "network-id", "", "Name of a host-only network. Instances launched with the same id share an isolated network.")
+	cmd.Flags().StringVar(&profileCloud, "profile", "", "Named preset of launch flags from the global config. Explicit flags take precedence.")
+	cmd.RegisterFlagCompletionFunc("profile", autoCompleteProfiles)
+	cmd.RegisterFlagCompletionFunc("image", autoCompleteImagesCloud)
+	cmd.RegisterFlagCompletionFunc("arch", host.AutoCompleteArch)
+	cmd.Flags().StringVar(&cloudInitCloud, "cloud-init", "", "Path to a cloud-init user-data file to be used for the instance, or - to read it from stdin.")
+	cmd.Flags().StringVar(&cloudInitInlineCloud, "cloud-init-inline", "", "cloud-init user-data given directly as a string. \\n sequences are expanded to newlines.")
+	cmd.Flags().StringVar(&cloudMetaDataCloud, "cloud-meta-data", "", "Path to a cloud-init meta-data file. instance-id is always managed by macpine.")
+	cmd.Flags().StringVar(&cloudVendorDataCloud, "cloud-vendor-data", "", "Path to a cloud-init vendor-data file.")
+	cmd.Flags().StringVar(&networkConfigCloud, "network-config", "", "Path to a cloud-init network-config (version 2) file to be used for the instance.")
+	cmd.Flags().StringVar(&staticIPCloud, "ip", "", "Static IP address of the instance in CIDR notation, e.g. 192.168.105.10/24.")
+	cmd.Flags().StringVar(&gatewayCloud, "gateway", "", "Default gateway for the static IP address.")
+
+	cmd.Flags().BoolVar(&rmOnFailCloud, "rm-on-fail", false, "Remove the instance and kill its process if launch fails. Logs are kept in ~/.macpine/cache/.error-logs.")
+	cmd.Flags().DurationVar(&launchTimeoutCloud, "timeout", 0, "Give up and remove the instance if it has not booted within this duration (e.g. 5m). 0 waits indefinitely.")
+	cmd.Flags().BoolVar(&jsonEventsCloud, "json-events", false, "Print launch progress as JSON events, one per line, on stdout. Also waits for cloud-init to finish.")
+	cmd.Flags().BoolVar(&writeHostsCloud, "write-hosts", false, "Map NAME.alpine to the instance address in /etc/hosts (vmnet modes, requires sudo).")
+	cmd.Flags().StringArrayVar(&copyFilesCloud, "copy-file", []string{}, "Copy a host file into the instance as hostpath:guestpath[:mode], using cloud-init write_files. Repeat for several files.")
+	cmd.Flags().StringArrayVar(&addDisksCloud, "add-disk", []string{}, "Attach an additional empty disk as SIZE[:format], e.g. 20G or 20G:raw. Repeat for several disks.")
+	cmd.Flags().StringArrayVar(&qemuArgsCloud, "qemu-arg", []string{}, "Append a raw argument to the qemu command line, e.g. --qemu-arg=-device --qemu-arg=usb-tablet. Unsupported, bad arguments can break boot.")
+	cmd.Flags().BoolVar(&balloonCloud, "balloon", false, "Add a virtio memory balloon so that `alpine balloon` can reclaim guest memory at runtime.")
+	cmd.Flags().BoolVar(&hostAliasCloud, "host-alias", false, "Map host.internal to the host in /etc/hosts of the instance, using cloud-init runcmd. Not available with bridged networking.")
+	cmd.Flags().BoolVar(&guestAgentCloud, "guest-agent", false, "Install qemu-guest-agent from cloud-init, used by `alpine ip`, `alpine exec --agent` and publish of running instances.")
+	cmd.Flags().BoolVar(&noRNGCloud, "no-rng", false, "Do not attach the virtio-rng device that feeds the guest entropy from the host, e.g. for deterministic boots.")
+	cmd.Flags().StringArrayVar(&usbDevicesCloud, "usb", []string{}, "Pass a host USB device through as vendorid:productid, e.g. 1a86:7523 (see `alpine usb list`). Repeat for several devices.")
+	cmd.Flags().StringVar(&firmwareCloud, "firmware", "", "Boot firmware, bios or uefi. Defaults to uefi on aarch64 and bios on x86_64, aarch64 only boots with uefi.")
+	cmd.RegisterFlagCompletionFunc("firmware", autoCompleteFirmware)
+	cmd.Flags().BoolVar(&audioCloud, "audio", false, "Add a sound card, played and recorded through Core Audio.")
+	cmd.Flags().StringVar(&timezoneCloud, "timezone", "", "Timezone of the instance, such as America/New_York. Defaults to the timezone of the host, UTC keeps the guest in UTC.")
+	cmd.Flags().BoolVar(&tpmCloud, "tpm", false, "Add a TPM 2.0 device backed by swtpm, with its state kept in the instance directory.")
+	cmd.Flags().StringVar(&restartPolicyCloud, "restart-policy", "no", "Restart the instance when qemu exits: no, on-failure or always.")
+	cmd.RegisterFlagCompletionFunc("restart-policy", autoCompleteRestartPolicy)
+	cmd.RegisterFlagCompletionFunc("tag", autoCompleteTags)
+}
 
-	cmd.MarkFlagRequired("cloud-init")
+// autoCompleteFirmware completes --firmware
+func autoCompleteFirmware(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{qemu.FirmwareBIOS, qemu.FirmwareUEFI}, cobra.ShellCompDirectiveNoFileComp
 }
 
-func CorrectArgumentsCloud(imageVersion string, machineArch string, machineCPU string,
-	machineMemory string, machineDisk string, sshPort string, machinePort string) error {
+// cachedImageNameCloud matches images downloaded by launch-cloud, e.g. nocloud_alpine-3.21.2-aarch64-uefi-cloudinit-r0.qcow2
+// or nocloud_ubuntu-24.04-aarch64.qcow2
+var cachedImageNameCloud = regexp.MustCompile(`^nocloud_(alpine|ubuntu|debian)-([^-]+)-(aarch64|x86_64)(-(bios|uefi)-cloudinit-r0)?\.qcow2$`)
+
+// autoCompleteImagesCloud completes --image with the default cloud image, the current Ubuntu and Debian
+// releases and the images already in the cache
+func autoCompleteImagesCloud(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	images := []string{cmd.Flags().Lookup("image").DefValue, "ubuntu_24.04", "debian_12"}
+	for _, image := range host.CachedImages() {
+		if m := cachedImageNameCloud.FindStringSubmatch(image); m != nil && !utils.StringSliceContains(images, m[1]+"_"+m[2]) {
+			images = append(images, m[1]+"_"+m[2])
+		}
+	}
+	return images, cobra.ShellCompDirectiveNoFileComp
+}
 
-	// if !utils.StringSliceContains([]string{"alpine_3.20.3"}, imageVersion) {
-	// 	return errors.New("unsupported image. only -i alpine_3.20.3 are currently available")
-	// }
+func CorrectArgumentsCloud(imageVersion string, machineArch string, machineCPU string,
+	machineMemory string, machineDisk string, sshPort string, machinePort string, machineMount string,
+	cloudInit string, cloudMetaData string, cloudVendorData string) error {
 
 	if machineArch != "" {
 		if machineArch != "aarch64" && machineArch != "x86_64" {
@@ -65,6 +164,10 @@ func CorrectArgumentsCloud(imageVersion string, machineArch string, machineCPU s
 		}
 	}
 
+	if _, err := qemu.ResolveCloudImage(imageVersion, machineArch, ""); err != nil {
+		return err
+	}
+
 	int, err := strconv.Atoi(machineCPU)
 	if err != nil || int < 0 {
 		return errors.New("number of cpus (-c) must be a positive integer")
@@ -107,107 +210,449 @@ func CorrectArgumentsCloud(imageVersion string, machineArch string, machineCPU s
 	if machineMount != "" {
 		if dir, err := os.Stat(machineMount); os.IsNotExist(err) {
 			return errors.New("mount target " + machineMount + " does not exist")
+		} else if err != nil {
+			return errors.New("mount target " + machineMount + " is not accessible: " + err.Error())
 		} else if !dir.IsDir() {
 			return errors.New("mount target " + machineMount + " is not a directory")
 		}
 	}
 
+	// the seed files are only copied after the image download, fail before it
+	if cloudInit != "-" {
+		if err := checkReadable("--cloud-init", cloudInit); err != nil {
+			return err
+		}
+	}
+	if err := checkReadable("--cloud-meta-data", cloudMetaData); err != nil {
+		return err
+	}
+	if err := checkReadable("--cloud-vendor-data", cloudVendorData); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkReadable checks that the file given to flag can be read by the current user, if one is given
+func checkReadable(flag string, path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New(flag + " file " + path + " does not exist")
+	} else if err != nil {
+		return errors.New(flag + " file " + path + " is not accessible: " + err.Error())
+	}
+	if info.IsDir() {
+		return errors.New(flag + " file " + path + " is a directory")
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrPermission) {
+		return errors.New(flag + " file " + path + " is not readable by the current user, check its permissions")
+	} else if err != nil {
+		return errors.New("unable to read " + flag + " file " + path + ": " + err.Error())
+	}
+	return f.Close()
+}
+
+// readUserData loads cloud-init user-data from a file, stdin (-), or an inline string, returning the
+// content and a description of its source
+func readUserData(path string, inline string) ([]byte, string, error) {
+	var userData []byte
+	var source string
+	var err error
+
+	switch {
+	case path != "" && inline != "":
+		return nil, "", errors.New("--cloud-init and --cloud-init-inline cannot be combined")
+	case path == "" && inline == "":
+		return nil, "", errors.New("cloud-init user-data is required, use --cloud-init or --cloud-init-inline")
+	case inline != "":
+		if !strings.Contains(inline, "\n") {
+			inline = strings.ReplaceAll(inline, `\n`, "\n")
+		}
+		userData, source = []byte(inline), "inline"
+	case path == "-":
+		userData, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, "", errors.New("unable to read user-data from stdin: " + err.Error())
+		}
+		source = "stdin"
+	default:
+		userData, err = os.ReadFile(path)
+		if err != nil {
+			return nil, "", errors.New("unable to read user-data: " + err.Error())
+		}
+		source, err = filepath.Abs(path)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// cloud-init silently ignores user-data it does not recognise
+	header := strings.TrimSpace(strings.SplitN(string(userData), "\n", 2)[0])
+	for _, prefix := range []string{"#cloud-config", "#!", "#include", "Content-Type: multipart"} {
+		if strings.HasPrefix(header, prefix) {
+			return userData, source, nil
+		}
+	}
+	return nil, "", errors.New("user-data from " + source + " must start with `#cloud-config` or a shebang (`#!/bin/sh`), " +
+		"otherwise cloud-init ignores it. found: \"" + header + "\"")
+}
+
+// validateStaticIP checks the static network settings of a cloud-init instance
+func validateStaticIP(ip string, gateway string, networkConfig string) error {
+	if networkConfig != "" {
+		if ip != "" || gateway != "" {
+			return errors.New("--network-config cannot be combined with --ip or --gateway")
+		}
+		if _, err := os.Stat(networkConfig); err != nil {
+			return errors.New("network-config " + networkConfig + " is not readable: " + err.Error())
+		}
+		return nil
+	}
+
+	if ip == "" {
+		if gateway != "" {
+			return errors.New("--gateway requires --ip")
+		}
+		return nil
+	}
+
+	address, subnet, err := net.ParseCIDR(ip)
+	if err != nil || address.To4() == nil {
+		return errors.New("static IP (--ip) must be an IPv4 address in CIDR notation, e.g. 192.168.105.10/24")
+	}
+
+	if gateway != "" {
+		gw := net.ParseIP(gateway)
+		if gw == nil || gw.To4() == nil {
+			return errors.New("gateway (--gateway) must be an IPv4 address")
+		}
+		if !subnet.Contains(gw) {
+			return errors.New("gateway " + gateway + " is not in the subnet of " + ip)
+		}
+	}
+
 	return nil
 }
 
 func launchCloud(cmd *cobra.Command, args []string) {
+	launchDefaults, err := applyGlobalDefaults(cmd, profileCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	events := launchEvents(jsonEventsCloud)
+	emitValidating(events, machineNameCloud)
+
+	if recreateCloud {
+		replaceCloud, replaceForceCloud = true, true
+	}
+	if ifNotExistsCloud && replaceCloud {
+		log.Fatalln("--if-not-exists cannot be combined with --replace or --recreate")
+	}
+	if startExistingCloud && !ifNotExistsCloud {
+		log.Fatalln("--start-existing requires --if-not-exists")
+	}
 
-	err := CorrectArgumentsCloud(imageVersionCloud, machineArchCloud, machineCPUCloud, machineMemoryCloud, machineDiskCloud, sshPortCloud, machinePortCloud)
+	err = CorrectArgumentsCloud(imageVersionCloud, machineArchCloud, machineCPUCloud, machineMemoryCloud, machineDiskCloud, sshPortCloud, machinePortCloud, machineMountCloud,
+		cloudInitCloud, cloudMetaDataCloud, cloudVendorDataCloud)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	imageSHA256Cloud, err = checkImageURLFlags(cmd, imageURLCloud, imageSHA256Cloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policy, err := qemu.ParseRestartPolicy(restartPolicyCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dataDir, err := host.DataDir()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	machineArchCloud, err = defaultArch(machineArchCloud, runtime.GOARCH)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tz := resolveTimezone(timezoneCloud)
+	if audioCloud {
+		if err := qemu.CheckAudio(machineArchCloud); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	firmware := qemu.DefaultFirmware(machineArchCloud)
+	if firmwareCloud != "" {
+		if firmware, err = qemu.ParseFirmware(firmwareCloud); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := qemu.CheckFirmware(machineArchCloud, firmware); err != nil {
+		log.Fatalln(err)
+	}
+
+	userData, source, err := readUserData(cloudInitCloud, cloudInitInlineCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	files, err := parseFileCopies(copyFilesCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dataDisks, err := parseDataDisks(addDisksCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	userHomeDir, err := os.UserHomeDir()
+	reverse, err := parseReversePorts(reversePortsCloud)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	if machineArch == "" {
-		arch := runtime.GOARCH
+	instanceLabels, err := qemu.ParseLabels(labelsCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	validateTags(tagsCloud)
+	usb, err := parseUSBDevices(usbDevicesCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = validateStaticIP(staticIPCloud, gatewayCloud, networkConfigCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if networkConfigCloud != "" {
+		networkConfigCloud, err = filepath.Abs(networkConfigCloud)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if _, err := qemu.ParseDiskFormat(diskFormatCloud); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := qemu.ParseDiskInterface(diskInterfaceCloud); err != nil {
+		log.Fatalln(err)
+	}
+	if tpmCloud && qemu.SwtpmPath() == "" {
+		log.Fatalln(qemu.ErrNoSwtpm)
+	}
+
+	network, iface, err := resolveNetwork(networkModeCloud, vmnetCloud, bridgeInterfaceCloud, networkIDCloud)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if writeHostsCloud && (network == qemu.NetworkUser || network == qemu.NetworkGvproxy || network == qemu.NetworkNone) {
+		log.Fatalln("--write-hosts requires a vmnet network mode (shared, bridged or host-only)")
+	}
+	if hostAliasCloud && (network == qemu.NetworkBridged || network == qemu.NetworkNone) {
+		log.Fatalln("--host-alias requires a network where the host is the gateway (user, gvproxy, shared or host-only), use --reverse-port instead")
+	}
+	if len(reversePortsCloud) > 0 && network == qemu.NetworkNone {
+		log.Fatalln("--reverse-port requires a network, ports are forwarded over SSH")
+	}
+
+	if namePrefixCloud != "" {
+		if machineNameCloud != "" {
+			log.Fatalln("--name and --name-prefix cannot be combined")
+		}
+		machineNameCloud = utils.NextIndexedName(host.ListVMNames(), namePrefixCloud, fillGapsCloud)
+	} else if fillGapsCloud {
+		log.Fatalln("--fill-gaps requires --name-prefix")
+	}
 
-		switch arch {
-		case "arm64":
-			machineArch = "aarch64"
-		case "amd64":
-			machineArch = "x86_64"
-		default:
-			log.Fatal("unsupported host architecture: " + arch)
+	if machineNameCloud != "" {
+		if err := utils.ValidateName(machineNameCloud); err != nil {
+			log.Fatalln(err)
 		}
 	}
 
 	vmList := host.ListVMNames()
 
-	if machineName == "" {
-		machineName = utils.GenerateRandomAlias()
-		for utils.StringSliceContains(vmList, machineName) { // if exists, re-randomize
-			machineName = utils.GenerateRandomAlias()
+	if ifNotExistsCloud && utils.StringSliceContains(vmList, machineNameCloud) {
+		launchExisting(machineNameCloud, startExistingCloud)
+		return
+	}
+	if replaceCloud && utils.StringSliceContains(vmList, machineNameCloud) {
+		replaceInstance(machineNameCloud, replaceForceCloud)
+		vmList = host.ListVMNames()
+	}
+
+	if machineNameCloud == "" {
+		machineNameCloud = utils.GenerateRandomAlias()
+		for utils.StringSliceContains(vmList, machineNameCloud) { // if exists, re-randomize
+			machineNameCloud = utils.GenerateRandomAlias()
 		}
-	} else if utils.StringSliceContains(vmList, machineName) {
-		log.Fatal("instance with name \"" + machineName + "\" already exists")
+	} else if utils.StringSliceContains(vmList, machineNameCloud) {
+		log.Fatal("instance with name \"" + machineNameCloud + "\" already exists, use --replace to recreate it")
 	}
 
-	macAddress, err := utils.GenerateMACAddress()
+	macAddress, err := resolveMACAddress(macAddressCloud)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	machineIP := "localhost"
+	if staticIPCloud != "" && network != qemu.NetworkUser && network != qemu.NetworkGvproxy {
+		machineIP = strings.Split(staticIPCloud, "/")[0]
+	}
 
-	machineType := "bios"
-	if machineArchCloud == "aarch64" {
-		machineType = "uefi"
+	cloudImage, err := qemu.ResolveCloudImage(imageVersionCloud, machineArchCloud, firmware)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	image, imageURL, distro := cloudImage.File, cloudImage.URL, cloudImage.Distro
+	if imageURLCloud != "" {
+		image = utils.URLImageName(imageURLCloud, imageSHA256Cloud, machineArchCloud)
+		imageURL, distro = imageURLCloud, qemu.CloudImageDistro(imageURLCloud)
 	}
 
 	rootPassword := "root"
 
 	machineConfig := qemu.MachineConfig{
-		Alias:        machineNameCloud,
-		Image:        fmt.Sprintf("nocloud_alpine-%s-%s-%s-cloudinit-r0.qcow2", imageVersionCloud, machineArchCloud, machineType),
-		Arch:         machineArchCloud,
-		CPU:          machineCPUCloud,
-		Memory:       machineMemoryCloud,
-		Disk:         machineDiskCloud,
-		Mount:        machineMountCloud,
-		MachineIP:    machineIP,
-		Port:         machinePortCloud,
-		SSHPort:      sshPortCloud,
-		MACAddress:   macAddress,
-		VMNet:        vmnetCloud,
-		SSHUser:      "alpine",
-		SSHPassword:  "raw::root",
-		RootUsername: "alpine",
-		RootPassword: &rootPassword,
-		CloudInit:    cloudInitCloud,
-		Tags:         []string{},
-	}
-	machineConfig.Location = filepath.Join(userHomeDir, ".macpine", machineConfig.Alias)
-
-	err = host.Launch(machineConfig)
+		Alias:           machineNameCloud,
+		Image:           image,
+		ImageURL:        imageURL,
+		ImageSHA256:     imageSHA256Cloud,
+		Distro:          distro,
+		Arch:            machineArchCloud,
+		CPU:             machineCPUCloud,
+		Memory:          machineMemoryCloud,
+		Disk:            machineDiskCloud,
+		DiskFormat:      diskFormatCloud,
+		DiskInterface:   diskInterfaceCloud,
+		Mount:           machineMountCloud,
+		MachineIP:       machineIP,
+		Port:            machinePortCloud,
+		SSHPort:         sshPortCloud,
+		MACAddress:      macAddress,
+		Network:         network,
+		BridgeInterface: iface,
+		NetworkID:       networkIDCloud,
+		SSHUser:         defaultSSHUser(launchDefaults, distro),
+		SSHPassword:     utils.RawCredential("root"),
+		RootUsername:    distro,
+		RootPassword:    &rootPassword,
+		CloudInit:       source,
+		UserData:        userData,
+		CloudMetaData:   cloudMetaDataCloud,
+		CloudVendorData: cloudVendorDataCloud,
+		StaticIP:        staticIPCloud,
+		Gateway:         gatewayCloud,
+		NetworkConfig:   networkConfigCloud,
+		CopyFiles:       files,
+		DataDisks:       dataDisks,
+		ReversePorts:    reverse,
+		WriteHosts:      writeHostsCloud,
+		Balloon:         balloonCloud,
+		GuestAgent:      guestAgentCloud,
+		TPM:             tpmCloud,
+		NoRNG:           noRNGCloud,
+		Audio:           audioCloud,
+		Timezone:        tz,
+		Firmware:        firmware,
+		USBDevices:      usb,
+		HostAlias:       hostAliasCloud,
+		FirstBoot:       noStartCloud,
+		RestartPolicy:   policy,
+		QEMUArgs:        qemuArgsCloud,
+		Events:          events,
+		Tags:            mergeTags(defaultTags(launchDefaults), tagsCloud),
+		Description:     descriptionCloud,
+		Labels:          instanceLabels,
+	}
+	machineConfig.Location = filepath.Join(dataDir, machineConfig.Alias)
+
+	machineConfig.UserData, err = machineConfig.AddCloudWriteFiles(userData)
 	if err != nil {
+		log.Fatalln(err)
+	}
+	machineConfig.UserData, err = machineConfig.AddCloudGuestAgent(machineConfig.UserData)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	machineConfig.UserData, err = machineConfig.AddCloudHostAlias(machineConfig.UserData)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	machineConfig.UserData, err = machineConfig.AddCloudTimezone(machineConfig.UserData)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = machineConfig.RenewInstanceID()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// holding the new directory locked keeps a concurrent launch from taking the same name
+	lock, err := machineConfig.Reserve()
+	if errors.Is(err, qemu.ErrInstanceExists) && ifNotExistsCloud {
+		// a concurrent launch took the name since it was checked
+		launchExisting(machineNameCloud, startExistingCloud)
+		return
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := launchContext(launchTimeoutCloud)
+	defer cancel()
+
+	err = host.LaunchWithContext(ctx, machineConfig)
+	if err != nil {
+		machineConfig.Emit(qemu.PhaseFailed, err.Error())
+		// an interrupted launch has already removed the instance
+		exitIfInterrupted(err)
 		// move the log file to the .error-logs directory
-		os.MkdirAll(filepath.Join(userHomeDir, ".macpine", "cache", ".error-logs"), 0755)
+		os.MkdirAll(filepath.Join(dataDir, "cache", ".error-logs"), 0755)
 		name := strings.ReplaceAll(machineConfig.Alias, " ", "_") + "_" + time.Now().Format("2006-01-02_15-04-05") + ".log"
-		os.Rename(filepath.Join(machineConfig.Location, "alpine.log"), filepath.Join(userHomeDir, ".macpine", "cache", ".error-logs", name))
-		fmt.Println("logs are in: " + filepath.Join(userHomeDir, ".macpine", "cache", ".error-logs", name))
-		fmt.Println("run this to clean up:")
-		fmt.Println("rm -rf " + filepath.Join(userHomeDir, ".macpine", machineConfig.Alias))
-		pid, _ := machineConfig.GetInstancePID()
-		fmt.Println("kill " + strconv.Itoa(pid))
-
-		// os.RemoveAll(machineConfig.Location)
-		// pid, _ := machineConfig.GetInstancePID()
-		// p, _ := os.FindProcess(pid)
-		// p.Signal(syscall.SIGKILL)
+		os.Rename(filepath.Join(machineConfig.Location, "alpine.log"), filepath.Join(dataDir, "cache", ".error-logs", name))
+		fmt.Println("logs are in: " + filepath.Join(dataDir, "cache", ".error-logs", name))
+		_, pid := machineConfig.Status()
+		if rmOnFailCloud {
+			// Stop checks that the PID is still this instance's qemu before killing it
+			machineConfig.Stop()
+			os.RemoveAll(machineConfig.Location)
+			fmt.Println("removed " + machineConfig.Location)
+		} else {
+			fmt.Println("run this to clean up (or relaunch with --rm-on-fail):")
+			fmt.Println("rm -rf " + filepath.Join(dataDir, machineConfig.Alias))
+			fmt.Println("kill " + strconv.Itoa(pid))
+		}
+
 		log.Fatal(err)
 	}
 
 	fmt.Println("")
-	log.Println("launchClouded: " + machineNameCloud)
+	if noStartCloud {
+		log.Noticeln("created: " + machineNameCloud)
+		machineConfig.Emit(qemu.PhaseLaunched, "created, not started")
+		return
+	}
+	log.Noticeln("launchClouded: " + machineNameCloud)
+	if err := host.StartSupervisor(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := host.StartForwarder(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := host.StartClockWatcher(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	machineConfig.Emit(qemu.PhaseLaunched, "")
 }
 
 func flagsLaunchCloud(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cloudArguments are valid arguments of CorrectArgumentsCloud, which each case changes
+type cloudArguments struct {
+	mount, cloudInit, metaData, vendorData string
+}
+
+func (a cloudArguments) check() error {
+	return CorrectArgumentsCloud("alpine_3.20.3", "aarch64", "2", "2048", "10G", "2222", "", a.mount,
+		a.cloudInit, a.metaData, a.vendorData)
+}
+
+func TestCorrectArgumentsCloudSeedFiles(t *testing.T) {
+	dir := t.TempDir()
+	userData := filepath.Join(dir, "user-data")
+	if err := os.WriteFile(userData, []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		args cloudArguments
+		want string
+	}{
+		{cloudArguments{cloudInit: userData}, ""},
+		{cloudArguments{cloudInit: "-"}, ""},
+		{cloudArguments{}, ""},
+		{cloudArguments{cloudInit: userData, metaData: userData, vendorData: userData}, ""},
+		{cloudArguments{cloudInit: missing}, "--cloud-init file " + missing + " does not exist"},
+		{cloudArguments{cloudInit: dir}, "--cloud-init file " + dir + " is a directory"},
+		{cloudArguments{cloudInit: userData, metaData: missing}, "--cloud-meta-data file " + missing + " does not exist"},
+		{cloudArguments{cloudInit: userData, vendorData: dir}, "--cloud-vendor-data file " + dir + " is a directory"},
+	}
+	for _, tt := range tests {
+		err := tt.args.check()
+		if tt.want == "" && err != nil {
+			t.Errorf("CorrectArgumentsCloud(%+v) = %v, want nil", tt.args, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("CorrectArgumentsCloud(%+v) = %v, want an error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestCorrectArgumentsCloudMount(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		mount string
+		want  string
+	}{
+		{"", ""},
+		{dir, ""},
+		{file, "mount target " + file + " is not a directory"},
+		{missing, "mount target " + missing + " does not exist"},
+	}
+	for _, tt := range tests {
+		err := cloudArguments{mount: tt.mount}.check()
+		if tt.want == "" && err != nil {
+			t.Errorf("CorrectArgumentsCloud with mount %q = %v, want nil", tt.mount, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("CorrectArgumentsCloud with mount %q = %v, want an error containing %q", tt.mount, err, tt.want)
+		}
+	}
+}
+
+func TestDefaultArch(t *testing.T) {
+	tests := []struct {
+		arch   string
+		goarch string
+		want   string
+	}{
+		{"", "arm64", "aarch64"},
+		{"", "amd64", "x86_64"},
+		{"x86_64", "arm64", "x86_64"},
+		{"aarch64", "amd64", "aarch64"},
+		{"", "riscv64", ""},
+	}
+	for _, tt := range tests {
+		got, err := defaultArch(tt.arch, tt.goarch)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("defaultArch(%q, %q) = %s, want an error", tt.arch, tt.goarch, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("defaultArch(%q, %q) = %s, %v, want %s", tt.arch, tt.goarch, got, err, tt.want)
+		}
+	}
+}
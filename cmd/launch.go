@@ -1,19 +1,25 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
-	"syscall"
+	"strings"
+	"time"
 
+	"github.com/beringresearch/macpine/client"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/oci"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 // launchCmd launches an Alpine instance
@@ -27,31 +33,201 @@ var launchCmd = &cobra.Command{
 }
 
 var machineArch, imageVersion, machineCPU, machineMemory, machineDisk, machinePort, sshPort, machineName, machineMount string
+var namePrefix string
+var fillGaps bool
+var replace, replaceForce, recreate bool
+var noStart bool
+var ifNotExists, startExisting bool
+var profile string
+var diskFormat, diskInterface string
+var imageURL, imageSHA256 string
+var description string
+var labels []string
+var tags []string
+var networkMode, bridgeInterface, networkID string
+var macAddressFlag string
 var vmnet bool
+var provisionScripts []string
+var provisionIgnoreErrors bool
+var copyFiles, addDisks, reversePorts []string
+var writeHosts bool
+var balloon bool
+var guestAgent bool
+var tpm bool
+var noRNG bool
+var audio bool
+var timezone string
+var usbDevices []string
+var restartPolicy string
+var qemuArgs []string
+var jsonEvents bool
+var launchTimeout time.Duration
 
 func init() {
 	includeLaunchFlags(launchCmd)
 }
 
 func includeLaunchFlags(cmd *cobra.Command) {
-	cmd.Flags().StringVarP(&imageVersion, "image", "i", "alpine_3.20.3", "Image to be launched.")
+	cmd.Flags().StringVarP(&imageVersion, "image", "i", "alpine_3.20.3", "Image to be launched, or oci://<reference> of an instance published to a registry.")
+	cmd.Flags().StringVar(&imageURL, "image-url", "", "Download a custom qcow2 image from an http(s) URL into the cache and launch it instead of --image.")
+	cmd.Flags().StringVar(&imageSHA256, "image-sha256", "", "Expected sha256 of the --image-url download, verified before it is used.")
 	cmd.Flags().StringVarP(&machineArch, "arch", "a", "", "Machine architecture. Defaults to host architecture.")
 	cmd.Flags().StringVarP(&machineCPU, "cpu", "c", "2", "Number of CPUs to allocate.")
 	cmd.Flags().StringVarP(&machineMemory, "memory", "m", "2048", "Amount of memory (in kB) to allocate.")
 	cmd.Flags().StringVarP(&machineDisk, "disk", "d", "5G", "Disk space (in bytes) to allocate. K, M, G suffixes are supported.")
+	cmd.Flags().StringVar(&diskInterface, "disk-interface", "virtio", "Disk interface: virtio (/dev/vda in the guest) or nvme (/dev/nvme0n1).")
+	cmd.Flags().StringVar(&diskFormat, "disk-format", "qcow2", "Disk image format: qcow2, or raw for better I/O performance.")
 	cmd.Flags().StringVar(&machineMount, "mount", "", "Path to a host directory to be shared with the instance.")
 	cmd.Flags().StringVarP(&sshPort, "ssh", "s", "22", "Host port to forward for SSH (required).")
 	cmd.Flags().StringVarP(&machinePort, "port", "p", "", "Forward additional host ports. Multiple ports can be separated by `,`.")
+	cmd.Flags().StringArrayVar(&reversePorts, "reverse-port", []string{}, "Forward a guest port to the host over SSH as guestport:host:hostport, e.g. 5432:localhost:5432. Repeat for several ports.")
 	cmd.Flags().StringVarP(&machineName, "name", "n", "", "Instance name for use in `alpine` commands.")
-	cmd.Flags().BoolVarP(&vmnet, "shared", "v", false, "Toggle whether to use mac's native vmnet-shared mode.")
+	cmd.Flags().StringVar(&description, "description", "", "Free-text description of the instance, shown by `alpine info`.")
+	cmd.Flags().StringArrayVar(&labels, "label", []string{}, "Attach a key=value label, e.g. owner=anna. Repeat for several labels.")
+	cmd.Flags().StringArrayVar(&tags, "tag", []string{}, "Tag the instance, for `alpine list` and `alpine <command> +tag`. Repeat for several tags.")
+	cmd.Flags().StringVar(&namePrefix, "name-prefix", "", "Name the instance PREFIX-N, with the next index after the existing PREFIX-N instances.")
+	cmd.Flags().BoolVar(&fillGaps, "fill-gaps", false, "With --name-prefix, use the lowest free index rather than the next after the highest.")
+	cmd.Flags().BoolVar(&replace, "replace", false, "Stop and delete an existing instance with the same name first.")
+	cmd.Flags().BoolVarP(&replaceForce, "force", "f", false, "With --replace, do not ask for confirmation.")
+	cmd.Flags().BoolVar(&recreate, "recreate", false, "Delete an existing instance with the same name without asking, same as --replace --force.")
+	cmd.Flags().BoolVar(&ifNotExists, "if-not-exists", false, "Do nothing and exit successfully when an instance with the same name exists.")
+	cmd.Flags().BoolVar(&startExisting, "start-existing", false, "With --if-not-exists, start the existing instance if it is stopped.")
+	cmd.Flags().BoolVar(&noStart, "no-start", false, "Create the instance without booting it. The first `alpine start` completes the launch.")
+	cmd.Flags().BoolVarP(&vmnet, "shared", "v", false, "Toggle whether to use mac's native vmnet-shared mode. Shorthand for --network shared.")
+	cmd.Flags().StringVar(&networkMode, "network", "user", "Network mode: user, gvproxy, shared, bridged[:<iface>], host-only, or none.")
+	cmd.Flags().StringVar(&bridgeInterface, "bridge-interface", "", "Host interface for bridged networking. Defaults to the interface of the default route.")
+	cmd.Flags().StringVar(&macAddressFlag, "mac", "", "MAC address of the instance, e.g. for a DHCP reservation. Must be locally administered. Generated by default.")
+	cmd.Flags().StringVar(&networkID, "network-id", "", "Name of a host-only network. Instances launched with the same id share an isolated network.")
+	cmd.Flags().StringVar(&profile, "profile", "", "Named preset of launch flags from the global config. Explicit flags take precedence.")
+	cmd.RegisterFlagCompletionFunc("profile", autoCompleteProfiles)
+	cmd.RegisterFlagCompletionFunc("image", autoCompleteImages)
+	cmd.RegisterFlagCompletionFunc("arch", host.AutoCompleteArch)
+	cmd.Flags().StringArrayVar(&provisionScripts, "provision", []string{}, "Script to run as root once the instance is reachable over SSH. Repeat to run several in order.")
+	cmd.Flags().BoolVar(&provisionIgnoreErrors, "provision-ignore-errors", false, "Continue with the remaining provisioning scripts when one fails.")
+	cmd.Flags().DurationVar(&launchTimeout, "timeout", 0, "Give up and remove the instance if it has not booted within this duration (e.g. 5m). 0 waits indefinitely.")
+	cmd.Flags().BoolVar(&jsonEvents, "json-events", false, "Print launch progress as JSON events, one per line, on stdout.")
+	cmd.Flags().BoolVar(&writeHosts, "write-hosts", false, "Map NAME.alpine to the instance address in /etc/hosts (vmnet modes, requires sudo).")
+	cmd.Flags().StringArrayVar(&copyFiles, "copy-file", []string{}, "Copy a host file into the instance as hostpath:guestpath[:mode]. Repeat for several files.")
+	cmd.Flags().StringArrayVar(&addDisks, "add-disk", []string{}, "Attach an additional empty disk as SIZE[:format], e.g. 20G or 20G:raw. Repeat for several disks.")
+	cmd.Flags().StringArrayVar(&qemuArgs, "qemu-arg", []string{}, "Append a raw argument to the qemu command line, e.g. --qemu-arg=-device --qemu-arg=usb-tablet. Unsupported, bad arguments can break boot.")
+	cmd.Flags().BoolVar(&balloon, "balloon", false, "Add a virtio memory balloon so that `alpine balloon` can reclaim guest memory at runtime.")
+	cmd.Flags().BoolVar(&guestAgent, "guest-agent", false, "Install qemu-guest-agent, used by `alpine ip`, `alpine exec --agent` and publish of running instances.")
+	cmd.Flags().BoolVar(&noRNG, "no-rng", false, "Do not attach the virtio-rng device that feeds the guest entropy from the host, e.g. for deterministic boots.")
+	cmd.Flags().StringArrayVar(&usbDevices, "usb", []string{}, "Pass a host USB device through as vendorid:productid, e.g. 1a86:7523 (see `alpine usb list`). Repeat for several devices.")
+	cmd.Flags().BoolVar(&audio, "audio", false, "Add a sound card, played and recorded through Core Audio.")
+	cmd.Flags().StringVar(&timezone, "timezone", "", "Timezone of the instance, such as America/New_York. Defaults to the timezone of the host, UTC keeps the guest in UTC.")
+	cmd.Flags().BoolVar(&tpm, "tpm", false, "Add a TPM 2.0 device backed by swtpm, with its state kept in the instance directory.")
+	cmd.Flags().StringVar(&restartPolicy, "restart-policy", "no", "Restart the instance when qemu exits: no, on-failure or always.")
+	cmd.RegisterFlagCompletionFunc("restart-policy", autoCompleteRestartPolicy)
+	cmd.RegisterFlagCompletionFunc("tag", autoCompleteTags)
 }
 
-func CorrectArguments(imageVersion string, machineArch string, machineCPU string,
-	machineMemory string, machineDisk string, sshPort string, machinePort string) error {
+// resolveNetwork combines the --network and --shared flags, detecting the host
+// interface for bridged mode when none was given
+func resolveNetwork(mode string, shared bool, iface string, networkID string) (qemu.NetworkMode, string, error) {
+	network, specIface, err := qemu.ParseNetworkSpec(mode)
+	if err != nil {
+		return "", "", err
+	}
+	if specIface != "" {
+		if iface != "" && iface != specIface {
+			return "", "", errors.New("--network " + mode + " conflicts with --bridge-interface " + iface)
+		}
+		iface = specIface
+	}
+
+	if shared {
+		if network != qemu.NetworkUser && network != qemu.NetworkShared {
+			return "", "", errors.New("--shared cannot be combined with --network " + mode)
+		}
+		network = qemu.NetworkShared
+	}
+
+	if networkID != "" && network != qemu.NetworkHostOnly {
+		return "", "", errors.New("--network-id requires --network host-only")
+	}
+
+	if network != qemu.NetworkBridged {
+		if iface != "" {
+			return "", "", errors.New("--bridge-interface requires --network bridged")
+		}
+		return network, "", nil
+	}
+
+	if iface == "" {
+		iface, err = utils.DefaultNetworkInterface()
+		if err != nil {
+			return "", "", err
+		}
+		log.Println("bridging to default interface " + iface)
+	}
+	return network, iface, nil
+}
+
+// defaultArch returns the guest architecture of a new instance, that of the host goarch unless one is given
+func defaultArch(machineArch string, goarch string) (string, error) {
+	if machineArch != "" {
+		return machineArch, nil
+	}
+	switch goarch {
+	case "arm64":
+		return "aarch64", nil
+	case "amd64":
+		return "x86_64", nil
+	}
+	return "", errors.New("unsupported host architecture: " + goarch)
+}
+
+// resolveMACAddress validates a MAC address given with --mac, or generates one that no other instance uses
+func resolveMACAddress(mac string) (string, error) {
+	if mac == "" {
+		return utils.UniqueMACAddress(host.UsedMACAddresses(), utils.GenerateMACAddress)
+	}
+	mac, err := utils.ParseMACAddress(mac)
+	if err != nil {
+		return "", err
+	}
+	if other := host.InstanceWithMAC(mac); other != "" {
+		return "", errors.New("MAC address " + mac + " is already used by " + other)
+	}
+	return mac, nil
+}
+
+// catalog is the image catalog, loaded once by imageCatalog
+var catalog *host.Catalog
+
+// imageCatalog returns the image catalog, loading it on first use
+func imageCatalog() (host.Catalog, error) {
+	if catalog == nil {
+		c, err := host.LoadCatalog(context.Background())
+		if err != nil {
+			return c, err
+		}
+		catalog = &c
+	}
+	return *catalog, nil
+}
 
-	if !utils.StringSliceContains([]string{"alpine_3.20.3"}, imageVersion) {
-		return errors.New("unsupported image. only -i alpine_3.20.3 are currently available")
+// cachedImageName matches images downloaded by launch, e.g. alpine_3.20.3-x86_64.qcow2
+var cachedImageName = regexp.MustCompile(`^(alpine_[^-]+)-(aarch64|x86_64)\.qcow2$`)
+
+// autoCompleteImages completes --image with the images in the catalog and those already in the cache
+func autoCompleteImages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var images []string
+	// completion must not wait for the network, the catalog is read from the cache
+	if c, err := host.LoadCachedCatalog(); err == nil {
+		images = c.Names()
+	}
+	for _, image := range host.CachedImages() {
+		if m := cachedImageName.FindStringSubmatch(image); m != nil && !utils.StringSliceContains(images, m[1]) {
+			images = append(images, m[1])
+		}
 	}
+	return images, cobra.ShellCompDirectiveNoFileComp
+}
+
+func CorrectArguments(imageVersion string, machineArch string, machineCPU string,
+	machineMemory string, machineDisk string, sshPort string, machinePort string, machineMount string) error {
 
 	if machineArch != "" {
 		if machineArch != "aarch64" && machineArch != "x86_64" {
@@ -59,6 +235,22 @@ func CorrectArguments(imageVersion string, machineArch string, machineCPU string
 		}
 	}
 
+	// images pulled from a registry are checked when pulled, an empty image is not checked
+	pulled := strings.HasPrefix(imageVersion, oci.Scheme) || host.IsPulledImage(imageVersion)
+	if !pulled && imageVersion != "" {
+		c, err := imageCatalog()
+		if err != nil {
+			return err
+		}
+		if _, ok := c.Lookup(imageVersion, machineArch); !ok {
+			if _, ok := c.Lookup(imageVersion, ""); ok {
+				return errors.New("image " + imageVersion + " is not available for " + machineArch)
+			}
+			return errors.New("unsupported image " + imageVersion + ". use -i with one of " + strings.Join(c.Names(), ", ") +
+				" (see `alpine images available`), --image-url or oci://<reference>")
+		}
+	}
+
 	int, err := strconv.Atoi(machineCPU)
 	if err != nil || int < 0 {
 		return errors.New("number of cpus (-c) must be a positive integer")
@@ -101,6 +293,8 @@ func CorrectArguments(imageVersion string, machineArch string, machineCPU string
 	if machineMount != "" {
 		if dir, err := os.Stat(machineMount); os.IsNotExist(err) {
 			return errors.New("mount target " + machineMount + " does not exist")
+		} else if err != nil {
+			return errors.New("mount target " + machineMount + " is not accessible: " + err.Error())
 		} else if !dir.IsDir() {
 			return errors.New("mount target " + machineMount + " is not a directory")
 		}
@@ -110,30 +304,109 @@ func CorrectArguments(imageVersion string, machineArch string, machineCPU string
 }
 
 func launch(cmd *cobra.Command, args []string) {
+	launchDefaults, err := applyGlobalDefaults(cmd, profile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	events := launchEvents(jsonEvents)
+	emitValidating(events, machineName)
 
-	err := CorrectArguments(imageVersion, machineArch, machineCPU, machineMemory, machineDisk, sshPort, machinePort)
+	if recreate {
+		replace, replaceForce = true, true
+	}
+	if ifNotExists && replace {
+		log.Fatalln("--if-not-exists cannot be combined with --replace or --recreate")
+	}
+	if startExisting && !ifNotExists {
+		log.Fatalln("--start-existing requires --if-not-exists")
+	}
+
+	err = CorrectArguments(imageVersion, machineArch, machineCPU, machineMemory, machineDisk, sshPort, machinePort, machineMount)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
+	imageSHA256, err = checkImageURLFlags(cmd, imageURL, imageSHA256)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	policy, err := qemu.ParseRestartPolicy(restartPolicy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dataDir, err := host.DataDir()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if _, err := qemu.ParseDiskFormat(diskFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := qemu.ParseDiskInterface(diskInterface); err != nil {
+		log.Fatalln(err)
+	}
+	if tpm && qemu.SwtpmPath() == "" {
+		log.Fatalln(qemu.ErrNoSwtpm)
+	}
 
-	userHomeDir, err := os.UserHomeDir()
+	network, iface, err := resolveNetwork(networkMode, vmnet, bridgeInterface, networkID)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	if machineArch == "" {
-		arch := runtime.GOARCH
+	if writeHosts && (network == qemu.NetworkUser || network == qemu.NetworkGvproxy || network == qemu.NetworkNone) {
+		log.Fatalln("--write-hosts requires a vmnet network mode (shared, bridged or host-only)")
+	}
+	if len(reversePorts) > 0 && network == qemu.NetworkNone {
+		log.Fatalln("--reverse-port requires a network, ports are forwarded over SSH")
+	}
+
+	if namePrefix != "" {
+		if machineName != "" {
+			log.Fatalln("--name and --name-prefix cannot be combined")
+		}
+		machineName = utils.NextIndexedName(host.ListVMNames(), namePrefix, fillGaps)
+	} else if fillGaps {
+		log.Fatalln("--fill-gaps requires --name-prefix")
+	}
 
-		switch arch {
-		case "arm64":
-			machineArch = "aarch64"
-		case "amd64":
-			machineArch = "x86_64"
-		default:
-			log.Fatal("unsupported host architecture: " + arch)
+	if machineName != "" {
+		if err := utils.ValidateName(machineName); err != nil {
+			log.Fatalln(err)
 		}
 	}
 
+	scripts, err := resolveProvisionScripts(provisionScripts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	files, err := parseFileCopies(copyFiles)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dataDisks, err := parseDataDisks(addDisks)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	reverse, err := parseReversePorts(reversePorts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	instanceLabels, err := qemu.ParseLabels(labels)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	validateTags(tags)
+	usb, err := parseUSBDevices(usbDevices)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	vmList := host.ListVMNames()
 
 	if machineName == "" {
@@ -142,10 +415,53 @@ func launch(cmd *cobra.Command, args []string) {
 			machineName = utils.GenerateRandomAlias()
 		}
 	} else if utils.StringSliceContains(vmList, machineName) {
-		log.Fatal("instance with name \"" + machineName + "\" already exists")
+		if ifNotExists {
+			launchExisting(machineName, startExisting)
+			return
+		}
+		if !replace {
+			log.Fatal("instance with name \"" + machineName + "\" already exists, use --replace to recreate it")
+		}
+	}
+
+	// pulled before an instance is replaced, so that a failed pull leaves it in place
+	image := ""
+	if strings.HasPrefix(imageVersion, oci.Scheme) {
+		image, machineArch, err = pullImage(imageVersion, machineArch)
+		if err != nil {
+			exitIfInterrupted(err)
+			log.Fatalln(err)
+		}
+	}
+
+	machineArch, err = defaultArch(machineArch, runtime.GOARCH)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	tz := resolveTimezone(timezone)
+	if audio {
+		if err := qemu.CheckAudio(machineArch); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if imageURL != "" {
+		image = utils.URLImageName(imageURL, imageSHA256, machineArch)
+	}
+	if image == "" {
+		image = imageVersion + "-" + machineArch + ".qcow2"
+		// catalog images are downloaded from the URL the catalog lists, which may be a mirror
+		if c, err := imageCatalog(); err == nil {
+			if entry, ok := c.Lookup(imageVersion, machineArch); ok {
+				imageURL, imageSHA256 = entry.URL, entry.SHA256
+			}
+		}
+	}
+
+	if replace && utils.StringSliceContains(vmList, machineName) {
+		replaceInstance(machineName, replaceForce)
 	}
 
-	macAddress, err := utils.GenerateMACAddress()
+	macAddress, err := resolveMACAddress(macAddressFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -153,37 +469,290 @@ func launch(cmd *cobra.Command, args []string) {
 	machineIP := "localhost"
 
 	machineConfig := qemu.MachineConfig{
-		Alias:       machineName,
-		Image:       imageVersion + "-" + machineArch + ".qcow2",
-		Arch:        machineArch,
-		CPU:         machineCPU,
-		Memory:      machineMemory,
-		Disk:        machineDisk,
-		Mount:       machineMount,
-		MachineIP:   machineIP,
-		Port:        machinePort,
-		SSHPort:     sshPort,
-		MACAddress:  macAddress,
-		VMNet:       vmnet,
-		SSHUser:     "root",
-		SSHPassword: "raw::root",
-		Tags:        []string{},
-	}
-	machineConfig.Location = filepath.Join(userHomeDir, ".macpine", machineConfig.Alias)
-
-	err = host.Launch(machineConfig)
+		Alias:           machineName,
+		Image:           image,
+		ImageURL:        imageURL,
+		ImageSHA256:     imageSHA256,
+		Arch:            machineArch,
+		CPU:             machineCPU,
+		Memory:          machineMemory,
+		Disk:            machineDisk,
+		DiskFormat:      diskFormat,
+		DiskInterface:   diskInterface,
+		Mount:           machineMount,
+		MachineIP:       machineIP,
+		Port:            machinePort,
+		SSHPort:         sshPort,
+		MACAddress:      macAddress,
+		Network:         network,
+		BridgeInterface: iface,
+		NetworkID:       networkID,
+		SSHUser:         defaultSSHUser(launchDefaults, "root"),
+		SSHPassword:     utils.RawCredential("root"),
+		Tags:            mergeTags(defaultTags(launchDefaults), tags),
+		Description:     description,
+		Labels:          instanceLabels,
+		Provision:       scripts,
+		CopyFiles:       files,
+		DataDisks:       dataDisks,
+		ReversePorts:    reverse,
+		WriteHosts:      writeHosts,
+		Balloon:         balloon,
+		GuestAgent:      guestAgent,
+		TPM:             tpm,
+		NoRNG:           noRNG,
+		Audio:           audio,
+		Timezone:        tz,
+		USBDevices:      usb,
+		FirstBoot:       noStart,
+		RestartPolicy:   policy,
+		QEMUArgs:        qemuArgs,
+		Events:          events,
+	}
+	machineConfig.Location = filepath.Join(dataDir, machineConfig.Alias)
+
+	// holding the new directory locked keeps a concurrent launch from taking the same name
+	lock, err := machineConfig.Reserve()
+	if errors.Is(err, qemu.ErrInstanceExists) && ifNotExists {
+		// a concurrent launch took the name since it was checked
+		launchExisting(machineName, startExisting)
+		return
+	}
 	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := launchContext(launchTimeout)
+	defer cancel()
+
+	err = host.LaunchWithContext(ctx, machineConfig)
+	if err != nil {
+		// Stop checks that the PID is still this instance's qemu before killing it
+		machineConfig.Stop()
 		os.RemoveAll(machineConfig.Location)
-		pid, _ := machineConfig.GetInstancePID()
-		p, _ := os.FindProcess(pid)
-		p.Signal(syscall.SIGKILL)
+		machineConfig.Emit(qemu.PhaseFailed, err.Error())
+		exitIfInterrupted(err)
 		log.Fatal(err)
 	}
 
 	fmt.Println("")
-	log.Println("launched: " + machineName)
+	if noStart {
+		log.Noticeln("created: " + machineName)
+		machineConfig.Emit(qemu.PhaseLaunched, "created, not started")
+		return
+	}
+	log.Noticeln("launched: " + machineName)
+
+	if len(files) > 0 || len(scripts) > 0 {
+		// reload, the vmnet address is discovered during launch
+		machineConfig, err = qemu.GetMachineConfig(machineName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		machineConfig.Events = events
+		machineConfig.SetLock(lock)
+	}
+
+	if len(files) > 0 {
+		err = host.InjectFiles(machineConfig)
+		if err != nil {
+			machineConfig.Emit(qemu.PhaseFailed, err.Error())
+			log.Fatalln(err.Error() + ". " + machineName + " is left running for debugging")
+		}
+	}
+
+	if len(scripts) > 0 {
+		err = host.Provision(machineConfig, scripts, provisionIgnoreErrors)
+		if err != nil {
+			machineConfig.Emit(qemu.PhaseFailed, err.Error())
+			log.Fatalln(err.Error() + ". " + machineName + " is left running for debugging")
+		}
+	}
+
+	if err := host.StartSupervisor(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := host.StartForwarder(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := host.StartClockWatcher(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	machineConfig.Emit(qemu.PhaseLaunched, "")
+}
+
+// checkImageURLFlags validates --image-url and --image-sha256 and returns the normalized sha256
+func checkImageURLFlags(cmd *cobra.Command, imageURL string, digest string) (string, error) {
+	digest = strings.ToLower(digest)
+	if imageURL == "" {
+		if digest != "" {
+			return "", errors.New("--image-sha256 requires --image-url")
+		}
+		return "", nil
+	}
+	if cmd.Flags().Changed("image") {
+		return "", errors.New("--image and --image-url cannot be combined")
+	}
+	if err := utils.CheckImageURL(imageURL); err != nil {
+		return "", err
+	}
+	if digest == "" {
+		log.Println("no --image-sha256 given, " + imageURL + " will not be verified")
+		return "", nil
+	}
+	return digest, utils.CheckSHA256(digest)
+}
+
+// pullImage pulls an instance published to a registry into the image cache and returns the cached
+// image and its architecture, which must match arch when set
+func pullImage(reference string, arch string) (string, string, error) {
+	image, published, err := host.PullOCI(interruptContext(), reference)
+	if err != nil {
+		return "", "", errors.New("unable to pull " + strings.TrimPrefix(reference, oci.Scheme) + ": " + err.Error())
+	}
+	if arch != "" && arch != published.Arch {
+		return "", "", errors.New(strings.TrimPrefix(reference, oci.Scheme) + " is an " + published.Arch + " instance, it cannot be launched with --arch " + arch)
+	}
+	return image, published.Arch, nil
+}
+
+// launchContext bounds a launch by --timeout, if set, and cancels it on Ctrl-C
+func launchContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(interruptContext())
+	}
+	return context.WithTimeout(interruptContext(), timeout)
+}
+
+// parseFileCopies parses the --copy-file specifications
+func parseFileCopies(specs []string) ([]qemu.FileCopy, error) {
+	files := make([]qemu.FileCopy, len(specs))
+	for i, spec := range specs {
+		f, err := qemu.ParseFileCopy(spec)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = f
+	}
+	return files, nil
+}
+
+// parseReversePorts parses the --reverse-port specifications
+func parseReversePorts(specs []string) ([]qemu.ReversePort, error) {
+	ports := make([]qemu.ReversePort, len(specs))
+	for i, spec := range specs {
+		r, err := qemu.ParseReversePort(spec)
+		if err != nil {
+			return nil, err
+		}
+		ports[i] = r
+	}
+	return ports, nil
+}
+
+// parseDataDisks parses the --add-disk specifications
+func parseDataDisks(specs []string) ([]qemu.DataDisk, error) {
+	disks := make([]qemu.DataDisk, len(specs))
+	for i, spec := range specs {
+		d, err := qemu.ParseDataDisk(spec)
+		if err != nil {
+			return nil, err
+		}
+		disks[i] = d
+	}
+	return disks, nil
+}
+
+// resolveTimezone validates --timezone, defaulting to the timezone of the host
+func resolveTimezone(tz string) string {
+	if tz == "" {
+		return qemu.HostTimezone()
+	}
+	tz, err := qemu.ParseTimezone(tz)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return tz
+}
+
+// parseUSBDevices parses the --usb specifications, dropping repeated devices
+func parseUSBDevices(specs []string) ([]qemu.USBDevice, error) {
+	devices := []qemu.USBDevice{}
+	seen := make(map[qemu.USBDevice]bool)
+	for _, spec := range specs {
+		d, err := qemu.ParseUSBDevice(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[d] {
+			seen[d] = true
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// resolveProvisionScripts checks that each provisioning script is readable and makes its path absolute
+func resolveProvisionScripts(scripts []string) ([]string, error) {
+	resolved := make([]string, len(scripts))
+	for i, script := range scripts {
+		abs, err := filepath.Abs(script)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(abs)
+		if err != nil {
+			return nil, errors.New("unable to read provisioning script: " + err.Error())
+		}
+		f.Close()
+		resolved[i] = abs
+	}
+	return resolved, nil
 }
 
 func flagsLaunch(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	return nil, cobra.ShellCompDirectiveNoFileComp
 }
+
+// replaceInstance stops and deletes an existing instance for launch --replace, asking first unless
+// force is set
+func replaceInstance(vmName string, force bool) {
+	if !force {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			log.Fatalln(vmName + " already exists, use --force to replace it without confirmation")
+		}
+		if !utils.Confirm("replace "+vmName+"? its disks will be deleted", false) {
+			log.Fatalln("nothing replaced")
+		}
+	}
+	if err := client.Stop(context.Background(), vmName, true); err != nil {
+		log.Fatalln("unable to stop " + vmName + ": " + err.Error())
+	}
+	if err := client.Delete(context.Background(), vmName); err != nil {
+		log.Fatalln("unable to delete " + vmName + ": " + err.Error())
+	}
+	log.Println("deleted " + vmName + ", launching it again")
+}
+
+// launchExisting handles launch --if-not-exists of an instance that exists, starting it if it is
+// stopped and start is set
+func launchExisting(vmName string, start bool) {
+	log.Noticeln(vmName + " already exists")
+	if !start {
+		return
+	}
+	// an instance that another command is still launching has no configuration yet, and is left to it
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Debugln(err)
+		return
+	}
+	if status, _ := machineConfig.Status(); status != "Stopped" {
+		return
+	}
+	if err := client.Start(context.Background(), vmName); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("started " + vmName)
+}
@@ -1,14 +1,16 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -22,43 +24,184 @@ var listCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+var listBroken, listNames bool
+var listTags, listLabels []string
+var listStatus, listOutput string
+
+// listColumns are the columns of the default table. Custom columns can also name any config.yaml field.
+var listColumns = []string{"NAME", "STATUS", "IP", "SSH", "PORTS", "NETWORK", "ARCH", "PID", "CREATED", "UPTIME", "AUTOSTART", "TAGS"}
+
+func init() {
+	listCmd.Flags().BoolVar(&listBroken, "broken", false, "Only list instances whose configuration cannot be loaded.")
+	listCmd.Flags().BoolVarP(&listNames, "names", "q", false, "Only print instance names, one per line.")
+	listCmd.Flags().StringArrayVar(&listTags, "tag", []string{}, "Only list instances with this tag. Repeat to require several tags.")
+	listCmd.Flags().StringArrayVar(&listLabels, "label-filter", []string{}, "Only list instances with this key=value label. Repeat to require several labels.")
+	listCmd.Flags().StringVar(&listStatus, "status", "", "Only list instances with this status: running, stopped, paused, created or broken.")
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format: table, or custom-columns=NAME,STATUS,SSHPORT with table columns or config.yaml fields.")
+	listCmd.RegisterFlagCompletionFunc("tag", host.AutoCompleteTags)
+	listCmd.RegisterFlagCompletionFunc("status", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"running", "stopped", "paused", "created", "broken"}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
 func list(cmd *cobra.Command, args []string) {
-	status := []string{}
-	configs := []qemu.MachineConfig{}
-	pid := []string{}
+	columns, err := parseListOutput(listOutput)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if listStatus != "" && !utils.StringSliceContains([]string{"running", "stopped", "paused", "created", "broken"}, strings.ToLower(listStatus)) {
+		log.Fatalln("invalid --status " + listStatus + ", expected running, stopped, paused, created or broken")
+	}
+	labels, err := qemu.ParseLabels(listLabels)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	vmNames := host.ListVMNames()
-	for _, vmName := range vmNames {
+	rows := []map[string]string{}
+	for _, vmName := range host.ListVMNames() {
 		machineConfig, err := qemu.GetMachineConfig(vmName)
 		if err != nil {
-			log.Fatal(err)
+			// show broken instances so they can be repaired or deleted, details are in `alpine info`
+			if listMatches(qemu.MachineConfig{}, host.StatusBroken, labels) {
+				rows = append(rows, listRow(qemu.MachineConfig{Alias: vmName}, host.StatusBroken, 0))
+			}
+			continue
+		}
+		if listBroken {
+			continue
 		}
 
-		configs = append(configs, machineConfig)
+		status, pid := host.Status(machineConfig)
+		if listMatches(machineConfig, status, labels) {
+			rows = append(rows, listRow(machineConfig, status, pid))
+		}
+	}
 
-		s, p := host.Status(machineConfig)
-		status = append(status, s)
-		if s == "Stopped" {
-			pid = append(pid, "-")
-		} else {
-			pid = append(pid, fmt.Sprint(p))
+	if listNames {
+		for _, row := range rows {
+			fmt.Println(row["NAME"])
 		}
+		return
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-	fmt.Fprintln(w, "NAME\tSTATUS\tSSH\tPORTS\tARCH\tPID\tTAGS\t")
-	for i, machine := range configs {
-		spacer := "    \t"
-		row := []string{
-			machine.Alias,
-			status[i],
-			machine.SSHPort,
-			machine.Port,
-			machine.Arch,
-			fmt.Sprint(pid[i]),
-			strings.Join(machine.Tags, ","),
+	fmt.Fprintln(w, strings.Join(columns, "\t")+"\t")
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = row[column]
+			// custom columns are read by scripts, keep every cell non-empty
+			if values[i] == "" && listOutput != "table" {
+				values[i] = "-"
+			}
 		}
-		fmt.Fprintln(w, strings.Join(row, "    \t")+spacer)
+		fmt.Fprintln(w, strings.Join(values, "    \t")+"    \t")
 	}
 	w.Flush()
 }
+
+// parseListOutput returns the columns selected by --output
+func parseListOutput(output string) ([]string, error) {
+	if output == "table" || output == "" {
+		return listColumns, nil
+	}
+	spec, ok := strings.CutPrefix(output, "custom-columns=")
+	if !ok || spec == "" {
+		return nil, errors.New("invalid --output " + output + ", expected table or custom-columns=NAME,STATUS,...")
+	}
+
+	known := append([]string{}, listColumns...)
+	for _, field := range host.ConfigFields(qemu.MachineConfig{}) {
+		if column := strings.ToUpper(field.Key); !utils.StringSliceContains(known, column) {
+			known = append(known, column)
+		}
+	}
+	columns := strings.Split(strings.ToUpper(spec), ",")
+	for _, column := range columns {
+		if !utils.StringSliceContains(known, column) {
+			return nil, errors.New("unknown column " + column + ", expected one of " + strings.Join(known, ", "))
+		}
+	}
+	return columns, nil
+}
+
+// listMatches applies the --broken, --status, --tag and --label-filter filters
+func listMatches(machine qemu.MachineConfig, status string, labels map[string]string) bool {
+	if listBroken && status != host.StatusBroken {
+		return false
+	}
+	if listStatus != "" && !strings.EqualFold(listStatus, status) {
+		return false
+	}
+	for _, tag := range listTags {
+		if !utils.StringSliceContains(machine.Tags, tag) {
+			return false
+		}
+	}
+	return machine.HasLabels(labels)
+}
+
+// listRow renders the table columns and config.yaml fields of an instance, keyed by column name
+func listRow(machine qemu.MachineConfig, status string, pid int) map[string]string {
+	row := map[string]string{}
+	if status != host.StatusBroken {
+		for _, field := range host.ConfigFields(machine) {
+			row[strings.ToUpper(field.Key)] = field.Value
+		}
+	}
+
+	created := "-"
+	if !machine.CreatedAt.IsZero() {
+		created = machine.CreatedAt.Local().Format("2006-01-02 15:04")
+	}
+	pidColumn, uptime := "-", "-"
+	if status != "Stopped" && status != host.StatusCreated && status != host.StatusBroken {
+		pidColumn = fmt.Sprint(pid)
+		if stats, err := utils.GetProcessStats(pid); err == nil {
+			uptime = stats.Elapsed.String()
+		}
+	}
+
+	row["NAME"] = machine.Alias
+	row["STATUS"] = status
+	row["IP"] = listIP(machine, status)
+	row["SSH"] = machine.SSHPort
+	row["PORTS"] = machine.Port
+	row["NETWORK"] = string(machine.Network)
+	row["ARCH"] = machine.Arch
+	row["PID"] = pidColumn
+	row["CREATED"] = created
+	row["UPTIME"] = uptime
+	row["AUTOSTART"] = listAutostart(machine, status)
+	row["TAGS"] = strings.Join(machine.Tags, ",")
+	return row
+}
+
+// listAutostart shows whether an instance starts at login
+func listAutostart(machine qemu.MachineConfig, status string) string {
+	if status == host.StatusBroken {
+		return "-"
+	}
+	if machine.Autostart {
+		return "yes"
+	}
+	return "no"
+}
+
+// listIP is the address an instance is reachable on: its vmnet address once known, otherwise the host
+func listIP(machine qemu.MachineConfig, status string) string {
+	if status == host.StatusBroken || !machine.HasNetwork() {
+		return "-"
+	}
+	if !machine.UsesVMNet() {
+		return "localhost"
+	}
+	ip := machine.MachineIP
+	if (ip == "" || ip == "localhost") && status != "Stopped" {
+		ip = machine.DiscoverIP()
+	}
+	if ip == "" || ip == "localhost" {
+		return "-"
+	}
+	return ip
+}
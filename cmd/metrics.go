@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// metricsCmd exports instance metrics in the Prometheus text format
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Export instance metrics in the Prometheus text format.",
+	Long: `Export instance metrics in the Prometheus text format, for node_exporter's textfile collector or,
+with --listen, served over HTTP at /metrics for Prometheus to scrape.
+
+  alpine metrics --stdout
+  alpine metrics --output /usr/local/var/node_exporter/macpine.prom --interval 15s
+  alpine metrics --listen :9100`,
+	Run: metrics,
+
+	ValidArgsFunction: flagsLaunch,
+}
+
+var metricsStdout bool
+var metricsOutput, metricsListen string
+var metricsInterval time.Duration
+
+func init() {
+	metricsCmd.Flags().BoolVar(&metricsStdout, "stdout", false, "Print the metrics instead of writing a file.")
+	metricsCmd.Flags().StringVar(&metricsOutput, "output", "", "File to write the metrics to, replaced atomically. Usually ends in .prom.")
+	metricsCmd.Flags().StringVar(&metricsListen, "listen", "", "Serve the metrics over HTTP at /metrics on this address, e.g. :9100 or 127.0.0.1:9100.")
+	metricsCmd.Flags().DurationVar(&metricsInterval, "interval", 0, "Rewrite the metrics at this interval until interrupted, e.g. 15s.")
+}
+
+func metrics(cmd *cobra.Command, args []string) {
+	if metricsStdout && metricsOutput != "" {
+		log.Fatalln("--stdout and --output cannot be combined")
+	}
+	if metricsInterval < 0 {
+		log.Fatalln("--interval must be positive")
+	}
+	if metricsListen != "" {
+		if metricsStdout || metricsOutput != "" || metricsInterval != 0 {
+			log.Fatalln("--listen cannot be combined with --stdout, --output or --interval")
+		}
+		serveMetrics(metricsListen)
+		return
+	}
+
+	for {
+		var buf bytes.Buffer
+		if err := host.WriteMetrics(&buf); err != nil {
+			log.Fatalln(err)
+		}
+
+		if metricsOutput == "" {
+			os.Stdout.Write(buf.Bytes())
+		} else if err := utils.WriteFileAtomic(metricsOutput, buf.Bytes(), 0644); err != nil {
+			log.Fatalln("unable to write metrics: " + err.Error())
+		}
+
+		if metricsInterval == 0 {
+			return
+		}
+		time.Sleep(metricsInterval)
+	}
+}
+
+// serveMetrics serves the metrics at /metrics until interrupted, collecting them on every scrape
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := host.WriteMetrics(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("macpine metrics are served at /metrics\n"))
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ctx := interruptContext()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	log.Printf("serving metrics on %s/metrics\n", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+}
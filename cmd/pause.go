@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"errors"
-	"log"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -58,7 +58,7 @@ func pause(cmd *cobra.Command, args []string) {
 	wasErr := false
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("failed: %v\n", res.Err)
+			log.Errorf("failed: %v\n", res.Err)
 			wasErr = true
 		}
 	}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// portCmd groups commands managing the port forwards of instances
+var portCmd = &cobra.Command{
+	Use:   "port",
+	Short: "Manage the port forwards of instances.",
+	Long: `Manage the port forwards of instances.
+
+Forwarded ports, set with --port at launch, expose guest ports on the host. Reverse ports, set with
+--reverse-port, expose an address reachable from the host, such as a database on the Mac, on a port of
+the guest. They are forwarded over SSH by a background process that starts with the instance and
+reconnects when the connection drops, so they work in every network mode.`,
+}
+
+// portAddCmd adds a port forward to an instance
+var portAddCmd = &cobra.Command{
+	Use:   "add <instance> <guestport:host:hostport>",
+	Short: "Add a reverse port to an instance, forwarded at once if it is running.",
+	Example: `  alpine port add dev 5432:localhost:5432 --reverse
+  alpine port add dev 8080 --reverse`,
+	Run: portAdd,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+// portRemoveCmd removes a port forward from an instance
+var portRemoveCmd = &cobra.Command{
+	Use:     "remove <instance> <guestport>",
+	Short:   "Remove a reverse port from an instance.",
+	Run:     portRemove,
+	Aliases: []string{"rm"},
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+// portListCmd shows the port forwards of an instance
+var portListCmd = &cobra.Command{
+	Use:     "list <instance>",
+	Short:   "Show the forwarded and reverse ports of an instance.",
+	Run:     portList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+var portReverse bool
+
+func init() {
+	portAddCmd.Flags().BoolVar(&portReverse, "reverse", false, "Forward a guest port to the host, as --reverse-port at launch.")
+	portRemoveCmd.Flags().BoolVar(&portReverse, "reverse", false, "Remove a reverse port.")
+
+	portCmd.AddCommand(portAddCmd)
+	portCmd.AddCommand(portRemoveCmd)
+	portCmd.AddCommand(portListCmd)
+}
+
+func portAdd(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatal("expected an instance name and a port, e.g. alpine port add dev 5432:localhost:5432 --reverse")
+	}
+	requireReverse()
+	r, err := qemu.ParseReversePort(args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	machineConfig, lock := lockPortInstance(args[0])
+	defer lock.Unlock()
+	if !machineConfig.HasNetwork() {
+		log.Fatalln(machineConfig.Alias + " has no network, reverse ports are forwarded over SSH")
+	}
+	for _, existing := range machineConfig.ReversePorts {
+		if existing.GuestPort == r.GuestPort {
+			log.Fatalln("port " + strconv.Itoa(r.GuestPort) + " of " + machineConfig.Alias + " is already forwarded to " + existing.HostAddress())
+		}
+	}
+
+	machineConfig.ReversePorts = append(machineConfig.ReversePorts, r)
+	if err := qemu.SaveMachineConfig(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	if err := host.RestartForwarder(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	if status, _ := host.Status(machineConfig); status != "Running" {
+		log.Println("port " + strconv.Itoa(r.GuestPort) + " of " + machineConfig.Alias + " will be forwarded to " + r.HostAddress() + " once it starts")
+		return
+	}
+	log.Println("forwarding port " + strconv.Itoa(r.GuestPort) + " of " + machineConfig.Alias + " to " + r.HostAddress())
+}
+
+func portRemove(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatal("expected an instance name and a guest port, e.g. alpine port remove dev 5432 --reverse")
+	}
+	requireReverse()
+	guestPort, err := strconv.Atoi(args[1])
+	if err != nil {
+		// the specification the port was added with is accepted as well
+		r, err := qemu.ParseReversePort(args[1])
+		if err != nil {
+			log.Fatalln("invalid port " + args[1])
+		}
+		guestPort = r.GuestPort
+	}
+
+	machineConfig, lock := lockPortInstance(args[0])
+	defer lock.Unlock()
+	ports := []qemu.ReversePort{}
+	for _, r := range machineConfig.ReversePorts {
+		if r.GuestPort != guestPort {
+			ports = append(ports, r)
+		}
+	}
+	if len(ports) == len(machineConfig.ReversePorts) {
+		log.Fatalln(machineConfig.Alias + " has no reverse port " + strconv.Itoa(guestPort))
+	}
+
+	machineConfig.ReversePorts = ports
+	if err := qemu.SaveMachineConfig(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	if err := host.RestartForwarder(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("removed reverse port " + strconv.Itoa(guestPort) + " from " + machineConfig.Alias)
+}
+
+func portList(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if !utils.StringSliceContains(host.ListVMNames(), args[0]) {
+		log.Fatalln("unknown instance " + args[0])
+	}
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	forwards, err := utils.ParsePort(machineConfig.Port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "DIRECTION\tGUEST\tHOST\t")
+	for _, p := range forwards {
+		proto := "tcp"
+		if p.Proto == utils.Udp {
+			proto = "udp"
+		}
+		fmt.Fprintf(w, "forward\t%d/%s\t%d\t\n", p.Guest, proto, p.Host)
+	}
+	for _, r := range machineConfig.ReversePorts {
+		fmt.Fprintf(w, "reverse\t%d/tcp\t%s\t\n", r.GuestPort, r.HostAddress())
+	}
+	w.Flush()
+}
+
+// requireReverse rejects changes to the forwarded ports, which qemu only sets up at boot
+func requireReverse() {
+	if !portReverse {
+		log.Fatalln("only reverse ports can be changed at runtime, pass --reverse. change forwarded ports with `alpine edit` and restart the instance")
+	}
+}
+
+// lockPortInstance locks the instance named vmName and loads its configuration
+func lockPortInstance(vmName string) (qemu.MachineConfig, *qemu.InstanceLock) {
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return machineConfig, lock
+}
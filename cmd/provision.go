@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// provisionCmd runs provisioning scripts on an existing instance
+var provisionCmd = &cobra.Command{
+	Use:   "provision <instance> [script...]",
+	Short: "Run provisioning scripts on an instance.",
+	Long: `Upload scripts to a running instance and execute them in order as root.
+Without scripts, re-runs the scripts given with --provision at launch.`,
+	Run: provision,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var provisionOnlyIgnoreErrors bool
+
+func init() {
+	provisionCmd.Flags().BoolVar(&provisionOnlyIgnoreErrors, "ignore-errors", false, "Continue with the remaining scripts when one fails.")
+}
+
+func provision(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if status, _ := machineConfig.Status(); status != "Running" {
+		log.Fatalf("%s is not running", machineConfig.Alias)
+	}
+
+	scripts := machineConfig.Provision
+	if len(args) > 1 {
+		scripts, err = resolveProvisionScripts(args[1:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(scripts) == 0 {
+		log.Fatalln(vmName + " has no provisioning scripts. pass scripts to run after the instance name")
+	}
+
+	err = host.Provision(machineConfig, scripts, provisionOnlyIgnoreErrors)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
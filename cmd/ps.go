@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// psCmd shows an overview of all instances with their resources
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "Show all instances with their resources, uptime and ports.",
+	Run:   ps,
+
+	DisableFlagsInUseLine: true,
+}
+
+var psSort string
+
+func init() {
+	psCmd.Flags().StringVar(&psSort, "sort", "name", "Sort instances by name, status or disk.")
+}
+
+// statusOrder ranks statuses so that running instances come first when sorting by status
+var statusOrder = map[string]int{"Running": 0, "Paused": 1, "Stopped": 2, host.StatusCreated: 3, host.StatusBroken: 4}
+
+func ps(cmd *cobra.Command, args []string) {
+	if psSort != "name" && psSort != "status" && psSort != "disk" {
+		log.Fatalln("unsupported sort key " + psSort + ". use name, status or disk")
+	}
+
+	infos := []host.InstanceInfo{}
+	for _, vmName := range host.ListVMNames() {
+		info, err := host.GetInfo(vmName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		infos = append(infos, info)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		switch psSort {
+		case "status":
+			if infos[i].Status != infos[j].Status {
+				return statusOrder[infos[i].Status] < statusOrder[infos[j].Status]
+			}
+		case "disk":
+			if infos[i].DiskActualBytes != infos[j].DiskActualBytes {
+				return infos[i].DiskActualBytes > infos[j].DiskActualBytes
+			}
+		}
+		return infos[i].Name < infos[j].Name
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tCPUS\tMEMORY\tDISK\tUPTIME\tPORTS\t")
+	for _, info := range infos {
+		uptime := "-"
+		if info.UptimeSeconds > 0 {
+			uptime = (time.Duration(info.UptimeSeconds) * time.Second).String()
+		}
+		disk := "-"
+		if info.DiskVirtualBytes > 0 {
+			disk = utils.FormatBytes(info.DiskActualBytes) + "/" + utils.FormatBytes(info.DiskVirtualBytes)
+		}
+		memory := "-"
+		if info.Memory != "" {
+			memory = info.Memory + "M"
+		}
+		ports := "-"
+		if len(info.PortForwards) > 0 {
+			ports = strings.Join(info.PortForwards, ",")
+		}
+		cpus := "-"
+		if info.CPUs != "" {
+			cpus = info.CPUs
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", info.Name, info.Status, cpus, memory, disk, uptime, ports)
+	}
+	w.Flush()
+}
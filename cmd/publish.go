@@ -3,13 +3,15 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"filippo.io/age"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/oci"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -17,8 +19,16 @@ import (
 
 // publishCmd stops an Alpine instance
 var publishCmd = &cobra.Command{
-	Use:     "publish <instance> [<instance>...]",
-	Short:   "Publish instances.",
+	Use:   "publish <instance> [<instance>...]",
+	Short: "Publish instances.",
+	Long: `Publish instances as <instance>.tar.gz archives in the current directory, for alpine import.
+
+Given an instance and a registry reference, publish pushes the disk and configuration of the stopped
+instance to an OCI registry such as ghcr.io instead, with the credentials of docker login. Passwords,
+addresses, mounts and scripts of the instance are not published. Launch it elsewhere with
+alpine launch --image oci://<reference>.`,
+	Example: `  alpine publish web
+  alpine publish web ghcr.io/org/web:1.0`,
 	Run:     publish,
 	Aliases: []string{"pub", "archive"},
 
@@ -41,6 +51,12 @@ func publish(cmd *cobra.Command, args []string) {
 		log.Fatal("missing instance name")
 	}
 
+	// instance names never contain a slash, a reference always does
+	if len(args) == 2 && strings.Contains(args[1], "/") {
+		publishOCI(args[0], args[1])
+		return
+	}
+
 	args, err := host.ExpandTagArguments(args)
 	if err != nil {
 		log.Fatal("unable to publish: " + err.Error())
@@ -65,37 +81,55 @@ func publish(cmd *cobra.Command, args []string) {
 		}
 
 		vmStatus, _ := host.Status(machineConfig)
+		thaw := func() error { return nil }
 		if vmStatus == "Running" {
-			_, err = machineConfig.Exec("sync", true)
+			thaw, err = host.QuiesceFilesystems(machineConfig)
 			if err != nil {
 				errs[i] = utils.CmdResult{
-					Name: vmName, Err: errors.New("error synchonizing filesystem before publish, stop instance and retry")}
+					Name: vmName, Err: errors.New("error synchonizing filesystem before publish, stop instance and retry: " + err.Error())}
 				continue
 			}
 			err = host.Pause(machineConfig)
 			if err != nil {
+				thaw()
 				errs[i] = utils.CmdResult{
 					Name: vmName, Err: errors.New("error pausing instance before publish, stop instance and retry")}
 				continue
 			}
 			time.Sleep(time.Second)
 		}
+		// a running instance is resumed and its filesystems thawed once the archive is written, or on failure
+		resume := func() error {
+			if vmStatus != "Running" {
+				return nil
+			}
+			if err := host.Resume(machineConfig); err != nil {
+				return err
+			}
+			// the agent only answers once the instance runs again
+			return thaw()
+		}
 
 		fileInfo, err := os.ReadDir(machineConfig.Location)
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			resume()
 			continue
 		}
 
 		err = machineConfig.CompressQemuDiskImage()
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			resume()
 			continue
 		}
 
+		// the TPM state is left out on purpose: it is the identity of the instance, an imported copy
+		// starts with a new TPM
 		files := []string{}
 		for _, f := range fileInfo {
-			if !utils.StringSliceContains([]string{"alpine.qmp", "alpine.sock", "alpine.pid"}, f.Name()) {
+			if !utils.StringSliceContains([]string{"alpine.qmp", "alpine.qga", "alpine.sock", "alpine.pid", ".lock", "supervisor.pid", "clockwatch.pid",
+				qemu.TPMStateDir, "swtpm.sock", "swtpm.pid"}, f.Name()) {
 				files = append(files, filepath.Join(machineConfig.Location, f.Name()))
 			}
 		}
@@ -103,6 +137,7 @@ func publish(cmd *cobra.Command, args []string) {
 		out, err := os.Create(machineConfig.Alias + ".tar.gz")
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			resume()
 			continue
 		}
 		defer out.Close()
@@ -117,6 +152,7 @@ func publish(cmd *cobra.Command, args []string) {
 		err = utils.Compress(files, out)
 		if err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			resume()
 			continue
 		}
 
@@ -124,22 +160,21 @@ func publish(cmd *cobra.Command, args []string) {
 			err = encryptArchive(&machineConfig)
 			if err != nil {
 				errs[i] = utils.CmdResult{Name: vmName, Err: err}
+				resume()
 				continue
 			}
 		}
 
-		if vmStatus == "Running" {
-			err = host.Resume(machineConfig)
-			if err != nil {
-				errs[i] = utils.CmdResult{Name: vmName, Err: err}
-				continue
-			}
+		err = resume()
+		if err != nil {
+			errs[i] = utils.CmdResult{Name: vmName, Err: err}
+			continue
 		}
 	}
 	wasErr := false
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("unable to publish %s: %v\n", res.Name, res.Err)
+			log.Errorf("unable to publish %s: %v\n", res.Name, res.Err)
 			wasErr = true
 		}
 	}
@@ -148,6 +183,29 @@ func publish(cmd *cobra.Command, args []string) {
 	}
 }
 
+// publishOCI pushes a stopped instance to a registry
+func publishOCI(vmName string, reference string) {
+	if encrypt {
+		log.Fatalln("--encrypt only applies to archives, access to a registry is controlled by the registry")
+	}
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	digest, err := host.PublishOCI(interruptContext(), machineConfig, reference)
+	if err != nil {
+		exitIfInterrupted(err)
+		log.Fatalln("unable to publish " + vmName + ": " + err.Error())
+	}
+	reference = strings.TrimPrefix(reference, oci.Scheme)
+	log.Noticeln("published " + vmName + " to " + reference + "@" + digest)
+	log.Println("launch it with: alpine launch --image " + oci.Scheme + reference)
+}
+
 func encryptArchive(machineConfig *qemu.MachineConfig) error {
 	pass, err := utils.PassphrasePromptForEncryption()
 	if err != nil {
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// qmpCmd sends a raw QMP or monitor command to a running instance
+var qmpCmd = &cobra.Command{
+	Use:   "qmp <instance> <command>",
+	Short: "Send a QMP command to a running instance.",
+	Long: `Send a command to the QEMU Machine Protocol socket of a running instance and print the result.
+
+command is a QMP request such as '{"execute":"query-status"}', a bare command name, or - to read the
+request from standard input. With --hmp the remaining arguments are a classic monitor command line,
+sent through human-monitor-command. ` + "`alpine info`" + ` shows the socket path for direct connections.`,
+	Example: `  alpine qmp myvm '{"execute":"query-block"}'
+  alpine qmp myvm query-status
+  alpine qmp myvm --hmp info network
+  alpine qmp myvm '{"execute":"screendump","arguments":{"filename":"/tmp/screen.ppm"}}'`,
+	Run: qmp,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var qmpHMP bool
+var qmpTimeout time.Duration
+
+func init() {
+	qmpCmd.Flags().BoolVar(&qmpHMP, "hmp", false, "Treat the arguments as a human monitor command line, e.g. info block.")
+	qmpCmd.Flags().DurationVar(&qmpTimeout, "timeout", qemu.QMPTimeout, "Give up when qemu does not answer within this duration.")
+}
+
+func qmp(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatal("missing command")
+	}
+
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	if qmpTimeout <= 0 {
+		log.Fatalln("--timeout must be positive")
+	}
+	qemu.QMPTimeout = qmpTimeout
+
+	var command string
+	var arguments map[string]interface{}
+	if qmpHMP {
+		command = "human-monitor-command"
+		arguments = map[string]interface{}{"command-line": strings.Join(args[1:], " ")}
+	} else {
+		var err error
+		command, arguments, err = parseQMPRequest(strings.Join(args[1:], " "))
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	q, err := machineConfig.QMP()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer q.Close()
+
+	out, err := q.Execute(command, arguments)
+	if err != nil {
+		q.Close()
+		log.Fatalln(err)
+	}
+
+	if qmpHMP {
+		// the monitor answers with the text it would have printed
+		var text string
+		if err := json.Unmarshal(out, &text); err == nil {
+			fmt.Print(text)
+			return
+		}
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, out, "", "  "); err != nil {
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Println(pretty.String())
+}
+
+// parseQMPRequest reads a QMP request given as JSON, as a bare command name, or as - for standard input
+func parseQMPRequest(request string) (string, map[string]interface{}, error) {
+	if request == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", nil, err
+		}
+		request = string(data)
+	}
+	request = strings.TrimSpace(request)
+	if !strings.HasPrefix(request, "{") {
+		return request, nil, nil
+	}
+
+	var req struct {
+		Execute   string                 `json:"execute"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(request), &req); err != nil {
+		return "", nil, errors.New("invalid QMP request: " + err.Error())
+	}
+	if req.Execute == "" {
+		return "", nil, errors.New("invalid QMP request: missing \"execute\"")
+	}
+	return req.Execute, req.Arguments, nil
+}
@@ -1,14 +1,11 @@
 package cmd
 
 import (
-	"errors"
-	"log"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -26,7 +23,7 @@ var renameCmd = &cobra.Command{
 
 func rename(cmd *cobra.Command, args []string) {
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := host.DataDir()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,13 +43,12 @@ func rename(cmd *cobra.Command, args []string) {
 	}
 
 	newName := args[1]
-	err = ValidateName(newName)
+	err = utils.ValidateName(newName)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln("cannot rename: " + err.Error())
 	}
 
-	configDir := filepath.Join(userHomeDir, ".macpine")
-	files, err := os.ReadDir(configDir)
+	files, err := os.ReadDir(dataDir)
 	if err != nil {
 		log.Fatalf("error reading config directory: %v\n", err)
 	}
@@ -63,13 +59,19 @@ func rename(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	machineConfig, err := qemu.GetMachineConfig(vmName)
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer lock.Unlock()
+
+	// the launchd agent refers to the instance by name, drop it before the old name disappears
+	if err := host.DisableAutostart(vmName); err != nil {
+		log.Fatalln(err)
+	}
 
 	oldLocation := machineConfig.Location
-	newLocation := filepath.Join(configDir, newName)
+	newLocation := filepath.Join(dataDir, newName)
 
 	err = os.Rename(oldLocation, newLocation)
 	if err != nil {
@@ -84,19 +86,11 @@ func rename(cmd *cobra.Command, args []string) {
 		log.Fatalf("error writing updated config: %v\n", err)
 	}
 
-	log.Printf("renamed '%s' to '%s'\n", vmName, newName)
-}
-
-func ValidateName(name string) error {
-	if name == "cache" {
-		return errors.New("cannot rename: 'cache' is reserved")
-	}
-	if strings.HasPrefix(name, ".") {
-		return errors.New("cannot rename: name must not begin with '.'")
-	}
-	format := regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
-	if !format.MatchString(name) {
-		return errors.New("cannot rename: invalid name, accepted characters are [A-Za-z0-9], '.', '_', and '-'")
+	if machineConfig.Autostart {
+		if err := host.EnableAutostart(machineConfig); err != nil {
+			log.Errorf("unable to re-enable autostart for '%s': %v\n", newName, err)
+		}
 	}
-	return nil
+
+	log.Printf("renamed '%s' to '%s'\n", vmName, newName)
 }
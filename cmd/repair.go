@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair <instance>",
+	Short: "Re-validate and rewrite the configuration of a broken instance.",
+	Run:   repair,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func repair(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	changes, err := host.Repair(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, change := range changes {
+		log.Println(change)
+	}
+
+	// report what the rewrite could not fix, e.g. values out of range
+	if res := validateConfig([]string{vmName})[0]; res.Err != nil {
+		log.Fatalln(vmName + " still has an invalid configuration: " + res.Err.Error())
+	}
+	log.Println(vmName + " repaired")
+}
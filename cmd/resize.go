@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// resizeCmd grows the disk of an instance
+var resizeCmd = &cobra.Command{
+	Use:   "resize <instance> [size]",
+	Short: "Resize the disk of an instance.",
+	Long: `Resize the disk image of a stopped instance to an absolute (20G) or relative (+5G) size.
+With --grow-fs, also expand the root filesystem of a running instance to fill its disk.`,
+	Run: resize,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var growFS bool
+
+func init() {
+	resizeCmd.Flags().BoolVar(&growFS, "grow-fs", false, "Expand the guest root partition and filesystem to fill the disk.")
+}
+
+func resize(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if len(args) == 1 && !growFS {
+		log.Fatal("missing size")
+	}
+
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+	status, _ := machineConfig.Status()
+
+	if len(args) > 1 {
+		if status != "Stopped" {
+			log.Fatalln(vmName + " is running, stop it before resizing its disk")
+		}
+		err = machineConfig.ResizeDisk(args[1])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("resized disk of " + vmName + " to " + args[1])
+	}
+
+	if !growFS {
+		return
+	}
+	if status != "Running" {
+		log.Println("skipping filesystem growth, " + vmName + " is not running. start it and run `alpine resize " + vmName + " --grow-fs`")
+		return
+	}
+
+	usage, err := machineConfig.GrowFilesystem()
+	if errors.Is(err, qemu.ErrGrowToolsMissing) {
+		log.Errorln("skipping filesystem growth: " + err.Error())
+		return
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Print(usage)
+}
@@ -1,11 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"errors"
-	"log"
 	"time"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -22,6 +23,10 @@ var restartCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+func init() {
+	restartCmd.Flags().BoolVar(&host.SkipHooks, "no-hooks", false, "Do not run the lifecycle hooks of the instances.")
+}
+
 func restart(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		log.Fatal("missing instance name")
@@ -45,30 +50,43 @@ func restart(cmd *cobra.Command, args []string) {
 			continue
 		}
 
-		machineConfig, err := qemu.GetMachineConfig(vmName)
+		machineConfig, lock, err := qemu.LockMachineConfig(vmName)
 		if err != nil {
 			wasErr = true
-			log.Println(err)
+			log.Errorln(err)
 			continue
 		}
 
 		log.Println("restarting " + vmName + "...")
 		err = host.Stop(machineConfig)
 		if err != nil {
+			lock.Unlock()
 			wasErr = true
-			log.Println(err)
+			log.Errorln(err)
 			continue
 		}
 
 		time.Sleep(time.Second)
 
-		err = host.Start(machineConfig)
+		err = host.Start(context.Background(), machineConfig)
 		if err != nil {
 			host.Stop(machineConfig)
+			lock.Unlock()
 			wasErr = true
-			log.Println(err)
+			log.Errorln(err)
 			continue
 		}
+
+		if err := host.StartSupervisor(machineConfig); err != nil {
+			log.Errorln(err)
+		}
+		if err := host.StartForwarder(machineConfig); err != nil {
+			log.Errorln(err)
+		}
+		if err := host.StartClockWatcher(machineConfig); err != nil {
+			log.Errorln(err)
+		}
+		lock.Unlock()
 	}
 	if wasErr {
 		log.Fatalln("error restarting instance(s)")
@@ -1,31 +1,119 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
 var completionOptions = cobra.CompletionOptions{DisableDefaultCmd: true}
 
+var dataDir, homeDir, imageDir string
+var verbose, quiet, logJSON bool
+
 // MacpineCmd represents the base command when called without any subcommands
 var MacpineCmd = &cobra.Command{
 	Use:               "alpine",
 	Short:             "Create, control, and connect to Alpine instances.",
 	Long:              ``,
 	CompletionOptions: completionOptions,
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if verbose && quiet {
+			return errors.New("--verbose and --quiet cannot be combined")
+		}
+		if verbose {
+			log.SetLevel(log.LevelDebug)
+		}
+		if quiet {
+			log.SetLevel(log.LevelNotice)
+		}
+		log.SetJSON(logJSON)
+		if qemu.LockTimeout < 0 {
+			return errors.New("--lock-timeout cannot be negative")
+		}
+
+		// --home is the older name of --data-dir
+		if homeDir != "" {
+			if dataDir != "" && dataDir != homeDir {
+				return errors.New("--home and --data-dir cannot be combined")
+			}
+			dataDir = homeDir
+		}
+		if dataDir != "" {
+			if err := host.SetDataDir(dataDir); err != nil {
+				return err
+			}
+		}
+		if imageDir != "" {
+			return utils.SetImageDir(imageDir)
+		}
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the MacpineCmd.
 func Execute() {
+	// alpine ssh runs this executable as SSH_ASKPASS
+	if qemu.Askpass() {
+		return
+	}
+
 	err := MacpineCmd.Execute()
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+var interruptOnce sync.Once
+var interruptCtx context.Context
+
+// interruptContext returns a context that is cancelled on the first Ctrl-C or SIGTERM, giving the
+// command a chance to clean up. A second Ctrl-C exits immediately with status 130.
+func interruptContext() context.Context {
+	interruptOnce.Do(func() {
+		var cancel context.CancelFunc
+		interruptCtx, cancel = context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			log.Errorln("interrupted, cleaning up. press Ctrl-C again to exit immediately")
+			cancel()
+			<-signals
+			os.Exit(130)
+		}()
+	})
+	return interruptCtx
+}
+
+// exitIfInterrupted reports err and exits with the conventional status 130 if the command was interrupted
+func exitIfInterrupted(err error) {
+	if interruptCtx != nil && interruptCtx.Err() != nil {
+		log.Errorln(err)
+		os.Exit(130)
+	}
+}
+
 func init() {
+	MacpineCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Also log the qemu and qemu-img command lines and SSH connection attempts.")
+	MacpineCmd.PersistentFlags().BoolVar(&quiet, "quiet", false, "Only log errors and essential results, such as the name of a new instance.")
+	MacpineCmd.PersistentFlags().BoolVar(&logJSON, "log-json", false, "Log one JSON object per line, with time, level and msg keys.")
+	MacpineCmd.PersistentFlags().StringVar(&dataDir, "data-dir", "", "Directory holding instances, images and configuration. Overrides $"+host.DataDirEnv+", defaults to ~/.macpine.")
+	MacpineCmd.PersistentFlags().StringVar(&homeDir, "home", "", "Same as --data-dir.")
+	MacpineCmd.PersistentFlags().MarkHidden("home")
+	MacpineCmd.PersistentFlags().DurationVar(&qemu.LockTimeout, "lock-timeout", qemu.LockTimeout, "How long to wait for another command to release an instance before failing with \"instance is busy\".")
+	MacpineCmd.PersistentFlags().StringVar(&imageDir, "image-dir", "", "Shared, possibly read-only, directory searched for images before the cache. Overrides $"+utils.ImageDirEnv+".")
 	MacpineCmd.AddCommand(infoCmd)
 	MacpineCmd.AddCommand(launchCmd)
 	MacpineCmd.AddCommand(stopCmd)
@@ -44,4 +132,37 @@ func init() {
 	MacpineCmd.AddCommand(completionCmd)
 	MacpineCmd.AddCommand(tagCmd)
 	MacpineCmd.AddCommand(launchCloudCmd)
+	MacpineCmd.AddCommand(setCmd)
+	MacpineCmd.AddCommand(doctorCmd)
+	MacpineCmd.AddCommand(cloudInitCmd)
+	MacpineCmd.AddCommand(provisionCmd)
+	MacpineCmd.AddCommand(resizeCmd)
+	MacpineCmd.AddCommand(cpCmd)
+	MacpineCmd.AddCommand(topCmd)
+	MacpineCmd.AddCommand(metricsCmd)
+	MacpineCmd.AddCommand(autostartCmd)
+	MacpineCmd.AddCommand(diskCmd)
+	MacpineCmd.AddCommand(superviseCmd)
+	MacpineCmd.AddCommand(psCmd)
+	MacpineCmd.AddCommand(gcCmd)
+	MacpineCmd.AddCommand(repairCmd)
+	MacpineCmd.AddCommand(configCmd)
+	MacpineCmd.AddCommand(balloonCmd)
+	MacpineCmd.AddCommand(enableCmd)
+	MacpineCmd.AddCommand(disableCmd)
+	MacpineCmd.AddCommand(qmpCmd)
+	MacpineCmd.AddCommand(serveCmd)
+	MacpineCmd.AddCommand(ipCmd)
+	MacpineCmd.AddCommand(dockerContextCmd)
+	MacpineCmd.AddCommand(portCmd)
+	MacpineCmd.AddCommand(forwardCmd)
+	MacpineCmd.AddCommand(tunnelCmd)
+	MacpineCmd.AddCommand(labelCmd)
+	MacpineCmd.AddCommand(upgradeCmd)
+	MacpineCmd.AddCommand(imagesCmd)
+	MacpineCmd.AddCommand(usbCmd)
+	MacpineCmd.AddCommand(sshConfigCmd)
+	MacpineCmd.AddCommand(keyCmd)
+	MacpineCmd.AddCommand(sshCopyIDCmd)
+	MacpineCmd.AddCommand(timeCmd)
 }
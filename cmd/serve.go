@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/server"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd serves the instance API on a unix socket
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve an API to manage instances on a unix socket.",
+	Long: `Serve a REST API to list, launch, start, stop, delete and run commands on instances, on a unix socket
+that only the current user can access. The socket defaults to macpine.sock in the data directory.
+
+  curl --unix-socket ~/.macpine/macpine.sock http://macpine/v1/instances
+  curl --unix-socket ~/.macpine/macpine.sock -X POST http://macpine/v1/instances/myvm/exec -d '{"command":"uname -a"}'`,
+	Run: serve,
+
+	ValidArgsFunction: flagsLaunch,
+}
+
+var serveSocket string
+
+func init() {
+	serveCmd.Flags().StringVar(&serveSocket, "socket", "", "Path of the unix socket. Defaults to macpine.sock in the data directory.")
+}
+
+func serve(cmd *cobra.Command, args []string) {
+	path := serveSocket
+	if path == "" {
+		var err error
+		path, err = server.SocketPath()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	log.Println("serving the macpine API on " + path)
+	if err := server.Serve(interruptContext(), path); err != nil {
+		log.Fatalln(err)
+	}
+}
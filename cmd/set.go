@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// setCmd changes settings of an existing instance
+var setCmd = &cobra.Command{
+	Use:   "set <instance>",
+	Short: "Change instance settings.",
+	Run:   set,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var setStaticIP, setGateway, setNetworkConfig, setRestartPolicy, setDescription string
+var setMaxRestarts int
+var setBalloon, setAudio bool
+var setQEMUArgs []string
+
+func init() {
+	includeSetFlags(setCmd)
+}
+
+func includeSetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&setStaticIP, "ip", "", "Static IP address in CIDR notation. An empty value reverts to DHCP.")
+	cmd.Flags().StringVar(&setGateway, "gateway", "", "Default gateway for the static IP address.")
+	cmd.Flags().StringVar(&setNetworkConfig, "network-config", "", "Path to a cloud-init network-config (version 2) file. An empty value reverts to DHCP.")
+	cmd.Flags().StringVar(&setRestartPolicy, "restart-policy", "no", "Restart the instance when qemu exits: no, on-failure or always.")
+	cmd.RegisterFlagCompletionFunc("restart-policy", autoCompleteRestartPolicy)
+	cmd.Flags().IntVar(&setMaxRestarts, "max-restarts", qemu.DefaultMaxRestarts, "Consecutive restarts attempted before the supervisor gives up.")
+	cmd.Flags().StringArrayVar(&setQEMUArgs, "qemu-arg", []string{}, "Replace the raw qemu arguments of the instance. Repeat for several, pass --qemu-arg= alone to clear them.")
+	cmd.Flags().BoolVar(&setBalloon, "balloon", false, "Add (or with --balloon=false remove) the virtio memory balloon device.")
+	cmd.Flags().BoolVar(&setAudio, "audio", false, "Add (or with --audio=false remove) the sound card.")
+	cmd.Flags().StringVar(&setDescription, "description", "", "Free-text description of the instance. An empty value removes it.")
+}
+
+// autoCompleteRestartPolicy completes --restart-policy
+func autoCompleteRestartPolicy(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{string(qemu.RestartNo), string(qemu.RestartOnFailure), string(qemu.RestartAlways)}, cobra.ShellCompDirectiveNoFileComp
+}
+
+func set(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+
+	vmName := args[0]
+	vmList := host.ListVMNames()
+	if !utils.StringSliceContains(vmList, vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+
+	reseed := false
+
+	if cmd.Flags().Changed("restart-policy") {
+		machineConfig.RestartPolicy, err = qemu.ParseRestartPolicy(setRestartPolicy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if cmd.Flags().Changed("max-restarts") {
+		if setMaxRestarts < 1 {
+			log.Fatalln("--max-restarts must be at least 1")
+		}
+		machineConfig.MaxRestarts = setMaxRestarts
+	}
+
+	if cmd.Flags().Changed("qemu-arg") {
+		machineConfig.QEMUArgs = nil
+		for _, arg := range setQEMUArgs {
+			if arg != "" {
+				machineConfig.QEMUArgs = append(machineConfig.QEMUArgs, arg)
+			}
+		}
+	}
+
+	if cmd.Flags().Changed("balloon") {
+		machineConfig.Balloon = setBalloon
+	}
+
+	if cmd.Flags().Changed("audio") {
+		if setAudio {
+			if err := qemu.CheckAudio(machineConfig.Arch); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		machineConfig.Audio = setAudio
+	}
+
+	if cmd.Flags().Changed("description") {
+		machineConfig.Description = setDescription
+	}
+
+	if cmd.Flags().Changed("network-config") {
+		machineConfig.NetworkConfig = ""
+		if setNetworkConfig != "" {
+			machineConfig.NetworkConfig, err = filepath.Abs(setNetworkConfig)
+			if err != nil {
+				log.Fatalln(err)
+			}
+		}
+		machineConfig.StaticIP = ""
+		machineConfig.Gateway = ""
+		reseed = true
+	}
+
+	if cmd.Flags().Changed("ip") || cmd.Flags().Changed("gateway") {
+		if cmd.Flags().Changed("ip") {
+			machineConfig.StaticIP = setStaticIP
+		}
+		if cmd.Flags().Changed("gateway") {
+			machineConfig.Gateway = setGateway
+		}
+		if machineConfig.StaticIP == "" {
+			machineConfig.Gateway = ""
+		}
+		if !cmd.Flags().Changed("network-config") {
+			machineConfig.NetworkConfig = ""
+		}
+		reseed = true
+	}
+
+	if reseed {
+		if machineConfig.CloudInit == "" {
+			log.Fatalln(errors.New("network settings require an instance created with `alpine launch-cloud`"))
+		}
+
+		err = validateStaticIP(machineConfig.StaticIP, machineConfig.Gateway, machineConfig.NetworkConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if machineConfig.UsesVMNet() {
+			machineConfig.MachineIP = "localhost"
+			if machineConfig.StaticIP != "" {
+				machineConfig.MachineIP = strings.Split(machineConfig.StaticIP, "/")[0]
+			}
+		}
+
+		err = machineConfig.RenewInstanceID()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		err = machineConfig.WriteCloudInitSeed()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	err = qemu.SaveMachineConfig(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// the description is metadata, only the other settings apply at boot
+	restart := false
+	for _, name := range []string{"ip", "gateway", "network-config", "restart-policy", "max-restarts", "qemu-arg", "balloon", "audio"} {
+		restart = restart || cmd.Flags().Changed(name)
+	}
+	if !restart {
+		log.Println(vmName + " configuration saved")
+		return
+	}
+	log.Println(vmName + " configuration saved, restart the instance for changes to take effect")
+}
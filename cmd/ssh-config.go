@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// sshConfigCmd prints ssh_config entries for instances
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config [<instance>...]",
+	Short: "Print ssh_config entries for instances.",
+	Long: `Print ssh_config entries that reach instances, all of them unless named, so that ssh, scp, rsync and
+editors connect with ssh NAME. The host key of an instance is checked against the keys macpine recorded for it,
+which are kept in the instance directory rather than ~/.ssh/known_hosts.`,
+	Example: `  alpine ssh-config > ~/.ssh/macpine_config   # then add Include macpine_config to ~/.ssh/config
+  ssh myvm`,
+	Run: sshConfig,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+func sshConfig(cmd *cobra.Command, args []string) {
+	vmList := host.ListVMNames()
+	names := args
+	if len(names) == 0 {
+		names = vmList
+	}
+
+	blocks := []string{}
+	for _, vmName := range names {
+		if !utils.StringSliceContains(vmList, vmName) {
+			log.Fatalln("unknown instance " + vmName)
+		}
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !machineConfig.HasNetwork() {
+			if len(args) > 0 {
+				log.Errorln(vmName + " has no network, it cannot be reached over ssh")
+			}
+			continue
+		}
+
+		ip := machineConfig.MachineIP
+		if !machineConfig.UsesVMNet() {
+			// ports of user mode networking are forwarded from localhost
+			if ip == "" {
+				ip = "localhost"
+			}
+		} else {
+			// the address of a vmnet instance is only known while it runs
+			if status, _ := host.Status(machineConfig); status == "Running" {
+				ip, err = machineConfig.IPAddress()
+				if err != nil {
+					log.Fatalln(err)
+				}
+			} else if ip == "localhost" {
+				ip = ""
+			}
+		}
+		if ip == "" {
+			log.Errorln("the address of " + vmName + " is not known yet, start it first")
+			continue
+		}
+		blocks = append(blocks, machineConfig.SSHConfig(ip))
+	}
+
+	for i, b := range blocks {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(b)
+	}
+}
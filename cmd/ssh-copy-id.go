@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// sshCopyIDCmd authorizes an SSH key in an instance
+var sshCopyIDCmd = &cobra.Command{
+	Use:   "ssh-copy-id <instance>",
+	Short: "Authorize an SSH public key for the SSH user of a running instance.",
+	Long: `Authorize an SSH public key for the SSH user of a running instance, as ssh-copy-id does.
+
+macpine logs in with the stored credentials of the instance, adds the key to ~/.ssh/authorized_keys unless it
+is there already, then checks that the key logs in. The key defaults to ~/.ssh/id_ed25519.pub, id_ecdsa.pub or
+id_rsa.pub. With --use-agent, macpine itself logs in with the key through ssh-agent from then on instead of
+the stored password.`,
+	Example: `  alpine ssh-copy-id myvm
+  alpine ssh-copy-id myvm --key ~/.ssh/work.pub --use-agent`,
+	Run: sshCopyID,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var sshCopyIDKey string
+var sshCopyIDUseAgent bool
+
+func init() {
+	sshCopyIDCmd.Flags().StringVarP(&sshCopyIDKey, "key", "i", "", "Public key to authorize. Defaults to ~/.ssh/id_ed25519.pub, id_ecdsa.pub or id_rsa.pub.")
+	sshCopyIDCmd.Flags().BoolVar(&sshCopyIDUseAgent, "use-agent", false, "Log into the instance with the key through ssh-agent from now on, instead of the stored password.")
+}
+
+func sshCopyID(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	key, path, err := host.CopySSHID(machineConfig, sshCopyIDKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Noticeln(path + " logs into " + machineConfig.Alias + " as " + machineConfig.SSHUser)
+	if !sshCopyIDUseAgent {
+		return
+	}
+
+	// the configuration is read again under the lock, logging in may have taken a while
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer lock.Unlock()
+	if err := host.UseSSHAgent(&machineConfig, key); err != nil {
+		log.Fatalln(err)
+	}
+	if err := qemu.SaveMachineConfig(machineConfig); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println(machineConfig.Alias + " now authenticates through ssh-agent, sshpassword is " + machineConfig.SSHPassword)
+}
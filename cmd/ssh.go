@@ -1,11 +1,10 @@
 package cmd
 
 import (
-	"fmt"
-	"log"
-	"time"
+	"os"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -15,10 +14,28 @@ import (
 var shellCmd = &cobra.Command{
 	Use:   "ssh <instance>",
 	Short: "Attach an interactive shell to an instance via ssh.",
-	Run:   shell,
+	Long: `Attach an interactive shell to an instance via ssh.
 
-	ValidArgsFunction:     host.AutoCompleteVMNames,
-	DisableFlagsInUseLine: true,
+The shell runs the ssh command of the host, so ~/.ssh/config, the SSH agent and port forwarding work as for any
+other host. Password credentials of the instance are supplied to ssh automatically.`,
+	Example: `  alpine ssh myvm
+  alpine ssh myvm --command "apk update"
+  alpine ssh myvm -A -L 8080:localhost:80 --workdir /srv`,
+	Run: shell,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var sshCommand, sshWorkDir string
+var sshForwardAgent bool
+var sshLocalForwards, sshRemoteForwards []string
+
+func init() {
+	shellCmd.Flags().StringVarP(&sshCommand, "command", "c", "", "Run a command and exit instead of starting a shell.")
+	shellCmd.Flags().StringVarP(&sshWorkDir, "workdir", "w", "", "Directory to start the shell or command in.")
+	shellCmd.Flags().BoolVarP(&sshForwardAgent, "forward-agent", "A", false, "Forward the SSH agent to the instance.")
+	shellCmd.Flags().StringArrayVarP(&sshLocalForwards, "local-forward", "L", []string{}, "Forward a local port, as ssh -L [bind_address:]port:host:hostport. Repeatable.")
+	shellCmd.Flags().StringArrayVarP(&sshRemoteForwards, "remote-forward", "R", []string{}, "Forward a port of the instance, as ssh -R [bind_address:]port:host:hostport. Repeatable.")
 }
 
 func shell(cmd *cobra.Command, args []string) {
@@ -42,15 +59,24 @@ func shell(cmd *cobra.Command, args []string) {
 		log.Fatalf("%s is not running", machineConfig.Alias)
 	}
 
-	for {
-		err = host.Exec(machineConfig, "bash")
-
-		if err == nil {
-			break
-		}
-
-		fmt.Print(".")
-		time.Sleep(4 * time.Second)
+	ssh, err := machineConfig.SSHCommand(qemu.SSHOptions{
+		Command:        sshCommand,
+		WorkDir:        sshWorkDir,
+		ForwardAgent:   sshForwardAgent,
+		LocalForwards:  sshLocalForwards,
+		RemoteForwards: sshRemoteForwards,
+	})
+	if err != nil {
+		log.Fatalln(err)
 	}
+	log.Debugln(ssh.String())
 
+	err = ssh.Run()
+	if exitErr, ok := err.(interface{ ExitCode() int }); ok {
+		// the exit status of the remote command, or 255 for ssh errors it has already reported
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
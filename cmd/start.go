@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"errors"
-	"log"
+	"runtime"
 
+	"github.com/beringresearch/macpine/client"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -21,53 +24,106 @@ var startCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+var startAll, startResetNVRAM bool
+var startParallel int
+var startTags, startLabels []string
+
+func init() {
+	startCmd.Flags().BoolVar(&startAll, "all", false, "Start every instance.")
+	startCmd.Flags().StringArrayVar(&startTags, "tag", []string{}, "Only start instances with this tag. Repeat to require several tags.")
+	startCmd.RegisterFlagCompletionFunc("tag", host.AutoCompleteTags)
+	startCmd.Flags().StringArrayVar(&startLabels, "label-filter", []string{}, "Only start instances with this key=value label. Repeat to require several labels.")
+	startCmd.Flags().BoolVar(&host.SkipHooks, "no-hooks", false, "Do not run the lifecycle hooks of the instances.")
+	startCmd.Flags().IntVar(&startParallel, "parallel", runtime.NumCPU(), "Number of instances started at the same time.")
+	startCmd.Flags().BoolVar(&startResetNVRAM, "reset-nvram", false, "Reset the UEFI variables, such as boot entries, of UEFI instances before starting them.")
+}
+
 func start(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
+	// with --all or only filters, instances that are already running are skipped rather than failed
+	bulk := len(args) == 0
+	labels, err := qemu.ParseLabels(startLabels)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	args, err := host.ExpandTagArguments(args)
+	if startParallel < 1 {
+		log.Fatalln("--parallel must be at least 1")
+	}
+	args, err = host.SelectInstances(args, startAll, startTags, labels)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	vmList := host.ListVMNames()
 	errs := make([]utils.CmdResult, len(args))
-	for i, vmName := range args {
+	skip := make([]bool, len(args))
+	claims := &host.PortClaims{}
+	utils.ForEach(len(args), startParallel, func(i int) {
+		vmName := args[i]
 		if utils.StringSliceContains(args[:i], vmName) {
-			continue
+			skip[i] = true
+			return
 		}
 		exists := utils.StringSliceContains(vmList, vmName)
 		if !exists {
 			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
-			continue
+			return
 		}
 
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+		if machineConfig, err := qemu.GetMachineConfig(vmName); err == nil {
+			if status, _ := machineConfig.Status(); bulk && status != "Stopped" {
+				skip[i] = true
+				return
+			}
+			// instances started at the same time would all find their ports free
+			if err := claims.Claim(machineConfig); err != nil {
+				errs[i] = utils.CmdResult{Name: vmName, Err: err}
+				return
+			}
 		}
-
-		if status, _ := machineConfig.Status(); status != "Stopped" {
-			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New(vmName + " is already running")}
-			continue
+		if startResetNVRAM {
+			if err := resetNVRAM(vmName); err != nil {
+				errs[i] = utils.CmdResult{Name: vmName, Err: err}
+				return
+			}
 		}
-		err = host.Start(machineConfig)
-		if err != nil {
-			host.Stop(machineConfig)
+		if err := client.Start(context.Background(), vmName); err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+		}
+	})
+	skipped := 0
+	for _, s := range skip {
+		if s {
+			skipped++
 		}
 	}
-	wasErr := false
+	failed := 0
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("failed to start %s: %v\n", res.Name, res.Err)
-			wasErr = true
+			log.Errorf("failed to start %s: %v\n", res.Name, res.Err)
+			failed++
 		}
 	}
-	if wasErr {
+	if len(args) > 1 {
+		log.Noticef("started %d of %d instance(s)\n", len(args)-skipped-failed, len(args)-skipped)
+	}
+	if failed > 0 {
 		log.Fatalln("error starting instance(s)")
 	}
 }
+
+// resetNVRAM resets the UEFI variable store of a stopped instance
+func resetNVRAM(vmName string) error {
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if status, _ := machineConfig.Status(); status != "Stopped" {
+		return errors.New(vmName + " is " + status + ", stop it to reset its UEFI variables")
+	}
+	if err := machineConfig.ResetUEFIVars(); err != nil {
+		return err
+	}
+	log.Println("reset UEFI variables of " + vmName)
+	return nil
+}
@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"context"
 	"errors"
-	"log"
+	"runtime"
 
+	"github.com/beringresearch/macpine/client"
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
@@ -21,51 +24,80 @@ var stopCmd = &cobra.Command{
 	DisableFlagsInUseLine: true,
 }
 
+var stopAll bool
+var stopTags, stopLabels []string
+var stopGraceful bool
+var stopParallel int
+
+func init() {
+	stopCmd.Flags().BoolVar(&stopGraceful, "graceful", false, "Power the guest off over SSH and wait for it, rather than killing qemu.")
+	stopCmd.Flags().IntVar(&stopParallel, "parallel", runtime.NumCPU(), "Number of instances stopped at the same time.")
+	stopCmd.Flags().BoolVar(&stopAll, "all", false, "Stop every instance.")
+	stopCmd.Flags().StringArrayVar(&stopTags, "tag", []string{}, "Only stop instances with this tag. Repeat to require several tags.")
+	stopCmd.RegisterFlagCompletionFunc("tag", host.AutoCompleteTags)
+	stopCmd.Flags().StringArrayVar(&stopLabels, "label-filter", []string{}, "Only stop instances with this key=value label. Repeat to require several labels.")
+	stopCmd.Flags().BoolVar(&host.SkipHooks, "no-hooks", false, "Do not run the lifecycle hooks of the instances.")
+}
+
 func stop(cmd *cobra.Command, args []string) {
-	if len(args) == 0 {
-		log.Fatal("missing instance name")
+	// with --all or only filters, instances that are already stopped are skipped rather than failed
+	bulk := len(args) == 0
+	labels, err := qemu.ParseLabels(stopLabels)
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	args, err := host.ExpandTagArguments(args)
+	if stopParallel < 1 {
+		log.Fatalln("--parallel must be at least 1")
+	}
+	args, err = host.SelectInstances(args, stopAll, stopTags, labels)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	vmList := host.ListVMNames()
 	errs := make([]utils.CmdResult, len(args))
-	for i, vmName := range args {
+	skip := make([]bool, len(args))
+	utils.ForEach(len(args), stopParallel, func(i int) {
+		vmName := args[i]
 		if utils.StringSliceContains(args[:i], vmName) {
-			continue
+			skip[i] = true
+			return
 		}
 		exists := utils.StringSliceContains(vmList, vmName)
 		if !exists {
 			errs[i] = utils.CmdResult{Name: vmName, Err: errors.New("unknown instance " + vmName)}
-			continue
-		}
-
-		machineConfig, err := qemu.GetMachineConfig(vmName)
-		if err != nil {
-			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+			return
 		}
 
-		if status, _ := machineConfig.Status(); status == "Paused" {
-			host.Resume(machineConfig)
+		if bulk {
+			if machineConfig, err := qemu.GetMachineConfigForStop(vmName); err == nil {
+				if status, _ := machineConfig.Status(); status == "Stopped" {
+					skip[i] = true
+					return
+				}
+			}
 		}
-		err = host.Stop(machineConfig)
-		if err != nil {
+		if err := client.Stop(context.Background(), vmName, stopGraceful); err != nil {
 			errs[i] = utils.CmdResult{Name: vmName, Err: err}
-			continue
+		}
+	})
+	skipped := 0
+	for _, s := range skip {
+		if s {
+			skipped++
 		}
 	}
-	wasErr := false
+	failed := 0
 	for _, res := range errs {
 		if res.Err != nil {
-			log.Printf("failed: %v\n", res.Err)
-			wasErr = true
+			log.Errorf("failed to stop %s: %v\n", res.Name, res.Err)
+			failed++
 		}
 	}
-	if wasErr {
+	if len(args) > 1 {
+		log.Noticef("stopped %d of %d instance(s)\n", len(args)-skipped-failed, len(args)-skipped)
+	}
+	if failed > 0 {
 		log.Fatalln("error stopping instance(s)")
 	}
 }
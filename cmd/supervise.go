@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/spf13/cobra"
+)
+
+// superviseCmd runs the restart supervisor of an instance, forked by start
+var superviseCmd = &cobra.Command{
+	Use:    "supervise <instance>",
+	Short:  "Watch an instance and restart it according to its restart policy.",
+	Run:    supervise,
+	Hidden: true,
+
+	DisableFlagsInUseLine: true,
+}
+
+func supervise(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if err := host.Supervise(args[0]); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -1,14 +1,15 @@
 package cmd
 
 import (
-	"log"
 	"regexp"
 	"strings"
 
 	"github.com/spf13/cobra"
 
 	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 )
 
 var remove bool
@@ -26,7 +27,38 @@ var tagCmd = &cobra.Command{
 	Short: "Add or remove tags from an instance.",
 	Run:   macpineTag,
 
-	ValidArgsFunction: host.AutoCompleteVMNames,
+	ValidArgsFunction: autoCompleteTag,
+}
+
+// autoCompleteTag completes the instance, then the tags it has with --remove, or the tags of other instances
+func autoCompleteTag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return host.ListVMNames(), cobra.ShellCompDirectiveNoFileComp
+	}
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	candidates := machineConfig.Tags
+	if !remove {
+		candidates, err = host.ListTags()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+	}
+
+	tags := []string{}
+	for _, tag := range candidates {
+		if utils.StringSliceContains(args[1:], tag) {
+			continue
+		}
+		if !remove && utils.StringSliceContains(machineConfig.Tags, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, cobra.ShellCompDirectiveNoFileComp
 }
 
 func validateTags(tags []string) {
@@ -47,18 +79,20 @@ func macpineTag(cmd *cobra.Command, args []string) {
 	tags := args[1:]
 	validateTags(tags)
 
-	machineConfig, err := qemu.GetMachineConfig(vmName)
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer lock.Unlock()
 
-	for _, tag := range tags {
-		i, found := find(machineConfig.Tags, tag)
-		if remove && found {
-			machineConfig.Tags = append(machineConfig.Tags[:i], machineConfig.Tags[i+1:]...)
-		} else if !remove && !found {
-			machineConfig.Tags = append(machineConfig.Tags[:i], append([]string{tag}, machineConfig.Tags[i:]...)...)
+	if remove {
+		for _, tag := range tags {
+			if i, found := find(machineConfig.Tags, tag); found {
+				machineConfig.Tags = append(machineConfig.Tags[:i], machineConfig.Tags[i+1:]...)
+			}
 		}
+	} else {
+		machineConfig.Tags = mergeTags(machineConfig.Tags, tags)
 	}
 
 	err = qemu.SaveMachineConfig(machineConfig)
@@ -68,6 +102,26 @@ func macpineTag(cmd *cobra.Command, args []string) {
 	log.Printf("%s tags: "+strings.Join(machineConfig.Tags[:], ", "), machineConfig.Alias)
 }
 
+// mergeTags adds tags to a sorted list of tags, keeping it sorted and skipping empty tags and those
+// already in it
+func mergeTags(tags []string, add []string) []string {
+	for _, tag := range add {
+		if i, found := find(tags, tag); !found && tag != "" {
+			tags = append(tags[:i], append([]string{tag}, tags[i:]...)...)
+		}
+	}
+	return tags
+}
+
+// autoCompleteTags completes the tags of existing instances
+func autoCompleteTags(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	tags, err := host.ListTags()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return tags, cobra.ShellCompDirectiveNoFileComp
+}
+
 func find(s []string, t string) (int, bool) {
 	for i, e := range s {
 		if e == t {
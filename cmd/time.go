@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// timeCmd groups commands managing the clocks of instances
+var timeCmd = &cobra.Command{
+	Use:   "time",
+	Short: "Manage the clocks of instances.",
+	Long: `Manage the clocks of instances.
+
+A guest clock stops while the host sleeps and is behind once it wakes. macpine starts a clock watcher with
+every instance that resyncs the guest clock with the host clock after the host wakes, and every 30 minutes
+when it is more than two seconds off. It logs each resync to clockwatch.log in the instance directory.`,
+}
+
+// timeSyncCmd sets the clock of an instance to the host clock
+var timeSyncCmd = &cobra.Command{
+	Use:   "sync <instance>",
+	Short: "Set the clock of a running instance to the host clock.",
+	Long: `Set the clock of a running instance to the host clock, through qemu-guest-agent when the instance has
+one and with date over SSH otherwise.`,
+	Run: timeSync,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+// timeWatchCmd runs the clock watcher of an instance, forked by start
+var timeWatchCmd = &cobra.Command{
+	Use:    "watch <instance>",
+	Short:  "Resync the clock of an instance after the host sleeps.",
+	Run:    timeWatch,
+	Hidden: true,
+
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	timeCmd.AddCommand(timeSyncCmd)
+	timeCmd.AddCommand(timeWatchCmd)
+}
+
+func timeSync(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	skew, _, err := host.SyncClock(machineConfig, true)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Noticeln("synced the clock of " + vmName + ", it was " + host.DescribeSkew(skew))
+}
+
+func timeWatch(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if err := host.WatchClock(args[0]); err != nil {
+		log.Fatalln(err)
+	}
+}
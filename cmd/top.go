@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// topCmd shows a live view of instance resource usage
+var topCmd = &cobra.Command{
+	Use:   "top [NAME]",
+	Short: "Display live resource usage of running instances.",
+	Long: `Display live resource usage of running instances, as seen from the host.
+
+With NAME, show the load, memory and disk usage and the busiest processes inside that instance instead,
+collected over SSH. This is printed once, --watch refreshes it every --interval.`,
+	Example: `  alpine top
+  alpine top --sort mem
+  alpine top hot-cow
+  alpine top hot-cow --watch --interval 5s`,
+	Run:  top,
+	Args: cobra.MaximumNArgs(1),
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var topOnce, topWatch bool
+var topOutput, topSort string
+var topInterval time.Duration
+
+func init() {
+	topCmd.Flags().BoolVar(&topOnce, "once", false, "Print a single sample and exit.")
+	topCmd.Flags().StringVarP(&topOutput, "output", "o", "table", "Output format: table or json.")
+	topCmd.Flags().StringVar(&topSort, "sort", "cpu", "Sort instances by cpu, mem, disk or name.")
+	topCmd.Flags().DurationVar(&topInterval, "interval", time.Second, "Time between samples.")
+	topCmd.Flags().BoolVarP(&topWatch, "watch", "w", false, "With NAME, refresh the view of the instance every --interval until interrupted.")
+}
+
+// topReport is a complete sample, as printed by --output json
+type topReport struct {
+	Time      time.Time             `json:"time"`
+	Instances []host.InstanceSample `json:"instances"`
+	Total     host.InstanceSample   `json:"total"`
+}
+
+func top(cmd *cobra.Command, args []string) {
+	if topOutput != "table" && topOutput != "json" {
+		log.Fatalln("unsupported output format " + topOutput + ". use table or json")
+	}
+	if topSort != "cpu" && topSort != "mem" && topSort != "disk" && topSort != "name" {
+		log.Fatalln("unsupported sort key " + topSort + ". use cpu, mem, disk or name")
+	}
+	if topInterval <= 0 {
+		log.Fatalln("--interval must be positive")
+	}
+	if len(args) == 1 {
+		topGuest(args[0])
+		return
+	}
+	if topWatch {
+		log.Fatalln("--watch requires an instance name, without one top always refreshes")
+	}
+
+	// the first sample only has ps's CPU estimate, measure over one interval before reporting
+	samples := host.SampleInstances(nil)
+	for {
+		time.Sleep(topInterval)
+		samples = host.SampleInstances(samples)
+
+		report := newTopReport(samples)
+		if topOutput == "json" {
+			out, err := json.Marshal(report)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println(string(out))
+		} else {
+			if !topOnce {
+				fmt.Print("\033[H\033[2J")
+			}
+			printTopTable(report)
+		}
+
+		if topOnce {
+			return
+		}
+	}
+}
+
+func newTopReport(samples []host.InstanceSample) topReport {
+	sorted := append([]host.InstanceSample{}, samples...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		switch topSort {
+		case "mem":
+			return sorted[i].MemoryRSSBytes > sorted[j].MemoryRSSBytes
+		case "disk":
+			return sorted[i].DiskBytes > sorted[j].DiskBytes
+		case "name":
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].CPUPercent > sorted[j].CPUPercent
+	})
+
+	total := host.InstanceSample{Name: "TOTAL"}
+	for _, s := range sorted {
+		total.CPUPercent += s.CPUPercent
+		total.MemoryRSSBytes += s.MemoryRSSBytes
+		total.DiskBytes += s.DiskBytes
+	}
+	return topReport{Time: time.Now().UTC(), Instances: sorted, Total: total}
+}
+
+func printTopTable(report topReport) {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPID\tCPU%\tMEM\tDISK\t")
+	row := func(s host.InstanceSample, pid string) {
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%s\t\n", s.Name, pid, s.CPUPercent, utils.FormatBytes(s.MemoryRSSBytes), utils.FormatBytes(s.DiskBytes))
+	}
+	for _, s := range report.Instances {
+		row(s, strconv.Itoa(s.PID))
+	}
+	row(report.Total, "")
+	w.Flush()
+}
+
+// topGuest shows the resource usage inside a running instance
+func topGuest(vmName string) {
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for {
+		switch status, _ := machineConfig.Status(); status {
+		case "Paused":
+			log.Fatalln(vmName + " is paused, resume it with `alpine resume " + vmName + "`")
+		case "Stopped":
+			log.Fatalln(vmName + " is not running, start it with `alpine start " + vmName + "`")
+		}
+		sample, err := host.SampleGuest(machineConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if topOutput == "json" {
+			out, err := json.Marshal(sample)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println(string(out))
+		} else {
+			if topWatch {
+				fmt.Print("\033[H\033[2J")
+			}
+			printGuestTop(sample)
+		}
+
+		if !topWatch {
+			return
+		}
+		time.Sleep(topInterval)
+	}
+}
+
+func printGuestTop(s host.GuestSample) {
+	fmt.Printf("%s up %s, load average: %.2f, %.2f, %.2f\n", s.Name,
+		time.Duration(s.UptimeSeconds)*time.Second, s.Load[0], s.Load[1], s.Load[2])
+	fmt.Printf("Memory: %s used, %s available, %s total\n", utils.FormatBytes(s.MemoryTotalBytes-min(s.MemoryAvailableBytes, s.MemoryTotalBytes)),
+		utils.FormatBytes(s.MemoryAvailableBytes), utils.FormatBytes(s.MemoryTotalBytes))
+	fmt.Printf("Disk /: %s used, %s total\n", utils.FormatBytes(s.DiskUsedBytes), utils.FormatBytes(s.DiskTotalBytes))
+	if len(s.Processes) > 0 {
+		fmt.Println()
+		fmt.Println(strings.Join(s.Processes, "\n"))
+	}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// tunnelCmd opens SSH tunnels through an instance
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel <instance>",
+	Short: "Open SSH tunnels through an instance.",
+	Long: `Open SSH tunnels through a running instance, as ssh -D and ssh -L do, with its stored credentials.
+
+Every tunnel runs in a background process that reconnects when the connection to the instance drops.
+Tunnels are stopped with the instance, or with alpine tunnel stop. Host names are resolved by the
+instance, so a SOCKS tunnel routes its traffic and DNS through the network of the instance.`,
+	Example: `  alpine tunnel dev --socks 1080
+  curl --socks5-hostname localhost:1080 https://example.com
+  alpine tunnel dev -L 3306:db.internal:3306
+  alpine tunnel list
+  alpine tunnel stop dev 3306`,
+	Run: tunnel,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+// tunnelListCmd shows the running tunnels
+var tunnelListCmd = &cobra.Command{
+	Use:     "list [<instance>...]",
+	Short:   "Show the running tunnels of all instances, or of the given ones.",
+	Run:     tunnelList,
+	Aliases: []string{"ls"},
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+// tunnelStopCmd stops tunnels
+var tunnelStopCmd = &cobra.Command{
+	Use:   "stop <instance> [<port>...]",
+	Short: "Stop the tunnels of an instance, or those listening on the given host ports.",
+	Run:   tunnelStop,
+
+	ValidArgsFunction:     host.AutoCompleteVMNames,
+	DisableFlagsInUseLine: true,
+}
+
+// tunnelRunCmd runs a tunnel, forked by tunnel
+var tunnelRunCmd = &cobra.Command{
+	Use:    "run <instance> <listen> [<target>]",
+	Short:  "Run a tunnel through an instance.",
+	Run:    tunnelRun,
+	Hidden: true,
+
+	DisableFlagsInUseLine: true,
+}
+
+var tunnelSOCKS, tunnelLocal []string
+
+func init() {
+	tunnelCmd.Flags().StringArrayVar(&tunnelSOCKS, "socks", []string{}, "Open a SOCKS5 proxy on [bind_address:]port of the host, as ssh -D. Repeat for several.")
+	tunnelCmd.Flags().StringArrayVarP(&tunnelLocal, "local", "L", []string{}, "Forward [bind_address:]port of the host to host:hostport as seen from the instance, as ssh -L. Repeat for several.")
+
+	tunnelCmd.AddCommand(tunnelListCmd)
+	tunnelCmd.AddCommand(tunnelStopCmd)
+	tunnelCmd.AddCommand(tunnelRunCmd)
+}
+
+func tunnel(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	if len(tunnelSOCKS) == 0 && len(tunnelLocal) == 0 {
+		log.Fatalln("nothing to tunnel, pass --socks or -L")
+	}
+
+	var tunnels []host.Tunnel
+	for _, spec := range tunnelSOCKS {
+		t, err := host.ParseSOCKSTunnel(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tunnels = append(tunnels, t)
+	}
+	for _, spec := range tunnelLocal {
+		t, err := host.ParseLocalTunnel(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tunnels = append(tunnels, t)
+	}
+
+	machineConfig := tunnelInstance(args[0])
+	wasErr := false
+	for _, t := range tunnels {
+		if err := host.StartTunnel(machineConfig, t); err != nil {
+			log.Errorln(err)
+			wasErr = true
+			continue
+		}
+		log.Println("tunnel " + t.String() + " through " + machineConfig.Alias)
+	}
+	if wasErr {
+		log.Fatalln("error starting tunnel(s)")
+	}
+}
+
+func tunnelList(cmd *cobra.Command, args []string) {
+	vmNames := args
+	if len(vmNames) == 0 {
+		vmNames = host.ListVMNames()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tLISTEN\tTARGET\tPID\tUPTIME\t")
+	for _, vmName := range vmNames {
+		var machineConfig qemu.MachineConfig
+		if len(args) > 0 {
+			machineConfig = tunnelInstance(vmName)
+		} else if config, err := qemu.GetMachineConfig(vmName); err == nil {
+			machineConfig = config
+		} else {
+			// broken instances have no tunnels to show
+			continue
+		}
+		tunnels, err := host.ListTunnels(machineConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, t := range tunnels {
+			target := t.Target
+			if target == "" {
+				target = "-"
+			}
+			uptime := time.Since(t.StartedAt).Round(time.Second).String()
+			fmt.Fprintln(w, vmName+"\t"+t.Kind()+"\t"+t.Listen+"\t"+target+"\t"+strconv.Itoa(t.PID)+"\t"+uptime+"\t")
+		}
+	}
+	w.Flush()
+}
+
+func tunnelStop(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	machineConfig := tunnelInstance(args[0])
+	tunnels, err := host.ListTunnels(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ports := args[1:]
+	for _, port := range ports {
+		found := false
+		for _, t := range tunnels {
+			found = found || t.Port() == port
+		}
+		if !found {
+			log.Fatalln(machineConfig.Alias + " has no tunnel on port " + port)
+		}
+	}
+
+	wasErr := false
+	for _, t := range tunnels {
+		if len(ports) > 0 && !utils.StringSliceContains(ports, t.Port()) {
+			continue
+		}
+		if err := host.StopTunnel(machineConfig, t); err != nil {
+			log.Errorln(err)
+			wasErr = true
+			continue
+		}
+		log.Println("stopped tunnel " + t.String())
+	}
+	if wasErr {
+		log.Fatalln("error stopping tunnel(s)")
+	}
+}
+
+func tunnelRun(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatal("expected an instance name and a listen address")
+	}
+	t := host.Tunnel{Listen: args[1]}
+	if len(args) > 2 {
+		t.Target = args[2]
+	}
+	if err := host.RunTunnel(args[0], t); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// tunnelInstance returns the configuration of the instance named vmName
+func tunnelInstance(vmName string) qemu.MachineConfig {
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return machineConfig
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/beringresearch/macpine/client"
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// upgradeCmd upgrades the Alpine release of an instance
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade <instance> --to <branch>",
+	Short: "Upgrade the Alpine release of an instance in place.",
+	Long: `Upgrade the Alpine release of a running instance in place, rather than recreating it.
+
+The instance is stopped and its disk snapshotted first, then it is started again, its apk repositories
+are pointed at the new branch, every package is upgraded with apk upgrade --available and the instance
+is restarted on the new release. When the upgrade fails, the disk can be rolled back to the snapshot.`,
+	Example: `  alpine upgrade dev --check
+  alpine upgrade dev --to 3.21`,
+	Run: upgrade,
+
+	ValidArgsFunction: host.AutoCompleteVMNames,
+}
+
+var upgradeTo string
+var upgradeCheck, upgradeNoSnapshot, upgradeRollback bool
+
+func init() {
+	upgradeCmd.Flags().StringVar(&upgradeTo, "to", "", "Alpine branch to upgrade to, e.g. 3.21, or edge.")
+	upgradeCmd.Flags().BoolVar(&upgradeCheck, "check", false, "Only report the current and the latest available release.")
+	upgradeCmd.Flags().BoolVar(&upgradeNoSnapshot, "no-snapshot", false, "Do not snapshot the disk first, as required for raw disks. A failed upgrade cannot be rolled back.")
+	upgradeCmd.Flags().BoolVar(&upgradeRollback, "rollback", false, "Roll back to the snapshot without asking when the upgrade fails.")
+}
+
+func upgrade(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("missing instance name")
+	}
+	vmName := args[0]
+	if !utils.StringSliceContains(host.ListVMNames(), vmName) {
+		log.Fatalln("unknown instance " + vmName)
+	}
+	machineConfig, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if distro := machineConfig.GuestDistro(); distro != qemu.DistroAlpine {
+		log.Fatalln(vmName + " runs " + distro + ", only Alpine instances can be upgraded")
+	}
+	if status, _ := machineConfig.Status(); status != "Running" {
+		log.Fatalln(vmName + " is " + status + ", start it first")
+	}
+
+	ctx := context.Background()
+	current, err := host.AlpineRelease(machineConfig)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if upgradeCheck {
+		latest, err := host.LatestAlpineRelease(ctx, machineConfig.Arch)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println("current: " + current)
+		fmt.Println("latest:  " + latest)
+		if host.CompareAlpineReleases(current, latest) < 0 {
+			log.Println("upgrade with `alpine upgrade " + vmName + " --to " + host.AlpineBranch(latest) + "`")
+		} else {
+			log.Println(vmName + " runs the latest release branch")
+		}
+		return
+	}
+
+	if upgradeTo == "" {
+		log.Fatalln("missing --to, e.g. --to 3.21. --check shows the latest release")
+	}
+	branch, err := host.ParseAlpineBranch(upgradeTo)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if host.CompareAlpineReleases(current, branch) >= 0 && branch != "edge" {
+		log.Fatalln(vmName + " runs Alpine " + current + ", which is not older than " + upgradeTo + ". downgrades are not supported")
+	}
+
+	if !upgradeNoSnapshot && machineConfig.GetDiskFormat() != qemu.DiskFormatQcow2 {
+		log.Fatalln(vmName + " has a " + machineConfig.GetDiskFormat() + " disk, which cannot be snapshotted. pass --no-snapshot to upgrade without one")
+	}
+
+	snapshot := ""
+	if !upgradeNoSnapshot {
+		snapshot = "pre-upgrade-" + current + "-" + time.Now().Format("20060102150405")
+		log.Println("stopping " + vmName + " to snapshot its disk as " + snapshot)
+		if err := snapshotInstance(ctx, vmName, snapshot); err != nil {
+			log.Fatalln(err)
+		}
+		machineConfig, err = qemu.GetMachineConfig(vmName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	var out io.Writer = io.Discard
+	if log.Enabled(log.LevelInfo) {
+		out = os.Stderr
+	}
+	log.Println("upgrading " + vmName + " from " + current + " to " + branch)
+	image := machineConfig.Image
+	release, err := upgradeInstance(ctx, machineConfig, current, branch, out)
+	if err != nil {
+		rollbackUpgrade(ctx, vmName, snapshot, current, image, err)
+	}
+
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	machineConfig.AlpineRelease = release
+	err = qemu.SaveMachineConfig(machineConfig)
+	lock.Unlock()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	log.Noticeln(vmName + " upgraded from Alpine " + current + " to " + release)
+	if snapshot != "" {
+		log.Println("the snapshot " + snapshot + " is kept. once the instance is stopped, `qemu-img snapshot -d " + snapshot + " " +
+			machineConfig.DiskPath() + "` removes it")
+	}
+}
+
+// snapshotInstance stops a running instance, snapshots its disk and starts it again
+func snapshotInstance(ctx context.Context, vmName string, snapshot string) error {
+	if err := client.Stop(ctx, vmName, true); err != nil {
+		return err
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+	err = machineConfig.CreateSnapshot(snapshot)
+	lock.Unlock()
+	if startErr := client.Start(ctx, vmName); startErr != nil && err == nil {
+		err = startErr
+	}
+	return err
+}
+
+// upgradeInstance upgrades the packages of a running instance from release current to branch,
+// restarts it and returns the release it then runs. While the instance is stopped, its disk is
+// renamed after the new release.
+func upgradeInstance(ctx context.Context, machineConfig qemu.MachineConfig, current string, branch string, out io.Writer) (string, error) {
+	if err := host.UpgradeAlpine(ctx, machineConfig, branch, out); err != nil {
+		return "", err
+	}
+	// apk upgrade has installed the /etc/alpine-release of the new release
+	upgraded, err := host.AlpineRelease(machineConfig)
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("restarting " + machineConfig.Alias + " on the new release")
+	if err := client.Stop(ctx, machineConfig.Alias, true); err != nil {
+		return "", err
+	}
+	if image := host.UpgradedImage(machineConfig.Image, current, upgraded); image != machineConfig.Image {
+		if err := renameDisk(machineConfig.Alias, image); err != nil {
+			log.Errorln("unable to rename the disk of " + machineConfig.Alias + ", keeping its image name: " + err.Error())
+		}
+	}
+	if err := client.Start(ctx, machineConfig.Alias); err != nil {
+		return "", err
+	}
+	// the restart may have changed the address and ports of the instance
+	machineConfig, err = qemu.GetMachineConfig(machineConfig.Alias)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := host.AlpineRelease(machineConfig)
+	if err != nil {
+		return "", err
+	}
+	if branch != "edge" && host.CompareAlpineReleases(release, branch) != 0 {
+		return release, fmt.Errorf("%s runs Alpine %s after the upgrade, expected %s", machineConfig.Alias, release, branch)
+	}
+	return release, nil
+}
+
+// renameDisk renames the disk of a stopped instance after image and records the new name. qemu finds
+// its own process by the disk path, so the disk of a running instance must keep its name.
+func renameDisk(vmName string, image string) error {
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if status, _ := machineConfig.Status(); status != "Stopped" {
+		return errors.New(vmName + " is " + status)
+	}
+
+	disk := machineConfig.DiskPath()
+	machineConfig.Image = image
+	if err := os.Rename(disk, machineConfig.DiskPath()); err != nil {
+		return err
+	}
+	if err := qemu.SaveMachineConfig(machineConfig); err != nil {
+		os.Rename(machineConfig.DiskPath(), disk)
+		return err
+	}
+	return nil
+}
+
+// rollbackUpgrade reports a failed upgrade and offers to restore the snapshot taken before it, and the
+// name of the disk, image, from before it
+func rollbackUpgrade(ctx context.Context, vmName string, snapshot string, release string, image string, upgradeErr error) {
+	log.Errorln(upgradeErr)
+	if snapshot == "" {
+		log.Fatalln("upgrade of " + vmName + " failed, no snapshot was taken to roll back to")
+	}
+	if !upgradeRollback && !utils.Confirm("roll "+vmName+" back to Alpine "+release+"?", true) {
+		machineConfig, _ := qemu.GetMachineConfig(vmName)
+		log.Fatalln("upgrade of " + vmName + " failed. to roll back, stop it and run `qemu-img snapshot -a " + snapshot + " " +
+			machineConfig.DiskPath() + "`")
+	}
+
+	if err := client.Stop(ctx, vmName, false); err != nil {
+		log.Fatalln(err)
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(vmName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = machineConfig.RevertSnapshot(snapshot)
+	lock.Unlock()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if machineConfig.Image != image {
+		if err := renameDisk(vmName, image); err != nil {
+			log.Errorln("unable to rename the disk of " + vmName + " back to " + image + ": " + err.Error())
+		}
+	}
+	if err := client.Start(ctx, vmName); err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln("upgrade of " + vmName + " failed, rolled back to Alpine " + release)
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"github.com/spf13/cobra"
+)
+
+// usbCmd groups commands passing host USB devices through to instances
+var usbCmd = &cobra.Command{
+	Use:   "usb",
+	Short: "Pass host USB devices through to instances.",
+}
+
+// usbAttachCmd passes a host USB device through to an instance
+var usbAttachCmd = &cobra.Command{
+	Use:   "attach <instance> <vendorid:productid>",
+	Short: "Pass a host USB device through to an instance.",
+	Long: `Pass a host USB device through to an instance, e.g. alpine usb attach myvm 1a86:7523.
+
+The device is recorded in the instance configuration and attached again whenever the instance starts. A running
+instance gets it right away if it was started with USB devices, otherwise once it restarts.`,
+	Run: usbAttach,
+
+	ValidArgsFunction:     autoCompleteUSBAttach,
+	DisableFlagsInUseLine: true,
+}
+
+// usbDetachCmd stops passing a USB device through
+var usbDetachCmd = &cobra.Command{
+	Use:   "detach <instance> <vendorid:productid>",
+	Short: "Stop passing a USB device through to an instance.",
+	Run:   usbDetach,
+
+	ValidArgsFunction:     autoCompleteUSBDetach,
+	DisableFlagsInUseLine: true,
+}
+
+// usbListCmd lists the USB devices of the host
+var usbListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the USB devices connected to the host and the instances they are attached to.",
+	Run:     usbList,
+	Aliases: []string{"ls"},
+
+	DisableFlagsInUseLine: true,
+}
+
+func init() {
+	usbCmd.AddCommand(usbAttachCmd)
+	usbCmd.AddCommand(usbDetachCmd)
+	usbCmd.AddCommand(usbListCmd)
+}
+
+// usbArgs checks the arguments of attach and detach and locks the instance
+func usbArgs(args []string) (qemu.MachineConfig, *qemu.InstanceLock, qemu.USBDevice) {
+	if len(args) < 1 {
+		log.Fatalln("missing instance name")
+	}
+	if len(args) < 2 {
+		log.Fatalln("missing USB device, see `alpine usb list`")
+	}
+	d, err := qemu.ParseUSBDevice(args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if !utils.StringSliceContains(host.ListVMNames(), args[0]) {
+		log.Fatalln("unknown instance " + args[0])
+	}
+	machineConfig, lock, err := qemu.LockMachineConfig(args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return machineConfig, lock, d
+}
+
+func usbAttach(cmd *cobra.Command, args []string) {
+	machineConfig, lock, d := usbArgs(args)
+	defer lock.Unlock()
+
+	// the device is kept in the configuration even if it cannot be hot-plugged
+	err := machineConfig.AttachUSBDevice(d)
+	if saveErr := qemu.SaveMachineConfig(machineConfig); saveErr != nil {
+		log.Fatalln(saveErr)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("attached %s to %s\n", d, machineConfig.Alias)
+}
+
+func usbDetach(cmd *cobra.Command, args []string) {
+	machineConfig, lock, d := usbArgs(args)
+	defer lock.Unlock()
+
+	err := machineConfig.DetachUSBDevice(d)
+	if saveErr := qemu.SaveMachineConfig(machineConfig); saveErr != nil {
+		log.Fatalln(saveErr)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("detached %s from %s\n", d, machineConfig.Alias)
+}
+
+func usbList(cmd *cobra.Command, args []string) {
+	devices, err := qemu.HostUSBDevices()
+	if err != nil {
+		log.Fatalln("unable to list host USB devices: " + err.Error())
+	}
+
+	attached := make(map[qemu.USBDevice][]string)
+	for _, vmName := range host.ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		for _, d := range machineConfig.USBDevices {
+			attached[d] = append(attached[d], vmName)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tVENDOR\tPRODUCT\tINSTANCES\t")
+	for _, d := range devices {
+		instances := "-"
+		if names, ok := attached[d.USBDevice]; ok {
+			instances = strings.Join(names, ",")
+		}
+		fmt.Fprintln(w, d.String()+"\t"+d.Vendor+"\t"+d.Name+"\t"+instances+"\t")
+	}
+	w.Flush()
+}
+
+// autoCompleteUSBAttach completes the instance name, then the host USB devices
+func autoCompleteUSBAttach(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return host.AutoCompleteVMNames(cmd, args, toComplete)
+	}
+	devices, err := qemu.HostUSBDevices()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ids := []string{}
+	for _, d := range devices {
+		ids = append(ids, d.String()+"\t"+d.Name)
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// autoCompleteUSBDetach completes the instance name, then its USB devices
+func autoCompleteUSBDetach(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return host.AutoCompleteVMNames(cmd, args, toComplete)
+	}
+	machineConfig, err := qemu.GetMachineConfig(args[0])
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	ids := []string{}
+	for _, d := range machineConfig.USBDevices {
+		ids = append(ids, d.String())
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
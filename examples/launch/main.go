@@ -0,0 +1,61 @@
+// Command launch shows the client package: it launches an Alpine instance, runs a command on it over
+// SSH and deletes it again.
+//
+//	go run ./examples/launch
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+
+	"github.com/beringresearch/macpine/client"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+func main() {
+	// Ctrl-C cancels the launch, which removes the half-created instance
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	arch := "aarch64"
+	if runtime.GOARCH == "amd64" {
+		arch = "x86_64"
+	}
+
+	config := qemu.MachineConfig{
+		Alias:   "example",
+		Image:   "alpine_3.20.3-" + arch + ".qcow2",
+		Arch:    arch,
+		Memory:  "1024",
+		SSHPort: "2222",
+	}
+	log.Println("launching " + config.Alias)
+	if err := client.Launch(ctx, config); err != nil {
+		log.Fatalln(err)
+	}
+	defer func() {
+		if err := client.Delete(context.Background(), config.Alias); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	execCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := client.Exec(execCtx, config.Alias, "uname -a && cat /etc/alpine-release", nil, os.Stdout, os.Stderr); err != nil {
+		log.Println(err)
+		return
+	}
+
+	instances, err := client.List()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, instance := range instances {
+		log.Printf("%s: %s\n", instance.Name, instance.Status)
+	}
+}
@@ -0,0 +1,290 @@
+package host
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// ErrNoGuestAgent is returned when an instance has no qemu-guest-agent answering, callers fall back
+// to SSH or to what macpine knows without asking the guest
+var ErrNoGuestAgent = errors.New("qemu-guest-agent is not running, launch with --guest-agent or install it in the instance")
+
+// AgentTimeout bounds each exchange with the guest agent
+var AgentTimeout = 10 * time.Second
+
+// agentSyncTimeout is how long a connection waits for the agent to answer at all. The channel accepts
+// connections whether or not an agent runs in the guest, so this decides that there is none.
+const agentSyncTimeout = 3 * time.Second
+
+// GuestAgent is a connection to the qemu-guest-agent of a running instance
+type GuestAgent struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+type agentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// GuestInterface is a network interface of the guest, as reported by guest-network-get-interfaces
+type GuestInterface struct {
+	Name            string           `json:"name"`
+	HardwareAddress string           `json:"hardware-address"`
+	IPAddresses     []GuestIPAddress `json:"ip-addresses"`
+}
+
+// GuestIPAddress is an address of a guest interface
+type GuestIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+// ConnectAgent connects to the guest agent of the instance, returning ErrNoGuestAgent when it does
+// not answer
+func ConnectAgent(config qemu.MachineConfig) (*GuestAgent, error) {
+	if status, _ := config.Status(); status != "Running" {
+		return nil, errors.New(config.Alias + " is not running")
+	}
+
+	conn, err := net.DialTimeout("unix", config.AgentPath(), agentSyncTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, errors.New("permission denied on " + config.AgentPath() + ", qemu runs as root: restart " + config.Alias + " or run this command with sudo")
+		}
+		// instances started by an older macpine have no agent channel
+		log.Debugln("unable to connect to the guest agent of " + config.Alias + ": " + err.Error())
+		return nil, ErrNoGuestAgent
+	}
+
+	a := &GuestAgent{conn: conn, dec: json.NewDecoder(conn)}
+	if err := a.sync(); err != nil {
+		log.Debugln("guest agent of " + config.Alias + " did not answer: " + err.Error())
+		conn.Close()
+		return nil, ErrNoGuestAgent
+	}
+	return a, nil
+}
+
+// sync discards answers to requests of an earlier client that gave up, so that the next response
+// read belongs to the next request
+func (a *GuestAgent) sync() error {
+	id := int64(rand.Int31())
+	a.conn.SetDeadline(time.Now().Add(agentSyncTimeout))
+	// 0xFF resets the parser of the agent, in case an earlier client left a partial request
+	if _, err := a.conn.Write([]byte{0xFF}); err != nil {
+		return err
+	}
+	req := map[string]interface{}{"execute": "guest-sync", "arguments": map[string]interface{}{"id": id}}
+	if err := json.NewEncoder(a.conn).Encode(req); err != nil {
+		return err
+	}
+	for {
+		var resp agentResponse
+		if err := a.dec.Decode(&resp); err != nil {
+			return err
+		}
+		var got int64
+		if json.Unmarshal(resp.Return, &got) == nil && got == id {
+			return nil
+		}
+	}
+}
+
+// Execute runs a guest agent command and returns its result
+func (a *GuestAgent) Execute(command string, arguments map[string]interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+
+	a.conn.SetDeadline(time.Now().Add(AgentTimeout))
+	if err := json.NewEncoder(a.conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp agentResponse
+	if err := a.dec.Decode(&resp); err != nil {
+		return nil, errors.New("guest agent " + command + ": " + err.Error())
+	}
+	if resp.Error != nil {
+		return nil, errors.New("guest agent " + command + ": " + resp.Error.Desc)
+	}
+	return resp.Return, nil
+}
+
+// Close closes the connection
+func (a *GuestAgent) Close() error {
+	return a.conn.Close()
+}
+
+// Interfaces returns the network interfaces of the guest and their addresses
+func (a *GuestAgent) Interfaces() ([]GuestInterface, error) {
+	out, err := a.Execute("guest-network-get-interfaces", nil)
+	if err != nil {
+		return nil, err
+	}
+	var interfaces []GuestInterface
+	if err := json.Unmarshal(out, &interfaces); err != nil {
+		return nil, err
+	}
+	return interfaces, nil
+}
+
+// Exec runs command with /bin/sh in the guest and returns its output and exit status. The agent
+// collects the output until the command exits, so nothing is streamed. Cancelling ctx stops waiting
+// but leaves the command running in the guest.
+func (a *GuestAgent) Exec(ctx context.Context, command string, stdin []byte) ([]byte, []byte, int, error) {
+	arguments := map[string]interface{}{
+		"path":           "/bin/sh",
+		"arg":            []string{"-c", command},
+		"capture-output": true,
+	}
+	if len(stdin) > 0 {
+		arguments["input-data"] = base64.StdEncoding.EncodeToString(stdin)
+	}
+	out, err := a.Execute("guest-exec", arguments)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := json.Unmarshal(out, &started); err != nil {
+		return nil, nil, 0, err
+	}
+
+	for {
+		out, err := a.Execute("guest-exec-status", map[string]interface{}{"pid": started.PID})
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		var status struct {
+			Exited       bool   `json:"exited"`
+			ExitCode     int    `json:"exitcode"`
+			Signal       int    `json:"signal"`
+			OutData      string `json:"out-data"`
+			ErrData      string `json:"err-data"`
+			OutTruncated bool   `json:"out-truncated"`
+			ErrTruncated bool   `json:"err-truncated"`
+		}
+		if err := json.Unmarshal(out, &status); err != nil {
+			return nil, nil, 0, err
+		}
+
+		if status.Exited {
+			stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			if status.OutTruncated || status.ErrTruncated {
+				log.Errorln("output of " + command + " was truncated by the guest agent, use exec without --agent for large output")
+			}
+			exitCode := status.ExitCode
+			if status.Signal != 0 {
+				// as a shell reports a command killed by a signal
+				exitCode = 128 + status.Signal
+			}
+			return stdout, stderr, exitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, 0, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Time returns the time of the guest clock
+func (a *GuestAgent) Time() (time.Time, error) {
+	out, err := a.Execute("guest-get-time", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nanoseconds int64
+	if err := json.Unmarshal(out, &nanoseconds); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanoseconds), nil
+}
+
+// SetTime sets the guest clock to t
+func (a *GuestAgent) SetTime(t time.Time) error {
+	_, err := a.Execute("guest-set-time", map[string]interface{}{"time": t.UnixNano()})
+	return err
+}
+
+// FreezeFilesystems flushes and freezes the filesystems of the guest so that a copy of its disk is
+// consistent, and returns how many were frozen. Writes in the guest block until ThawFilesystems.
+func (a *GuestAgent) FreezeFilesystems() (int, error) {
+	return a.fsfreeze("guest-fsfreeze-freeze")
+}
+
+// ThawFilesystems unfreezes the filesystems frozen by FreezeFilesystems and returns how many were thawed
+func (a *GuestAgent) ThawFilesystems() (int, error) {
+	return a.fsfreeze("guest-fsfreeze-thaw")
+}
+
+func (a *GuestAgent) fsfreeze(command string) (int, error) {
+	out, err := a.Execute(command, nil)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if err := json.Unmarshal(out, &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QuiesceFilesystems makes the disk of a running instance consistent before it is copied: the guest
+// filesystems are frozen through the guest agent, or synced over SSH when there is no agent. The
+// returned function thaws them and must be called once the copy is done and the instance is resumed.
+func QuiesceFilesystems(config qemu.MachineConfig) (func() error, error) {
+	agent, err := ConnectAgent(config)
+	if errors.Is(err, ErrNoGuestAgent) {
+		log.Debugln(config.Alias + " has no guest agent, syncing filesystems over ssh")
+		if _, err := config.Exec("sync", true); err != nil {
+			return nil, errors.New("unable to sync filesystems of " + config.Alias + ": " + err.Error())
+		}
+		return func() error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := agent.FreezeFilesystems()
+	if err != nil {
+		// a partial freeze is undone by a thaw
+		agent.ThawFilesystems()
+		agent.Close()
+		return nil, errors.New("unable to freeze filesystems of " + config.Alias + ": " + err.Error())
+	}
+	log.Println("froze " + strconv.Itoa(count) + " filesystems of " + config.Alias)
+
+	return func() error {
+		defer agent.Close()
+		if _, err := agent.ThawFilesystems(); err != nil {
+			return errors.New("unable to thaw filesystems of " + config.Alias + ": " + err.Error())
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,145 @@
+package host
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+const autostartLabelPrefix = "com.beringresearch.macpine."
+
+// AutostartLabel returns the launchd label of the agent that starts an instance at login
+func AutostartLabel(vmName string) string {
+	return autostartLabelPrefix + vmName
+}
+
+// AutostartPlistPath returns the location of the launchd agent of an instance
+func AutostartPlistPath(vmName string) (string, error) {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHomeDir, "Library", "LaunchAgents", AutostartLabel(vmName)+".plist"), nil
+}
+
+// EnableAutostart installs and loads a launchd agent running `alpine start` for the instance at login
+func EnableAutostart(config qemu.MachineConfig) error {
+	plistPath, err := AutostartPlistPath(config.Alias)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.New("unable to locate the alpine executable: " + err.Error())
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return errors.New("unable to locate the alpine executable: " + err.Error())
+	}
+
+	plist := autostartPlist(AutostartLabel(config.Alias), []string{executable, "start", config.Alias},
+		filepath.Join(config.Location, "autostart.log"))
+
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return err
+	}
+	// reloading picks up a changed executable path or instance location
+	if _, err := os.Stat(plistPath); err == nil {
+		launchctl("unload", plistPath)
+	}
+	if err := utils.WriteFileAtomic(plistPath, plist, 0644); err != nil {
+		return errors.New("unable to write " + plistPath + ": " + err.Error())
+	}
+	return launchctl("load", "-w", plistPath)
+}
+
+// DisableAutostart unloads and removes the launchd agent of an instance, if there is one
+func DisableAutostart(vmName string) error {
+	plistPath, err := AutostartPlistPath(vmName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	// the agent may not be loaded, e.g. after a failed enable, removing the plist is what matters
+	launchctl("unload", "-w", plistPath)
+	if err := os.Remove(plistPath); err != nil {
+		return errors.New("unable to remove " + plistPath + ": " + err.Error())
+	}
+	return nil
+}
+
+// AutostartInstalled reports whether the launchd agent of an instance is present
+func AutostartInstalled(vmName string) bool {
+	plistPath, err := AutostartPlistPath(vmName)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(plistPath)
+	return err == nil
+}
+
+func launchctl(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("launchctl", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("launchctl " + args[0] + " failed: " + strings.TrimSpace(stderr.String()) + " " + err.Error())
+	}
+	return nil
+}
+
+func autostartPlist(label string, program []string, logPath string) []byte {
+	var b bytes.Buffer
+	str := func(s string) {
+		b.WriteString("\t<string>")
+		xml.EscapeText(&b, []byte(s))
+		b.WriteString("</string>\n")
+	}
+	key := func(k string) {
+		b.WriteString("\t<key>" + k + "</key>\n")
+	}
+
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	key("Label")
+	str(label)
+	key("ProgramArguments")
+	b.WriteString("\t<array>\n")
+	for _, arg := range program {
+		b.WriteString("\t")
+		str(arg)
+	}
+	b.WriteString("\t</array>\n")
+	// launchd starts agents with a minimal PATH, qemu and friends usually live in the Homebrew prefix
+	key("EnvironmentVariables")
+	b.WriteString("\t<dict>\n\t\t<key>PATH</key>\n\t")
+	str(os.Getenv("PATH"))
+	// an instance outside ~/.macpine is only found with the same data directory
+	if dataDir := os.Getenv(DataDirEnv); dataDir != "" {
+		b.WriteString("\t\t<key>" + DataDirEnv + "</key>\n\t")
+		str(dataDir)
+	}
+	b.WriteString("\t</dict>\n")
+	key("RunAtLoad")
+	b.WriteString("\t<true/>\n")
+	key("StandardOutPath")
+	str(logPath)
+	key("StandardErrorPath")
+	str(logPath)
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
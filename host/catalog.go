@@ -0,0 +1,204 @@
+package host
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// CatalogEnv selects the image catalog, a local file or an http(s) URL
+const CatalogEnv = "MACPINE_CATALOG"
+
+// DefaultCatalogURL is the catalog published with the macpine images. None is published yet, so the
+// built-in catalog is used unless $MACPINE_CATALOG or a local catalog.yaml names another.
+const DefaultCatalogURL = ""
+
+// catalogMaxAge is how long a downloaded catalog is used before it is fetched again
+const catalogMaxAge = 24 * time.Hour
+
+// catalogRetryInterval is how long a catalog that could not be fetched is not asked for again
+const catalogRetryInterval = time.Hour
+
+// builtinCatalog is used when no catalog can be fetched
+//
+//go:embed catalog.yaml
+var builtinCatalog []byte
+
+// CatalogImage is an image alpine launch can download
+type CatalogImage struct {
+	// Name is passed to launch --image, e.g. alpine_3.20.3
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	Arch    string `yaml:"arch"`
+	URL     string `yaml:"url"`
+	// SHA256 is verified after the download when it is set
+	SHA256 string `yaml:"sha256,omitempty"`
+}
+
+// Catalog lists the images alpine launch can download
+type Catalog struct {
+	Images []CatalogImage `yaml:"images"`
+	// Source is the file or URL the catalog was read from, or "built-in"
+	Source string `yaml:"-"`
+}
+
+// LoadCatalog returns the image catalog: the file or URL in $MACPINE_CATALOG, else catalog.yaml in the
+// data directory, else the published catalog. A downloaded catalog is cached for a day and the
+// catalog built into macpine is used when it cannot be fetched, which is not tried again for an hour.
+// Local files are never replaced by another catalog, so that an air-gapped mirror is not bypassed.
+func LoadCatalog(ctx context.Context) (Catalog, error) {
+	return loadCatalog(ctx, true)
+}
+
+// LoadCachedCatalog is LoadCatalog without the network: a remote catalog is read from the cache,
+// however old, or replaced by the built-in one. It is fast enough for shell completion.
+func LoadCachedCatalog() (Catalog, error) {
+	return loadCatalog(context.Background(), false)
+}
+
+func loadCatalog(ctx context.Context, fetch bool) (Catalog, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return Catalog{}, err
+	}
+
+	source := os.Getenv(CatalogEnv)
+	if source == "" {
+		local := filepath.Join(dataDir, "catalog.yaml")
+		if _, err := os.Stat(local); err == nil {
+			source = local
+		} else {
+			source = DefaultCatalogURL
+		}
+	}
+	if source == "" {
+		return parseCatalog(builtinCatalog, "built-in")
+	}
+
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return Catalog{}, errors.New("unable to read image catalog: " + err.Error())
+		}
+		return parseCatalog(data, source)
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	cachePath := filepath.Join(dataDir, "cache", "catalog_"+hex.EncodeToString(sum[:])[:12]+".yaml")
+	// a failed fetch is remembered, so that every command does not wait for an unreachable catalog
+	failedPath := cachePath + ".failed"
+	if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < catalogMaxAge {
+		fetch = false
+	}
+	if info, err := os.Stat(failedPath); err == nil && time.Since(info.ModTime()) < catalogRetryInterval {
+		fetch = false
+	}
+
+	if fetch {
+		data, err := fetchCatalog(ctx, source)
+		if err == nil {
+			var catalog Catalog
+			if catalog, err = parseCatalog(data, source); err == nil {
+				if err := os.MkdirAll(filepath.Dir(cachePath), os.ModePerm); err == nil {
+					utils.WriteFileAtomic(cachePath, data, 0644)
+				}
+				os.Remove(failedPath)
+				return catalog, nil
+			}
+		}
+		log.Debugln("using a cached or the built-in image catalog: " + err.Error())
+		if os.MkdirAll(filepath.Dir(failedPath), os.ModePerm) == nil {
+			os.WriteFile(failedPath, []byte(err.Error()+"\n"), 0644)
+		}
+	}
+
+	if data, err := os.ReadFile(cachePath); err == nil {
+		if catalog, err := parseCatalog(data, source); err == nil {
+			return catalog, nil
+		}
+	}
+	return parseCatalog(builtinCatalog, "built-in")
+}
+
+// fetchCatalog downloads the catalog at url
+func fetchCatalog(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New("unable to fetch " + url + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to fetch " + url + ": " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseCatalog reads a YAML or JSON catalog and checks its entries
+func parseCatalog(data []byte, source string) (Catalog, error) {
+	catalog := Catalog{}
+	if err := yaml.Unmarshal(data, &catalog); err != nil {
+		return catalog, errors.New("invalid image catalog " + source + ": " + err.Error())
+	}
+	for i, image := range catalog.Images {
+		var err error
+		switch {
+		case image.Name == "":
+			err = errors.New("missing name")
+		case image.Arch != "aarch64" && image.Arch != "x86_64":
+			err = errors.New("unsupported arch " + image.Arch)
+		default:
+			err = utils.CheckImageURL(image.URL)
+			if err == nil && image.SHA256 != "" {
+				err = utils.CheckSHA256(image.SHA256)
+			}
+		}
+		if err != nil {
+			return catalog, errors.New("invalid image catalog " + source + ", image " + image.Name + " (entry " +
+				strconv.Itoa(i+1) + "): " + err.Error())
+		}
+	}
+	catalog.Source = source
+	return catalog, nil
+}
+
+// Lookup returns the image named name for arch. An empty arch matches any architecture.
+func (c Catalog) Lookup(name string, arch string) (CatalogImage, bool) {
+	for _, image := range c.Images {
+		if image.Name == name && (arch == "" || image.Arch == arch) {
+			return image, true
+		}
+	}
+	return CatalogImage{}, false
+}
+
+// Names returns the sorted names of the images, once each
+func (c Catalog) Names() []string {
+	var names []string
+	for _, image := range c.Images {
+		if !utils.StringSliceContains(names, image.Name) {
+			names = append(names, image.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
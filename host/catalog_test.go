@@ -0,0 +1,74 @@
+package host
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLoadCatalogRemembersFailedFetch(t *testing.T) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+	t.Setenv(CatalogEnv, server.URL+"/catalog.yaml")
+
+	// completion never asks the network
+	c, err := LoadCachedCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source != "built-in" || requests.Load() != 0 {
+		t.Errorf("LoadCachedCatalog() read %s after %d requests, want the built-in catalog and none", c.Source, requests.Load())
+	}
+
+	for i := 0; i < 3; i++ {
+		c, err := LoadCatalog(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Source != "built-in" {
+			t.Errorf("LoadCatalog() read %s, want the built-in catalog", c.Source)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("LoadCatalog() fetched the catalog %d times, want once", requests.Load())
+	}
+}
+
+func TestLoadCatalogCachesFetch(t *testing.T) {
+	t.Setenv(DataDirEnv, t.TempDir())
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("images:\n  - name: mirror_1.0\n    arch: aarch64\n    url: https://mirror.example/mirror_1.0-aarch64.qcow2\n"))
+	}))
+	defer server.Close()
+	source := server.URL + "/catalog.yaml"
+	t.Setenv(CatalogEnv, source)
+
+	for i := 0; i < 2; i++ {
+		c, err := LoadCatalog(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.Lookup("mirror_1.0", "aarch64"); !ok || c.Source != source {
+			t.Errorf("LoadCatalog() = %+v, want mirror_1.0 from %s", c, source)
+		}
+	}
+	c, err := LoadCachedCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup("mirror_1.0", "aarch64"); !ok {
+		t.Errorf("LoadCachedCatalog() = %+v, want the cached mirror_1.0", c)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("the catalog was fetched %d times, want once", requests.Load())
+	}
+}
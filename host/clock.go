@@ -0,0 +1,206 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+const (
+	clockWatchInterval = 5 * time.Second
+	// guest clocks drift without the host sleeping as well, e.g. while an instance is paused
+	clockCheckInterval = 30 * time.Minute
+	// the wall clock running ahead of the monotonic clock by this much means the host slept or its
+	// clock was stepped
+	clockJumpThreshold = 2 * time.Second
+	clockSyncTimeout   = 15 * time.Second
+)
+
+func clockWatcherPIDFile(config qemu.MachineConfig) string {
+	return filepath.Join(config.Location, "clockwatch.pid")
+}
+
+// ClockWatcherPID returns the PID of the clock watcher of an instance, or 0 if none is running
+func ClockWatcherPID(config qemu.MachineConfig) int {
+	return backgroundPID(clockWatcherPIDFile(config))
+}
+
+// StartClockWatcher forks a background `alpine time watch` process that resyncs the guest clock
+// after the host sleeps
+func StartClockWatcher(config qemu.MachineConfig) error {
+	if (!config.HasNetwork() && !config.GuestAgent) || ClockWatcherPID(config) > 0 {
+		return nil
+	}
+	cmd, err := startBackground("clock watcher", filepath.Join(config.Location, "clockwatch.log"), "time", "watch", config.Alias)
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// StopClockWatcher terminates the clock watcher of an instance
+func StopClockWatcher(config qemu.MachineConfig) error {
+	return stopBackground(config, clockWatcherPIDFile(config), "clock watcher")
+}
+
+// GuestClockSkew returns how far the clock of a running instance is ahead of the host, asking
+// qemu-guest-agent or, without one, the guest over SSH
+func GuestClockSkew(ctx context.Context, config qemu.MachineConfig) (time.Duration, error) {
+	agent, err := ConnectAgent(config)
+	if err == nil {
+		defer agent.Close()
+		before := time.Now()
+		guest, err := agent.Time()
+		if err != nil {
+			return 0, err
+		}
+		after := time.Now()
+		switch {
+		case guest.After(after):
+			return guest.Sub(after).Truncate(time.Millisecond), nil
+		case guest.Before(before):
+			return guest.Sub(before).Truncate(time.Millisecond), nil
+		}
+		return 0, nil
+	}
+	if !errors.Is(err, ErrNoGuestAgent) {
+		return 0, err
+	}
+	if !config.HasNetwork() {
+		return 0, errors.New(config.Alias + " has neither a guest agent nor a network, its clock cannot be read")
+	}
+	return config.ClockSkew(ctx)
+}
+
+// SyncClock sets the clock of a running instance to the host clock, through qemu-guest-agent's
+// guest-set-time or, without an agent, with date over SSH. Unless force is set, a clock within
+// maxClockSkew of the host is left alone. It returns the skew found before the sync and whether the
+// clock was set.
+func SyncClock(config qemu.MachineConfig, force bool) (time.Duration, bool, error) {
+	if status, _ := Status(config); status != "Running" {
+		return 0, false, errors.New(config.Alias + " is not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clockSyncTimeout)
+	defer cancel()
+
+	skew, err := GuestClockSkew(ctx, config)
+	if err != nil {
+		return 0, false, errors.New("unable to read the clock of " + config.Alias + ": " + err.Error())
+	}
+	if !force && skew <= maxClockSkew && skew >= -maxClockSkew {
+		return skew, false, nil
+	}
+
+	agent, err := ConnectAgent(config)
+	if err == nil {
+		err = agent.SetTime(time.Now())
+		agent.Close()
+		if err == nil {
+			return skew, true, nil
+		}
+		if !config.HasNetwork() {
+			return skew, false, errors.New("unable to set the clock of " + config.Alias + ": " + err.Error())
+		}
+		log.Debugln("guest agent of " + config.Alias + " did not set the clock, setting it over ssh: " + err.Error())
+	} else if !errors.Is(err, ErrNoGuestAgent) {
+		return skew, false, err
+	}
+
+	if err := config.SetClock(ctx, time.Now()); err != nil {
+		return skew, false, err
+	}
+	return skew, true, nil
+}
+
+// DescribeSkew words a clock skew for log messages
+func DescribeSkew(skew time.Duration) string {
+	switch {
+	case skew > 0:
+		return skew.String() + " ahead of the host"
+	case skew < 0:
+		return (-skew).String() + " behind the host"
+	}
+	return "in sync with the host"
+}
+
+// WatchClock resyncs the clock of an instance whenever the host wakes from sleep, which shows as
+// the wall clock jumping ahead of the monotonic clock, and every clockCheckInterval. It returns
+// when the instance is stopped or the watcher is terminated by StopClockWatcher.
+func WatchClock(vmName string) error {
+	config, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(clockWatcherPIDFile(config), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(clockWatcherPIDFile(config))
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(terminate)
+
+	log.Println("watching the clock of " + vmName)
+	ticker := time.NewTicker(clockWatchInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	// the clock is checked once the instance is up, it may have been paused or restored
+	due := true
+	checked := time.Now()
+	for {
+		select {
+		case <-terminate:
+			log.Println("clock watcher of " + vmName + " stopped")
+			return nil
+		case <-ticker.C:
+		}
+
+		// the monotonic clock stops while the host sleeps, the wall clock does not
+		now := time.Now()
+		jump := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if jump > clockJumpThreshold {
+			log.Println("host clock jumped " + jump.Truncate(time.Second).String() + ", checking the clock of " + vmName)
+			due = true
+		}
+		if time.Since(checked) > clockCheckInterval {
+			due = true
+		}
+
+		config, err = qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return err
+		}
+		status, _ := Status(config)
+		if status == "Stopped" && SupervisorPID(config) == 0 {
+			log.Println(vmName + " is stopped")
+			return nil
+		}
+		if !due || status != "Running" {
+			continue
+		}
+
+		skew, synced, err := SyncClock(config, false)
+		if err != nil {
+			// the guest may still be waking up, try again on the next tick
+			log.Errorln(err)
+			continue
+		}
+		due = false
+		checked = time.Now()
+		if synced {
+			log.Noticeln("resynced the clock of " + vmName + ", it was " + DescribeSkew(skew))
+		}
+	}
+}
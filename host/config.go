@@ -0,0 +1,113 @@
+package host
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// ConfigField is a single setting of config.yaml, rendered for display
+type ConfigField struct {
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// secretFields are never displayed, only whether they are set
+var secretFields = []string{"sshpassword", "rootpassword"}
+
+// ConfigFields lists every persisted field of an instance configuration, in config.yaml order and
+// including unset ones, with passwords masked
+func ConfigFields(config qemu.MachineConfig) []ConfigField {
+	fields := []ConfigField{}
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "-" || key == "" {
+			continue
+		}
+
+		value := formatConfigValue(v.Field(i))
+		for _, secret := range secretFields {
+			if key == secret && value != "" {
+				value = "********"
+			}
+		}
+		fields = append(fields, ConfigField{Key: key, Value: value})
+	}
+	return fields
+}
+
+// ConfigMap returns the persisted fields of an instance configuration keyed as in config.yaml, with
+// passwords masked, for JSON and YAML output
+func ConfigMap(config qemu.MachineConfig) map[string]interface{} {
+	m := map[string]interface{}{}
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "-" || key == "" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				m[key] = nil
+				continue
+			}
+			field = field.Elem()
+		}
+		m[key] = field.Interface()
+		if t, ok := m[key].(time.Time); ok && t.IsZero() {
+			m[key] = nil
+		}
+		for _, secret := range secretFields {
+			if key == secret && !field.IsZero() {
+				m[key] = "********"
+			}
+		}
+	}
+	return m
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if s, ok := v.Interface().(fmt.Stringer); ok && v.Kind() != reflect.Ptr {
+		if t, isTime := s.(time.Time); isTime {
+			if t.IsZero() {
+				return ""
+			}
+			return t.Format(time.RFC3339)
+		}
+		return s.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return formatConfigValue(v.Elem())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("%d bytes", v.Len())
+		}
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatConfigValue(v.Index(i))
+		}
+		return strings.Join(items, ", ")
+	case reflect.Map:
+		items := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			items = append(items, formatConfigValue(iter.Key())+"="+formatConfigValue(iter.Value()))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprint(v.Interface())
+}
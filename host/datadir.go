@@ -0,0 +1,18 @@
+package host
+
+import "github.com/beringresearch/macpine/utils"
+
+// DataDirEnv is the environment variable that moves the macpine state directory
+const DataDirEnv = utils.DataDirEnv
+
+// DataDir returns the directory holding instances, the image cache and the global configuration:
+// --data-dir, else $MACPINE_HOME, else ~/.macpine. Commands consult it rather than utils.DataDir,
+// which only the qemu package and the image cache resolve through since they sit below host.
+func DataDir() (string, error) {
+	return utils.DataDir()
+}
+
+// SetDataDir overrides the state directory for this process and the processes it spawns
+func SetDataDir(dir string) error {
+	return utils.SetDataDir(dir)
+}
@@ -0,0 +1,30 @@
+package host
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInstancesUnderDataDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dataDir := filepath.Join(t.TempDir(), "macpine")
+	t.Setenv(DataDirEnv, dataDir)
+
+	for _, dir := range []string{filepath.Join(dataDir, "web"), filepath.Join(dataDir, "cache"), filepath.Join(home, ".macpine", "old")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := ListVMNames(); !reflect.DeepEqual(got, []string{"web"}) {
+		t.Errorf("ListVMNames() with %s set = %v, want [web]", DataDirEnv, got)
+	}
+
+	// without the override instances under ~/.macpine are still found
+	t.Setenv(DataDirEnv, "")
+	if got := ListVMNames(); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Errorf("ListVMNames() without %s = %v, want [old]", DataDirEnv, got)
+	}
+}
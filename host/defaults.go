@@ -0,0 +1,113 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LaunchDefaultKeys are the settings of new instances that `alpine config defaults` reports, in display
+// order. They are set in defaults.yaml, under defaults in the global config, or with MACPINE_*
+// environment variables. sshuser and tags have no launch flag.
+var LaunchDefaultKeys = []string{"image", "arch", "cpu", "memory", "disk", "mount", "sshuser", "tags"}
+
+// Sources of a launch default
+const (
+	DefaultSourceBuiltin = "builtin"
+	DefaultSourceFile    = "file"
+	DefaultSourceEnv     = "env"
+	DefaultSourceProfile = "profile"
+)
+
+// LaunchDefault is the value of a launch default and where it came from
+type LaunchDefault struct {
+	Key    string `json:"key" yaml:"key"`
+	Value  string `json:"value" yaml:"value"`
+	Source string `json:"source" yaml:"source"`
+	// Origin is the file and line, the environment variable or the profile that set the value
+	Origin string `json:"origin,omitempty" yaml:"origin,omitempty"`
+}
+
+// DefaultsPath returns the location of the launch defaults file, which the defaults section of the
+// global config overrides
+func DefaultsPath() (string, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "defaults.yaml"), nil
+}
+
+// DefaultsEnvVar returns the environment variable that overrides a launch default, e.g. MACPINE_CPU
+func DefaultsEnvVar(key string) string {
+	if key == "sshuser" {
+		return "MACPINE_SSH_USER"
+	}
+	return "MACPINE_" + strings.ToUpper(key)
+}
+
+// GetLaunchDefaults returns the launch defaults set in defaults.yaml and under defaults in the global
+// config, and by the MACPINE_* environment variables, which take precedence. Only keys that are set
+// are returned.
+func GetLaunchDefaults(globalConfig GlobalConfig) (map[string]LaunchDefault, error) {
+	defaults := map[string]LaunchDefault{}
+	for _, key := range LaunchDefaultKeys {
+		if value, ok := globalConfig.Defaults[key]; ok {
+			defaults[key] = LaunchDefault{Key: key, Value: value, Source: DefaultSourceFile, Origin: globalConfig.DefaultOrigin(key)}
+		}
+	}
+
+	for _, key := range LaunchDefaultKeys {
+		env := DefaultsEnvVar(key)
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := validateLaunchDefault(key, value); err != nil {
+			return nil, errors.New(env + ": " + err.Error())
+		}
+		defaults[key] = LaunchDefault{Key: key, Value: value, Source: DefaultSourceEnv, Origin: env}
+	}
+	return defaults, nil
+}
+
+var defaultDiskSize = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+
+// validateLaunchDefault checks the form of a default, launch validates the values it ends up using
+func validateLaunchDefault(key string, value string) error {
+	switch key {
+	case "arch":
+		if value != "aarch64" && value != "x86_64" {
+			return errors.New("arch must be aarch64 or x86_64, not " + value)
+		}
+	case "cpu", "memory":
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return errors.New(key + " must be a positive number, not " + value)
+		}
+	case "disk":
+		if !defaultDiskSize.MatchString(value) {
+			return errors.New("disk must be a size such as 20G, not " + value)
+		}
+	case "mount":
+		if value == "" {
+			return nil
+		}
+		if !filepath.IsAbs(value) {
+			return errors.New("mount must be an absolute path, not " + value)
+		}
+	case "sshuser":
+		if value == "" || strings.ContainsAny(value, " \t:@") {
+			return errors.New("sshuser must be a user name, not \"" + value + "\"")
+		}
+	case "tags":
+		for _, tag := range strings.Split(value, ",") {
+			if strings.TrimSpace(tag) == "" {
+				return errors.New("tags must not be empty")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// Delete stops an instance and removes it along with its disks, hosts entry, autostart agent and
+// docker context
+func Delete(vmName string) error {
+	if IsBroken(vmName) {
+		return RemoveBroken(vmName)
+	}
+
+	machineConfig, lock, err := qemu.LockMachineConfigForStop(vmName)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	_, pid := machineConfig.Status()
+	err = Stop(machineConfig)
+	if err != nil {
+		return err
+	}
+	// a qemu that outlived the kill would keep writing to the deleted disk
+	if err := waitForExit(machineConfig, pid); err != nil {
+		return err
+	}
+	if err := checkNoProcesses(vmName); err != nil {
+		return err
+	}
+
+	if err := RemoveHosts(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := DisableAutostart(vmName); err != nil {
+		log.Errorln(err)
+	}
+	if _, err := RemoveDockerContext(machineConfig); err != nil {
+		log.Errorln(err)
+	}
+	if err := os.RemoveAll(machineConfig.Location); err != nil {
+		return err
+	}
+	if err := RunHooks(machineConfig, qemu.HookPostDelete); err != nil {
+		log.Errorln(err)
+	}
+	return nil
+}
+
+// waitForExit waits for the qemu process pid of the instance to be gone
+func waitForExit(config qemu.MachineConfig, pid int) error {
+	for i := 0; i < 20; i++ {
+		if !config.OwnsProcess(pid) {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return errors.New("qemu process " + strconv.Itoa(pid) + " of " + config.Alias + " is still running, not deleting its disk")
+}
@@ -0,0 +1,189 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// dockerInstall installs dockerd on an Alpine guest and starts it at boot
+const dockerInstall = "apk add --no-cache docker && rc-update add docker default && rc-service docker start"
+
+// defaultSSHKeys are the public keys offered by ssh without configuration, in its order of preference
+var defaultSSHKeys = []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub"}
+
+// DockerContextName returns the name of the docker context of an instance
+func DockerContextName(vmName string) string {
+	return "macpine-" + vmName
+}
+
+// dockerCLI returns the path of the docker command of the host
+func dockerCLI() (string, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return "", errors.New("the docker CLI is not installed on this host, install it with `brew install docker`, the engine runs in the instance")
+	}
+	return docker, nil
+}
+
+// CreateDockerContext points a docker context at the dockerd of a running instance, installing
+// docker in the guest if install is set. The docker CLI connects with the system ssh, so publicKey,
+// or the default key of the user, is authorized in the guest and its host key added to known_hosts.
+// The context is updated if it exists. It returns the name of the context.
+func CreateDockerContext(config qemu.MachineConfig, install bool, publicKey string) (string, error) {
+	docker, err := dockerCLI()
+	if err != nil {
+		return "", err
+	}
+	if status, _ := Status(config); status != "Running" {
+		return "", errors.New(config.Alias + " is not running, start it first")
+	}
+	if !config.HasNetwork() {
+		return "", errors.New(config.Alias + " has no network, docker connects to it over ssh")
+	}
+
+	key, _, err := readPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := config.Exec("command -v dockerd || true", true)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(out) == "" {
+		if !install {
+			return "", errors.New("docker is not installed in " + config.Alias + ", rerun with --install to install it")
+		}
+		log.Println("installing docker in " + config.Alias + "...")
+		if _, err := config.Exec(dockerInstall, true); err != nil {
+			return "", errors.New("unable to install docker: " + err.Error())
+		}
+	}
+	if config.SSHUser != "root" {
+		// the docker socket is only accessible to root and the docker group
+		if _, err := config.Exec("addgroup "+config.SSHUser+" docker", true); err != nil {
+			return "", errors.New("unable to add " + config.SSHUser + " to the docker group: " + err.Error())
+		}
+	}
+
+	if err := config.AuthorizeKey(key); err != nil {
+		return "", err
+	}
+	ip, err := config.IPAddress()
+	if err != nil {
+		return "", err
+	}
+	if err := trustHostKey(ip, config.SSHPort); err != nil {
+		return "", err
+	}
+
+	name := DockerContextName(config.Alias)
+	endpoint := "host=ssh://" + config.SSHUser + "@" + ip + ":" + config.SSHPort
+	var cmd *exec.Cmd
+	if exec.Command(docker, "context", "inspect", name).Run() == nil {
+		cmd = exec.Command(docker, "context", "update", name, "--docker", endpoint)
+	} else {
+		cmd = exec.Command(docker, "context", "create", name, "--description", "macpine instance "+config.Alias, "--docker", endpoint)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.New("unable to create docker context " + name + ": " + strings.TrimSpace(string(out)))
+	}
+	return name, nil
+}
+
+// RemoveDockerContext removes the docker context of an instance and its host key from known_hosts,
+// and reports whether there was one. Instances without a docker context, or hosts without docker,
+// have nothing to remove.
+func RemoveDockerContext(config qemu.MachineConfig) (bool, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return false, nil
+	}
+	name := DockerContextName(config.Alias)
+	if exec.Command(docker, "context", "inspect", name).Run() != nil {
+		return false, nil
+	}
+
+	if out, err := exec.Command(docker, "context", "rm", "--force", name).CombinedOutput(); err != nil {
+		return false, errors.New("unable to remove docker context " + name + ": " + strings.TrimSpace(string(out)))
+	}
+	// the address of a vmnet instance is only known while it runs, a stale entry is replaced by the next create
+	if config.SSHPort != "" && !config.UsesVMNet() {
+		forgetHostKey(config.MachineIP, config.SSHPort)
+	}
+	return true, nil
+}
+
+// readPublicKey reads the public key at path, or the first default key of the user. It returns the
+// key and the file it was read from.
+func readPublicKey(path string) (string, string, error) {
+	if path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", errors.New("unable to read SSH key: " + err.Error())
+		}
+		return string(key), path, nil
+	}
+
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	for _, name := range defaultSSHKeys {
+		path := filepath.Join(userHomeDir, ".ssh", name)
+		key, err := os.ReadFile(path)
+		if err == nil {
+			return string(key), path, nil
+		}
+	}
+	return "", "", errors.New("no SSH key in ~/.ssh, create one with `ssh-keygen -t ed25519` or pass the public key to use")
+}
+
+// knownHostsName returns how ssh names a host and port in known_hosts
+func knownHostsName(host string, port string) string {
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// trustHostKey replaces the known_hosts entries of the instance at host and port with its current
+// host keys. Instances are recreated with new host keys under the same address and port, which ssh
+// would otherwise refuse as a changed key.
+func trustHostKey(host string, port string) error {
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	keys, err := exec.Command("ssh-keyscan", "-p", port, host).Output()
+	if err != nil || len(keys) == 0 {
+		return errors.New("unable to read the SSH host keys of " + knownHostsName(host, port))
+	}
+
+	forgetHostKey(host, port)
+	knownHosts := filepath.Join(userHomeDir, ".ssh", "known_hosts")
+	if err := os.MkdirAll(filepath.Dir(knownHosts), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(keys)
+	return err
+}
+
+// forgetHostKey removes the known_hosts entries of host and port
+func forgetHostKey(host string, port string) {
+	out, err := exec.Command("ssh-keygen", "-R", knownHostsName(host, port)).CombinedOutput()
+	if err != nil {
+		log.Debugln("ssh-keygen -R " + knownHostsName(host, port) + ": " + strings.TrimSpace(string(out)))
+	}
+}
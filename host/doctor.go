@@ -0,0 +1,201 @@
+package host
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// CheckStatus is the outcome of a single environment check
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// Check is the result of a single environment check run by Doctor
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+// minimum qemu version providing the vmnet network backends
+const minQemuMajor, minQemuMinor = 7, 1
+
+// Doctor inspects the host environment for everything macpine needs to run instances, and the clocks
+// of running instances
+func Doctor() []Check {
+	var checks []Check
+
+	nativeArch := "aarch64"
+	if runtime.GOARCH == "amd64" {
+		nativeArch = "x86_64"
+	}
+	for _, arch := range []string{"aarch64", "x86_64"} {
+		checks = append(checks, checkQemuBinary("qemu-system-"+arch, arch == nativeArch))
+	}
+
+	checks = append(checks, checkCommand("qemu-img", true, "required to create and resize disks, install qemu"))
+	checks = append(checks, checkCommand("mkisofs", false, "required by launch-cloud, install cdrtools"))
+	checks = append(checks, checkGvproxy())
+	checks = append(checks, checkSwtpm())
+	checks = append(checks, checkAccelerator())
+	checks = append(checks, checkMacpineHome())
+	checks = append(checks, checkClocks()...)
+
+	return checks
+}
+
+func checkCommand(name string, required bool, hint string) Check {
+	if path, err := exec.LookPath(name); err == nil {
+		return Check{Name: name, Status: CheckPass, Detail: path}
+	}
+	if required {
+		return Check{Name: name, Status: CheckFail, Detail: "not found on $PATH, " + hint}
+	}
+	return Check{Name: name, Status: CheckWarn, Detail: "not found on $PATH, " + hint}
+}
+
+// checkGvproxy looks for gvproxy where podman installs it as well as on $PATH
+func checkGvproxy() Check {
+	if path := qemu.GvproxyPath(); path != "" {
+		return Check{Name: "gvproxy", Status: CheckPass, Detail: path}
+	}
+	return Check{Name: "gvproxy", Status: CheckWarn, Detail: "not found, --network gvproxy falls back to user-mode networking. install podman"}
+}
+
+// checkSwtpm looks for swtpm where Homebrew installs it as well as on $PATH
+func checkSwtpm() Check {
+	if path := qemu.SwtpmPath(); path != "" {
+		return Check{Name: "swtpm", Status: CheckPass, Detail: path}
+	}
+	return Check{Name: "swtpm", Status: CheckWarn, Detail: "not found, required by instances launched with --tpm. install swtpm"}
+}
+
+func checkQemuBinary(name string, native bool) Check {
+	if !utils.CommandExists(name) {
+		if native {
+			return Check{Name: name, Status: CheckFail, Detail: "not found on $PATH, install qemu (`brew install qemu`)"}
+		}
+		return Check{Name: name, Status: CheckWarn, Detail: "not found on $PATH, emulated instances of this architecture are unavailable"}
+	}
+
+	out, err := exec.Command(name, "--version").Output()
+	if err != nil {
+		return Check{Name: name, Status: CheckFail, Detail: "unable to run: " + err.Error()}
+	}
+
+	version := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	matches := regexp.MustCompile(`version (\d+)\.(\d+)`).FindStringSubmatch(version)
+	if len(matches) != 3 {
+		return Check{Name: name, Status: CheckWarn, Detail: "unable to determine version from \"" + version + "\""}
+	}
+
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	if major < minQemuMajor || (major == minQemuMajor && minor < minQemuMinor) {
+		return Check{Name: name, Status: CheckWarn, Detail: version + ", vmnet networking requires qemu 7.1 or newer"}
+	}
+	return Check{Name: name, Status: CheckPass, Detail: version}
+}
+
+func checkAccelerator() Check {
+	switch runtime.GOOS {
+	case "darwin":
+		out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+		if err == nil && strings.TrimSpace(string(out)) == "1" {
+			return Check{Name: "accelerator", Status: CheckPass, Detail: "hvf available"}
+		}
+		return Check{Name: "accelerator", Status: CheckWarn, Detail: "Hypervisor.framework unavailable, instances fall back to slow tcg emulation"}
+	case "linux":
+		if f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err == nil {
+			f.Close()
+			return Check{Name: "accelerator", Status: CheckPass, Detail: "kvm available"}
+		}
+		return Check{Name: "accelerator", Status: CheckWarn, Detail: "/dev/kvm unavailable, instances fall back to slow tcg emulation"}
+	}
+	return Check{Name: "accelerator", Status: CheckWarn, Detail: "no supported accelerator on " + runtime.GOOS + ", instances use tcg emulation"}
+}
+
+func checkMacpineHome() Check {
+	dataDir, err := DataDir()
+	if err != nil {
+		return Check{Name: "data directory", Status: CheckFail, Detail: err.Error()}
+	}
+
+	// name the active directory and what selected it, since instances elsewhere are not listed
+	name := "data directory " + dataDir
+	if os.Getenv(DataDirEnv) != "" {
+		name += " (from --data-dir or $" + DataDirEnv + ")"
+	}
+
+	dir := dataDir
+	info, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		// created on first launch, the parent must be writable
+		dir = filepath.Dir(dataDir)
+	} else if err != nil {
+		return Check{Name: name, Status: CheckFail, Detail: err.Error()}
+	} else if !info.IsDir() {
+		return Check{Name: name, Status: CheckFail, Detail: "exists but is not a directory"}
+	}
+
+	probe, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return Check{Name: name, Status: CheckFail, Detail: "not writable: " + err.Error()}
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	if dir != dataDir {
+		return Check{Name: name, Status: CheckPass, Detail: "does not exist yet, will be created on first launch"}
+	}
+	return Check{Name: name, Status: CheckPass, Detail: "writable"}
+}
+
+// maxClockSkew is how far the clock of a guest may be off before doctor warns about it
+const maxClockSkew = 2 * time.Second
+
+// checkClocks compares the clock of every running instance reachable over SSH with the host clock
+func checkClocks() []Check {
+	var checks []Check
+	for _, vmName := range ListVMNames() {
+		config, err := qemu.GetMachineConfig(vmName)
+		if err != nil || !config.HasNetwork() {
+			continue
+		}
+		if status, _ := Status(config); status != "Running" {
+			continue
+		}
+
+		name := "clock of " + vmName
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		skew, err := config.ClockSkew(ctx)
+		cancel()
+		if err != nil {
+			checks = append(checks, Check{Name: name, Status: CheckWarn, Detail: "unable to read: " + err.Error()})
+			continue
+		}
+		switch {
+		case skew > maxClockSkew:
+			checks = append(checks, Check{Name: name, Status: CheckWarn, Detail: skew.String() + " ahead of the host"})
+		case skew < -maxClockSkew:
+			checks = append(checks, Check{Name: name, Status: CheckWarn, Detail: (-skew).String() + " behind the host, as after the host slept. resync it with `alpine time sync " + vmName + "`"})
+		default:
+			checks = append(checks, Check{Name: name, Status: CheckPass, Detail: "in sync with the host"})
+		}
+	}
+	return checks
+}
@@ -0,0 +1,240 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	reconnectPollInterval = 2 * time.Second
+	reconnectMaxBackoff   = 30 * time.Second
+	// keepalives detect a dropped connection, e.g. after the host slept, well before TCP would
+	reconnectKeepalive = 15 * time.Second
+	// a connection that stayed up this long resets the backoff
+	reconnectStableAfter = time.Minute
+)
+
+// errDone ends a reconnectLoop without an error
+var errDone = errors.New("done")
+
+func forwarderPIDFile(config qemu.MachineConfig) string {
+	return filepath.Join(config.Location, "forwarder.pid")
+}
+
+// ForwarderPID returns the PID of the reverse port forwarder of an instance, or 0 if none is running
+func ForwarderPID(config qemu.MachineConfig) int {
+	return backgroundPID(forwarderPIDFile(config))
+}
+
+// StartForwarder forks a background `alpine forward` process for instances with reverse ports
+func StartForwarder(config qemu.MachineConfig) error {
+	if len(config.ReversePorts) == 0 || !config.HasNetwork() || ForwarderPID(config) > 0 {
+		return nil
+	}
+	cmd, err := startBackground("forwarder", filepath.Join(config.Location, "forwarder.log"), "forward", config.Alias)
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// StopForwarder terminates the reverse port forwarder of an instance
+func StopForwarder(config qemu.MachineConfig) error {
+	return stopBackground(config, forwarderPIDFile(config), "forwarder")
+}
+
+// RestartForwarder restarts the reverse port forwarder of a running instance, picking up changes
+// to its reverse ports
+func RestartForwarder(config qemu.MachineConfig) error {
+	if err := StopForwarder(config); err != nil {
+		return err
+	}
+	if status, _ := Status(config); status != "Running" {
+		return nil
+	}
+	return StartForwarder(config)
+}
+
+// Forward listens on the reverse ports of an instance over SSH, as ssh -R does, and forwards the
+// connections to their host addresses. It returns when the instance is stopped, it has no reverse
+// ports left, or the forwarder is terminated by StopForwarder.
+func Forward(vmName string) error {
+	config, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(forwarderPIDFile(config), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(forwarderPIDFile(config))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer stop()
+
+	err = reconnectLoop(ctx, vmName, func(ctx context.Context, config qemu.MachineConfig) error {
+		if len(config.ReversePorts) == 0 {
+			log.Println(vmName + " has no reverse ports")
+			return errDone
+		}
+		return forwardReversePorts(ctx, config)
+	})
+	log.Println("forwarder of " + vmName + " stopped")
+	return err
+}
+
+// reconnectLoop calls connect while the instance is running, with backoff, until ctx is done, the
+// instance is stopped or connect returns errDone. connect holds a connection to the instance and
+// returns when it drops. Instances restarted by their supervisor are waited for.
+func reconnectLoop(ctx context.Context, vmName string, connect func(ctx context.Context, config qemu.MachineConfig) error) error {
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		// select picks either case when both are ready
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		config, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return err
+		}
+		status, _ := Status(config)
+		if status == "Stopped" && SupervisorPID(config) == 0 {
+			log.Println(vmName + " is stopped")
+			return nil
+		}
+		if status != "Running" {
+			backoff = reconnectPollInterval
+			continue
+		}
+
+		connected := time.Now()
+		err = connect(ctx, config)
+		if errors.Is(err, errDone) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		log.Errorln(err)
+
+		if time.Since(connected) > reconnectStableAfter {
+			backoff = 0
+		}
+		backoff = 2*backoff + reconnectPollInterval
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+		log.Println("reconnecting to " + vmName + " in " + backoff.String())
+	}
+}
+
+// holdConnection sends keepalives over an SSH connection until ctx is done or the connection drops
+func holdConnection(ctx context.Context, config qemu.MachineConfig, client *ssh.Client) error {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Wait()
+	}()
+
+	ticker := time.NewTicker(reconnectKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-closed:
+			if err == nil {
+				err = io.EOF
+			}
+			return errors.New("lost connection to " + config.Alias + ": " + err.Error())
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				return errors.New("lost connection to " + config.Alias + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// forwardReversePorts forwards the reverse ports of an instance until ctx is done or the SSH
+// connection drops
+func forwardReversePorts(ctx context.Context, config qemu.MachineConfig) error {
+	if err := config.EnableTCPForwarding(); err != nil {
+		return err
+	}
+	// root may listen on privileged ports of the guest
+	client, err := config.DialContext(ctx, true)
+	if err != nil {
+		return errors.New("unable to connect to " + config.Alias + ": " + err.Error())
+	}
+	defer client.Close()
+
+	ports := make([]string, len(config.ReversePorts))
+	for i, r := range config.ReversePorts {
+		listener, err := client.Listen("tcp", "127.0.0.1:"+strconv.Itoa(r.GuestPort))
+		if err != nil {
+			return errors.New("unable to listen on port " + strconv.Itoa(r.GuestPort) + " of " + config.Alias + ": " + err.Error())
+		}
+		go acceptReversePort(listener, r)
+		ports[i] = r.String()
+	}
+	log.Println("forwarding " + strings.Join(ports, ", ") + " of " + config.Alias)
+
+	return holdConnection(ctx, config, client)
+}
+
+// acceptReversePort proxies the connections to a guest port to its host address, until the SSH
+// connection listening on it is closed
+func acceptReversePort(listener net.Listener, r qemu.ReversePort) {
+	for {
+		guestConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer guestConn.Close()
+			hostConn, err := net.DialTimeout("tcp", r.HostAddress(), 10*time.Second)
+			if err != nil {
+				log.Errorln("unable to forward port " + strconv.Itoa(r.GuestPort) + ": " + err.Error())
+				return
+			}
+			defer hostConn.Close()
+			proxy(guestConn, hostConn)
+		}()
+	}
+}
+
+// proxy copies between two connections in both directions until both are done
+func proxy(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyConn := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		// let the other side see EOF while the reply is still being written
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyConn(a, b)
+	go copyConn(b, a)
+	<-done
+	<-done
+}
@@ -0,0 +1,151 @@
+package host
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// OrphanProcess is a qemu process running a macpine disk that no instance accounts for
+type OrphanProcess struct {
+	PID      int
+	Instance string
+	Disk     string
+	Reason   string
+}
+
+// FindOrphans lists qemu-system processes whose disk lives under the data directory but whose instance
+// directory or pidfile is missing, or whose pidfile points at another process
+func FindOrphans() ([]OrphanProcess, error) {
+	processes, err := qemuProcesses()
+	if err != nil {
+		return nil, err
+	}
+	orphans := []OrphanProcess{}
+	for _, p := range processes {
+		if p.Reason = orphanReason(p.Instance, p.PID); p.Reason != "" {
+			orphans = append(orphans, p)
+		}
+	}
+	return orphans, nil
+}
+
+// InstanceProcesses lists the qemu-system processes running a disk of an instance, found by their
+// command line rather than the pidfile, which a broken instance may not lead to
+func InstanceProcesses(vmName string) ([]OrphanProcess, error) {
+	processes, err := qemuProcesses()
+	if err != nil {
+		return nil, err
+	}
+	found := []OrphanProcess{}
+	for _, p := range processes {
+		if p.Instance == vmName {
+			found = append(found, p)
+		}
+	}
+	return found, nil
+}
+
+// qemuProcesses lists the qemu-system processes whose disk lives under the data directory
+func qemuProcesses() ([]OrphanProcess, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+	macpineDir := dataDir + string(filepath.Separator)
+
+	out, err := exec.Command("ps", "-axww", "-o", "pid=,command=").Output()
+	if err != nil {
+		return nil, errors.New("unable to list processes: " + err.Error())
+	}
+
+	processes := []OrphanProcess{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.Contains(fields[1], "qemu-system") {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		disk := macpineDisk(fields[2:], macpineDir)
+		if disk == "" {
+			continue
+		}
+		vmName := strings.SplitN(strings.TrimPrefix(disk, macpineDir), string(filepath.Separator), 2)[0]
+		processes = append(processes, OrphanProcess{PID: pid, Instance: vmName, Disk: disk})
+	}
+	return processes, nil
+}
+
+// macpineDisk returns the first -drive file under the macpine directory in a qemu command line
+func macpineDisk(args []string, macpineDir string) string {
+	for i, arg := range args {
+		if arg != "-drive" || i+1 >= len(args) {
+			continue
+		}
+		for _, opt := range strings.Split(args[i+1], ",") {
+			if file, ok := strings.CutPrefix(opt, "file="); ok && strings.HasPrefix(file, macpineDir) {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+func orphanReason(vmName string, pid int) string {
+	config, err := qemu.GetMachineConfigForStop(vmName)
+	if err != nil {
+		return "instance directory or config.yaml is missing"
+	}
+	if !config.HasPIDFile() {
+		return "pidfile is missing"
+	}
+	recorded, err := config.GetInstancePID()
+	if err != nil {
+		return ""
+	}
+	if recorded != pid {
+		return "pidfile points to " + strconv.Itoa(recorded)
+	}
+	return ""
+}
+
+// KillOrphan terminates an orphaned qemu process, using sudo when it runs as root
+func KillOrphan(orphan OrphanProcess) error {
+	err := syscall.Kill(orphan.PID, syscall.SIGKILL)
+	if errors.Is(err, syscall.EPERM) {
+		out, sudoErr := exec.Command("sudo", "kill", "-9", strconv.Itoa(orphan.PID)).CombinedOutput()
+		if sudoErr != nil {
+			return errors.New("unable to kill " + strconv.Itoa(orphan.PID) + ": " + strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return err
+}
+
+// CleanStaleRuntimeFiles removes the pidfiles and sockets left behind by instances whose qemu
+// process is gone, and returns their names. Supervised instances are skipped: their supervisor
+// tells a crash from a clean stop by the pidfile and cleans up itself.
+func CleanStaleRuntimeFiles() []string {
+	cleaned := []string{}
+	for _, vmName := range ListVMNames() {
+		config, err := qemu.GetMachineConfig(vmName)
+		if err != nil || !config.HasPIDFile() || SupervisorPID(config) > 0 {
+			continue
+		}
+		if status, _ := config.Status(); status != "Stopped" {
+			continue
+		}
+		config.CleanRuntimeFiles()
+		cleaned = append(cleaned, vmName)
+	}
+	return cleaned
+}
@@ -0,0 +1,166 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// GlobalConfig holds user preferences shared by all instances, read from ~/.macpine/config.yaml
+type GlobalConfig struct {
+	// Defaults maps launch flag names to the value used when the flag is not given
+	Defaults map[string]string `yaml:"defaults"`
+	// Profiles are named flag presets selected with --profile, taking precedence over Defaults
+	Profiles map[string]map[string]string `yaml:"profiles"`
+
+	// origins maps the keys of Defaults to the file and line that set them
+	origins map[string]string
+}
+
+// GlobalConfigPath returns the location of the global config file
+func GlobalConfigPath() (string, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "config.yaml"), nil
+}
+
+// GetGlobalConfig reads the global config file, with the launch defaults of defaults.yaml below its
+// defaults section. Missing files yield an empty config.
+func GetGlobalConfig() (GlobalConfig, error) {
+	globalConfig := GlobalConfig{origins: map[string]string{}}
+	if err := readDefaultsFile(&globalConfig); err != nil {
+		return globalConfig, err
+	}
+
+	path, err := GlobalConfigPath()
+	if err != nil {
+		return globalConfig, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return globalConfig, nil
+	} else if err != nil {
+		return globalConfig, err
+	}
+
+	// values are decoded as nodes, so that errors name their line and tags may be given as a list
+	raw := struct {
+		Defaults map[string]yaml.Node            `yaml:"defaults"`
+		Profiles map[string]map[string]yaml.Node `yaml:"profiles"`
+	}{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&raw); err != nil && err != io.EOF {
+		return globalConfig, errors.New("invalid " + path + ": " + err.Error())
+	}
+
+	if raw.Defaults != nil && globalConfig.Defaults == nil {
+		globalConfig.Defaults = map[string]string{}
+	}
+	for key, node := range raw.Defaults {
+		at := path + ":" + strconv.Itoa(node.Line)
+		value, err := defaultValue(key, &node)
+		if err != nil {
+			return globalConfig, errors.New(at + ": " + err.Error())
+		}
+		globalConfig.Defaults[key] = value
+		globalConfig.origins[key] = at
+	}
+	if raw.Profiles != nil {
+		globalConfig.Profiles = map[string]map[string]string{}
+	}
+	for name, values := range raw.Profiles {
+		globalConfig.Profiles[name] = map[string]string{}
+		for key, node := range values {
+			value, err := defaultValue(key, &node)
+			if err != nil {
+				return globalConfig, errors.New(path + ":" + strconv.Itoa(node.Line) + ": " + err.Error())
+			}
+			globalConfig.Profiles[name][key] = value
+		}
+	}
+	return globalConfig, nil
+}
+
+// readDefaultsFile reads the launch defaults of defaults.yaml into Defaults. The file only takes the
+// keys of LaunchDefaultKeys, at its top level.
+func readDefaultsFile(globalConfig *GlobalConfig) error {
+	path, err := DefaultsPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return errors.New("invalid " + path + ": " + err.Error())
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New(path + ":" + strconv.Itoa(root.Line) + ": expected a mapping of defaults such as `cpu: 4`")
+	}
+
+	globalConfig.Defaults = map[string]string{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+		at := path + ":" + strconv.Itoa(keyNode.Line)
+		if !utils.StringSliceContains(LaunchDefaultKeys, keyNode.Value) {
+			return errors.New(at + ": unknown key " + keyNode.Value + ", expected one of " + strings.Join(LaunchDefaultKeys, ", "))
+		}
+		value, err := defaultValue(keyNode.Value, valueNode)
+		if err != nil {
+			return errors.New(at + ": " + err.Error())
+		}
+		globalConfig.Defaults[keyNode.Value] = value
+		globalConfig.origins[keyNode.Value] = at
+	}
+	return nil
+}
+
+// DefaultOrigin returns the file and line that set a key of Defaults
+func (g GlobalConfig) DefaultOrigin(key string) string {
+	return g.origins[key]
+}
+
+// defaultValue returns a default or profile value as the flag takes it. Launch defaults are checked
+// here, other flags when they are applied.
+func defaultValue(key string, node *yaml.Node) (string, error) {
+	var value string
+	switch {
+	case node.Kind == yaml.ScalarNode:
+		value = node.Value
+	case key == "tags" && node.Kind == yaml.SequenceNode:
+		tags := []string{}
+		for _, tag := range node.Content {
+			if tag.Kind != yaml.ScalarNode {
+				return "", errors.New("tags must be a list of names")
+			}
+			tags = append(tags, tag.Value)
+		}
+		value = strings.Join(tags, ",")
+	default:
+		return "", errors.New(key + " must be a single value")
+	}
+	if err := validateLaunchDefault(key, value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
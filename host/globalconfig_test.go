@@ -0,0 +1,126 @@
+package host
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetLaunchDefaults(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(DataDirEnv, dataDir)
+	t.Setenv("MACPINE_CPU", "8")
+	path := filepath.Join(dataDir, "config.yaml")
+	config := "defaults:\n  cpu: 4\n  memory: 8192\n  tags: [team, dev]\n  sshuser: alpine\n  network: shared\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	globalConfig, err := GetGlobalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := GetLaunchDefaults(globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]LaunchDefault{
+		"cpu":     {Key: "cpu", Value: "8", Source: DefaultSourceEnv, Origin: "MACPINE_CPU"},
+		"memory":  {Key: "memory", Value: "8192", Source: DefaultSourceFile, Origin: path + ":3"},
+		"tags":    {Key: "tags", Value: "team,dev", Source: DefaultSourceFile, Origin: path + ":4"},
+		"sshuser": {Key: "sshuser", Value: "alpine", Source: DefaultSourceFile, Origin: path + ":5"},
+	}
+	if len(defaults) != len(want) {
+		t.Errorf("GetLaunchDefaults() = %+v, want %+v", defaults, want)
+	}
+	for key, d := range want {
+		if defaults[key] != d {
+			t.Errorf("GetLaunchDefaults()[%s] = %+v, want %+v", key, defaults[key], d)
+		}
+	}
+	// flags without a launch default are kept for the launch commands
+	if globalConfig.Defaults["network"] != "shared" {
+		t.Errorf("Defaults[network] = %q, want shared", globalConfig.Defaults["network"])
+	}
+}
+
+func TestGetGlobalConfigInvalid(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(DataDirEnv, dataDir)
+
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"defaults:\n  cpu: 4\n  memory: lots\n", "config.yaml:3: memory must be a positive number"},
+		{"defaults:\n  arch: sparc\n", "config.yaml:2: "},
+		{"defaults:\n  cpu: [4]\n", "config.yaml:2: cpu must be a single value"},
+		{"profiles:\n  web:\n    disk: big\n", "config.yaml:3: "},
+		{"default:\n  cpu: 4\n", "invalid "},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(dataDir, "config.yaml"), []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := GetGlobalConfig()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("GetGlobalConfig() with %q = %v, want an error containing %q", tt.config, err, tt.want)
+		}
+	}
+}
+
+func TestGetGlobalConfigDefaultsFile(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(DataDirEnv, dataDir)
+	defaultsPath := filepath.Join(dataDir, "defaults.yaml")
+	configPath := filepath.Join(dataDir, "config.yaml")
+	if err := os.WriteFile(defaultsPath, []byte("cpu: 4\nmemory: 8192\ntags: [team]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// defaults.yaml applies without a config.yaml
+	globalConfig, err := GetGlobalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if globalConfig.Defaults["cpu"] != "4" || globalConfig.DefaultOrigin("cpu") != defaultsPath+":1" {
+		t.Errorf("cpu = %q from %s, want 4 from %s:1", globalConfig.Defaults["cpu"], globalConfig.DefaultOrigin("cpu"), defaultsPath)
+	}
+
+	// the defaults section of config.yaml overrides it key by key
+	if err := os.WriteFile(configPath, []byte("defaults:\n  memory: 4096\n  network: shared\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	globalConfig, err = GetGlobalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"cpu": "4", "memory": "4096", "tags": "team", "network": "shared"}
+	origins := map[string]string{"cpu": defaultsPath + ":1", "memory": configPath + ":2", "tags": defaultsPath + ":3"}
+	for key, value := range want {
+		if globalConfig.Defaults[key] != value {
+			t.Errorf("Defaults[%s] = %q, want %q", key, globalConfig.Defaults[key], value)
+		}
+	}
+	for key, origin := range origins {
+		if globalConfig.DefaultOrigin(key) != origin {
+			t.Errorf("DefaultOrigin(%s) = %s, want %s", key, globalConfig.DefaultOrigin(key), origin)
+		}
+	}
+
+	// defaults.yaml only takes launch defaults
+	for config, wantErr := range map[string]string{
+		"cpu: 4\nnetwork: shared\n": "defaults.yaml:2: unknown key network",
+		"cpu: 4\nmemory: lots\n":    "defaults.yaml:2: memory must be a positive number",
+		"- cpu\n":                   "defaults.yaml:1: expected a mapping",
+	} {
+		if err := os.WriteFile(defaultsPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetGlobalConfig(); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("GetGlobalConfig() with defaults.yaml %q = %v, want an error containing %q", config, err, wantErr)
+		}
+	}
+}
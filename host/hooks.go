@@ -0,0 +1,82 @@
+package host
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// SkipHooks disables the lifecycle hooks of every instance, set by --no-hooks
+var SkipHooks bool
+
+// RunHooks runs the hooks of the instance for event in order, with /bin/sh on the host. Their output
+// is logged line by line, prefixed with the instance and event, and appended to alpine.log. The first
+// failing command stops the remaining ones and its error is returned.
+func RunHooks(config qemu.MachineConfig, event qemu.HookEvent) error {
+	if SkipHooks {
+		return nil
+	}
+	for _, command := range config.Hooks.Commands(event) {
+		if err := runHook(config, event, command); err != nil {
+			return errors.New(string(event) + " hook of " + config.Alias + " failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func runHook(config qemu.MachineConfig, event qemu.HookEvent, command string) error {
+	prefix := config.Alias + " " + string(event) + ": "
+	hookLog(config, prefix+"running "+command)
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"MACPINE_NAME="+config.Alias,
+		"MACPINE_HOOK="+string(event),
+		"MACPINE_IP="+config.MachineIP,
+		"MACPINE_SSH_PORT="+config.SSHPort,
+		"MACPINE_SSH_USER="+config.SSHUser,
+		"MACPINE_DIR="+config.Location,
+	)
+	// the instance directory is gone by the time postdelete hooks run
+	if _, err := os.Stat(config.Location); err == nil {
+		cmd.Dir = config.Location
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		hookLog(config, prefix+scanner.Text())
+	}
+	r.Close()
+	return cmd.Wait()
+}
+
+// hookLog logs a line of hook output and appends it to the instance log, when writable
+func hookLog(config qemu.MachineConfig, line string) {
+	log.Println(line)
+
+	f, err := os.OpenFile(filepath.Join(config.Location, "alpine.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(time.Now().Format(time.RFC3339) + " macpine hook " + line + "\n")
+}
@@ -0,0 +1,32 @@
+package host
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// RotateHostKeys regenerates the SSH host keys of a running instance and records the new ones, in
+// the known_hosts of the instance and, for its docker context, in ~/.ssh/known_hosts
+func RotateHostKeys(config qemu.MachineConfig) error {
+	if status, _ := Status(config); status != "Running" {
+		return errors.New(config.Alias + " is not running, start it first")
+	}
+	if !config.HasNetwork() {
+		return errors.New(config.Alias + " has no network, its host keys are only used over ssh")
+	}
+	if err := config.RotateHostKeys(); err != nil {
+		return err
+	}
+
+	docker, err := exec.LookPath("docker")
+	if err != nil || exec.Command(docker, "context", "inspect", DockerContextName(config.Alias)).Run() != nil {
+		return nil
+	}
+	ip, err := config.IPAddress()
+	if err != nil {
+		return err
+	}
+	return trustHostKey(ip, config.SSHPort)
+}
@@ -0,0 +1,127 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+const (
+	hostsFile       = "/etc/hosts"
+	hostsBlockBegin = "# BEGIN macpine managed block, do not edit"
+	hostsBlockEnd   = "# END macpine managed block"
+	hostsNameSuffix = ".alpine"
+)
+
+// HostsName returns the name an instance is reachable as from the host with --write-hosts
+func HostsName(vmName string) string {
+	return vmName + hostsNameSuffix
+}
+
+// UpdateHosts maps the instance to its vmnet address in the managed block of /etc/hosts
+func UpdateHosts(config qemu.MachineConfig) error {
+	if !config.WriteHosts {
+		return nil
+	}
+	ip, err := config.IPAddress()
+	if err != nil {
+		return errors.New("unable to update " + hostsFile + ": " + err.Error())
+	}
+	return editHosts(config.Alias, ip)
+}
+
+// RemoveHosts drops the instance from the managed block of /etc/hosts
+func RemoveHosts(config qemu.MachineConfig) error {
+	if !config.WriteHosts {
+		return nil
+	}
+	return editHosts(config.Alias, "")
+}
+
+// hostsMu serializes edits of /etc/hosts by instances started or stopped together
+var hostsMu sync.Mutex
+
+func editHosts(vmName string, ip string) error {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+
+	current, err := os.ReadFile(hostsFile)
+	if err != nil {
+		return err
+	}
+
+	updated := updateHostsBlock(string(current), HostsName(vmName), ip)
+	if updated == string(current) {
+		return nil
+	}
+
+	// /etc/hosts is owned by root, only ask for sudo when it actually changes
+	cmd := exec.Command("sudo", "tee", hostsFile)
+	cmd.Stdin = strings.NewReader(updated)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("unable to update " + hostsFile + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// updateHostsBlock sets or, with an empty ip, removes the entry for name in the managed
+// block of a hosts file, leaving everything outside the block untouched
+func updateHostsBlock(content string, name string, ip string) string {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+
+	outside := []string{}
+	entries := map[string]string{}
+	inBlock := false
+	for _, line := range lines {
+		switch {
+		case line == hostsBlockBegin:
+			inBlock = true
+		case line == hostsBlockEnd:
+			inBlock = false
+		case inBlock:
+			fields := strings.Fields(line)
+			if len(fields) == 2 {
+				entries[fields[1]] = fields[0]
+			}
+		default:
+			outside = append(outside, line)
+		}
+	}
+
+	if ip == "" {
+		delete(entries, name)
+	} else {
+		entries[name] = ip
+	}
+
+	// drop blank lines left behind by a previous block
+	for len(outside) > 0 && outside[len(outside)-1] == "" {
+		outside = outside[:len(outside)-1]
+	}
+
+	if len(entries) == 0 {
+		return strings.Join(outside, "\n") + "\n"
+	}
+
+	names := make([]string, 0, len(entries))
+	for n := range entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	block := []string{"", hostsBlockBegin}
+	for _, n := range names {
+		block = append(block, entries[n]+" "+n)
+	}
+	block = append(block, hostsBlockEnd)
+
+	return strings.Join(append(outside, block...), "\n") + "\n"
+}
@@ -2,26 +2,277 @@ package host
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 )
 
-func Info(vmName string) (string, error) {
+// InstanceInfo describes an instance: its configuration and, when running, runtime statistics
+type InstanceInfo struct {
+	Name          string            `json:"name" yaml:"name"`
+	Status        string            `json:"status" yaml:"status"`
+	IP            string            `json:"ip" yaml:"ip"`
+	Network       string            `json:"network" yaml:"network"`
+	Image         string            `json:"image" yaml:"image"`
+	AlpineRelease string            `json:"alpineRelease,omitempty" yaml:"alpinerelease,omitempty"`
+	Arch          string            `json:"arch" yaml:"arch"`
+	Disk          string            `json:"disk" yaml:"disk"`
+	Memory        string            `json:"memory" yaml:"memory"`
+	CPUs          string            `json:"cpus" yaml:"cpus"`
+	Mount         string            `json:"mount" yaml:"mount"`
+	Tags          []string          `json:"tags" yaml:"tags"`
+	Description   string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	StaticIP      string            `json:"staticIP,omitempty" yaml:"staticip,omitempty"`
+	Gateway       string            `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	NetworkConfig string            `json:"networkConfig,omitempty" yaml:"networkconfig,omitempty"`
+	CopiedFiles   []string          `json:"copiedFiles,omitempty" yaml:"copiedfiles,omitempty"`
+	ReversePorts  []string          `json:"reversePorts,omitempty" yaml:"reverseports,omitempty"`
+	ForwarderPID  int               `json:"forwarderPID,omitempty" yaml:"forwarderpid,omitempty"`
+	CreatedAt     string            `json:"createdAt,omitempty" yaml:"createdat,omitempty"`
+	RestartPolicy string            `json:"restartPolicy" yaml:"restartpolicy"`
+	SupervisorPID int               `json:"supervisorPID,omitempty" yaml:"supervisorpid,omitempty"`
+	ImagePath     string            `json:"imagePath" yaml:"imagepath"`
+	DiskPath      string            `json:"diskPath" yaml:"diskpath"`
+	QMPSocket     string            `json:"qmpSocket,omitempty" yaml:"qmpsocket,omitempty"`
+
+	DiskActualBytes  uint64   `json:"diskActualBytes" yaml:"diskactualbytes"`
+	DiskVirtualBytes uint64   `json:"diskVirtualBytes" yaml:"diskvirtualbytes"`
+	PID              int      `json:"pid,omitempty" yaml:"pid,omitempty"`
+	UptimeSeconds    int64    `json:"uptimeSeconds,omitempty" yaml:"uptimeseconds,omitempty"`
+	MemoryRSSBytes   uint64   `json:"memoryRSSBytes,omitempty" yaml:"memoryrssbytes,omitempty"`
+	PortForwards     []string `json:"portForwards,omitempty" yaml:"portforwards,omitempty"`
+
+	Error        string                 `json:"error,omitempty" yaml:"error,omitempty"`
+	Config       map[string]interface{} `json:"config" yaml:"config"`
+	ConfigFields []ConfigField          `json:"-" yaml:"-"`
+}
+
+// StatusBroken is reported for instances whose configuration cannot be loaded
+const StatusBroken = "Broken"
+
+// StatusCreated is reported for instances created with --no-start that have never been started
+const StatusCreated = "Created"
+
+// GetInfo collects the configuration of an instance and, if it is running, its runtime statistics.
+// An instance whose configuration cannot be loaded is reported as broken, with the load error.
+func GetInfo(vmName string) (InstanceInfo, error) {
 	machineConfig, err := qemu.GetMachineConfig(vmName)
 	if err != nil {
-		return "", err
+		if !instanceDirExists(vmName) {
+			return InstanceInfo{}, err
+		}
+		return InstanceInfo{Name: vmName, Status: StatusBroken, Error: err.Error()}, nil
+	}
+
+	network := string(machineConfig.Network)
+	if machineConfig.Network == qemu.NetworkBridged {
+		network += " (" + machineConfig.BridgeInterface + ")"
+	}
+	if machineConfig.NetworkID != "" {
+		network += " (" + machineConfig.NetworkID + ")"
+	}
+
+	info := InstanceInfo{
+		Name:          machineConfig.Alias,
+		IP:            machineConfig.MachineIP,
+		Network:       network,
+		Image:         machineConfig.Image,
+		AlpineRelease: machineConfig.AlpineRelease,
+		Arch:          machineConfig.Arch,
+		Disk:          machineConfig.Disk,
+		Memory:        machineConfig.Memory,
+		CPUs:          machineConfig.CPU,
+		Mount:         machineConfig.Mount,
+		Tags:          machineConfig.Tags,
+		Description:   machineConfig.Description,
+		Labels:        machineConfig.Labels,
+		StaticIP:      machineConfig.StaticIP,
+		Gateway:       machineConfig.Gateway,
+		NetworkConfig: machineConfig.NetworkConfig,
+		RestartPolicy: string(machineConfig.GetRestartPolicy()),
+		SupervisorPID: SupervisorPID(machineConfig),
+		ForwarderPID:  ForwarderPID(machineConfig),
+	}
+	info.DiskPath = machineConfig.DiskPath()
+	info.ImagePath = "(not cached)"
+	if imagePath, err := utils.ImagePath(machineConfig.Image); err == nil {
+		if _, err := os.Stat(imagePath); err == nil {
+			info.ImagePath = imagePath
+		}
+	}
+	info.Config = ConfigMap(machineConfig)
+	info.ConfigFields = ConfigFields(machineConfig)
+
+	// instances launched before creation times were recorded have none
+	if !machineConfig.CreatedAt.IsZero() {
+		info.CreatedAt = machineConfig.CreatedAt.Format(time.RFC3339)
+	}
+	for _, f := range machineConfig.CopyFiles {
+		info.CopiedFiles = append(info.CopiedFiles, f.String())
+	}
+	for _, r := range machineConfig.ReversePorts {
+		info.ReversePorts = append(info.ReversePorts, r.String())
+	}
+
+	// a missing or foreign image only loses the disk figures
+	info.DiskActualBytes, info.DiskVirtualBytes, _ = machineConfig.DiskUsage()
+
+	status, pid := Status(machineConfig)
+	info.Status = status
+	if status == "Stopped" || status == StatusCreated {
+		return info, nil
+	}
+
+	info.PID = pid
+	info.QMPSocket = machineConfig.QMPPath()
+	if stats, err := utils.GetProcessStats(pid); err == nil {
+		info.UptimeSeconds = int64(stats.Elapsed.Seconds())
+		info.MemoryRSSBytes = stats.RSS
+	}
+
+	if machineConfig.UsesVMNet() {
+		// only report a lease that is already known, IPAddress would block until one appears
+		if info.IP == "localhost" || info.IP == "" {
+			info.IP = machineConfig.DiscoverIP()
+		}
+	} else if machineConfig.HasNetwork() {
+		info.PortForwards = []string{machineConfig.SSHPort + "->22/tcp"}
+		ports, err := utils.ParsePort(machineConfig.Port)
+		if err == nil {
+			for _, p := range ports {
+				proto := "tcp"
+				if p.Proto == utils.Udp {
+					proto = "udp"
+				}
+				info.PortForwards = append(info.PortForwards, strconv.Itoa(p.Host)+"->"+strconv.Itoa(p.Guest)+"/"+proto)
+			}
+		}
 	}
 
-	info := fmt.Sprintf("Name: %s\nIP: %s\nImage: %s\nArch: %s\nDisk size: %s\nMemory size: %s\nCPUs: %s\nMount: %s\nTags: %s\n",
-		machineConfig.Alias,
-		machineConfig.MachineIP,
-		machineConfig.Image,
-		machineConfig.Arch,
-		machineConfig.Disk,
-		machineConfig.Memory,
-		machineConfig.CPU,
-		machineConfig.Mount,
-		machineConfig.Tags,
-	)
 	return info, nil
 }
+
+func (info InstanceInfo) String() string {
+	if info.Status == StatusBroken {
+		return "Name: " + info.Name + "\nStatus: broken\nError: " + info.Error +
+			"\nRun `alpine repair " + info.Name + "` to fix the configuration or `alpine delete " + info.Name + "` to remove it.\n"
+	}
+	s := fmt.Sprintf("Name: %s\nStatus: %s\nIP: %s\nNetwork: %s\nImage: %s\nImage path: %s\nDisk path: %s\nArch: %s\nDisk size: %s\nMemory size: %s\nCPUs: %s\nMount: %s\nTags: %s\n",
+		info.Name,
+		strings.ToLower(info.Status),
+		info.IP,
+		info.Network,
+		info.Image,
+		info.ImagePath,
+		info.DiskPath,
+		info.Arch,
+		info.Disk,
+		info.Memory,
+		info.CPUs,
+		info.Mount,
+		info.Tags,
+	)
+
+	if info.AlpineRelease != "" {
+		s += "Alpine release: " + info.AlpineRelease + "\n"
+	}
+	if len(info.Labels) > 0 {
+		labels := []string{}
+		for key, value := range info.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		s += "Labels: " + strings.Join(labels, ", ") + "\n"
+	}
+	if info.Description != "" {
+		s += "Description: " + info.Description + "\n"
+	}
+	if info.CreatedAt != "" {
+		s += "Created: " + info.CreatedAt + "\n"
+	}
+	s += "Restart policy: " + info.RestartPolicy
+	if info.SupervisorPID > 0 {
+		s += " (supervisor " + strconv.Itoa(info.SupervisorPID) + ")"
+	} else if info.RestartPolicy != string(qemu.RestartNo) && info.Status != "Stopped" && info.Status != StatusCreated {
+		s += " (no supervisor running)"
+	}
+	s += "\n"
+	if info.StaticIP != "" {
+		s += "Static IP: " + info.StaticIP
+		if info.Gateway != "" {
+			s += " via " + info.Gateway
+		}
+		s += "\n"
+	}
+	if info.NetworkConfig != "" {
+		s += "Network config: " + info.NetworkConfig + "\n"
+	}
+	if len(info.CopiedFiles) > 0 {
+		s += "Copied files:\n"
+		for _, f := range info.CopiedFiles {
+			s += "  " + f + "\n"
+		}
+	}
+	if len(info.ReversePorts) > 0 {
+		s += "Reverse ports: " + strings.Join(info.ReversePorts, ", ")
+		if info.ForwarderPID > 0 {
+			s += " (forwarder " + strconv.Itoa(info.ForwarderPID) + ")"
+		} else if info.Status == "Running" {
+			s += " (no forwarder running)"
+		}
+		s += "\n"
+	}
+
+	if info.DiskVirtualBytes > 0 {
+		s += "Disk usage: " + utils.FormatBytes(info.DiskActualBytes) + " of " + utils.FormatBytes(info.DiskVirtualBytes) + "\n"
+	}
+	if info.PID > 0 {
+		s += "PID: " + strconv.Itoa(info.PID) + "\n"
+	}
+	if info.QMPSocket != "" {
+		s += "QMP socket: " + info.QMPSocket + "\n"
+	}
+	if info.UptimeSeconds > 0 {
+		s += "Uptime: " + (time.Duration(info.UptimeSeconds) * time.Second).String() + "\n"
+	}
+	if info.MemoryRSSBytes > 0 {
+		s += "Memory used (RSS): " + utils.FormatBytes(info.MemoryRSSBytes) + "\n"
+	}
+	if len(info.PortForwards) > 0 {
+		s += "Port forwards: " + strings.Join(info.PortForwards, ", ") + "\n"
+	}
+	return s
+}
+
+// FullString is String followed by every field of config.yaml
+func (info InstanceInfo) FullString() string {
+	if info.Status == StatusBroken {
+		return info.String()
+	}
+	s := info.String() + "Configuration:\n"
+	width := 0
+	for _, f := range info.ConfigFields {
+		if len(f.Key) > width {
+			width = len(f.Key)
+		}
+	}
+	for _, f := range info.ConfigFields {
+		s += fmt.Sprintf("  %-*s  %s\n", width+1, f.Key+":", f.Value)
+	}
+	return s
+}
+
+// Info returns a human readable description of an instance
+func Info(vmName string) (string, error) {
+	info, err := GetInfo(vmName)
+	if err != nil {
+		return "", err
+	}
+	return info.String(), nil
+}
@@ -1,17 +1,42 @@
 package host
 
 import (
+	"context"
+	"errors"
+	"os"
 	"strconv"
 
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 )
 
 // Launch launches a new VM using user-defined configuration
 func Launch(config qemu.MachineConfig) error {
+	return LaunchWithContext(context.Background(), config)
+}
+
+// LaunchWithContext launches a new VM, giving up when ctx is done before the VM has booted.
+// A cancelled launch kills the spawned qemu process and removes the instance directory.
+func LaunchWithContext(ctx context.Context, config qemu.MachineConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Only parse ports of using qemu's default slirp network
-	if !config.VMNet {
+	if config.UsesVMNet() {
+		if config.Port != "" {
+			return errors.New("port forwarding is not available with " + string(config.Network) +
+				" networking, the instance is reachable directly on its vmnet address. drop --port or use --network user")
+		}
+		if err := checkVMNet(config); err != nil {
+			return err
+		}
+	} else if !config.HasNetwork() {
+		if err := checkNoNetwork(config); err != nil {
+			return err
+		}
+	} else {
 		ports, err := utils.ParsePort(config.Port)
 		if err != nil {
 			return err
@@ -30,12 +55,39 @@ func Launch(config qemu.MachineConfig) error {
 		}
 	}
 
-	err := config.Launch()
+	done := make(chan error, 1)
+	go func() {
+		done <- config.Launch(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// stop the boot as soon as possible, then wait for Launch to notice the cancellation
+		config.Stop()
+		<-done
+		config.Stop()
+		config.CleanPIDFile()
+		os.RemoveAll(config.Location)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.New("launch of " + config.Alias + " timed out, the instance was removed")
+		}
+		return errors.New("launch of " + config.Alias + " cancelled, the instance was removed")
+	}
 	if err != nil {
 		config.Stop()
 		config.CleanPIDFile()
 		return err
 	}
 
+	// an instance created with --no-start has no address yet
+	if config.FirstBoot {
+		return nil
+	}
+	if err := UpdateHosts(config); err != nil {
+		log.Errorln(err)
+	}
+
 	return nil
 }
@@ -0,0 +1,91 @@
+package host
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+// WriteMetrics writes the state of every instance in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) error {
+	up := &metric{name: "macpine_instance_up", help: "Whether the instance is running.", kind: "gauge"}
+	cpu := &metric{name: "macpine_instance_cpu_seconds_total", help: "CPU time consumed by the instance qemu process.", kind: "counter"}
+	rss := &metric{name: "macpine_instance_memory_rss_bytes", help: "Resident memory of the instance qemu process.", kind: "gauge"}
+	disk := &metric{name: "macpine_instance_disk_bytes", help: "Size of the instance disk, allocated (virtual) or actually used on the host.", kind: "gauge"}
+	status := &metric{name: "macpine_instance_status", help: "The status of the instance, 1 for the current one.", kind: "gauge"}
+	uptime := &metric{name: "macpine_instance_uptime_seconds", help: "Time since the instance qemu process started.", kind: "gauge"}
+	cpus := &metric{name: "macpine_instance_cpus", help: "CPUs allocated to the instance.", kind: "gauge"}
+	memory := &metric{name: "macpine_instance_memory_bytes", help: "Memory allocated to the instance.", kind: "gauge"}
+
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		labels := `instance="` + escapeLabel(vmName) + `",tags="` + escapeLabel(strings.Join(machineConfig.Tags, ",")) + `"`
+
+		if n, err := strconv.ParseFloat(machineConfig.CPU, 64); err == nil {
+			cpus.add(labels, n)
+		}
+		if mb, err := strconv.ParseFloat(machineConfig.Memory, 64); err == nil {
+			memory.add(labels, mb*1024*1024)
+		}
+
+		actual, virtual, err := machineConfig.DiskUsage()
+		if err == nil {
+			disk.add(labels+`,type="allocated"`, float64(virtual))
+			disk.add(labels+`,type="actual"`, float64(actual))
+		}
+
+		current, pid := machineConfig.Status()
+		for _, s := range []string{"Running", "Paused", "Stopped"} {
+			value := 0.0
+			if s == current {
+				value = 1
+			}
+			status.add(labels+`,status="`+strings.ToLower(s)+`"`, value)
+		}
+
+		stats, err := utils.GetProcessStats(pid)
+		if current == "Stopped" || err != nil {
+			up.add(labels, 0)
+			continue
+		}
+		up.add(labels, 1)
+		uptime.add(labels, stats.Elapsed.Seconds())
+		cpu.add(labels, stats.CPUTime.Seconds())
+		rss.add(labels, float64(stats.RSS))
+	}
+
+	for _, m := range []*metric{up, status, uptime, cpus, memory, cpu, rss, disk} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, s := range m.samples {
+			if _, err := fmt.Fprintln(w, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *metric) add(labels string, value float64) {
+	m.samples = append(m.samples, fmt.Sprintf("%s{%s} %g", m.name, labels, value))
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
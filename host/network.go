@@ -0,0 +1,81 @@
+package host
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// UsedMACAddresses maps the MAC address of every instance, in canonical form, to the instance name
+func UsedMACAddresses() map[string]string {
+	used := map[string]string{}
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		if hw, err := net.ParseMAC(machineConfig.MACAddress); err == nil {
+			used[hw.String()] = vmName
+		}
+	}
+	return used
+}
+
+// InstanceWithMAC returns the name of the instance configured with the MAC address, or "" if there is none
+func InstanceWithMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+	return UsedMACAddresses()[hw.String()]
+}
+
+// checkNoNetwork rejects launch options that need a network on an instance without one
+func checkNoNetwork(config qemu.MachineConfig) error {
+	var option string
+	switch {
+	case config.Port != "":
+		option = "--port"
+	case len(config.Provision) > 0:
+		option = "--provision"
+	case len(config.CopyFiles) > 0:
+		option = "--copy-file"
+	case config.WriteHosts:
+		option = "--write-hosts"
+	default:
+		return nil
+	}
+	return errors.New(option + " is not available with --network none, the instance has no network to reach it on")
+}
+
+// checkVMNet verifies that the vmnet framework can be used for the instance network
+func checkVMNet(config qemu.MachineConfig) error {
+	netdev := strings.Split(config.NetDev(), ",")[0]
+
+	if config.Network == qemu.NetworkBridged {
+		if config.BridgeInterface == "" {
+			return errors.New("bridged networking requires a host interface, set one with --bridge-interface")
+		}
+		if _, err := net.InterfaceByName(config.BridgeInterface); err != nil {
+			return errors.New("bridge interface " + config.BridgeInterface + " not found on host: " + err.Error())
+		}
+	}
+
+	qemuCmd := "qemu-system-" + config.Arch
+	out, err := exec.Command(qemuCmd, "-netdev", "help").Output()
+	if err == nil && !strings.Contains(string(out), netdev) {
+		return errors.New(qemuCmd + " was built without " + netdev + " support, upgrade to qemu 7.1 or newer")
+	}
+
+	// vmnet requires root or the com.apple.vm.networking entitlement, qemu is started through sudo
+	if os.Geteuid() != 0 && exec.Command("sudo", "-n", "true").Run() != nil {
+		return errors.New(netdev + " networking requires root privileges to access the vmnet framework. " +
+			"run `sudo -v` before this command, run it with sudo, or allow passwordless sudo for " + qemuCmd)
+	}
+
+	return nil
+}
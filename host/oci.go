@@ -0,0 +1,190 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/oci"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// pulledSuffix matches the suffix PullOCI adds to the version of a pulled image
+var pulledSuffix = regexp.MustCompile(`_oci-[0-9a-f]{12}$`)
+
+// PublishOCI pushes the disk and a sanitized config.yaml of a stopped instance to a registry as an
+// OCI artifact, with the docker credentials of the registry, and returns the digest of its manifest
+func PublishOCI(ctx context.Context, config qemu.MachineConfig, reference string) (string, error) {
+	ref, err := oci.ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", errors.New("cannot publish to a digest, use a tag such as " + ref.Registry + "/" + ref.Repository + ":latest")
+	}
+	// the instance cannot be started while its disk is compressed and uploaded
+	lock, err := config.Lock()
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if status, _ := Status(config); status != "Stopped" && status != StatusCreated {
+		return "", errors.New(config.Alias + " is " + strings.ToLower(status) + ", stop it before publishing to a registry")
+	}
+	if config.GetDiskFormat() == qemu.DiskFormatRaw {
+		return "", errors.New("instances with raw disks cannot be published to a registry")
+	}
+
+	log.Println("compressing disk of " + config.Alias + "...")
+	if err := config.CompressQemuDiskImage(); err != nil {
+		return "", errors.New("unable to compress disk: " + err.Error())
+	}
+
+	stage, err := os.MkdirTemp("", "macpine-publish-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stage)
+	configPath := filepath.Join(stage, "config.yaml")
+	data, err := yaml.Marshal(publishedConfig(config))
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(configPath, data, 0644); err != nil {
+		return "", err
+	}
+
+	log.Println("pushing " + config.Alias + " to " + ref.String() + "...")
+	files := []oci.File{
+		{Path: configPath, MediaType: oci.ConfigMediaType},
+		{Path: config.DiskPath(), MediaType: oci.DiskMediaType},
+	}
+	annotations := map[string]string{
+		"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+		oci.TitleAnnotation:                config.Alias,
+	}
+	return oci.NewClient(ref).Push(ctx, files, annotations)
+}
+
+// publishedConfig returns what an instance launched from the published disk needs of its config.
+// Credentials, addresses, host paths and scripts stay on the host of the publisher: guest passwords
+// are reset to the defaults of launch. The TPM state is not published either.
+func publishedConfig(config qemu.MachineConfig) qemu.MachineConfig {
+	return qemu.MachineConfig{
+		ConfigVersion: config.ConfigVersion,
+		Image:         config.Image,
+		Arch:          config.Arch,
+		CPU:           config.CPU,
+		Memory:        config.Memory,
+		Disk:          config.Disk,
+		DiskInterface: config.DiskInterface,
+		SSHUser:       config.SSHUser,
+		RootUsername:  config.RootUsername,
+		Balloon:       config.Balloon,
+		GuestAgent:    config.GuestAgent,
+		Tags:          config.Tags,
+	}
+}
+
+// PullOCI pulls an instance published with PublishOCI into the image cache and returns the name of
+// the cached image and the published config. Blobs are verified against their digest and kept under
+// cache/oci by digest, so pulling an image again only fetches what changed.
+func PullOCI(ctx context.Context, reference string) (string, qemu.MachineConfig, error) {
+	var published qemu.MachineConfig
+
+	ref, err := oci.ParseReference(reference)
+	if err != nil {
+		return "", published, err
+	}
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", published, err
+	}
+	blobDir := filepath.Join(dataDir, "cache", "oci", "sha256")
+	if err := os.MkdirAll(blobDir, os.ModePerm); err != nil {
+		return "", published, err
+	}
+
+	client := oci.NewClient(ref)
+	manifest, digest, err := client.Manifest(ctx)
+	if err != nil {
+		return "", published, err
+	}
+	if manifest.ArtifactType != oci.ArtifactType {
+		return "", published, errors.New(ref.String() + " is not an instance published by alpine publish")
+	}
+	log.Debugln("pulling " + ref.String() + "@" + digest)
+
+	blobs := map[string]string{}
+	for _, mediaType := range []string{oci.ConfigMediaType, oci.DiskMediaType} {
+		layer, ok := manifest.Layer(mediaType)
+		if !ok {
+			return "", published, errors.New(ref.String() + " has no " + mediaType + " layer")
+		}
+		hexDigest, err := layer.Hex()
+		if err != nil {
+			return "", published, err
+		}
+		path := filepath.Join(blobDir, hexDigest)
+		// blobs are only renamed into the cache once verified
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			log.Println("pulling " + layer.Annotations[oci.TitleAnnotation] + " (" + utils.FormatBytes(uint64(layer.Size)) + ")...")
+			if err := client.FetchBlob(ctx, layer, path); err != nil {
+				return "", published, err
+			}
+		} else if err != nil {
+			return "", published, err
+		}
+		blobs[mediaType] = path
+	}
+
+	data, err := os.ReadFile(blobs[oci.ConfigMediaType])
+	if err != nil {
+		return "", published, err
+	}
+	if err := yaml.Unmarshal(data, &published); err != nil {
+		return "", published, errors.New("invalid config.yaml in " + ref.String() + ": " + err.Error())
+	}
+	if published.Arch != "aarch64" && published.Arch != "x86_64" {
+		return "", published, errors.New("unsupported arch " + published.Arch + " in " + ref.String())
+	}
+	if published.Image == "" {
+		return "", published, errors.New("config.yaml in " + ref.String() + " names no image")
+	}
+
+	// the image keeps the version it was launched from, which decides how the guest is set up
+	diskHex := filepath.Base(blobs[oci.DiskMediaType])
+	version := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(published.Image), ".qcow2"), "-"+published.Arch)
+	version = pulledSuffix.ReplaceAllString(version, "")
+	image := version + "_oci-" + diskHex[:12] + "-" + published.Arch + ".qcow2"
+
+	imagePath, err := utils.ImagePath(image)
+	if err != nil {
+		return "", published, err
+	}
+	if _, err := os.Stat(imagePath); errors.Is(err, os.ErrNotExist) {
+		if err := os.Link(blobs[oci.DiskMediaType], imagePath); err != nil {
+			if _, err := utils.CopyFile(blobs[oci.DiskMediaType], imagePath+".part"); err != nil {
+				os.Remove(imagePath + ".part")
+				return "", published, err
+			}
+			if err := os.Rename(imagePath+".part", imagePath); err != nil {
+				return "", published, err
+			}
+		}
+	}
+	return image, published, nil
+}
+
+// IsPulledImage reports whether an image version, e.g. alpine_3.20.3_oci-0123456789ab, names an
+// image pulled by PullOCI
+func IsPulledImage(version string) bool {
+	return pulledSuffix.MatchString(version)
+}
@@ -0,0 +1,15 @@
+package host
+
+import (
+	"github.com/beringresearch/macpine/qemu"
+)
+
+// Provision runs provisioning scripts as root inside a running VM
+func Provision(config qemu.MachineConfig, scripts []string, ignoreErrors bool) error {
+	return config.RunProvision(scripts, ignoreErrors)
+}
+
+// InjectFiles copies the files given with --copy-file into a running VM
+func InjectFiles(config qemu.MachineConfig) error {
+	return config.InjectFiles()
+}
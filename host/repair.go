@@ -0,0 +1,148 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"gopkg.in/yaml.v3"
+)
+
+// Repair rewrites the configuration of an instance, salvaging what can be read and deriving the name
+// and location from the instance directory. It returns a description of every change made.
+func Repair(vmName string) ([]string, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+	location := filepath.Join(dataDir, vmName)
+
+	lock, err := qemu.LockInstance(vmName, location)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	configPath := filepath.Join(location, "config.yaml")
+	raw, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.New("unable to read " + configPath + ": " + err.Error() + ". remove the instance with `alpine delete " + vmName + "`")
+	}
+
+	changes := []string{}
+	machineConfig := qemu.MachineConfig{}
+	err = yaml.Unmarshal(raw, &machineConfig)
+	machineConfig.SetLock(lock)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, e := range typeErr.Errors {
+			changes = append(changes, "dropped invalid value: "+e)
+		}
+	} else if err != nil {
+		return nil, errors.New(configPath + " is not valid YAML and has to be fixed by hand: " + err.Error())
+	}
+
+	if machineConfig.ConfigVersion > qemu.CurrentConfigVersion {
+		return nil, errors.New("configuration of " + vmName + " was written by a newer macpine, please upgrade macpine")
+	}
+
+	if machineConfig.Alias != vmName {
+		changes = append(changes, "alias "+machineConfig.Alias+" -> "+vmName)
+		machineConfig.Alias = vmName
+	}
+	if machineConfig.Location != location {
+		changes = append(changes, "location "+machineConfig.Location+" -> "+location)
+		machineConfig.Location = location
+	}
+	if machineConfig.Image == "" {
+		return nil, errors.New("configuration of " + vmName + " does not name its disk image, it cannot be repaired")
+	}
+	if _, err := os.Stat(machineConfig.DiskPath()); err != nil {
+		return nil, errors.New("disk image of " + vmName + " is missing: " + err.Error())
+	}
+
+	if len(changes) == 0 {
+		changes = append(changes, "rewrote config.yaml")
+	}
+	if err := qemu.SaveMachineConfig(machineConfig); err != nil {
+		return nil, err
+	}
+
+	// loading migrates a configuration of an older release in memory only, store the result
+	migrated, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return nil, err
+	}
+	migrated.SetLock(lock)
+	if err := qemu.SaveMachineConfig(migrated); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// RemoveBroken deletes the directory of an instance whose configuration cannot be read. It refuses
+// while a qemu process still runs a disk of the instance, KillInstanceProcesses stops them.
+func RemoveBroken(vmName string) error {
+	dataDir, err := DataDir()
+	if err != nil {
+		return err
+	}
+	location := filepath.Join(dataDir, vmName)
+
+	lock, err := qemu.LockInstance(vmName, location)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// without a configuration the pidfile cannot be trusted, look for qemu by its disk instead
+	if err := checkNoProcesses(vmName); err != nil {
+		return err
+	}
+	if err := DisableAutostart(vmName); err != nil {
+		log.Errorln(err)
+	}
+	return os.RemoveAll(location)
+}
+
+// checkNoProcesses fails while a qemu process runs a disk of an instance, which must not be deleted
+// from under it
+func checkNoProcesses(vmName string) error {
+	processes, err := InstanceProcesses(vmName)
+	if err != nil {
+		return err
+	}
+	if len(processes) > 0 {
+		return errors.New("qemu process " + strconv.Itoa(processes[0].PID) + " is still running " + processes[0].Disk +
+			", not deleting " + vmName + ". stop it with `alpine delete --force " + vmName + "`")
+	}
+	return nil
+}
+
+// KillInstanceProcesses kills the qemu processes running a disk of an instance that its pidfile
+// does not lead to, as with a broken instance, and waits for them to exit
+func KillInstanceProcesses(vmName string) error {
+	processes, err := InstanceProcesses(vmName)
+	if err != nil {
+		return err
+	}
+	for _, p := range processes {
+		if err := KillOrphan(p); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 20 && len(processes) > 0; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if processes, err = InstanceProcesses(vmName); err != nil {
+			return err
+		}
+	}
+	if len(processes) > 0 {
+		return errors.New("qemu process " + strconv.Itoa(processes[0].PID) + " of " + vmName + " is still running")
+	}
+	return nil
+}
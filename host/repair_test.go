@@ -0,0 +1,46 @@
+package host
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/beringresearch/macpine/qemu"
+)
+
+func TestRepairMigratesConfig(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(DataDirEnv, dataDir)
+	location := filepath.Join(dataDir, "old")
+	if err := os.Mkdir(location, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a configuration of a release before configversion, copied from another data directory
+	config := "alias: old\nimage: alpine_3.16.0-aarch64.qcow2\ncpu: \"4\"\nmemory: \"2048\"\ndisk: 10G\n" +
+		"machineip: localhost\nsshport: \"2022\"\nsshpassword: root\nlocation: /Users/someone/.macpine/old\n"
+	if err := os.WriteFile(filepath.Join(location, "config.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(location, "alpine_3.16.0-aarch64.qcow2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Repair("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(location, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repaired, err := qemu.ParseMachineConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired.ConfigVersion != qemu.CurrentConfigVersion {
+		t.Errorf("repaired config.yaml has configversion %d, want %d", repaired.ConfigVersion, qemu.CurrentConfigVersion)
+	}
+	if repaired.Location != location || repaired.Arch != "aarch64" {
+		t.Errorf("repaired config.yaml has location %s and arch %s, want %s and aarch64", repaired.Location, repaired.Arch, location)
+	}
+}
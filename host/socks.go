@@ -0,0 +1,98 @@
+package host
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 (RFC 1928) constants of the subset served by tunnels: no authentication and CONNECT
+const (
+	socksVersion          = 5
+	socksNoAuth           = 0
+	socksNoAcceptable     = 0xff
+	socksConnect          = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+	socksSucceeded        = 0
+	socksFailure          = 1
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+)
+
+// socksHandshake negotiates a SOCKS5 CONNECT on conn and returns the requested address. Domain
+// names are returned unresolved, so that they are resolved by the instance.
+func socksHandshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])) + ", only SOCKS5 is supported")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == socksNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("SOCKS client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return "", errors.New("unsupported SOCKS command " + strconv.Itoa(int(request[1])))
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", errors.New("unsupported SOCKS address type " + strconv.Itoa(int(request[3])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socksReply answers a SOCKS5 request. The bound address is not meaningful through SSH and is
+// reported as 0.0.0.0:0.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
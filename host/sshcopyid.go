@@ -0,0 +1,83 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// CopySSHID authorizes an SSH public key, the one at path or the default key of the user, for the SSH
+// user of a running instance, logging in with its stored credentials, then checks that the key logs
+// in. It returns the key and the file it was read from.
+func CopySSHID(config qemu.MachineConfig, path string) (string, string, error) {
+	if status, _ := Status(config); status != "Running" {
+		return "", "", errors.New(config.Alias + " is not running, start it first")
+	}
+	if !config.HasNetwork() {
+		return "", "", errors.New(config.Alias + " has no network, keys are only used over ssh")
+	}
+
+	key, path, err := readPublicKey(path)
+	if err != nil {
+		return "", "", err
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+		return "", "", errors.New(path + " is not an SSH public key: " + err.Error())
+	}
+	if err := config.AuthorizeKey(key); err != nil {
+		return "", "", err
+	}
+
+	// ssh offers the private key next to the public one, or the matching key of ssh-agent
+	identity := path
+	if private := strings.TrimSuffix(path, ".pub"); private != path {
+		if _, err := os.Stat(private); err == nil {
+			identity = private
+		}
+	}
+	if err := config.CheckKeyLogin(identity); err != nil {
+		return "", "", errors.New(err.Error() + ". keys with a passphrase must be added to ssh-agent with ssh-add")
+	}
+	return key, path, nil
+}
+
+// UseSSHAgent switches the credentials macpine logs into an instance with to ssh-agent, provided the
+// agent holds key. Root operations use the agent as well when the SSH user is root.
+func UseSSHAgent(config *qemu.MachineConfig, key string) error {
+	want, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return err
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return errors.New("ssh-agent is not running, SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.New("failed to open SSH_AUTH_SOCK: " + err.Error())
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return errors.New("unable to list the keys of ssh-agent: " + err.Error())
+	}
+
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), want.Marshal()) {
+			cred := utils.EncodeCredential(utils.SSHScheme, config.Alias)
+			config.SSHPassword = cred
+			if config.SSHUser == "root" {
+				config.RootPassword = &cred
+			}
+			return nil
+		}
+	}
+	return errors.New("ssh-agent does not hold the key, add it with ssh-add before switching to key authentication")
+}
@@ -1,16 +1,20 @@
 package host
 
 import (
-	"log"
+	"context"
+	"errors"
 	"strconv"
 	"strings"
+	"sync"
 
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 	"github.com/beringresearch/macpine/utils"
 )
 
-// Start launches a new VM using user-defined configuration
-func Start(config qemu.MachineConfig) error {
+// Start launches a new VM using user-defined configuration. Cancelling ctx stops the first boot of an
+// instance created with --no-start from waiting for the guest.
+func Start(ctx context.Context, config qemu.MachineConfig) error {
 
 	status, _ := config.Status()
 	if status == "Running" {
@@ -19,18 +23,19 @@ func Start(config qemu.MachineConfig) error {
 	}
 
 	// Only parse ports of using qemu's default slirp network
-	if !config.VMNet {
-		ports, err := utils.ParsePort(config.Port)
-		if err != nil {
+	if config.UsesVMNet() {
+		if config.Port != "" {
+			log.Println("ignoring port forwards for " + config.Alias + ", not available with " + string(config.Network) + " networking")
+		}
+		if err := checkVMNet(config); err != nil {
 			return err
 		}
-		hostports := make([]string, len(ports))
-		for i, p := range ports {
-			hostports[i] = strconv.Itoa(p.Host)
+	} else if config.HasNetwork() {
+		ports, err := HostPorts(config)
+		if err != nil {
+			return err
 		}
-		allPorts := append([]string{config.SSHPort}, hostports...)
-
-		for _, p := range allPorts {
+		for _, p := range ports {
 			if strings.Contains(p, ":") {
 				p = strings.Split(p, ":")[0]
 			}
@@ -41,5 +46,99 @@ func Start(config qemu.MachineConfig) error {
 		}
 	}
 
-	return config.Start()
+	if err := RunHooks(config, qemu.HookPreStart); err != nil {
+		return err
+	}
+
+	// an instance created with --no-start is set up on its first boot as a launch would have
+	firstBoot := config.FirstBoot
+	start := config.Start
+	if firstBoot {
+		log.Println("first boot of " + config.Alias)
+		start = func() error { return config.Boot(ctx) }
+	}
+
+	err := start()
+	if err != nil {
+		// let the poststop hooks undo what the prestart hooks set up
+		config.Stop()
+		if err := RunHooks(config, qemu.HookPostStop); err != nil {
+			log.Errorln(err)
+		}
+		return err
+	}
+
+	if err := UpdateHosts(config); err != nil {
+		log.Errorln(err)
+	}
+	if firstBoot {
+		provisionFirstBoot(config)
+	}
+	if err := RunHooks(config, qemu.HookPostStart); err != nil {
+		log.Errorln(err)
+	}
+	return nil
+}
+
+// HostPorts returns the localhost ports an instance forwards, its SSH port first. Instances on vmnet or
+// without network forward none.
+func HostPorts(config qemu.MachineConfig) ([]string, error) {
+	if config.UsesVMNet() || !config.HasNetwork() {
+		return nil, nil
+	}
+	ports, err := utils.ParsePort(config.Port)
+	if err != nil {
+		return nil, err
+	}
+	hostports := []string{config.SSHPort}
+	for _, p := range ports {
+		hostports = append(hostports, strconv.Itoa(p.Host))
+	}
+	return hostports, nil
+}
+
+// PortClaims records the host ports of instances started together, so that two of them forwarding
+// the same port are told apart before either binds it, whichever starts first
+type PortClaims struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+// Claim reserves the host ports of an instance, or returns an error naming the instance that holds one
+func (p *PortClaims) Claim(config qemu.MachineConfig) error {
+	ports, err := HostPorts(config)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.owners == nil {
+		p.owners = make(map[string]string)
+	}
+	for _, port := range ports {
+		if owner, ok := p.owners[port]; ok && owner != config.Alias {
+			return errors.New("port " + port + " of " + config.Alias + " is also forwarded by " + owner)
+		}
+	}
+	for _, port := range ports {
+		p.owners[port] = config.Alias
+	}
+	return nil
+}
+
+// provisionFirstBoot copies the --copy-file files and runs the provisioning scripts of an instance
+// created with --no-start. Failures leave the instance running for debugging, as with a launch.
+func provisionFirstBoot(config qemu.MachineConfig) {
+	// cloud-init writes the files itself
+	if len(config.CopyFiles) > 0 && config.CloudInit == "" {
+		if err := InjectFiles(config); err != nil {
+			log.Errorln(err.Error() + ". " + config.Alias + " is left running for debugging")
+			return
+		}
+	}
+	if len(config.Provision) > 0 {
+		if err := Provision(config, config.Provision, false); err != nil {
+			log.Errorln(err.Error() + ". " + config.Alias + " is left running for debugging")
+		}
+	}
 }
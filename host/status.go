@@ -6,5 +6,9 @@ import (
 
 // Status launches a new VM using user-defined configuration
 func Status(config qemu.MachineConfig) (string, int) {
-	return config.Status() // status, pid
+	status, pid := config.Status()
+	if status == "Stopped" && config.FirstBoot {
+		return StatusCreated, 0
+	}
+	return status, pid
 }
@@ -1,10 +1,66 @@
 package host
 
 import (
+	"context"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/qemu"
 )
 
 // Stop launches a new VM using user-defined configuration
 func Stop(config qemu.MachineConfig) error {
-	return config.Stop()
+	return stop(config, config.Stop)
+}
+
+// Shutdown powers the guest off over SSH and waits for qemu to exit, killing it once ctx is done
+func Shutdown(ctx context.Context, config qemu.MachineConfig) error {
+	return stop(config, func() error {
+		// the connection drops as the guest goes down, so the result of poweroff says nothing
+		config.Run(ctx, "poweroff", true, nil, nil, nil)
+		for {
+			if status, _ := config.Status(); status == "Stopped" {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return config.Stop()
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+		// clean up what qemu leaves behind, such as gvproxy
+		return config.Stop()
+	})
+}
+
+// stop runs halt between the prestop and poststop hooks of a running instance
+func stop(config qemu.MachineConfig, halt func() error) error {
+	// the supervisor goes first, otherwise it would restart the instance it sees dying
+	if err := StopSupervisor(config); err != nil {
+		return err
+	}
+	if err := StopForwarder(config); err != nil {
+		log.Errorln(err)
+	}
+	if err := StopTunnels(config); err != nil {
+		log.Errorln(err)
+	}
+	if err := StopClockWatcher(config); err != nil {
+		log.Errorln(err)
+	}
+
+	status, _ := config.Status()
+	running := status != "Stopped"
+	if running {
+		if err := RunHooks(config, qemu.HookPreStop); err != nil {
+			log.Errorln(err)
+		}
+	}
+	err := halt()
+	if running {
+		if err := RunHooks(config, qemu.HookPostStop); err != nil {
+			log.Errorln(err)
+		}
+	}
+	return err
 }
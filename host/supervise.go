@@ -0,0 +1,234 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+)
+
+const (
+	supervisorPollInterval = 2 * time.Second
+	supervisorMaxBackoff   = 5 * time.Minute
+	// an instance that stayed up this long is considered healthy again and gets a fresh retry budget
+	supervisorStableAfter = 10 * time.Minute
+)
+
+func supervisorPIDFile(config qemu.MachineConfig) string {
+	return filepath.Join(config.Location, "supervisor.pid")
+}
+
+// SupervisorPID returns the PID of the supervisor of an instance, or 0 if none is running
+func SupervisorPID(config qemu.MachineConfig) int {
+	return backgroundPID(supervisorPIDFile(config))
+}
+
+// backgroundPID returns the PID recorded in the pidfile of a background process, or 0 if it is not running
+func backgroundPID(pidFile string) int {
+	out, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
+
+// processAlive reports whether a process exists, including processes of other users such as qemu under sudo
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// StartSupervisor forks a background `alpine supervise` process for instances with a restart policy
+func StartSupervisor(config qemu.MachineConfig) error {
+	if config.GetRestartPolicy() == qemu.RestartNo || SupervisorPID(config) > 0 {
+		return nil
+	}
+	cmd, err := startBackground("supervisor", filepath.Join(config.Location, "supervisor.log"), "supervise", config.Alias)
+	if err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// startBackground forks `alpine <args>`, logging to logPath. The caller waits for or releases the process.
+func startBackground(name string, logPath string, args ...string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.New("unable to start " + name + ": " + err.Error())
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.New("unable to start " + name + ": " + err.Error())
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// detach from the terminal so the process outlives the shell that ran alpine start
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.New("unable to start " + name + ": " + err.Error())
+	}
+	return cmd, nil
+}
+
+// StopSupervisor terminates the supervisor of an instance, so that an intentional stop is not undone
+func StopSupervisor(config qemu.MachineConfig) error {
+	return stopBackground(config, supervisorPIDFile(config), "supervisor")
+}
+
+// stopBackground terminates the background process recorded in pidFile and waits for it to exit
+func stopBackground(config qemu.MachineConfig, pidFile string, name string) error {
+	pid := backgroundPID(pidFile)
+	if pid == 0 {
+		os.Remove(pidFile)
+		return nil
+	}
+	if err := terminateProcess(pid, name+" of "+config.Alias); err != nil {
+		return err
+	}
+	os.Remove(pidFile)
+	return nil
+}
+
+// terminateProcess sends SIGTERM to a process and waits up to 5 seconds for it to exit
+func terminateProcess(pid int, name string) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return errors.New("unable to stop " + name + ": " + err.Error())
+	}
+	for i := 0; i < 50 && processAlive(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		return errors.New(name + " (" + strconv.Itoa(pid) + ") did not exit")
+	}
+	return nil
+}
+
+// Supervise watches the qemu process of an instance and restarts it according to its restart
+// policy, with exponential backoff. It returns when the policy no longer asks for a restart,
+// the retry budget is spent, or the supervisor is terminated by StopSupervisor.
+func Supervise(vmName string) error {
+	config, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(supervisorPIDFile(config), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(supervisorPIDFile(config))
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(terminate)
+
+	supervisorLog(config, "supervising "+vmName+" with restart policy "+string(config.GetRestartPolicy()))
+
+	attempts := 0
+	restartFailed := false
+	upSince := time.Now()
+	for {
+		select {
+		case <-terminate:
+			supervisorLog(config, "supervisor of "+vmName+" stopped")
+			return nil
+		case <-time.After(supervisorPollInterval):
+		}
+
+		// pick up policy changes made with alpine set while supervised
+		config, err = qemu.GetMachineConfig(vmName)
+		if err != nil {
+			return err
+		}
+
+		leftPIDFile := config.HasPIDFile()
+		status, pid := config.Status()
+		if status != "Stopped" && processAlive(pid) {
+			if attempts > 0 && time.Since(upSince) > supervisorStableAfter {
+				attempts = 0
+			}
+			continue
+		}
+
+		// qemu removes its pidfile on a clean exit, a pidfile left behind means it died
+		crashed := leftPIDFile || restartFailed
+		policy := config.GetRestartPolicy()
+		if policy == qemu.RestartNo || (policy == qemu.RestartOnFailure && !crashed) {
+			supervisorLog(config, vmName+" exited, not restarting with restart policy "+string(policy))
+			return nil
+		}
+
+		if attempts >= config.GetMaxRestarts() {
+			supervisorLog(config, "giving up on "+vmName+" after "+strconv.Itoa(attempts)+" restarts")
+			return errors.New("restart limit reached for " + vmName)
+		}
+
+		backoff := time.Second << attempts
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+		attempts++
+		reason := "was shut down"
+		if crashed {
+			reason = "died unexpectedly"
+		}
+		supervisorLog(config, vmName+" "+reason+", restarting in "+backoff.String()+
+			" (attempt "+strconv.Itoa(attempts)+"/"+strconv.Itoa(config.GetMaxRestarts())+")")
+
+		select {
+		case <-terminate:
+			supervisorLog(config, "supervisor of "+vmName+" stopped")
+			return nil
+		case <-time.After(backoff):
+		}
+
+		lock, err := config.Lock()
+		if err != nil {
+			supervisorLog(config, "unable to restart "+vmName+": "+err.Error())
+			restartFailed = true
+			continue
+		}
+		config.CleanRuntimeFiles()
+		err = Start(context.Background(), config)
+		lock.Unlock()
+		if err != nil {
+			supervisorLog(config, "unable to restart "+vmName+": "+err.Error())
+			restartFailed = true
+			continue
+		}
+		restartFailed = false
+		upSince = time.Now()
+		supervisorLog(config, vmName+" restarted by supervisor (attempt "+strconv.Itoa(attempts)+")")
+	}
+}
+
+// supervisorLog records supervisor activity in its own log and, when writable, in the instance log
+func supervisorLog(config qemu.MachineConfig, message string) {
+	log.Println(message)
+
+	f, err := os.OpenFile(filepath.Join(config.Location, "alpine.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(time.Now().Format(time.RFC3339) + " macpine supervisor: " + message + "\n")
+}
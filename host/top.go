@@ -0,0 +1,142 @@
+package host
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// InstanceSample is a point-in-time resource sample of a running instance's qemu process
+type InstanceSample struct {
+	Name           string  `json:"name"`
+	PID            int     `json:"pid"`
+	CPUPercent     float64 `json:"cpuPercent"`
+	MemoryRSSBytes uint64  `json:"memoryRSSBytes"`
+	DiskBytes      uint64  `json:"diskBytes"`
+
+	cpuTime   time.Duration
+	sampledAt time.Time
+}
+
+// SampleInstances samples every running instance. CPU usage is measured against the previous
+// sample of the same process when there is one, otherwise the estimate reported by ps is used.
+// Instances that are stopped, or stop while being sampled, are left out.
+func SampleInstances(previous []InstanceSample) []InstanceSample {
+	last := make(map[string]InstanceSample, len(previous))
+	for _, s := range previous {
+		last[s.Name] = s
+	}
+
+	samples := []InstanceSample{}
+	for _, vmName := range ListVMNames() {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			continue
+		}
+		status, pid := machineConfig.Status()
+		if status == "Stopped" {
+			continue
+		}
+		stats, err := utils.GetProcessStats(pid)
+		if err != nil {
+			continue
+		}
+
+		sample := InstanceSample{
+			Name:           vmName,
+			PID:            pid,
+			CPUPercent:     stats.CPUPercent,
+			MemoryRSSBytes: stats.RSS,
+			cpuTime:        stats.CPUTime,
+			sampledAt:      time.Now(),
+		}
+		if prev, ok := last[vmName]; ok && prev.PID == pid {
+			if wall := sample.sampledAt.Sub(prev.sampledAt); wall > 0 {
+				sample.CPUPercent = 100 * float64(sample.cpuTime-prev.cpuTime) / float64(wall)
+			}
+		}
+		sample.DiskBytes, _, _ = machineConfig.DiskUsage()
+
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// GuestSample is a point-in-time view of resource usage inside a running instance
+type GuestSample struct {
+	Name                 string     `json:"name"`
+	UptimeSeconds        int64      `json:"uptimeSeconds"`
+	Load                 [3]float64 `json:"load"`
+	MemoryTotalBytes     uint64     `json:"memoryTotalBytes"`
+	MemoryAvailableBytes uint64     `json:"memoryAvailableBytes"`
+	DiskTotalBytes       uint64     `json:"diskTotalBytes"`
+	DiskUsedBytes        uint64     `json:"diskUsedBytes"`
+	// Processes is the process table of top -bn1, its header and the busiest processes, in the
+	// format of the top of the guest
+	Processes []string `json:"processes"`
+}
+
+// guestStatsScript prints, in order, /proc/loadavg, /proc/uptime, the total and available memory,
+// the usage of the root filesystem and, after a separator, the head of the guest's process table.
+// It only relies on /proc and on commands busybox provides as well.
+const guestStatsScript = `cat /proc/loadavg /proc/uptime
+grep -E '^(MemTotal|MemAvailable):' /proc/meminfo
+df -kP / | tail -n 1
+echo ---
+top -bn1 | sed -n '/^ *PID /,$p' | head -n 11`
+
+// SampleGuest collects load, memory, disk and process statistics inside a running instance over SSH
+func SampleGuest(machineConfig qemu.MachineConfig) (GuestSample, error) {
+	sample := GuestSample{Name: machineConfig.Alias}
+
+	out, err := machineConfig.Exec(guestStatsScript, false)
+	if err != nil {
+		return sample, errors.New("unable to collect statistics from " + machineConfig.Alias + ": " + err.Error())
+	}
+	stats, processes, _ := strings.Cut(out, "---\n")
+	lines := strings.Split(strings.TrimSpace(stats), "\n")
+	if len(lines) < 5 {
+		return sample, errors.New("unexpected statistics from " + machineConfig.Alias + ": " + strings.TrimSpace(out))
+	}
+
+	load := strings.Fields(lines[0])
+	for i := 0; i < 3 && i < len(load); i++ {
+		sample.Load[i], _ = strconv.ParseFloat(load[i], 64)
+	}
+	if uptime := strings.Fields(lines[1]); len(uptime) > 0 {
+		if seconds, err := strconv.ParseFloat(uptime[0], 64); err == nil {
+			sample.UptimeSeconds = int64(seconds)
+		}
+	}
+	for _, line := range lines[2:4] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			sample.MemoryTotalBytes = kb << 10
+		case "MemAvailable:":
+			sample.MemoryAvailableBytes = kb << 10
+		}
+	}
+	// Filesystem 1024-blocks Used Available Capacity Mounted-on
+	if df := strings.Fields(lines[4]); len(df) >= 4 {
+		total, _ := strconv.ParseUint(df[1], 10, 64)
+		used, _ := strconv.ParseUint(df[2], 10, 64)
+		sample.DiskTotalBytes, sample.DiskUsedBytes = total<<10, used<<10
+	}
+
+	sample.Processes = []string{}
+	for _, line := range strings.Split(strings.TrimRight(processes, "\n"), "\n") {
+		if line != "" {
+			sample.Processes = append(sample.Processes, line)
+		}
+	}
+	return sample, nil
+}
@@ -0,0 +1,401 @@
+package host
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// tunnelStartTimeout is how long StartTunnel waits for a tunnel process to listen
+const tunnelStartTimeout = 10 * time.Second
+
+// Tunnel is an SSH tunnel through an instance, run by a background `alpine tunnel run` process.
+// SOCKS tunnels have no target, the SOCKS client names the address of every connection.
+type Tunnel struct {
+	Instance  string    `yaml:"instance" json:"instance"`
+	Listen    string    `yaml:"listen" json:"listen"`
+	Target    string    `yaml:"target,omitempty" json:"target,omitempty"`
+	PID       int       `yaml:"pid" json:"pid"`
+	StartedAt time.Time `yaml:"startedat" json:"startedAt"`
+}
+
+// Kind returns socks or local, after the ssh options -D and -L
+func (t Tunnel) Kind() string {
+	if t.Target == "" {
+		return "socks"
+	}
+	return "local"
+}
+
+// Port returns the host port the tunnel listens on, which identifies it
+func (t Tunnel) Port() string {
+	_, port, _ := net.SplitHostPort(t.Listen)
+	return port
+}
+
+func (t Tunnel) String() string {
+	if t.Target == "" {
+		return t.Listen + " (socks)"
+	}
+	return t.Listen + " -> " + t.Target
+}
+
+// ParseSOCKSTunnel parses a [bind_address:]port specification, as ssh -D
+func ParseSOCKSTunnel(spec string) (Tunnel, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 {
+		return Tunnel{}, errors.New("invalid --socks " + spec + ", expected [bind_address:]port, e.g. 1080")
+	}
+	listen, err := tunnelListen(parts[:len(parts)-1], parts[len(parts)-1])
+	if err != nil {
+		return Tunnel{}, errors.New("invalid --socks " + spec + ": " + err.Error())
+	}
+	return Tunnel{Listen: listen}, nil
+}
+
+// ParseLocalTunnel parses a [bind_address:]port:host:hostport specification, as ssh -L. host is
+// resolved by the instance.
+func ParseLocalTunnel(spec string) (Tunnel, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return Tunnel{}, errors.New("invalid -L " + spec + ", expected [bind_address:]port:host:hostport, e.g. 3306:db.internal:3306")
+	}
+	n := len(parts)
+	listen, err := tunnelListen(parts[:n-3], parts[n-3])
+	if err != nil {
+		return Tunnel{}, errors.New("invalid -L " + spec + ": " + err.Error())
+	}
+	if parts[n-2] == "" || !validPort(parts[n-1]) {
+		return Tunnel{}, errors.New("invalid -L " + spec + ", expected [bind_address:]port:host:hostport, e.g. 3306:db.internal:3306")
+	}
+	return Tunnel{Listen: listen, Target: net.JoinHostPort(parts[n-2], parts[n-1])}, nil
+}
+
+// tunnelListen returns the host address of a tunnel from its optional bind address and port
+func tunnelListen(bind []string, port string) (string, error) {
+	if !validPort(port) {
+		return "", errors.New("invalid port " + port)
+	}
+	address := "localhost"
+	if len(bind) == 1 && bind[0] != "" {
+		address = bind[0]
+	}
+	return net.JoinHostPort(address, port), nil
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= 65535
+}
+
+func tunnelDir(config qemu.MachineConfig) string {
+	return filepath.Join(config.Location, "tunnels")
+}
+
+// tunnelFile returns the state file of the tunnel on a host port. The tunnel process holds a flock
+// on it while it runs.
+func tunnelFile(config qemu.MachineConfig, port string) string {
+	return filepath.Join(tunnelDir(config), port+".yaml")
+}
+
+// ListTunnels returns the running tunnels of an instance by port. State files whose process is gone,
+// e.g. after a reboot of the host, are removed.
+func ListTunnels(config qemu.MachineConfig) ([]Tunnel, error) {
+	entries, err := os.ReadDir(tunnelDir(config))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels := []Tunnel{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		path := filepath.Join(tunnelDir(config), entry.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		// the flock of the tunnel process is released when it exits, however it exits
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			os.Remove(path)
+			f.Close()
+			continue
+		}
+		var t Tunnel
+		err = yaml.NewDecoder(f).Decode(&t)
+		f.Close()
+		if err != nil {
+			log.Debugln("ignoring tunnel " + path + ": " + err.Error())
+			continue
+		}
+		tunnels = append(tunnels, t)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		pi, _ := strconv.Atoi(tunnels[i].Port())
+		pj, _ := strconv.Atoi(tunnels[j].Port())
+		return pi < pj
+	})
+	return tunnels, nil
+}
+
+// StartTunnel forks a background process running a tunnel through a running instance and waits
+// for it to listen
+func StartTunnel(config qemu.MachineConfig, t Tunnel) error {
+	if status, _ := Status(config); status != "Running" {
+		return errors.New(config.Alias + " is not running, start it first")
+	}
+	if !config.HasNetwork() {
+		return errors.New(config.Alias + " has no network, tunnels go over SSH")
+	}
+	tunnels, err := ListTunnels(config)
+	if err != nil {
+		return err
+	}
+	for _, existing := range tunnels {
+		if existing.Port() == t.Port() {
+			return errors.New("port " + t.Port() + " is already tunnelled through " + config.Alias + ": " + existing.String())
+		}
+	}
+	listener, err := net.Listen("tcp", t.Listen)
+	if err != nil {
+		return errors.New("unable to listen on " + t.Listen + ": " + err.Error())
+	}
+	listener.Close()
+
+	if err := os.MkdirAll(tunnelDir(config), 0755); err != nil {
+		return err
+	}
+	logPath := filepath.Join(tunnelDir(config), t.Port()+".log")
+	args := []string{"tunnel", "run", config.Alias, t.Listen}
+	if t.Target != "" {
+		args = append(args, t.Target)
+	}
+	cmd, err := startBackground("tunnel", logPath, args...)
+	if err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	deadline := time.After(tunnelStartTimeout)
+	for {
+		select {
+		case <-exited:
+			return errors.New("tunnel " + t.String() + " failed: " + lastLine(logPath))
+		case <-deadline:
+			return errors.New("tunnel " + t.String() + " did not start, see " + logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+		tunnels, err := ListTunnels(config)
+		if err != nil {
+			return err
+		}
+		for _, running := range tunnels {
+			if running.PID == cmd.Process.Pid {
+				return cmd.Process.Release()
+			}
+		}
+	}
+}
+
+// lastLine returns the last line of a log file, the error of a process that failed to start
+func lastLine(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "see " + path
+	}
+	defer f.Close()
+	line := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if text := strings.TrimSpace(scanner.Text()); text != "" {
+			line = text
+		}
+	}
+	if line == "" {
+		return "see " + path
+	}
+	return line
+}
+
+// StopTunnel terminates the tunnel of an instance on a host port
+func StopTunnel(config qemu.MachineConfig, t Tunnel) error {
+	if err := terminateProcess(t.PID, "tunnel "+t.String()+" of "+config.Alias); err != nil {
+		return err
+	}
+	os.Remove(tunnelFile(config, t.Port()))
+	return nil
+}
+
+// StopTunnels terminates all tunnels of an instance
+func StopTunnels(config qemu.MachineConfig) error {
+	tunnels, err := ListTunnels(config)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, t := range tunnels {
+		if err := StopTunnel(config, t); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// RunTunnel listens on the host address of a tunnel and forwards the connections through an SSH
+// connection to the instance, reconnecting with backoff when it drops. It returns when the instance
+// is stopped or the tunnel is terminated by StopTunnel.
+func RunTunnel(vmName string, t Tunnel) error {
+	config, err := qemu.GetMachineConfig(vmName)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", t.Listen)
+	if err != nil {
+		return errors.New("unable to listen on " + t.Listen + ": " + err.Error())
+	}
+	defer listener.Close()
+
+	t.Instance = vmName
+	t.PID = os.Getpid()
+	t.StartedAt = time.Now()
+	state, err := writeTunnelState(config, t)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	defer os.Remove(tunnelFile(config, t.Port()))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer stop()
+
+	var mu sync.Mutex
+	var current *ssh.Client
+	go acceptTunnel(listener, t, func() *ssh.Client {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	})
+
+	log.Println("tunnel " + t.String() + " through " + vmName)
+	err = reconnectLoop(ctx, vmName, func(ctx context.Context, config qemu.MachineConfig) error {
+		if err := config.EnableTCPForwarding(); err != nil {
+			return err
+		}
+		client, err := config.DialContext(ctx, false)
+		if err != nil {
+			return errors.New("unable to connect to " + config.Alias + ": " + err.Error())
+		}
+		defer client.Close()
+
+		mu.Lock()
+		current = client
+		mu.Unlock()
+		log.Println("connected to " + config.Alias)
+		err = holdConnection(ctx, config, client)
+		mu.Lock()
+		current = nil
+		mu.Unlock()
+		return err
+	})
+	log.Println("tunnel " + t.String() + " stopped")
+	return err
+}
+
+// writeTunnelState records a running tunnel in its state file and returns the file, locked until
+// the process exits. The file is locked before it is renamed into place, so that ListTunnels never
+// takes it for the file of a dead process.
+func writeTunnelState(config qemu.MachineConfig, t Tunnel) (*os.File, error) {
+	data, err := yaml.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	path := tunnelFile(config, t.Port())
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, errors.New("port " + t.Port() + " is already tunnelled through " + config.Alias)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// acceptTunnel forwards the connections to a tunnel through the current SSH connection, refusing
+// them while it is reconnecting
+func acceptTunnel(listener net.Listener, t Tunnel, current func() *ssh.Client) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			target := t.Target
+			if target == "" {
+				target, err = socksHandshake(conn)
+				if err != nil {
+					log.Errorln("SOCKS: " + err.Error())
+					return
+				}
+			}
+
+			client := current()
+			if client == nil {
+				if t.Target == "" {
+					socksReply(conn, socksFailure)
+				}
+				log.Errorln("refused connection to " + target + ", not connected to " + t.Instance)
+				return
+			}
+			remote, err := client.Dial("tcp", target)
+			if err != nil {
+				if t.Target == "" {
+					socksReply(conn, socksFailure)
+				}
+				log.Errorln("unable to connect to " + target + ": " + err.Error())
+				return
+			}
+			defer remote.Close()
+			if t.Target == "" {
+				if err := socksReply(conn, socksSucceeded); err != nil {
+					return
+				}
+			}
+			proxy(conn, remote)
+		}()
+	}
+}
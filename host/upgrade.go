@@ -0,0 +1,153 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beringresearch/macpine/qemu"
+	"gopkg.in/yaml.v3"
+)
+
+// alpineBranch matches an Alpine release branch as passed to alpine upgrade --to, e.g. 3.21 or v3.21
+var alpineBranch = regexp.MustCompile(`^v?(\d+)\.(\d+)$`)
+
+// alpineVersion matches the branch of a release, e.g. 3.20 of 3.20.3 or of 3.22_alpha20250108 on edge
+var alpineVersion = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// stableRelease matches a stable Alpine release, e.g. 3.21.2 but not 3.22_alpha20250108 on edge
+var stableRelease = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// latestReleasesURL lists the current stable release for an architecture
+const latestReleasesURL = "https://dl-cdn.alpinelinux.org/alpine/latest-stable/releases/%s/latest-releases.yaml"
+
+// upgradeScript points the apk repositories of the guest at a release branch and upgrades every
+// package to it. %s is the branch, e.g. v3.21 or edge.
+const upgradeScript = `set -e
+sed -i -E 's#/(v[0-9]+\.[0-9]+|edge)/#/%s/#' /etc/apk/repositories
+cat /etc/apk/repositories
+apk update
+apk upgrade --available
+sync`
+
+// ParseAlpineBranch validates a release branch such as 3.21, v3.21 or edge and returns the name of
+// its repository directory, v3.21 or edge
+func ParseAlpineBranch(branch string) (string, error) {
+	if branch == "edge" {
+		return branch, nil
+	}
+	if !alpineBranch.MatchString(branch) {
+		return "", errors.New("invalid Alpine branch " + branch + ", expected a release such as 3.21, or edge")
+	}
+	return "v" + strings.TrimPrefix(branch, "v"), nil
+}
+
+// CompareAlpineReleases compares the branches of two Alpine releases such as 3.20.3 and v3.21,
+// returning -1, 0 or 1. edge is newer than every release.
+func CompareAlpineReleases(a string, b string) int {
+	av, bv := releaseBranch(a), releaseBranch(b)
+	for i := range av {
+		if av[i] != bv[i] {
+			if av[i] < bv[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// AlpineBranch returns the branch of a release, e.g. 3.21 for 3.21.2
+func AlpineBranch(release string) string {
+	m := alpineVersion.FindStringSubmatch(release)
+	if m == nil {
+		return release
+	}
+	return m[1] + "." + m[2]
+}
+
+// releaseBranch returns the major and minor version of a release, edge sorting last
+func releaseBranch(release string) [2]int {
+	m := alpineVersion.FindStringSubmatch(release)
+	if release == "edge" || m == nil {
+		return [2]int{1 << 30, 0}
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return [2]int{major, minor}
+}
+
+// AlpineRelease returns the Alpine release of a running instance, from /etc/alpine-release
+func AlpineRelease(config qemu.MachineConfig) (string, error) {
+	out, err := config.Exec("cat /etc/alpine-release", false)
+	if err != nil {
+		return "", errors.New("unable to read the Alpine release of " + config.Alias + ": " + err.Error())
+	}
+	release := strings.TrimSpace(out)
+	if release == "" {
+		return "", errors.New(config.Alias + " has no /etc/alpine-release, it does not run Alpine")
+	}
+	return release, nil
+}
+
+// UpgradedImage returns the base image name of an instance upgraded from one Alpine release to another,
+// e.g. alpine_3.21.2-aarch64.qcow2 for alpine_3.20.3-aarch64.qcow2. Images not named after the release
+// they were upgraded from, and upgrades to edge, keep their name.
+func UpgradedImage(image string, from string, to string) string {
+	if !stableRelease.MatchString(from) || !stableRelease.MatchString(to) {
+		return image
+	}
+	return strings.Replace(image, from, to, 1)
+}
+
+// LatestAlpineRelease returns the current stable Alpine release for an architecture, e.g. 3.21.2
+func LatestAlpineRelease(ctx context.Context, arch string) (string, error) {
+	url := fmt.Sprintf(latestReleasesURL, arch)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.New("unable to look up the latest Alpine release: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("unable to look up the latest Alpine release: " + url + " returned " + resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var releases []struct {
+		Version string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(data, &releases); err != nil {
+		return "", errors.New("unable to parse " + url + ": " + err.Error())
+	}
+	for _, r := range releases {
+		if r.Version != "" {
+			return r.Version, nil
+		}
+	}
+	return "", errors.New("no release listed in " + url)
+}
+
+// UpgradeAlpine switches the apk repositories of a running instance to branch and upgrades every
+// package, streaming the output of apk. The new release is in place after a reboot.
+func UpgradeAlpine(ctx context.Context, config qemu.MachineConfig, branch string, out io.Writer) error {
+	script := fmt.Sprintf(upgradeScript, branch)
+	if err := config.Run(ctx, script, true, nil, out, out); err != nil {
+		return errors.New("unable to upgrade " + config.Alias + " to " + branch + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package host
+
+import "testing"
+
+func TestUpgradedImage(t *testing.T) {
+	tests := []struct {
+		image, from, to string
+		want            string
+	}{
+		{"alpine_3.20.3-aarch64.qcow2", "3.20.3", "3.21.2", "alpine_3.21.2-aarch64.qcow2"},
+		{"nocloud_alpine-3.20.3-x86_64-bios-cloudinit-r0.qcow2", "3.20.3", "3.21.2", "nocloud_alpine-3.21.2-x86_64-bios-cloudinit-r0.qcow2"},
+		// the image was not named after the release the guest ran
+		{"alpine_3.19.1-aarch64.qcow2", "3.20.3", "3.21.2", "alpine_3.19.1-aarch64.qcow2"},
+		{"custom-aarch64.qcow2", "3.20.3", "3.21.2", "custom-aarch64.qcow2"},
+		{"alpine_3.20.3-aarch64.qcow2", "3.20.3", "3.22_alpha20250108", "alpine_3.20.3-aarch64.qcow2"},
+	}
+	for _, tt := range tests {
+		if got := UpgradedImage(tt.image, tt.from, tt.to); got != tt.want {
+			t.Errorf("UpgradedImage(%q, %q, %q) = %s, want %s", tt.image, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -4,21 +4,23 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
 	"github.com/spf13/cobra"
 )
 
 func ListVMNames() []string {
 	var vmList []string
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := DataDir()
 	if err != nil {
 		return vmList
 	}
 
-	dirList, err := os.ReadDir(filepath.Join(userHomeDir, ".macpine"))
+	dirList, err := os.ReadDir(dataDir)
 	if err != nil {
 		return vmList
 	}
@@ -34,6 +36,26 @@ func ListVMNames() []string {
 	return vmList
 }
 
+// IsBroken reports whether an instance directory exists but its configuration cannot be read. A
+// configuration that reads but fails validation is not broken: the instance can still be stopped
+// and deleted, and fixed with alpine edit.
+func IsBroken(vmName string) bool {
+	if !instanceDirExists(vmName) {
+		return false
+	}
+	_, err := qemu.GetMachineConfigForStop(vmName)
+	return err != nil
+}
+
+func instanceDirExists(vmName string) bool {
+	dataDir, err := DataDir()
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dataDir, vmName))
+	return err == nil && info.IsDir()
+}
+
 // autocomplete with VM Names
 func AutoCompleteVMNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	return ListVMNames(), cobra.ShellCompDirectiveNoFileComp
@@ -51,31 +73,139 @@ func AutoCompleteVMNamesOrTags(cmd *cobra.Command, args []string, toComplete str
 	return append(vmNames, tags...), cobra.ShellCompDirectiveNoFileComp
 }
 
+// AutoCompleteTags completes --tag filters with the tags used by any instance
+func AutoCompleteTags(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	tags, err := ListTags()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return tags, cobra.ShellCompDirectiveNoFileComp
+}
+
+// AutoCompleteArch completes --arch with the supported guest architectures
+func AutoCompleteArch(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{"aarch64", "x86_64"}, cobra.ShellCompDirectiveNoFileComp
+}
+
+// CachedImages returns the file names of the images downloaded to the cache or available in the
+// shared image directory
+func CachedImages() []string {
+	var images []string
+
+	dataDir, err := DataDir()
+	if err != nil {
+		return images
+	}
+	dirs := []string{filepath.Join(dataDir, "cache")}
+	if imageDir, err := utils.ImageDir(); err == nil && imageDir != "" {
+		dirs = append(dirs, imageDir)
+	}
+
+	for _, dir := range dirs {
+		dirList, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range dirList {
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".qcow2") && !utils.StringSliceContains(images, f.Name()) {
+				images = append(images, f.Name())
+			}
+		}
+	}
+	return images
+}
+
+// ListTags returns the tags used by any instance, sorted and without duplicates
 func ListTags() ([]string, error) {
 	var tagList []string
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := DataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	dirList, err := os.ReadDir(filepath.Join(userHomeDir, ".macpine"))
+	dirList, err := os.ReadDir(dataDir)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, f := range dirList {
-		if f.Name() != "cache" {
+		if f.IsDir() && f.Name() != "cache" {
 			machineConfig, err := qemu.GetMachineConfig(f.Name())
 			if err != nil {
-				return nil, err
+				// broken instances have no readable tags
+				continue
+			}
+			for _, tag := range machineConfig.Tags {
+				if !utils.StringSliceContains(tagList, tag) {
+					tagList = append(tagList, tag)
+				}
 			}
-			tagList = append(tagList, machineConfig.Tags...)
 		}
 	}
+	sort.Strings(tagList)
 	return tagList, nil
 }
 
+// SelectInstances resolves the instances a command acts on: the named instances and +tag arguments, or
+// every instance when all is set or only tags or labels are given. tags and labels narrow the selection
+// to instances that carry all of them.
+func SelectInstances(args []string, all bool, tags []string, labels map[string]string) ([]string, error) {
+	if all && len(args) > 0 {
+		return nil, errors.New("--all cannot be combined with instance names")
+	}
+	if !all && len(args) == 0 && len(tags) == 0 && len(labels) == 0 {
+		return nil, errors.New("missing instance name")
+	}
+
+	var names []string
+	if len(args) == 0 {
+		for _, vmName := range ListVMNames() {
+			if !IsBroken(vmName) {
+				names = append(names, vmName)
+			}
+		}
+	} else {
+		var err error
+		names, err = ExpandTagArguments(args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) == 0 && len(labels) == 0 {
+		return names, nil
+	}
+
+	selected := []string{}
+	for _, vmName := range names {
+		machineConfig, err := qemu.GetMachineConfig(vmName)
+		if err != nil {
+			// keep unknown names so that the command reports them
+			selected = append(selected, vmName)
+			continue
+		}
+		hasTags := true
+		for _, tag := range tags {
+			hasTags = hasTags && utils.StringSliceContains(machineConfig.Tags, tag)
+		}
+		if hasTags && machineConfig.HasLabels(labels) {
+			selected = append(selected, vmName)
+		}
+	}
+	if len(selected) == 0 {
+		filters := []string{}
+		if len(tags) > 0 {
+			filters = append(filters, "tag "+strings.Join(tags, ", "))
+		}
+		if len(labels) > 0 {
+			selector := qemu.MachineConfig{Labels: labels}
+			filters = append(filters, "label "+strings.Join(selector.LabelStrings(), ", "))
+		}
+		return nil, errors.New("no instances found with " + strings.Join(filters, " and "))
+	}
+	return selected, nil
+}
+
 func ExpandTagArguments(args []string) ([]string, error) {
 	var expandedArgs []string
 	var tags []string
@@ -90,21 +220,22 @@ func ExpandTagArguments(args []string) ([]string, error) {
 		return args, nil
 	}
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := DataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	dirList, err := os.ReadDir(filepath.Join(userHomeDir, ".macpine"))
+	dirList, err := os.ReadDir(dataDir)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, f := range dirList {
-		if f.Name() != "cache" {
+		if f.IsDir() && f.Name() != "cache" {
 			machineConfig, err := qemu.GetMachineConfig(f.Name())
 			if err != nil {
-				return nil, err
+				// broken instances have no readable tags
+				continue
 			}
 			for _, tag := range machineConfig.Tags {
 				if arr, ok := tagMap[tag]; ok {
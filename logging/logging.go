@@ -0,0 +1,158 @@
+// Package logging is the leveled logger used by cmd, host and qemu. Print, Printf and Println log at
+// the info level and Fatal, Fatalf and Fatalln at the error level, mirroring the standard log package,
+// so that it can be imported as log.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message
+type Level int
+
+const (
+	// LevelDebug messages are shown with --verbose: qemu and qemu-img invocations, SSH dial attempts
+	LevelDebug Level = iota
+	// LevelInfo messages report progress
+	LevelInfo
+	// LevelNotice messages are essential results, such as the name of a new instance, shown even with --quiet
+	LevelNotice
+	// LevelError messages are always shown
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelNotice:
+		return "notice"
+	}
+	return "error"
+}
+
+var (
+	mu         sync.Mutex
+	level      = LevelInfo
+	jsonOutput bool
+	out        io.Writer = os.Stderr
+)
+
+// SetLevel hides messages below l
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetJSON switches to one JSON object per message, with time, level and msg keys
+func SetJSON(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	jsonOutput = enabled
+}
+
+// SetOutput sets the destination of messages, standard error by default
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// JSON reports whether messages are logged as JSON objects
+func JSON() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return jsonOutput
+}
+
+// Output returns the destination of messages
+func Output() io.Writer {
+	mu.Lock()
+	defer mu.Unlock()
+	return out
+}
+
+// Enabled reports whether messages of level l are shown
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l >= level
+}
+
+func output(l Level, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l < level {
+		return
+	}
+
+	msg = strings.TrimSuffix(msg, "\n")
+	now := time.Now()
+	if jsonOutput {
+		line, _ := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{now.Format(time.RFC3339), l.String(), msg})
+		out.Write(append(line, '\n'))
+		return
+	}
+	fmt.Fprintln(out, now.Format("2006/01/02 15:04:05")+" "+msg)
+}
+
+// Debug logs at the debug level, arguments are handled as in fmt.Print
+func Debug(v ...interface{}) { output(LevelDebug, fmt.Sprint(v...)) }
+
+// Debugf logs at the debug level, arguments are handled as in fmt.Printf
+func Debugf(format string, v ...interface{}) { output(LevelDebug, fmt.Sprintf(format, v...)) }
+
+// Debugln logs at the debug level, arguments are handled as in fmt.Println
+func Debugln(v ...interface{}) { output(LevelDebug, fmt.Sprintln(v...)) }
+
+// Print logs at the info level, arguments are handled as in fmt.Print
+func Print(v ...interface{}) { output(LevelInfo, fmt.Sprint(v...)) }
+
+// Printf logs at the info level, arguments are handled as in fmt.Printf
+func Printf(format string, v ...interface{}) { output(LevelInfo, fmt.Sprintf(format, v...)) }
+
+// Println logs at the info level, arguments are handled as in fmt.Println
+func Println(v ...interface{}) { output(LevelInfo, fmt.Sprintln(v...)) }
+
+// Noticef logs an essential result, arguments are handled as in fmt.Printf
+func Noticef(format string, v ...interface{}) { output(LevelNotice, fmt.Sprintf(format, v...)) }
+
+// Noticeln logs an essential result, arguments are handled as in fmt.Println
+func Noticeln(v ...interface{}) { output(LevelNotice, fmt.Sprintln(v...)) }
+
+// Errorf logs at the error level, arguments are handled as in fmt.Printf
+func Errorf(format string, v ...interface{}) { output(LevelError, fmt.Sprintf(format, v...)) }
+
+// Errorln logs at the error level, arguments are handled as in fmt.Println
+func Errorln(v ...interface{}) { output(LevelError, fmt.Sprintln(v...)) }
+
+// Fatal logs at the error level and exits with status 1
+func Fatal(v ...interface{}) {
+	output(LevelError, fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// Fatalf logs at the error level and exits with status 1
+func Fatalf(format string, v ...interface{}) {
+	output(LevelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// Fatalln logs at the error level and exits with status 1
+func Fatalln(v ...interface{}) {
+	output(LevelError, fmt.Sprintln(v...))
+	os.Exit(1)
+}
@@ -0,0 +1,118 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// credentials are a user name and password or token for a registry
+type credentials struct {
+	Username string
+	Secret   string
+}
+
+// dockerConfig is the part of ~/.docker/config.json that names the credentials of registries
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// lookupCredentials returns the credentials docker would use for registry, from a credential helper
+// or from auths in the docker configuration. No configuration or no entry for the registry is not an
+// error, the registry is then accessed anonymously.
+func lookupCredentials(registry string) (*credentials, error) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		configDir = filepath.Join(userHomeDir, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.New("unable to parse docker configuration: " + err.Error())
+	}
+
+	// docker stores the credentials of Docker Hub under its v1 URL
+	server := registry
+	if registry == "docker.io" {
+		server = "https://index.docker.io/v1/"
+	}
+
+	if helper, ok := config.CredHelpers[registry]; ok {
+		return credentialHelper(helper, server)
+	}
+
+	for key, auth := range config.Auths {
+		if registryHost(key) != registry {
+			continue
+		}
+		if auth.IdentityToken != "" {
+			return &credentials{Username: "<token>", Secret: auth.IdentityToken}, nil
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.New("invalid auth for " + key + " in docker configuration")
+			}
+			username, secret, _ := strings.Cut(string(decoded), ":")
+			return &credentials{Username: username, Secret: secret}, nil
+		}
+	}
+
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, server)
+	}
+	return nil, nil
+}
+
+// credentialHelper asks docker-credential-<helper> for the credentials of server
+func credentialHelper(helper string, server string) (*credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		// helpers report a registry they have nothing for on their output
+		if strings.Contains(output, "credentials not found") {
+			return nil, nil
+		}
+		return nil, errors.New("docker-credential-" + helper + ": " + err.Error() + " " + output)
+	}
+
+	var creds credentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, errors.New("invalid output of docker-credential-" + helper + ": " + err.Error())
+	}
+	return &creds, nil
+}
+
+// registryHost returns the host of a key of auths, which may be a URL
+func registryHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	if key == "index.docker.io" {
+		return "docker.io"
+	}
+	return key
+}
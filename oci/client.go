@@ -0,0 +1,438 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ManifestMediaType is the media type of the manifests pushed and accepted
+	ManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// ArtifactType identifies a macpine instance among the artifacts of a registry
+	ArtifactType = "application/vnd.macpine.instance.v1"
+	// DiskMediaType is the media type of the layer holding the qcow2 disk of the instance
+	DiskMediaType = "application/vnd.macpine.disk.layer.v1.qcow2"
+	// ConfigMediaType is the media type of the layer holding the config.yaml of the instance
+	ConfigMediaType = "application/vnd.macpine.config.layer.v1+yaml"
+	// TitleAnnotation names the file of a layer
+	TitleAnnotation = "org.opencontainers.image.title"
+
+	// emptyMediaType is the media type of the empty config of artifacts
+	emptyMediaType = "application/vnd.oci.empty.v1+json"
+)
+
+// Descriptor describes a blob of a repository
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Hex returns the hex encoded sha256 of the blob, which is safe to use as a file name
+func (d Descriptor) Hex() (string, error) {
+	hexDigest, ok := strings.CutPrefix(d.Digest, "sha256:")
+	if _, err := hex.DecodeString(hexDigest); !ok || err != nil || len(hexDigest) != 64 || hexDigest != strings.ToLower(hexDigest) {
+		return "", errors.New("unsupported digest " + d.Digest + ", expected sha256:<64 hex digits>")
+	}
+	return hexDigest, nil
+}
+
+// Manifest is an OCI image manifest
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Layer returns the first layer with mediaType
+func (m Manifest) Layer(mediaType string) (Descriptor, bool) {
+	for _, layer := range m.Layers {
+		if layer.MediaType == mediaType {
+			return layer, true
+		}
+	}
+	return Descriptor{}, false
+}
+
+// File is a file pushed as a layer
+type File struct {
+	Path      string
+	MediaType string
+}
+
+// Client talks to the repository of a reference, with the docker credentials of its registry
+type Client struct {
+	ref     Reference
+	base    string
+	http    *http.Client
+	auth    string
+	actions string
+}
+
+// NewClient returns a client for the repository of ref. Registries on localhost are accessed over
+// plain HTTP, as docker does.
+func NewClient(ref Reference) *Client {
+	scheme := "https"
+	if host, _, _ := strings.Cut(ref.Registry, ":"); host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	registry := ref.Registry
+	if registry == "docker.io" {
+		registry = "registry-1.docker.io"
+	}
+	return &Client{
+		ref:  ref,
+		base: scheme + "://" + registry + "/v2/" + ref.Repository,
+		http: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: time.Minute}},
+	}
+}
+
+// Push uploads files as the layers of an artifact and tags its manifest, returning the digest of
+// the manifest. Blobs already in the repository are not uploaded again.
+func (c *Client) Push(ctx context.Context, files []File, annotations map[string]string) (string, error) {
+	if err := c.authorize(ctx, "pull,push"); err != nil {
+		return "", err
+	}
+
+	empty := []byte("{}")
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     ManifestMediaType,
+		ArtifactType:  ArtifactType,
+		Config:        Descriptor{MediaType: emptyMediaType, Digest: digestOf(empty), Size: int64(len(empty))},
+		Annotations:   annotations,
+	}
+	if err := c.pushBlob(ctx, manifest.Config, func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(empty)), nil }); err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		desc, err := describeFile(file)
+		if err != nil {
+			return "", err
+		}
+		open := func() (io.ReadCloser, error) { return os.Open(file.Path) }
+		if err := c.pushBlob(ctx, desc, open); err != nil {
+			return "", errors.New("unable to push " + file.Path + ": " + err.Error())
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	req, err := c.request(ctx, http.MethodPut, c.base+"/manifests/"+c.ref.reference(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", ManifestMediaType)
+	resp, err := c.do(req, http.StatusCreated)
+	if err != nil {
+		return "", errors.New("unable to push manifest: " + err.Error())
+	}
+	resp.Body.Close()
+	return digestOf(body), nil
+}
+
+// Manifest fetches the manifest of the reference and returns it with its digest. The manifest is
+// verified against the digest of the reference, or the digest reported by the registry.
+func (c *Client) Manifest(ctx context.Context) (Manifest, string, error) {
+	var manifest Manifest
+	if err := c.authorize(ctx, "pull"); err != nil {
+		return manifest, "", err
+	}
+
+	req, err := c.request(ctx, http.MethodGet, c.base+"/manifests/"+c.ref.reference(), nil)
+	if err != nil {
+		return manifest, "", err
+	}
+	req.Header.Set("Accept", ManifestMediaType)
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return manifest, "", errors.New("unable to fetch manifest of " + c.ref.String() + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return manifest, "", err
+	}
+
+	digest := digestOf(body)
+	for _, expected := range []string{c.ref.Digest, resp.Header.Get("Docker-Content-Digest")} {
+		if expected != "" && expected != digest {
+			return manifest, "", errors.New("manifest of " + c.ref.String() + " does not match digest " + expected + ", got " + digest)
+		}
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return manifest, "", errors.New("invalid manifest of " + c.ref.String() + ": " + err.Error())
+	}
+	if manifest.MediaType != "" && manifest.MediaType != ManifestMediaType {
+		return manifest, "", errors.New(c.ref.String() + " is a " + manifest.MediaType + ", not a macpine instance")
+	}
+	return manifest, digest, nil
+}
+
+// FetchBlob downloads the blob of desc to path, verifying its size and digest. The blob is written
+// next to path and renamed once verified, so path never holds a partial or corrupt blob.
+func (c *Client) FetchBlob(ctx context.Context, desc Descriptor, path string) error {
+	if err := c.authorize(ctx, "pull"); err != nil {
+		return err
+	}
+
+	req, err := c.request(ctx, http.MethodGet, c.base+"/blobs/"+desc.Digest, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return errors.New("unable to fetch " + desc.Digest + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	part := path + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(part)
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("unable to fetch " + desc.Digest + ": " + err.Error())
+	}
+	if n != desc.Size {
+		return errors.New("blob " + desc.Digest + " is " + strconv.FormatInt(n, 10) + " bytes, expected " + strconv.FormatInt(desc.Size, 10))
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != desc.Digest {
+		return errors.New("blob " + desc.Digest + " does not match its digest, got " + digest)
+	}
+	return os.Rename(part, path)
+}
+
+// pushBlob uploads a blob in a single request unless the repository already has it
+func (c *Client) pushBlob(ctx context.Context, desc Descriptor, open func() (io.ReadCloser, error)) error {
+	req, err := c.request(ctx, http.MethodHead, c.base+"/blobs/"+desc.Digest, nil)
+	if err != nil {
+		return err
+	}
+	if resp, err := c.do(req, http.StatusOK); err == nil {
+		resp.Body.Close()
+		return nil
+	}
+
+	req, err = c.request(ctx, http.MethodPost, c.base+"/blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		return errors.New("registry did not return an upload location: " + err.Error())
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	req, err = c.request(ctx, http.MethodPut, location.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// authorize gets a token for actions on the repository when the registry asks for one, with the
+// docker credentials of the registry if there are any
+func (c *Client) authorize(ctx context.Context, actions string) error {
+	if c.actions == actions || c.actions == "pull,push" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.base, c.ref.Repository), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("unable to reach " + c.ref.Registry + ": " + err.Error())
+	}
+	resp.Body.Close()
+	c.actions = actions
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+
+	creds, err := lookupCredentials(c.ref.Registry)
+	if err != nil {
+		return err
+	}
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch scheme {
+	case "basic":
+		if creds == nil {
+			return errors.New(c.ref.Registry + " requires a login, run docker login " + c.ref.Registry)
+		}
+		req.SetBasicAuth(creds.Username, creds.Secret)
+		c.auth = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		return c.token(ctx, params, actions, creds)
+	}
+	return errors.New(c.ref.Registry + " asks for unsupported authentication " + resp.Header.Get("WWW-Authenticate"))
+}
+
+// token gets a bearer token from the authorization service of the registry
+func (c *Client) token(ctx context.Context, params map[string]string, actions string, creds *credentials) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return errors.New("invalid authentication realm of " + c.ref.Registry)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+c.ref.Repository+":"+actions)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		req.SetBasicAuth(creds.Username, creds.Secret)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("unable to authenticate to " + c.ref.Registry + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unable to authenticate to " + c.ref.Registry + ": " + resp.Status + ", check docker login " + c.ref.Registry)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return errors.New("invalid token from " + realm.Host + ": " + err.Error())
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.auth = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://ghcr.io/token",service="ghcr.io"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, "\"") {
+			value, rest, _ = strings.Cut(rest[1:], "\"")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(scheme), params
+}
+
+func (c *Client) request(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.auth != "" {
+		req.Header.Set("Authorization", c.auth)
+	}
+	return req, nil
+}
+
+// do sends req and returns an error with the message of the registry unless it answers with status
+func (c *Client) do(req *http.Request, status int) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == status {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	message := resp.Status
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body) == nil && len(body.Errors) > 0 {
+		message += ": " + body.Errors[0].Message
+	}
+	return nil, errors.New(message)
+}
+
+// describeFile hashes a file into the descriptor of its layer
+func describeFile(file File) (Descriptor, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{
+		MediaType:   file.MediaType,
+		Digest:      "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:        size,
+		Annotations: map[string]string{TitleAnnotation: filepath.Base(file.Path)},
+	}, nil
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,74 @@
+// Package oci pushes and pulls macpine instance images to and from OCI registries such as ghcr.io,
+// as artifacts in the style of ORAS: an OCI image manifest with an empty config and one layer per file.
+package oci
+
+import (
+	"errors"
+	"strings"
+)
+
+// Scheme prefixes image references given to alpine launch --image
+const Scheme = "oci://"
+
+// Reference is a parsed image reference such as ghcr.io/org/image:tag or
+// ghcr.io/org/image@sha256:...
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference, with or without the oci:// scheme. The registry is
+// required, the tag defaults to latest.
+func ParseReference(s string) (Reference, error) {
+	s = strings.TrimPrefix(s, Scheme)
+	ref := Reference{}
+
+	registry, rest, ok := strings.Cut(s, "/")
+	// the first component is a registry when it looks like a host name, as with docker
+	if !ok || rest == "" || !(strings.ContainsAny(registry, ".:") || registry == "localhost") {
+		return ref, errors.New("invalid image reference " + s + ", expected a registry, e.g. ghcr.io/org/image:tag")
+	}
+	ref.Registry = registry
+
+	if name, digest, ok := strings.Cut(rest, "@"); ok {
+		if !strings.HasPrefix(digest, "sha256:") || len(digest) != len("sha256:")+64 {
+			return ref, errors.New("invalid digest " + digest + " in image reference " + s + ", expected sha256:<64 hex digits>")
+		}
+		rest = name
+		ref.Digest = digest
+	}
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	if rest == "" || rest != strings.ToLower(rest) {
+		return ref, errors.New("invalid repository in image reference " + s + ", repositories are lowercase")
+	}
+	ref.Repository = rest
+	return ref, nil
+}
+
+// String returns the reference without scheme
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// reference returns what identifies the manifest in registry URLs, the digest if known
+func (r Reference) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
@@ -0,0 +1,76 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// agentInstall installs and starts qemu-guest-agent on an Alpine guest
+const agentInstall = "apk add --no-cache qemu-guest-agent && rc-update add qemu-guest-agent default && rc-service qemu-guest-agent restart"
+
+// AgentPath returns the location of the guest agent socket of the instance
+func (c *MachineConfig) AgentPath() string {
+	return filepath.Join(c.Location, "alpine.qga")
+}
+
+// agentArgs returns the qemu arguments of the virtio-serial channel qemu-guest-agent listens on. The
+// channel is always present, so an agent installed by hand works as well as one added by --guest-agent.
+func (c *MachineConfig) agentArgs() []string {
+	return []string{
+		"-chardev", "socket,id=char-qga,path=" + c.AgentPath() + ",server=on,wait=off",
+		"-device", "virtio-serial-pci",
+		"-device", "virtserialport,chardev=char-qga,name=org.qemu.guest_agent.0",
+	}
+}
+
+// InstallGuestAgent installs qemu-guest-agent over SSH and enables it at boot
+func (c *MachineConfig) InstallGuestAgent(ctx context.Context) error {
+	if _, err := c.ExecContext(ctx, agentInstall, true); err != nil {
+		return errors.New("unable to install qemu-guest-agent: " + err.Error())
+	}
+	return nil
+}
+
+// AddCloudGuestAgent adds qemu-guest-agent to the packages of #cloud-config user-data and starts it
+// from runcmd
+func (c *MachineConfig) AddCloudGuestAgent(userData []byte) ([]byte, error) {
+	if !c.GuestAgent {
+		return userData, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(userData)), "#cloud-config") {
+		return nil, errors.New("--guest-agent requires #cloud-config user-data, install qemu-guest-agent from the script instead")
+	}
+
+	cloudConfig := map[string]interface{}{}
+	if err := yaml.Unmarshal(userData, &cloudConfig); err != nil {
+		return nil, errors.New("unable to parse user-data: " + err.Error())
+	}
+	if cloudConfig == nil {
+		cloudConfig = map[string]interface{}{}
+	}
+
+	packages, ok := cloudConfig["packages"].([]interface{})
+	if !ok && cloudConfig["packages"] != nil {
+		return nil, errors.New("packages in user-data must be a list")
+	}
+	runcmd, ok := cloudConfig["runcmd"].([]interface{})
+	if !ok && cloudConfig["runcmd"] != nil {
+		return nil, errors.New("runcmd in user-data must be a list")
+	}
+	cloudConfig["packages"] = append(packages, "qemu-guest-agent")
+	if c.GuestDistro() == DistroAlpine {
+		cloudConfig["runcmd"] = append(runcmd, "rc-update add qemu-guest-agent default", "rc-service qemu-guest-agent restart")
+	} else {
+		cloudConfig["runcmd"] = append(runcmd, "systemctl enable --now qemu-guest-agent")
+	}
+
+	merged, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), merged...), nil
+}
@@ -0,0 +1,52 @@
+package qemu
+
+import (
+	"errors"
+	"strings"
+)
+
+// AudioBackends returns the audio backends qemu-system-arch was built with
+func AudioBackends(arch string) ([]string, error) {
+	out, err := command("qemu-system-"+arch, "-audiodev", "help").Output()
+	if err != nil {
+		return nil, errors.New("unable to list the audio backends of qemu-system-" + arch + ": " + err.Error())
+	}
+	// Available audio drivers:
+	// none
+	// coreaudio
+	backends := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasSuffix(line, ":") {
+			backends = append(backends, line)
+		}
+	}
+	return backends, nil
+}
+
+// CheckAudio returns an error unless qemu-system-arch can play and record through Core Audio
+func CheckAudio(arch string) error {
+	backends, err := AudioBackends(arch)
+	if err != nil {
+		return err
+	}
+	for _, backend := range backends {
+		if backend == "coreaudio" {
+			return nil
+		}
+	}
+	return errors.New("qemu-system-" + arch + " was built without coreaudio support, which audio requires. install qemu with `brew install qemu`")
+}
+
+// audioArgs returns the qemu arguments that add an Intel HD Audio sound card played and recorded
+// through Core Audio. The card is emulated on both architectures and supported by stock guest kernels.
+func (c *MachineConfig) audioArgs() []string {
+	if !c.Audio {
+		return nil
+	}
+	return []string{
+		"-audiodev", "coreaudio,id=audio0",
+		"-device", "intel-hda",
+		"-device", "hda-duplex,audiodev=audio0",
+	}
+}
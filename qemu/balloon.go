@@ -0,0 +1,64 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// balloonArgs returns the qemu arguments that add a memory balloon device
+func (c *MachineConfig) balloonArgs() []string {
+	if !c.Balloon {
+		return nil
+	}
+	return []string{"-device", "virtio-balloon-pci,id=balloon0"}
+}
+
+// BalloonSize returns the memory the guest currently has, in MB
+func (c *MachineConfig) BalloonSize() (int64, error) {
+	q, err := c.balloonQMP()
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+
+	out, err := q.Execute("query-balloon", nil)
+	if err != nil {
+		return 0, err
+	}
+	var info struct {
+		Actual int64 `json:"actual"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, err
+	}
+	return info.Actual >> 20, nil
+}
+
+// SetBalloonSize asks the guest to shrink or grow its memory to sizeMB, at most the memory the
+// instance was started with. The guest balloon driver applies the request asynchronously.
+func (c *MachineConfig) SetBalloonSize(sizeMB int64) error {
+	memory, err := strconv.ParseInt(c.Memory, 10, 64)
+	if err == nil && sizeMB > memory {
+		return errors.New("cannot grow " + c.Alias + " beyond its configured memory of " + c.Memory + "M")
+	}
+	if sizeMB < 64 {
+		return errors.New("balloon target must be at least 64M")
+	}
+
+	q, err := c.balloonQMP()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	_, err = q.Execute("balloon", map[string]interface{}{"value": sizeMB << 20})
+	return err
+}
+
+func (c *MachineConfig) balloonQMP() (*QMPClient, error) {
+	if !c.Balloon {
+		return nil, errors.New(c.Alias + " has no memory balloon, enable it with `alpine set " + c.Alias + " --balloon` and restart it")
+	}
+	return c.QMP()
+}
@@ -0,0 +1,141 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Distros of the cloud images launch-cloud can download. cloud-init creates a default user named
+// after the distro in each of them.
+const (
+	DistroAlpine = "alpine"
+	DistroUbuntu = "ubuntu"
+	DistroDebian = "debian"
+)
+
+// debianCodenames maps Debian releases to the codenames their cloud images are published under
+var debianCodenames = map[string]string{"11": "bullseye", "12": "bookworm", "13": "trixie"}
+
+var alpineCloudVersion = regexp.MustCompile(`^(\d+)\.(\d+)\.\d+$`)
+var ubuntuCloudVersion = regexp.MustCompile(`^\d{2}\.\d{2}$`)
+
+// CloudImage is a cloud image named by launch-cloud --image
+type CloudImage struct {
+	Distro string
+	// File is the name the image is cached under
+	File string
+	URL  string
+}
+
+// ResolveCloudImage resolves launch-cloud --image for arch and firmware, the default of arch if empty:
+// alpine_3.21.2 (or just 3.21.2), ubuntu_24.04 or debian_12
+func ResolveCloudImage(image string, arch string, firmware string) (CloudImage, error) {
+	distro, version, found := strings.Cut(image, "_")
+	if !found {
+		distro, version = DistroAlpine, image
+	}
+	// cloud images name architectures the Debian way
+	debArch := map[string]string{"aarch64": "arm64", "x86_64": "amd64"}[arch]
+
+	switch distro {
+	case DistroAlpine:
+		m := alpineCloudVersion.FindStringSubmatch(version)
+		if m == nil {
+			return CloudImage{}, errors.New("invalid Alpine version " + version + ", expected e.g. alpine_3.21.2")
+		}
+		// Alpine publishes an image per firmware, Ubuntu and Debian images boot with either
+		if firmware == "" {
+			firmware = DefaultFirmware(arch)
+		}
+		file := fmt.Sprintf("nocloud_alpine-%s-%s-%s-cloudinit-r0.qcow2", version, arch, firmware)
+		return CloudImage{
+			Distro: DistroAlpine,
+			File:   file,
+			URL:    fmt.Sprintf("https://dl-cdn.alpinelinux.org/alpine/v%s.%s/releases/cloud/%s", m[1], m[2], file),
+		}, nil
+	case DistroUbuntu:
+		if !ubuntuCloudVersion.MatchString(version) {
+			return CloudImage{}, errors.New("invalid Ubuntu release " + version + ", expected e.g. ubuntu_24.04")
+		}
+		return CloudImage{
+			Distro: DistroUbuntu,
+			File:   "nocloud_ubuntu-" + version + "-" + arch + ".qcow2",
+			URL: fmt.Sprintf("https://cloud-images.ubuntu.com/releases/%s/release/ubuntu-%s-server-cloudimg-%s.img",
+				version, version, debArch),
+		}, nil
+	case DistroDebian:
+		codename, ok := debianCodenames[version]
+		if !ok {
+			return CloudImage{}, errors.New("unsupported Debian release " + version + ", expected debian_11, debian_12 or debian_13")
+		}
+		return CloudImage{
+			Distro: DistroDebian,
+			File:   "nocloud_debian-" + version + "-" + arch + ".qcow2",
+			URL: fmt.Sprintf("https://cloud.debian.org/images/cloud/%s/latest/debian-%s-generic-%s.qcow2",
+				codename, version, debArch),
+		}, nil
+	}
+	return CloudImage{}, errors.New("unsupported cloud image " + image + ", expected alpine_<version>, ubuntu_<release> or debian_<release>")
+}
+
+// CloudImageDistro guesses the distro of a cloud image downloaded from rawURL from its file name,
+// falling back to Alpine
+func CloudImageDistro(rawURL string) string {
+	name := strings.ToLower(path.Base(rawURL))
+	for _, distro := range []string{DistroUbuntu, DistroDebian} {
+		if strings.Contains(name, distro) {
+			return distro
+		}
+	}
+	return DistroAlpine
+}
+
+// GuestDistro returns the distro of the instance. Instances that do not record one run Alpine.
+func (c *MachineConfig) GuestDistro() string {
+	if c.Distro == "" {
+		return DistroAlpine
+	}
+	return c.Distro
+}
+
+// edk2Dirs are searched for the UEFI firmware qemu ships, for Apple silicon and Intel Homebrew
+var edk2Dirs = []string{"/opt/homebrew/share/qemu", "/usr/local/share/qemu"}
+
+// edk2Firmware returns the path of the UEFI firmware qemu ships for arch
+func edk2Firmware(arch string) string {
+	return edk2File("edk2-" + arch + "-code.fd")
+}
+
+// edk2VarsTemplate returns the path of the empty UEFI variable store qemu ships for arch
+func edk2VarsTemplate(arch string) string {
+	if arch == "x86_64" {
+		return edk2File("edk2-i386-vars.fd")
+	}
+	return edk2File("edk2-arm-vars.fd")
+}
+
+// edk2File returns the path of a firmware file qemu ships, next to the qemu binary on $PATH if it
+// is not in a Homebrew prefix
+func edk2File(file string) string {
+	dirs := append([]string{}, edk2Dirs...)
+	for _, name := range []string{"qemu-system-aarch64", "qemu-system-x86_64"} {
+		if qemu, err := exec.LookPath(name); err == nil {
+			if resolved, err := filepath.EvalSymlinks(qemu); err == nil {
+				qemu = resolved
+			}
+			dirs = append(dirs, filepath.Join(filepath.Dir(filepath.Dir(qemu)), "share", "qemu"))
+		}
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return filepath.Join(dir, file)
+		}
+	}
+	return filepath.Join(edk2Dirs[0], file)
+}
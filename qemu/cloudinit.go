@@ -0,0 +1,168 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+const metadataTemplate = `instance-id: %s
+local-hostname: %s
+`
+
+const dhcpNetworkConfig = `version: 2
+ethernets:
+  eth0:
+    dhcp4: true
+    dhcp6: true
+    optional: true
+    nameservers:
+      addresses: [8.8.8.8, 8.8.4.4]
+    dhcp4-overrides:
+      send-hostname: true
+      use-hostname: true
+      use-mtu: true
+    routes:
+      - to: 0.0.0.0/0
+        via: 10.0.2.2
+        metric: 100
+`
+
+const staticNetworkConfig = `version: 2
+ethernets:
+  eth0:
+    dhcp4: false
+    dhcp6: false
+    addresses: [%s]
+    nameservers:
+      addresses: [8.8.8.8, 8.8.4.4]
+`
+
+const macMatchConfig = `  eth0:
+    match:
+      macaddress: "%s"
+    set-name: eth0
+`
+
+const staticRouteConfig = `    routes:
+      - to: 0.0.0.0/0
+        via: %s
+`
+
+// CloudNetworkConfig returns the cloud-init network-config (version 2) for the instance.
+// A user supplied file takes precedence over a static address, which takes precedence over DHCP.
+func (c *MachineConfig) CloudNetworkConfig() ([]byte, error) {
+	if c.NetworkConfig != "" {
+		network, err := os.ReadFile(c.NetworkConfig)
+		if err != nil {
+			return nil, errors.New("unable to read network-config: " + err.Error())
+		}
+		return network, nil
+	}
+
+	network := dhcpNetworkConfig
+	if c.StaticIP != "" {
+		network = fmt.Sprintf(staticNetworkConfig, c.StaticIP)
+		if c.Gateway != "" {
+			network += fmt.Sprintf(staticRouteConfig, c.Gateway)
+		}
+	}
+
+	// Ubuntu and Debian name interfaces by their PCI slot, so the interface is matched by its MAC address
+	if c.GuestDistro() != DistroAlpine && c.MACAddress != "" {
+		network = strings.Replace(network, "  eth0:\n", fmt.Sprintf(macMatchConfig, c.MACAddress), 1)
+	}
+	return []byte(network), nil
+}
+
+// RenewInstanceID assigns a fresh cloud-init instance-id, so that cloud-init treats the
+// next boot as a first boot and applies the seed again
+func (c *MachineConfig) RenewInstanceID() error {
+	id, err := utils.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	c.InstanceID = c.Alias + "-" + id
+	return nil
+}
+
+// cloudMetaData merges the stored meta-data, if any, with the instance identity managed by macpine
+func (c *MachineConfig) cloudMetaData(path string) ([]byte, error) {
+	instanceID := c.InstanceID
+	if instanceID == "" {
+		instanceID = c.Alias
+	}
+
+	stored, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []byte(fmt.Sprintf(metadataTemplate, instanceID, c.Alias)), nil
+	} else if err != nil {
+		return nil, errors.New("unable to read meta-data: " + err.Error())
+	}
+
+	metaData := map[string]interface{}{}
+	if err := yaml.Unmarshal(stored, &metaData); err != nil {
+		return nil, errors.New("unable to parse meta-data: " + err.Error())
+	}
+	metaData["instance-id"] = instanceID
+	if _, ok := metaData["local-hostname"]; !ok {
+		metaData["local-hostname"] = c.Alias
+	}
+	return yaml.Marshal(metaData)
+}
+
+// WriteCloudInitSeed writes the NoCloud meta-data, user-data and network-config files to the
+// instance directory and packs them, with any vendor-data, into the cidata.iso seed attached at boot
+func (c *MachineConfig) WriteCloudInitSeed() error {
+	userData := filepath.Join(c.Location, "user-data")
+	metaData := filepath.Join(c.Location, "meta-data")
+	networkConfig := filepath.Join(c.Location, "network-config")
+	vendorData := filepath.Join(c.Location, "vendor-data")
+	seed := filepath.Join(c.Location, "cidata.iso")
+
+	if _, err := os.Stat(userData); err != nil {
+		return errors.New("unable to find user-data: " + err.Error())
+	}
+
+	meta, err := c.cloudMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	err = utils.WriteFileAtomic(metaData, meta, 0644)
+	if err != nil {
+		return errors.New("unable to create meta-data file: " + err.Error())
+	}
+
+	network, err := c.CloudNetworkConfig()
+	if err != nil {
+		return err
+	}
+	err = utils.WriteFileAtomic(networkConfig, network, 0644)
+	if err != nil {
+		return errors.New("unable to create network-config file: " + err.Error())
+	}
+
+	if !utils.CommandExists("mkisofs") {
+		return errors.New("mkisofs is not available on $PATH. install it with `brew install cdrtools`")
+	}
+
+	args := []string{"-output", seed, "-volid", "cidata", "-joliet", "-rock", userData, metaData, networkConfig}
+	if _, err := os.Stat(vendorData); err == nil {
+		args = append(args, vendorData)
+	}
+	cmd := command("mkisofs", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return errors.New("unable to create cloud-init iso: " + err.Error())
+	}
+
+	c.ISO = seed
+	return nil
+}
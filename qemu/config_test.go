@@ -0,0 +1,70 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+func TestGetMachineConfigForStop(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(utils.DataDirEnv, dataDir)
+	fixture, err := os.ReadFile(filepath.Join("testdata", "config-v1.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		// broken configurations cannot be read at all, invalid ones only fail Validate
+		broken bool
+	}{
+		{"valid", string(fixture), false},
+		{"invalid", strings.Replace(string(fixture), `cpu: "2"`, `cpu: "0"`, 1), false},
+		{"renamed", strings.Replace(string(fixture), "alias: one", "alias: \"\"", 1), false},
+		{"garbage", "cpu: [\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location := filepath.Join(dataDir, tt.name)
+			if err := os.MkdirAll(location, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(location, "config.yaml"), []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := GetMachineConfigForStop(tt.name)
+			if tt.broken {
+				if err == nil {
+					t.Errorf("GetMachineConfigForStop() = %+v, want an error", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetMachineConfigForStop() = %v", err)
+			}
+
+			_, err = GetMachineConfig(tt.name)
+			var invalid *ConfigError
+			if tt.name == "valid" {
+				if err != nil {
+					t.Fatalf("GetMachineConfig() = %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &invalid) {
+				t.Errorf("GetMachineConfig() = %v, want a *ConfigError", err)
+			}
+			// the pidfile and disk are found from the instance directory
+			if c.Alias != tt.name || c.Location != location {
+				t.Errorf("GetMachineConfigForStop() named %s at %s, want %s at %s", c.Alias, c.Location, tt.name, location)
+			}
+		})
+	}
+}
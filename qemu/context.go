@@ -0,0 +1,18 @@
+package qemu
+
+import (
+	"context"
+	"time"
+)
+
+// sleep pauses for d, returning early with the context error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
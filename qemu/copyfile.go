@@ -0,0 +1,152 @@
+package qemu
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileCopy is a host file injected into the instance at launch
+type FileCopy struct {
+	Source string `yaml:"source" json:"source"`
+	Dest   string `yaml:"dest" json:"dest"`
+	Mode   string `yaml:"mode" json:"mode"`
+}
+
+func (f FileCopy) String() string {
+	return f.Source + " -> " + f.Dest + " (" + f.Mode + ")"
+}
+
+// ParseFileCopy parses a hostpath:guestpath[:mode] specification. The guest path must be
+// absolute and the mode is octal, defaulting to the permissions of the host file.
+func ParseFileCopy(spec string) (FileCopy, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return FileCopy{}, errors.New("invalid --copy-file " + spec + ", expected hostpath:guestpath[:mode]")
+	}
+
+	source, err := filepath.Abs(parts[0])
+	if err != nil {
+		return FileCopy{}, err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return FileCopy{}, errors.New("unable to read " + parts[0] + ": " + err.Error())
+	}
+	if info.IsDir() {
+		return FileCopy{}, errors.New(parts[0] + " is a directory, only files can be copied")
+	}
+
+	if !path.IsAbs(parts[1]) {
+		return FileCopy{}, errors.New("guest path " + parts[1] + " must be absolute")
+	}
+	dest := parts[1]
+	if strings.HasSuffix(dest, "/") {
+		dest = path.Join(dest, filepath.Base(source))
+	}
+
+	mode := fmt.Sprintf("%04o", info.Mode().Perm())
+	if len(parts) == 3 {
+		m, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || m > 07777 {
+			return FileCopy{}, errors.New("invalid mode " + parts[2] + " for " + dest + ", expected octal such as 0644")
+		}
+		mode = fmt.Sprintf("%04o", m)
+	}
+
+	return FileCopy{Source: source, Dest: dest, Mode: mode}, nil
+}
+
+func (f FileCopy) fileMode() os.FileMode {
+	m, _ := strconv.ParseUint(f.Mode, 8, 32)
+	return os.FileMode(m)
+}
+
+// InjectFiles copies the configured files into the running instance over SFTP as root,
+// creating parent directories
+func (c *MachineConfig) InjectFiles() error {
+	if len(c.CopyFiles) == 0 {
+		return nil
+	}
+
+	conn, err := c.Dial(true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sftp, err := NewSFTPClient(conn)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	for _, f := range c.CopyFiles {
+		if err := injectFile(sftp, f); err != nil {
+			return fmt.Errorf("unable to copy %s to %s:%s: %v", f.Source, c.Alias, f.Dest, err)
+		}
+	}
+	return nil
+}
+
+func injectFile(sftp *SFTPClient, f FileCopy) error {
+	src, err := os.Open(f.Source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := sftp.MkdirAll(path.Dir(f.Dest), 0755); err != nil {
+		return err
+	}
+	return sftp.WriteFile(f.Dest, src, f.fileMode())
+}
+
+// AddCloudWriteFiles embeds the configured files into #cloud-config user-data as write_files entries
+func (c *MachineConfig) AddCloudWriteFiles(userData []byte) ([]byte, error) {
+	if len(c.CopyFiles) == 0 {
+		return userData, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(userData)), "#cloud-config") {
+		return nil, errors.New("--copy-file requires #cloud-config user-data, files cannot be added to scripts or multipart user-data")
+	}
+
+	cloudConfig := map[string]interface{}{}
+	if err := yaml.Unmarshal(userData, &cloudConfig); err != nil {
+		return nil, errors.New("unable to parse user-data: " + err.Error())
+	}
+	if cloudConfig == nil {
+		cloudConfig = map[string]interface{}{}
+	}
+
+	writeFiles, ok := cloudConfig["write_files"].([]interface{})
+	if !ok && cloudConfig["write_files"] != nil {
+		return nil, errors.New("write_files in user-data must be a list")
+	}
+	for _, f := range c.CopyFiles {
+		content, err := os.ReadFile(f.Source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s for %s: %v", f.Source, f.Dest, err)
+		}
+		writeFiles = append(writeFiles, map[string]interface{}{
+			"path":        f.Dest,
+			"content":     base64.StdEncoding.EncodeToString(content),
+			"encoding":    "b64",
+			"permissions": f.Mode,
+		})
+	}
+	cloudConfig["write_files"] = writeFiles
+
+	merged, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), merged...), nil
+}
@@ -0,0 +1,102 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DataDisk is an additional disk attached to the instance next to its root disk
+type DataDisk struct {
+	Name   string `yaml:"name" json:"name"`
+	Size   string `yaml:"size" json:"size"`
+	Format string `yaml:"format" json:"format"`
+}
+
+func (d DataDisk) String() string {
+	return d.Name + " (" + d.Size + " " + d.Format + ")"
+}
+
+var dataDiskSize = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+
+// ParseDataDisk parses a SIZE[:format] specification, the format defaults to qcow2
+func ParseDataDisk(spec string) (DataDisk, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 || !dataDiskSize.MatchString(parts[0]) {
+		return DataDisk{}, errors.New("invalid disk " + spec + ", expected SIZE[:format] such as 20G or 20G:raw")
+	}
+	d := DataDisk{Size: parts[0], Format: DiskFormatQcow2}
+	if len(parts) == 2 {
+		format, err := ParseDiskFormat(parts[1])
+		if err != nil {
+			return DataDisk{}, err
+		}
+		d.Format = format
+	}
+	return d, nil
+}
+
+// DataDiskPath returns the location of a data disk image in the instance directory
+func (c *MachineConfig) DataDiskPath(d DataDisk) string {
+	return filepath.Join(c.Location, d.Name+"."+d.Format)
+}
+
+// AddDataDisk creates an empty disk image in the instance directory and records it in the
+// configuration under the next free dataN name
+func (c *MachineConfig) AddDataDisk(d DataDisk) (DataDisk, error) {
+	for i := 1; ; i++ {
+		name := "data" + strconv.Itoa(i)
+		if c.dataDiskIndex(name) < 0 {
+			d.Name = name
+			break
+		}
+	}
+
+	out, err := command("qemu-img", "create", "-f", d.Format, c.DataDiskPath(d), d.Size).CombinedOutput()
+	if err != nil {
+		return DataDisk{}, errors.New("unable to create " + d.Name + ": " + strings.TrimSpace(string(out)))
+	}
+	c.DataDisks = append(c.DataDisks, d)
+	return d, nil
+}
+
+// RemoveDataDisk detaches a data disk and deletes its image
+func (c *MachineConfig) RemoveDataDisk(name string) error {
+	i := c.dataDiskIndex(name)
+	if i < 0 {
+		return errors.New(c.Alias + " has no disk " + name)
+	}
+	if err := os.Remove(c.DataDiskPath(c.DataDisks[i])); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	c.DataDisks = append(c.DataDisks[:i], c.DataDisks[i+1:]...)
+	return nil
+}
+
+func (c *MachineConfig) dataDiskIndex(name string) int {
+	for i, d := range c.DataDisks {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// dataDriveArgs returns the qemu arguments that attach the data disks, on the same interface as the root disk
+func (c *MachineConfig) dataDriveArgs() []string {
+	args := []string{}
+	for _, d := range c.DataDisks {
+		drive := "format=" + d.Format + ",file=" + c.DataDiskPath(d)
+		if c.GetDiskInterface() == DiskInterfaceNVMe {
+			args = append(args,
+				"-drive", "if=none,id="+d.Name+","+drive,
+				"-device", "nvme,drive="+d.Name+",serial=macpine-"+d.Name)
+		} else {
+			args = append(args, "-drive", "if=virtio,"+drive)
+		}
+	}
+	return args
+}
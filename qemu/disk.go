@@ -0,0 +1,137 @@
+package qemu
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// DiskFormatQcow2 is the default, copy-on-write and compressible disk format
+	DiskFormatQcow2 = "qcow2"
+	// DiskFormatRaw is a plain disk image, trading features for I/O performance
+	DiskFormatRaw = "raw"
+)
+
+const (
+	// DiskInterfaceVirtio attaches the disk as virtio-blk, /dev/vda in the guest
+	DiskInterfaceVirtio = "virtio"
+	// DiskInterfaceNVMe attaches the disk as an NVMe controller, /dev/nvme0n1 in the guest
+	DiskInterfaceNVMe = "nvme"
+)
+
+// ParseDiskInterface validates a disk interface
+func ParseDiskInterface(iface string) (string, error) {
+	if iface != DiskInterfaceVirtio && iface != DiskInterfaceNVMe {
+		return "", errors.New("unsupported disk interface " + iface + ". use virtio or nvme")
+	}
+	return iface, nil
+}
+
+// GetDiskInterface returns how the disk is attached to the instance, virtio unless configured otherwise
+func (c *MachineConfig) GetDiskInterface() string {
+	if c.DiskInterface == "" {
+		return DiskInterfaceVirtio
+	}
+	return c.DiskInterface
+}
+
+// GuestDiskDevice returns the device name of the instance disk inside the guest
+func (c *MachineConfig) GuestDiskDevice() string {
+	if c.GetDiskInterface() == DiskInterfaceNVMe {
+		return "/dev/nvme0n1"
+	}
+	return "/dev/vda"
+}
+
+// GuestDiskPartition returns the device name of a partition of the instance disk inside the guest
+func (c *MachineConfig) GuestDiskPartition(n int) string {
+	if c.GetDiskInterface() == DiskInterfaceNVMe {
+		return c.GuestDiskDevice() + "p" + strconv.Itoa(n)
+	}
+	return c.GuestDiskDevice() + strconv.Itoa(n)
+}
+
+// driveArgs returns the qemu arguments that attach the instance disk
+func (c *MachineConfig) driveArgs() []string {
+	drive := "format=" + c.GetDiskFormat() + ",file=" + c.DiskPath()
+	if c.GetDiskInterface() == DiskInterfaceNVMe {
+		return []string{
+			"-drive", "if=none,id=disk0," + drive,
+			"-device", "nvme,drive=disk0,serial=macpine0",
+		}
+	}
+	return []string{"-drive", "if=virtio," + drive}
+}
+
+// ParseDiskFormat validates a disk image format
+func ParseDiskFormat(format string) (string, error) {
+	if format != DiskFormatQcow2 && format != DiskFormatRaw {
+		return "", errors.New("unsupported disk format " + format + ". use qcow2 or raw")
+	}
+	return format, nil
+}
+
+// GetDiskFormat returns the format of the instance disk image, qcow2 unless configured otherwise
+func (c *MachineConfig) GetDiskFormat() string {
+	if c.DiskFormat == "" {
+		return DiskFormatQcow2
+	}
+	return c.DiskFormat
+}
+
+// DiskPath returns the location of the instance disk image
+func (c *MachineConfig) DiskPath() string {
+	if c.GetDiskFormat() == DiskFormatRaw {
+		return filepath.Join(c.Location, strings.TrimSuffix(c.Image, ".qcow2")+".raw")
+	}
+	return filepath.Join(c.Location, c.Image)
+}
+
+// DiskUsage returns the space the instance disk image takes on the host and its virtual size
+func (c *MachineConfig) DiskUsage() (uint64, uint64, error) {
+	image := c.DiskPath()
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return 0, 0, err
+	}
+	actual := uint64(info.Size())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		// images are sparse, count the blocks actually in use
+		actual = uint64(stat.Blocks) * 512
+	}
+
+	if c.GetDiskFormat() == DiskFormatRaw {
+		return actual, uint64(info.Size()), nil
+	}
+
+	virtual, err := qcow2VirtualSize(image)
+	if err != nil {
+		return actual, 0, err
+	}
+	return actual, virtual, nil
+}
+
+// qcow2VirtualSize reads the virtual disk size from a qcow2 header, without needing qemu-img
+func qcow2VirtualSize(image string) (uint64, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != "QFI\xfb" {
+		return 0, errors.New(filepath.Base(image) + " is not a qcow2 image")
+	}
+	return binary.BigEndian.Uint64(header[24:32]), nil
+}
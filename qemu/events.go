@@ -0,0 +1,44 @@
+package qemu
+
+import (
+	"time"
+)
+
+// LaunchPhase names a step of launching an instance
+type LaunchPhase string
+
+const (
+	// PhaseValidating is emitted before the launch arguments are checked
+	PhaseValidating LaunchPhase = "validating"
+	// PhaseImageResolved is emitted once the base image is available in the cache
+	PhaseImageResolved LaunchPhase = "image-resolved"
+	// PhaseProcessStarted is emitted once the qemu process is running
+	PhaseProcessStarted LaunchPhase = "process-started"
+	// PhaseSSHReady is emitted once the instance accepts SSH connections
+	PhaseSSHReady LaunchPhase = "ssh-ready"
+	// PhaseCloudInitDone is emitted once cloud-init has finished in a cloud-init instance
+	PhaseCloudInitDone LaunchPhase = "cloud-init-done"
+	// PhaseLaunched is emitted when the launch has completed
+	PhaseLaunched LaunchPhase = "launched"
+	// PhaseFailed is emitted when the launch fails, with the error as message
+	PhaseFailed LaunchPhase = "failed"
+)
+
+// Event reports the progress of a launch
+type Event struct {
+	Time     time.Time   `json:"time"`
+	Phase    LaunchPhase `json:"phase"`
+	Instance string      `json:"instance"`
+	Message  string      `json:"message,omitempty"`
+}
+
+// EventFunc receives launch events
+type EventFunc func(Event)
+
+// Emit reports a launch phase to the configured event receiver, if any
+func (c *MachineConfig) Emit(phase LaunchPhase, message string) {
+	if c.Events == nil {
+		return
+	}
+	c.Events(Event{Time: time.Now().UTC(), Phase: phase, Instance: c.Alias, Message: message})
+}
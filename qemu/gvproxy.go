@@ -0,0 +1,156 @@
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/utils"
+)
+
+// gvproxyGuestIP is the address gvproxy leases to the instance
+const gvproxyGuestIP = "192.168.127.2"
+
+// gvproxyPaths are where podman and Homebrew install gvproxy, which is often not on $PATH
+var gvproxyPaths = []string{
+	"/opt/homebrew/opt/podman/libexec/podman/gvproxy",
+	"/usr/local/opt/podman/libexec/podman/gvproxy",
+	"/opt/podman/bin/gvproxy",
+	"/opt/homebrew/bin/gvproxy",
+	"/usr/local/bin/gvproxy",
+}
+
+// GvproxyPath returns the gvproxy executable, or "" when it is not installed
+func GvproxyPath() string {
+	if path, err := exec.LookPath("gvproxy"); err == nil {
+		return path
+	}
+	for _, path := range gvproxyPaths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// usesGvproxy reports whether the instance network goes through gvproxy. Instances launched with
+// --network gvproxy fall back to qemu's user-mode network on hosts without gvproxy.
+func (c *MachineConfig) usesGvproxy() bool {
+	return c.Network == NetworkGvproxy && GvproxyPath() != ""
+}
+
+// usesSlirp reports whether the instance uses qemu's user-mode network with hostfwd port forwarding
+func (c *MachineConfig) usesSlirp() bool {
+	return c.Network == NetworkUser || (c.Network == NetworkGvproxy && !c.usesGvproxy())
+}
+
+func (c *MachineConfig) gvproxySocket() string {
+	return filepath.Join(c.Location, "gvproxy.sock")
+}
+
+func (c *MachineConfig) gvproxyAPISocket() string {
+	return filepath.Join(c.Location, "gvproxy-api.sock")
+}
+
+func (c *MachineConfig) gvproxyPIDFile() string {
+	return filepath.Join(c.Location, "gvproxy.pid")
+}
+
+// startGvproxy starts the gvproxy process of the instance, forwarding its SSH port and --port mappings
+func (c *MachineConfig) startGvproxy() error {
+	c.stopGvproxy()
+
+	args := []string{
+		"-listen-qemu", "unix://" + c.gvproxySocket(),
+		"-listen", "unix://" + c.gvproxyAPISocket(),
+		"-ssh-port", c.SSHPort,
+		"-pid-file", c.gvproxyPIDFile(),
+		"-log-file", filepath.Join(c.Location, "gvproxy.log"),
+	}
+	cmd := command(GvproxyPath(), args...)
+	// gvproxy outlives this command, like the daemonized qemu it serves
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.New("unable to start gvproxy: " + err.Error())
+	}
+	cmd.Process.Release()
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(c.gvproxySocket()); err == nil {
+			break
+		}
+		if i == 50 {
+			c.stopGvproxy()
+			return errors.New("gvproxy did not start, see " + filepath.Join(c.Location, "gvproxy.log"))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ports, err := utils.ParsePort(c.Port)
+	if err != nil {
+		c.stopGvproxy()
+		return errors.New("error configuring ports: " + err.Error())
+	}
+	for _, p := range ports {
+		protocol := "tcp"
+		if p.Proto == utils.Udp {
+			protocol = "udp"
+		}
+		if err := c.gvproxyExpose(":"+strconv.Itoa(p.Host), gvproxyGuestIP+":"+strconv.Itoa(p.Guest), protocol); err != nil {
+			c.stopGvproxy()
+			return err
+		}
+	}
+	return nil
+}
+
+// gvproxyExpose forwards a host address to the instance through the gvproxy API
+func (c *MachineConfig) gvproxyExpose(local string, remote string, protocol string) error {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.gvproxyAPISocket())
+			},
+		},
+	}
+	body, _ := json.Marshal(map[string]string{"local": local, "remote": remote, "protocol": protocol})
+	resp, err := client.Post("http://gvproxy/services/forwarder/expose", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.New("unable to forward " + local + " through gvproxy: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unable to forward " + local + " through gvproxy: " + resp.Status)
+	}
+	return nil
+}
+
+// stopGvproxy stops the gvproxy process of the instance, if any
+func (c *MachineConfig) stopGvproxy() {
+	data, err := os.ReadFile(c.gvproxyPIDFile())
+	if err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+			if p, err := os.FindProcess(pid); err == nil {
+				if err := p.Signal(syscall.SIGTERM); err == nil {
+					log.Debugf("stopped gvproxy of %s (%d)", c.Alias, pid)
+				}
+			}
+		}
+	}
+	for _, path := range []string{c.gvproxyPIDFile(), c.gvproxySocket(), c.gvproxyAPISocket()} {
+		os.Remove(path)
+	}
+}
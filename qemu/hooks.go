@@ -0,0 +1,53 @@
+package qemu
+
+import "strings"
+
+// HookEvent is a point in the life of an instance where its hooks run
+type HookEvent string
+
+const (
+	HookPreStart   HookEvent = "prestart"
+	HookPostStart  HookEvent = "poststart"
+	HookPreStop    HookEvent = "prestop"
+	HookPostStop   HookEvent = "poststop"
+	HookPostDelete HookEvent = "postdelete"
+)
+
+// HookEvents lists the events in the order they happen
+var HookEvents = []HookEvent{HookPreStart, HookPostStart, HookPreStop, HookPostStop, HookPostDelete}
+
+// Hooks are host shell commands run around lifecycle events of the instance
+type Hooks struct {
+	PreStart   []string `yaml:"prestart,omitempty" json:"prestart,omitempty"`
+	PostStart  []string `yaml:"poststart,omitempty" json:"poststart,omitempty"`
+	PreStop    []string `yaml:"prestop,omitempty" json:"prestop,omitempty"`
+	PostStop   []string `yaml:"poststop,omitempty" json:"poststop,omitempty"`
+	PostDelete []string `yaml:"postdelete,omitempty" json:"postdelete,omitempty"`
+}
+
+// Commands returns the commands to run for event
+func (h Hooks) Commands(event HookEvent) []string {
+	switch event {
+	case HookPreStart:
+		return h.PreStart
+	case HookPostStart:
+		return h.PostStart
+	case HookPreStop:
+		return h.PreStop
+	case HookPostStop:
+		return h.PostStop
+	case HookPostDelete:
+		return h.PostDelete
+	}
+	return nil
+}
+
+func (h Hooks) String() string {
+	events := []string{}
+	for _, event := range HookEvents {
+		if commands := h.Commands(event); len(commands) > 0 {
+			events = append(events, string(event)+": "+strings.Join(commands, "; "))
+		}
+	}
+	return strings.Join(events, ", ")
+}
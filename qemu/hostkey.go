@@ -0,0 +1,143 @@
+package qemu
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	log "github.com/beringresearch/macpine/logging"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsFile is the file of the instance directory that holds the SSH host keys of the guest,
+// recorded the first time macpine connects to it
+const KnownHostsFile = "known_hosts"
+
+// HostKeyAlias names the instance in its known_hosts, so that the recorded keys hold whatever address
+// and port the instance is reached under and survive renames
+const HostKeyAlias = "macpine-instance"
+
+// errHostKeyChanged is returned when the guest presents a host key other than the recorded one
+var errHostKeyChanged = errors.New("host key changed")
+
+// KnownHostsPath returns the known_hosts of the instance
+func (c *MachineConfig) KnownHostsPath() string {
+	return filepath.Join(c.Location, KnownHostsFile)
+}
+
+// hostKeyCallback checks the host key of the guest against the known_hosts of the instance. Keys
+// are trusted on first use: the key of a guest without recorded keys is added to the file.
+func (c *MachineConfig) hostKeyCallback() ssh.HostKeyCallback {
+	path := c.KnownHostsPath()
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if _, err := os.Stat(path); err == nil {
+			check, err := knownhosts.New(path)
+			if err != nil {
+				return errors.New("unable to read " + path + ": " + err.Error())
+			}
+			var keyErr *knownhosts.KeyError
+			err = check(HostKeyAlias+":22", remote, key)
+			switch {
+			case err == nil:
+				return nil
+			case !errors.As(err, &keyErr):
+				return err
+			case len(keyErr.Want) > 0:
+				return errHostKeyChanged
+			}
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.New("unable to record host key: " + err.Error())
+		}
+		defer f.Close()
+		if _, err := f.WriteString(knownhosts.Line([]string{HostKeyAlias}, key) + "\n"); err != nil {
+			return errors.New("unable to record host key: " + err.Error())
+		}
+		log.Debugf("recorded %s host key of %s", key.Type(), c.Alias)
+		return nil
+	}
+}
+
+// hostKeyAlgorithms returns the host key algorithms of the keys recorded for the instance, so that
+// the guest presents a key that can be checked rather than another of its keys. It returns nil, any
+// algorithm, when no key is recorded.
+func (c *MachineConfig) hostKeyAlgorithms() []string {
+	data, err := os.ReadFile(c.KnownHostsPath())
+	if err != nil {
+		return nil
+	}
+	algorithms := []string{}
+	for len(data) > 0 {
+		var key ssh.PublicKey
+		_, _, key, _, data, err = ssh.ParseKnownHosts(data)
+		if err != nil {
+			break
+		}
+		if key.Type() == ssh.KeyAlgoRSA {
+			// RSA keys are signed with SHA-2 by current servers
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, key.Type())
+	}
+	if len(algorithms) == 0 {
+		return nil
+	}
+	return algorithms
+}
+
+// hostKeyChangedError explains a host key that does not match the recorded one
+func (c *MachineConfig) hostKeyChangedError() error {
+	return errors.New("the SSH host key of " + c.Alias + " does not match the one recorded in " + c.KnownHostsPath() +
+		". if its keys were regenerated on purpose, remove that file to trust the new ones")
+}
+
+// regenerateHostKeys replaces the SSH host keys of the guest with new ones
+const regenerateHostKeys = "rm -f /etc/ssh/ssh_host_*key* && ssh-keygen -A"
+
+// RotateHostKeys regenerates the SSH host keys of the running guest and records the new ones in the
+// known_hosts of the instance. Open sessions are kept, sshd restarts with the new keys.
+func (c *MachineConfig) RotateHostKeys() error {
+	restart := "rc-service sshd restart"
+	if c.GuestDistro() != DistroAlpine {
+		restart = "systemctl restart ssh || systemctl restart sshd"
+	}
+	if _, err := c.Exec(regenerateHostKeys+" && ("+restart+")", true); err != nil {
+		return errors.New("unable to regenerate host keys: " + err.Error())
+	}
+
+	if err := os.Remove(c.KnownHostsPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// the first connection records the new keys
+	conn, err := c.Dial(false)
+	if err != nil {
+		return errors.New("unable to record the new host keys: " + err.Error())
+	}
+	return conn.Close()
+}
+
+// HostKeyFingerprints returns the SHA256 fingerprints of the host keys recorded for the instance
+func (c *MachineConfig) HostKeyFingerprints() ([]string, error) {
+	data, err := os.ReadFile(c.KnownHostsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := []string{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		var key ssh.PublicKey
+		_, _, key, _, data, err = ssh.ParseKnownHosts(data)
+		if err != nil {
+			return nil, errors.New("unable to read " + c.KnownHostsPath() + ": " + err.Error())
+		}
+		fingerprints = append(fingerprints, key.Type()+" "+ssh.FingerprintSHA256(key))
+	}
+	return fingerprints, nil
+}
@@ -0,0 +1,62 @@
+package qemu
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelKey is the format of label keys, e.g. owner or team.example.com/project
+var labelKey = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.\-/]*[a-zA-Z0-9])?$`)
+
+// ParseLabel parses a key=value label. Values may be empty, but not span lines.
+func ParseLabel(spec string) (string, string, error) {
+	key, value, found := strings.Cut(spec, "=")
+	if !found {
+		return "", "", errors.New("invalid label " + spec + ", expected key=value")
+	}
+	if !labelKey.MatchString(key) {
+		return "", "", errors.New("invalid label key " + key + ", expected letters, digits, _, -, . and /, starting and ending with a letter or digit")
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", "", errors.New("invalid value for label " + key + ", labels must fit on one line")
+	}
+	return key, value, nil
+}
+
+// ParseLabels parses key=value labels, as passed to --label
+func ParseLabels(specs []string) (map[string]string, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, spec := range specs {
+		key, value, err := ParseLabel(spec)
+		if err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// HasLabels reports whether the instance has every label of filters, with the same value
+func (c *MachineConfig) HasLabels(filters map[string]string) bool {
+	for key, value := range filters {
+		if v, ok := c.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// LabelStrings renders the labels of the instance as key=value, sorted by key
+func (c *MachineConfig) LabelStrings() []string {
+	labels := []string{}
+	for key, value := range c.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	return labels
+}
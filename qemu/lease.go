@@ -0,0 +1,102 @@
+package qemu
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dhcpdLeases is where macOS records the leases it hands out on vmnet networks
+const dhcpdLeases = "/var/db/dhcpd_leases"
+
+// DiscoverIP returns the current vmnet address of the instance, from the host's DHCP leases, the
+// ARP cache or the guest's boot log, in that order. It returns "" if none knows the address yet.
+func (c *MachineConfig) DiscoverIP() string {
+	if ip := c.leaseIP(); ip != "" {
+		return ip
+	}
+	if ip := c.arpIP(); ip != "" {
+		return ip
+	}
+	return c.GetIPFromLogFile()
+}
+
+// leaseIP looks the instance MAC address up in the vmnet DHCP leases. Entries are blocks of
+// key=value lines, hw_address is "1,<mac>" with leading zeros of each octet dropped.
+func (c *MachineConfig) leaseIP() string {
+	f, err := os.Open(dhcpdLeases)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	mac := normalizeMAC(c.MACAddress)
+	if mac == "" {
+		return ""
+	}
+
+	ip, hw := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "{":
+			ip, hw = "", ""
+		case strings.HasPrefix(line, "ip_address="):
+			ip = strings.TrimPrefix(line, "ip_address=")
+		case strings.HasPrefix(line, "hw_address="):
+			hw = strings.TrimPrefix(line, "hw_address=")
+			if _, addr, found := strings.Cut(hw, ","); found {
+				hw = addr
+			}
+		case line == "}":
+			// the file lists the most recent lease first
+			if ip != "" && normalizeMAC(hw) == mac {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+var arpEntry = regexp.MustCompile(`\((\d+\.\d+\.\d+\.\d+)\) at (\S+)`)
+
+// arpIP looks the instance MAC address up in the host ARP cache, which knows guests that have
+// talked to the host even when their lease is not recorded
+func (c *MachineConfig) arpIP() string {
+	mac := normalizeMAC(c.MACAddress)
+	if mac == "" {
+		return ""
+	}
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := arpEntry.FindStringSubmatch(line)
+		if m != nil && normalizeMAC(m[2]) == mac {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// normalizeMAC writes a MAC address with two lowercase hex digits per octet, so that the
+// abbreviated forms used by macOS compare equal. Invalid addresses normalize to "".
+func normalizeMAC(mac string) string {
+	octets := strings.Split(mac, ":")
+	if len(octets) != 6 {
+		return ""
+	}
+	for i, o := range octets {
+		n, err := strconv.ParseUint(o, 16, 8)
+		if err != nil {
+			return ""
+		}
+		octets[i] = strconv.FormatUint(n|0x100, 16)[1:]
+	}
+	return strings.Join(octets, ":")
+}
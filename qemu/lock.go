@@ -0,0 +1,180 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrInstanceExists is returned by ReserveInstance when the name is taken
+var ErrInstanceExists = errors.New("already exists")
+
+// LockTimeout is how long commands wait for another command to release an instance
+var LockTimeout = 3 * time.Second
+
+// InstanceLock is an exclusive advisory lock on an instance directory. It is released by Unlock,
+// or by the kernel when the holding process exits. Locking is not reentrant: a second lock on the
+// instance waits for the first even within this process, so that goroutines exclude each other
+// like commands do. Code that runs under a lock is handed it on the MachineConfig it works on, see
+// MachineConfig.Lock and SetLock.
+type InstanceLock struct {
+	file *os.File
+}
+
+func lockPath(location string) string {
+	return filepath.Join(location, ".lock")
+}
+
+// Lock waits up to LockTimeout for exclusive access to the instance and records the lock in c, so
+// that SaveMachineConfig writes c under it
+func (c *MachineConfig) Lock() (*InstanceLock, error) {
+	lock, err := LockInstance(c.Alias, c.Location)
+	if err != nil {
+		return nil, err
+	}
+	c.lock = lock
+	return lock, nil
+}
+
+// SetLock records that the caller holds lock on the instance of c, e.g. from LockInstance or
+// ReserveInstance, so that SaveMachineConfig writes c under it rather than waiting for it
+func (c *MachineConfig) SetLock(lock *InstanceLock) {
+	c.lock = lock
+}
+
+// Held reports whether the lock is taken and not yet released
+func (l *InstanceLock) Held() bool {
+	return l != nil && l.file != nil
+}
+
+// LockInstance locks the instance directory at location, which must exist
+func LockInstance(vmName string, location string) (*InstanceLock, error) {
+	path := lockPath(location)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("unknown instance " + vmName)
+		}
+		return nil, errors.New("unable to lock " + vmName + ": " + err.Error())
+	}
+
+	// flocks on separate descriptors exclude each other, also within one process
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, errors.New("unable to lock " + vmName + ": " + err.Error())
+		}
+		if time.Now().After(deadline) {
+			holder, _ := os.ReadFile(path)
+			f.Close()
+			return nil, errors.New("instance " + vmName + " is busy (locked by PID " + strings.TrimSpace(string(holder)) + ")")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the holder may have deleted the instance while we waited, leaving us a lock on a removed file
+	current, err := os.Stat(path)
+	locked, statErr := f.Stat()
+	if err != nil || statErr != nil || !os.SameFile(current, locked) {
+		f.Close()
+		return nil, errors.New("unknown instance " + vmName)
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &InstanceLock{file: f}, nil
+}
+
+// LockMachineConfig locks an instance and loads its configuration, so that the configuration cannot
+// change until the lock is released. A configuration written by an older release is migrated and
+// written back while the lock is held.
+func LockMachineConfig(vmName string) (MachineConfig, *InstanceLock, error) {
+	machineConfig, err := GetMachineConfig(vmName)
+	if err != nil {
+		return machineConfig, nil, err
+	}
+	lock, err := machineConfig.Lock()
+	if err != nil {
+		return machineConfig, nil, err
+	}
+	// another command may have rewritten the configuration while we waited
+	machineConfig, migrated, err := loadMachineConfig(vmName)
+	if err != nil {
+		lock.Unlock()
+		return machineConfig, nil, err
+	}
+	machineConfig.SetLock(lock)
+	if migrated {
+		if err := SaveMachineConfig(machineConfig); err != nil {
+			lock.Unlock()
+			return machineConfig, nil, err
+		}
+	}
+	return machineConfig, lock, nil
+}
+
+// LockMachineConfigForStop is LockMachineConfig for stopping and deleting an instance, which also
+// returns a configuration that only fails Validate, as GetMachineConfigForStop does
+func LockMachineConfigForStop(vmName string) (MachineConfig, *InstanceLock, error) {
+	machineConfig, err := GetMachineConfigForStop(vmName)
+	if err != nil {
+		return machineConfig, nil, err
+	}
+	lock, err := LockInstance(vmName, machineConfig.Location)
+	if err != nil {
+		return machineConfig, nil, err
+	}
+	// another command may have rewritten the configuration while we waited
+	machineConfig, err = GetMachineConfigForStop(vmName)
+	if err != nil {
+		lock.Unlock()
+		return machineConfig, nil, err
+	}
+	machineConfig.SetLock(lock)
+	return machineConfig, lock, nil
+}
+
+// ReserveInstance creates the directory of a new instance and locks it, failing if the name is taken
+func ReserveInstance(vmName string, location string) (*InstanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(location, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("instance %s %w", vmName, ErrInstanceExists)
+		}
+		return nil, err
+	}
+	return LockInstance(vmName, location)
+}
+
+// Reserve reserves the directory of a new instance as ReserveInstance does and records the lock in c
+func (c *MachineConfig) Reserve() (*InstanceLock, error) {
+	lock, err := ReserveInstance(c.Alias, c.Location)
+	if err != nil {
+		return nil, err
+	}
+	c.lock = lock
+	return lock, nil
+}
+
+// Unlock releases the lock. It is safe to call on a nil lock and more than once.
+func (l *InstanceLock) Unlock() {
+	if !l.Held() {
+		return
+	}
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+}
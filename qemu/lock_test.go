@@ -0,0 +1,78 @@
+package qemu
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockInstanceSerializesGoroutines(t *testing.T) {
+	location := t.TempDir()
+
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := LockInstance("web", location)
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if maxHolders != 1 {
+		t.Errorf("%d goroutines held the lock of one instance at the same time", maxHolders)
+	}
+}
+
+func TestSaveMachineConfigUnderLock(t *testing.T) {
+	timeout := LockTimeout
+	LockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { LockTimeout = timeout })
+
+	c := MachineConfig{Alias: "web", Location: t.TempDir()}
+	lock, err := c.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the configuration that holds the lock is written under it
+	if err := SaveMachineConfig(c); err != nil {
+		t.Errorf("SaveMachineConfig() of the locked configuration: %v", err)
+	}
+	// a copy loaded elsewhere waits for the lock like another command would
+	other := MachineConfig{Alias: c.Alias, Location: c.Location}
+	if err := SaveMachineConfig(other); err == nil {
+		t.Error("SaveMachineConfig() wrote a configuration while another holds the instance lock")
+	}
+
+	lock.Unlock()
+	if c.lock.Held() {
+		t.Error("the lock is still held after Unlock")
+	}
+	if err := SaveMachineConfig(other); err != nil {
+		t.Errorf("SaveMachineConfig() once the lock is released: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package qemu
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// CurrentConfigVersion is the config.yaml schema written by this release. Configurations without a
+// version predate versioning and are migrated on load.
+const CurrentConfigVersion = 2
+
+// migrateConfig brings a configuration written by an older release up to CurrentConfigVersion,
+// filling the defaults that older releases left implicit. Each version is migrated from the one
+// before it, in order. It reports whether anything changed.
+func migrateConfig(c *MachineConfig) (bool, error) {
+	if c.ConfigVersion > CurrentConfigVersion {
+		return false, errors.New("configuration of " + c.Alias + " has version " + strconv.Itoa(c.ConfigVersion) +
+			", newer than this macpine supports (" + strconv.Itoa(CurrentConfigVersion) + "). please upgrade macpine")
+	}
+	if c.ConfigVersion == CurrentConfigVersion {
+		return false, nil
+	}
+
+	if c.ConfigVersion < 1 {
+		if err := migrateConfigV1(c); err != nil {
+			return false, err
+		}
+	}
+	if c.ConfigVersion < 2 {
+		c.setDefaults()
+	}
+
+	c.ConfigVersion = CurrentConfigVersion
+	return true, nil
+}
+
+// migrateConfigV1 migrates version 0 to 1, spelling out what Start and Dial used to assume
+func migrateConfigV1(c *MachineConfig) error {
+	if c.Arch == "" {
+		switch {
+		case strings.Contains(c.Image, "aarch64"):
+			c.Arch = "aarch64"
+		case strings.Contains(c.Image, "x86_64"):
+			c.Arch = "x86_64"
+		}
+	}
+	if c.Location == "" {
+		dataDir, err := utils.DataDir()
+		if err != nil {
+			return err
+		}
+		c.Location = filepath.Join(dataDir, c.Alias)
+	}
+	if c.SSHUser == "" {
+		c.SSHUser = "root"
+	}
+	if c.RootUsername == "" {
+		c.RootUsername = "root"
+	}
+	if c.RootPassword == nil {
+		rootPassword := "root"
+		c.RootPassword = &rootPassword
+	}
+	if c.Tags == nil {
+		c.Tags = []string{}
+	}
+	return nil
+}
+
+// setDefaults writes out the settings that are implied when left empty, so that config.yaml shows
+// what the instance runs with. It is the migration from version 1 to 2, which added these settings
+// with defaults matching how earlier instances ran.
+func (c *MachineConfig) setDefaults() {
+	c.DiskFormat = c.GetDiskFormat()
+	c.DiskInterface = c.GetDiskInterface()
+	c.RestartPolicy = c.GetRestartPolicy()
+	c.Distro = c.GuestDistro()
+	c.Firmware = c.GetFirmware()
+}
@@ -0,0 +1,149 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+func readFixture(t *testing.T, name string) MachineConfig {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c MachineConfig
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMigrateConfig(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv(utils.DataDirEnv, dataDir)
+	root := "root"
+
+	tests := []struct {
+		fixture string
+		want    MachineConfig
+	}{
+		{
+			fixture: "config-v0.yaml",
+			want: MachineConfig{
+				ConfigVersion: CurrentConfigVersion,
+				Alias:         "old",
+				Image:         "alpine_3.16.0-aarch64.qcow2",
+				Arch:          "aarch64",
+				CPU:           "4",
+				Memory:        "2048",
+				Disk:          "10G",
+				MachineIP:     "localhost",
+				Port:          "8080",
+				Network:       NetworkUser,
+				SSHPort:       "2022",
+				SSHUser:       "root",
+				SSHPassword:   "root",
+				RootUsername:  "root",
+				RootPassword:  &root,
+				Location:      filepath.Join(dataDir, "old"),
+				Tags:          []string{},
+				DiskFormat:    DiskFormatQcow2,
+				DiskInterface: DiskInterfaceVirtio,
+				RestartPolicy: RestartNo,
+				Distro:        DistroAlpine,
+				Firmware:      FirmwareUEFI,
+			},
+		},
+		{
+			fixture: "config-v0-vmnet.yaml",
+			want: MachineConfig{
+				ConfigVersion: CurrentConfigVersion,
+				Alias:         "shared",
+				Image:         "alpine_3.18.4-x86_64.qcow2",
+				Arch:          "x86_64",
+				CPU:           "2",
+				Memory:        "1024",
+				Disk:          "5G",
+				MachineIP:     "192.168.64.5",
+				Network:       NetworkShared,
+				SSHPort:       "22",
+				SSHUser:       "alpine",
+				SSHPassword:   "raw::alpine",
+				RootUsername:  "root",
+				RootPassword:  &root,
+				MACAddress:    "52:54:00:12:34:56",
+				Location:      "/Users/someone/.macpine/shared",
+				Tags:          []string{"web"},
+				DiskFormat:    DiskFormatQcow2,
+				DiskInterface: DiskInterfaceVirtio,
+				RestartPolicy: RestartNo,
+				Distro:        DistroAlpine,
+				Firmware:      FirmwareBIOS,
+			},
+		},
+		{
+			fixture: "config-v1.yaml",
+			want: MachineConfig{
+				ConfigVersion: CurrentConfigVersion,
+				Alias:         "one",
+				Image:         "alpine_3.20.3-aarch64.qcow2",
+				Arch:          "aarch64",
+				CPU:           "2",
+				Memory:        "2048",
+				Disk:          "10G",
+				MachineIP:     "localhost",
+				Network:       NetworkUser,
+				SSHPort:       "2222",
+				SSHUser:       "root",
+				SSHPassword:   "raw::root",
+				RootUsername:  "root",
+				RootPassword:  &root,
+				Location:      "/Users/someone/.macpine/one",
+				Tags:          []string{},
+				DiskFormat:    DiskFormatQcow2,
+				DiskInterface: DiskInterfaceVirtio,
+				RestartPolicy: RestartNo,
+				Distro:        DistroAlpine,
+				Firmware:      FirmwareUEFI,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			c := readFixture(t, tt.fixture)
+			migrated, err := migrateConfig(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !migrated {
+				t.Error("migrateConfig reported no change")
+			}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("migrated to\n%+v\nwant\n%+v", c, tt.want)
+			}
+
+			// a migrated configuration is current, migrating it again changes nothing
+			again := c
+			migrated, err = migrateConfig(&again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if migrated || !reflect.DeepEqual(again, c) {
+				t.Error("migrating a current configuration changed it")
+			}
+		})
+	}
+}
+
+func TestMigrateConfigNewer(t *testing.T) {
+	c := readFixture(t, "config-v1.yaml")
+	c.ConfigVersion = CurrentConfigVersion + 1
+	if _, err := migrateConfig(&c); err == nil {
+		t.Error("migrateConfig accepted a configuration from a newer release")
+	}
+}
@@ -0,0 +1,123 @@
+package qemu
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// NetworkMode selects how an instance is attached to the host network
+type NetworkMode string
+
+const (
+	// NetworkUser is qemu's built-in user-mode (slirp) network with host port forwarding
+	NetworkUser NetworkMode = "user"
+	// NetworkShared is Apple's vmnet-shared mode, NAT with a dynamic guest IP
+	NetworkShared NetworkMode = "shared"
+	// NetworkBridged is Apple's vmnet-bridged mode, the guest joins the LAN of a host interface
+	NetworkBridged NetworkMode = "bridged"
+	// NetworkHostOnly is Apple's vmnet-host mode, the guest reaches the host and other
+	// host-only instances but not the internet
+	NetworkHostOnly NetworkMode = "host-only"
+	// NetworkGvproxy routes the instance through gvproxy, a user-mode network stack that is faster
+	// than slirp. Without gvproxy installed it falls back to NetworkUser.
+	NetworkGvproxy NetworkMode = "gvproxy"
+	// NetworkNone attaches no network device, the instance is only reachable on its serial console
+	NetworkNone NetworkMode = "none"
+)
+
+// NetworkModes lists all supported network modes
+var NetworkModes = []NetworkMode{NetworkUser, NetworkGvproxy, NetworkShared, NetworkBridged, NetworkHostOnly, NetworkNone}
+
+// ParseNetworkMode validates a network mode string
+func ParseNetworkMode(mode string) (NetworkMode, error) {
+	for _, m := range NetworkModes {
+		if string(m) == mode {
+			return m, nil
+		}
+	}
+	return "", errors.New("unsupported network mode " + mode + ". use user, gvproxy, shared, bridged[:<iface>], host-only, or none")
+}
+
+// ParseNetworkSpec parses a --network value, which is a network mode or bridged:<iface> to name
+// the host interface of a bridged network in the same flag
+func ParseNetworkSpec(spec string) (NetworkMode, string, error) {
+	mode, iface, found := strings.Cut(spec, ":")
+	network, err := ParseNetworkMode(mode)
+	if err != nil {
+		return "", "", err
+	}
+	if found {
+		if network != NetworkBridged || iface == "" {
+			return "", "", errors.New("invalid network " + spec + ". only bridged takes an interface, e.g. bridged:en0")
+		}
+	}
+	return network, iface, nil
+}
+
+// HasNetwork reports whether the instance has a network device, and so can be reached over SSH
+func (c *MachineConfig) HasNetwork() bool {
+	return c.Network != NetworkNone
+}
+
+// errNoNetwork is returned by operations that need SSH on an instance launched with --network none
+func (c *MachineConfig) errNoNetwork() error {
+	return errors.New(c.Alias + " has no network (--network none), connect to its serial console at " +
+		filepath.Join(c.Location, "alpine.sock") + " instead")
+}
+
+// UsesVMNet reports whether the instance network is provided by Apple's vmnet framework
+func (c *MachineConfig) UsesVMNet() bool {
+	return c.Network == NetworkShared || c.Network == NetworkBridged || c.Network == NetworkHostOnly
+}
+
+// NetDev returns the qemu -netdev specification for the instance network mode, empty without a network
+func (c *MachineConfig) NetDev() string {
+	switch c.Network {
+	case NetworkNone:
+		return ""
+	case NetworkShared:
+		return "vmnet-shared,id=net0"
+	case NetworkBridged:
+		return "vmnet-bridged,id=net0,ifname=" + c.BridgeInterface
+	case NetworkHostOnly:
+		if c.NetworkID != "" {
+			return "vmnet-host,id=net0,net-uuid=" + utils.NameUUID(c.NetworkID)
+		}
+		return "vmnet-host,id=net0"
+	case NetworkGvproxy:
+		if c.usesGvproxy() {
+			return "stream,id=net0,server=off,addr.type=unix,addr.path=" + c.gvproxySocket()
+		}
+	}
+	return "user,id=net0,hostfwd=tcp::" + c.SSHPort + "-:22"
+}
+
+// UnmarshalYAML reads a MachineConfig, converting the legacy `vmnet` toggle
+// into a network mode for configs written by older releases
+func (c *MachineConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plainConfig MachineConfig
+	legacy := struct {
+		plainConfig `yaml:",inline"`
+		VMNet       bool `yaml:"vmnet"`
+	}{}
+
+	// a field of the wrong type leaves the others decoded, keep them so that repair can salvage the rest
+	err := value.Decode(&legacy)
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return err
+	}
+
+	*c = MachineConfig(legacy.plainConfig)
+	if c.Network == "" {
+		c.Network = NetworkUser
+		if legacy.VMNet {
+			c.Network = NetworkShared
+		}
+	}
+	return err
+}
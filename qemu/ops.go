@@ -1,15 +1,17 @@
 package qemu
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 	"syscall"
 	"time"
 
+	log "github.com/beringresearch/macpine/logging"
 	"github.com/beringresearch/macpine/utils"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -25,26 +28,70 @@ import (
 )
 
 type MachineConfig struct {
-	Alias        string   `yaml:"alias"`
-	Image        string   `yaml:"image"`
-	Arch         string   `yaml:"arch"`
-	CPU          string   `yaml:"cpu"`
-	Memory       string   `yaml:"memory"`
-	Disk         string   `yaml:"disk"`
-	Mount        string   `yaml:"mount"`
-	MachineIP    string   `yaml:"machineip"`
-	Port         string   `yaml:"port"`
-	VMNet        bool     `yaml:"vmnet"`
-	SSHPort      string   `yaml:"sshport"`
-	SSHUser      string   `yaml:"sshuser"`
-	SSHPassword  string   `yaml:"sshpassword"`
-	RootPassword *string  `yaml:"rootpassword,omitempty"`
-	MACAddress   string   `yaml:"macaddress"`
-	Location     string   `yaml:"location"`
-	Tags         []string `yaml:"tags"`
-	CloudInit    string   `yaml:"cloudinit"`
-	RootUsername string   `yaml:"rootusername"`
-	ISO          string   `yaml:"iso"`
+	ConfigVersion   int               `yaml:"configversion"`
+	Alias           string            `yaml:"alias"`
+	Image           string            `yaml:"image"`
+	Distro          string            `yaml:"distro,omitempty"`
+	ImageURL        string            `yaml:"imageurl,omitempty"`
+	ImageSHA256     string            `yaml:"imagesha256,omitempty"`
+	AlpineRelease   string            `yaml:"alpinerelease,omitempty"`
+	Arch            string            `yaml:"arch"`
+	CPU             string            `yaml:"cpu"`
+	Memory          string            `yaml:"memory"`
+	Disk            string            `yaml:"disk"`
+	Mount           string            `yaml:"mount"`
+	MachineIP       string            `yaml:"machineip"`
+	Port            string            `yaml:"port"`
+	Network         NetworkMode       `yaml:"network"`
+	BridgeInterface string            `yaml:"bridgeinterface,omitempty"`
+	NetworkID       string            `yaml:"networkid,omitempty"`
+	SSHPort         string            `yaml:"sshport"`
+	SSHUser         string            `yaml:"sshuser"`
+	SSHPassword     string            `yaml:"sshpassword"`
+	RootPassword    *string           `yaml:"rootpassword,omitempty"`
+	MACAddress      string            `yaml:"macaddress"`
+	Location        string            `yaml:"location"`
+	Tags            []string          `yaml:"tags"`
+	Description     string            `yaml:"description,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"`
+	CloudInit       string            `yaml:"cloudinit"`
+	CloudMetaData   string            `yaml:"cloudmetadata,omitempty"`
+	CloudVendorData string            `yaml:"cloudvendordata,omitempty"`
+	InstanceID      string            `yaml:"instanceid,omitempty"`
+	UserData        []byte            `yaml:"-"`
+	Events          EventFunc         `yaml:"-"`
+	StaticIP        string            `yaml:"staticip,omitempty"`
+	Gateway         string            `yaml:"gateway,omitempty"`
+	NetworkConfig   string            `yaml:"networkconfig,omitempty"`
+	DiskFormat      string            `yaml:"diskformat,omitempty"`
+	DiskInterface   string            `yaml:"diskinterface,omitempty"`
+	Autostart       bool              `yaml:"autostart,omitempty"`
+	DataDisks       []DataDisk        `yaml:"datadisks,omitempty"`
+	RestartPolicy   RestartPolicy     `yaml:"restartpolicy,omitempty"`
+	MaxRestarts     int               `yaml:"maxrestarts,omitempty"`
+	Balloon         bool              `yaml:"balloon,omitempty"`
+	GuestAgent      bool              `yaml:"guestagent,omitempty"`
+	TPM             bool              `yaml:"tpm,omitempty"`
+	NoRNG           bool              `yaml:"norng,omitempty"`
+	USBDevices      []USBDevice       `yaml:"usbdevices,omitempty"`
+	Audio           bool              `yaml:"audio,omitempty"`
+	Firmware        string            `yaml:"firmware,omitempty"`
+	UEFIVars        string            `yaml:"uefivars,omitempty"`
+	Timezone        string            `yaml:"timezone,omitempty"`
+	FirstBoot       bool              `yaml:"firstboot,omitempty"`
+	QEMUArgs        []string          `yaml:"qemuargs,omitempty"`
+	Hooks           Hooks             `yaml:"hooks,omitempty"`
+	CreatedAt       time.Time         `yaml:"createdat,omitempty"`
+	Provision       []string          `yaml:"provision,omitempty"`
+	CopyFiles       []FileCopy        `yaml:"copyfiles,omitempty"`
+	WriteHosts      bool              `yaml:"writehosts,omitempty"`
+	ReversePorts    []ReversePort     `yaml:"reverseports,omitempty"`
+	HostAlias       bool              `yaml:"hostalias,omitempty"`
+	RootUsername    string            `yaml:"rootusername"`
+	ISO             string            `yaml:"iso"`
+
+	// lock is the instance lock the configuration was loaded or is being created under, if any
+	lock *InstanceLock
 }
 
 func (c *MachineConfig) GetIPFromLogFile() string {
@@ -68,43 +115,39 @@ func (c *MachineConfig) GetIPFromLogFile() string {
 	return ""
 }
 
-// Exec starts an interactive shell terminal in VM
-func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
-	if cmd == "" {
-		return "", nil
-	}
+// IPAddress returns the address the instance is reachable on from the host. For vmnet modes
+// the address is looked up from the DHCP lease when unknown and stored in the config, Start
+// forgets it so that every boot looks it up again.
+func (c *MachineConfig) IPAddress() (string, error) {
+	return c.ipAddress(context.Background())
+}
+
+// ipAddress is IPAddress, giving up the DHCP lease lookup when ctx is done
+func (c *MachineConfig) ipAddress(ctx context.Context) (string, error) {
 	ip := c.MachineIP
 
-	if c.VMNet {
+	if c.UsesVMNet() {
 		if ip == "localhost" || ip == "" {
 			log.Println("getting instance IP address from DHCP leases")
 
 			for i := 0; i < 10; i++ {
-				ip = c.GetIPFromLogFile()
-				//ip = c.GetIPAddressFromMachine()
+				ip = c.DiscoverIP()
 				if ip != "" {
 					break
 				}
-				fmt.Print(".")
-				time.Sleep(4 * time.Second)
+				if err := sleep(ctx, 4*time.Second); err != nil {
+					return "", err
+				}
 			}
 
 			if ip == "" {
 				return "", errors.New("failed to get IP address from DHCP leases")
 			}
 
-			fmt.Println("GOT IT: ", ip)
+			log.Println("found " + c.Alias + " at " + ip)
 
 			c.MachineIP = ip
-			config, err := yaml.Marshal(&c)
-
-			if err != nil {
-				c.Stop()
-				c.CleanPIDFile()
-				return "", err
-			}
-
-			err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
+			err := SaveMachineConfig(*c)
 			if err != nil {
 				c.Stop()
 				c.CleanPIDFile()
@@ -114,6 +157,25 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 
 	}
 
+	return ip, nil
+}
+
+// Dial opens an SSH connection to the instance as the default user, or as root,
+// waiting for the guest to come up
+func (c *MachineConfig) Dial(root bool) (*ssh.Client, error) {
+	return c.DialContext(context.Background(), root)
+}
+
+// DialContext is Dial, giving up waiting for the guest when ctx is done
+func (c *MachineConfig) DialContext(ctx context.Context, root bool) (*ssh.Client, error) {
+	if !c.HasNetwork() {
+		return nil, c.errNoNetwork()
+	}
+	ip, err := c.ipAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	host := ip + ":" + c.SSHPort
 	user := c.SSHUser
 	pwd := c.SSHPassword
@@ -133,14 +195,13 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 	}
 	cred, err := utils.GetCredential(pwd)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var conf *ssh.ClientConfig
 	if cred.CRType == utils.PwdCred {
 		conf = &ssh.ClientConfig{
-			User:            user,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			User: user,
 			Auth: []ssh.AuthMethod{
 				ssh.Password(cred.CR),
 			},
@@ -150,7 +211,7 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 		socket := os.Getenv("SSH_AUTH_SOCK")
 		conn, err := net.Dial("unix", socket)
 		if err != nil {
-			log.Fatalf("failed to open SSH_AUTH_SOCK: %v", err)
+			return nil, errors.New("failed to open SSH_AUTH_SOCK: " + err.Error())
 		}
 		agentClient := agent.NewClient(conn)
 		conf = &ssh.ClientConfig{
@@ -158,9 +219,10 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 			Auth: []ssh.AuthMethod{
 				ssh.PublicKeysCallback(agentClient.Signers),
 			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		}
 	}
+	conf.HostKeyCallback = c.hostKeyCallback()
+	conf.HostKeyAlgorithms = c.hostKeyAlgorithms()
 
 	var conn *ssh.Client
 
@@ -170,8 +232,11 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 		if err == nil {
 			break
 		}
+		if errors.Is(err, errHostKeyChanged) {
+			return nil, c.hostKeyChangedError()
+		}
 		if i == 1110 {
-			return "", err
+			return nil, err
 		}
 
 		perr := err.Error()
@@ -180,20 +245,39 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 		logFile := filepath.Join(c.Location, "alpine.log")
 		data, err := os.ReadFile(logFile)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		logContent := string(data)
 		if strings.Contains(logContent, "Welcome to Alpine Linux") {
 			break
 		}
 
-		fmt.Println("waiting for ssh connection [", i, "]: ", perr)
-		time.Sleep(1 * time.Second)
+		log.Debugf("waiting for ssh connection to %s [%d]: %s", host, i, perr)
+		if err := sleep(ctx, 1*time.Second); err != nil {
+			return nil, err
+		}
 
 	}
 
 	if conn == nil {
-		return "", errors.New("failed to connect to " + host)
+		return nil, errors.New("failed to connect to " + host)
+	}
+	return conn, nil
+}
+
+// Exec starts an interactive shell terminal in VM
+func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
+	return c.ExecContext(context.Background(), cmd, root)
+}
+
+// ExecContext is Exec, giving up waiting for the guest to come up when ctx is done
+func (c *MachineConfig) ExecContext(ctx context.Context, cmd string, root bool) (string, error) {
+	if cmd == "" {
+		return "", nil
+	}
+	conn, err := c.DialContext(ctx, root)
+	if err != nil {
+		return "", err
 	}
 	defer conn.Close()
 
@@ -236,6 +320,38 @@ func (c *MachineConfig) Exec(cmd string, root bool) (string, error) {
 	return output, nil
 }
 
+// Run runs cmd on the instance over SSH with the given standard streams, any of which may be nil.
+// Cancelling ctx kills the command and closes the connection.
+func (c *MachineConfig) Run(ctx context.Context, cmd string, root bool, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	conn, err := c.DialContext(ctx, root)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		conn.Close()
+		return ctx.Err()
+	}
+}
+
 func attachShell(session *ssh.Session) error {
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
@@ -297,7 +413,14 @@ func (c *MachineConfig) Status() (string, int) {
 
 	if _, err := os.Stat(pidFile); err == nil {
 		status = "Running"
-		pid, _ = c.GetInstancePID()
+		pid, err = c.GetInstancePID()
+
+		// a stale pidfile, or one whose PID now belongs to another process, means the instance is gone.
+		// The pidfile is left for the supervisor to tell a crash from a clean stop, CleanRuntimeFiles
+		// removes it.
+		if err == nil && !c.OwnsProcess(pid) {
+			return "Stopped", 0
+		}
 
 		// check if stopped and return "Paused"
 		execArgs := []string{"-o", "stat=", "-p", strconv.Itoa(pid)}
@@ -318,6 +441,9 @@ func (c *MachineConfig) Status() (string, int) {
 
 // Stop stops an Alpine VM
 func (c *MachineConfig) Stop() error {
+	defer c.stopGvproxy()
+	defer c.stopSwtpm()
+
 	// qemu creates PID file with -pidfile flag, and deletes it on sigterm
 	if status, pid := c.Status(); status != "Stopped" {
 		if pid > 0 {
@@ -336,6 +462,7 @@ func (c *MachineConfig) Stop() error {
 			os.Remove(pidFile)
 			os.Remove(sockFile)
 			os.Remove(qmpFile)
+			os.Remove(c.AgentPath())
 
 			log.Println(c.Alias + " stopped")
 			return nil
@@ -344,6 +471,8 @@ func (c *MachineConfig) Stop() error {
 			return errors.New("failed to stop instance `" + c.Alias + "` due to inadequate privileges")
 		}
 	}
+	// the instance may have died and left its pidfile and sockets behind
+	c.CleanRuntimeFiles()
 	return nil
 }
 
@@ -381,7 +510,7 @@ func (c *MachineConfig) Resume() error {
 			}
 			_, err := c.Exec("hwclock -s", true)
 			if err != nil {
-				log.Println("failed to synchonrize clock, instance system clock may be skewed")
+				log.Errorln("failed to synchonrize clock, instance system clock may be skewed")
 				return err
 			}
 			log.Println(c.Alias + " resumed")
@@ -436,18 +565,114 @@ func (c *MachineConfig) GetAccel() string {
 	return "tcg,tb-size=1024,thread=multi"
 }
 
+// command builds an external command, logging it for --verbose
+func command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	log.Debugln(cmd.String())
+	return cmd
+}
+
 // Start starts up an Alpine VM
 func (c *MachineConfig) Start() error {
+	withCmd, err := c.commandLine()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sudo", withCmd...)
+
+	cmd.Stdout = os.Stdout
+
+	// Uncomment to debug qemu messages
+	cmd.Stderr = os.Stderr
+
+	// vmnet leases can change between boots, look the address up again once the instance is up
+	if c.UsesVMNet() && c.StaticIP == "" {
+		c.MachineIP = "localhost"
+	}
+
+	log.Println("booting " + c.Alias)
+
+	if c.usesGvproxy() {
+		if err := c.startGvproxy(); err != nil {
+			return err
+		}
+	}
+	if c.TPM {
+		if err := c.startSwtpm(); err != nil {
+			c.stopGvproxy()
+			return err
+		}
+	}
+
+	log.Debugln(cmd.String())
+	err = cmd.Run()
+	if err != nil {
+		c.stopGvproxy()
+		c.stopSwtpm()
+		c.Stop()
+		c.CleanPIDFile()
+		return err
+	}
+
+	// qemu runs as root, hand the QMP and guest agent sockets to the user so that commands such as
+	// balloon and ip work without sudo
+	if u, err := user.Current(); err == nil {
+		exec.Command("sudo", "-n", "chown", u.Uid, c.QMPPath(), c.AgentPath()).Run()
+	}
+
+	if c.UsesVMNet() {
+		if _, err := c.IPAddress(); err != nil {
+			log.Errorln("unable to discover the address of " + c.Alias + ": " + err.Error())
+		}
+	}
+
+	if c.Mount != "" {
+		basename := filepath.Base(c.Mount)
+		mntcmd := make([]string, 3)
+		mntcmd[0] = "mkdir -p /mnt/" + basename
+		mntcmd[1] = "chmod 777 /mnt/" + basename
+		mntcmd[2] = "mount -t 9p -o trans=virtio,version=9p2000.L,msize=104857600 host0 /mnt/" + basename
+		if _, err := c.Exec(strings.Join(mntcmd, " && "), true); err != nil {
+			log.Errorln("error mounting directory: " + err.Error())
+		} else {
+			log.Println("mounted " + c.Mount + " on /mnt/" + basename)
+		}
+	}
 
-	networkDevice := "user,id=net0,hostfwd=tcp::" + c.SSHPort + "-:22"
+	status, pid := c.Status()
+	if status != "Running" {
+		return errors.New("unable to start instance")
+	}
+
+	// err = c.Exec("hwclock -s", true)
+	// if err != nil {
+	// 	c.Stop()
+	// 	c.CleanPIDFile()
+	// 	return err
+	// }
+
+	err = SaveMachineConfig(*c)
+	if err != nil {
+		c.Stop()
+		c.CleanPIDFile()
+		return err
+	}
+
+	log.Println(c.Alias + " started (" + strconv.Itoa(pid) + ")")
+
+	return nil
+}
 
-	if c.VMNet {
-		networkDevice = "vmnet-shared,id=net0"
+// commandLine returns the qemu command line that boots the instance
+func (c *MachineConfig) commandLine() ([]string, error) {
+	networkDevice := c.NetDev()
 
+	if c.UsesVMNet() {
 		if c.MACAddress == "" {
 			macAddress, err := utils.GenerateMACAddress()
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 
 			c.MACAddress = macAddress
@@ -455,10 +680,13 @@ func (c *MachineConfig) Start() error {
 	}
 
 	// Only parse ports of using qemu's default slirp network
-	if !c.VMNet {
+	if c.Network == NetworkGvproxy && !c.usesGvproxy() {
+		log.Println("gvproxy is not installed, " + c.Alias + " falls back to user-mode networking. install it with `brew install podman`")
+	}
+	if c.usesSlirp() {
 		ports, err := utils.ParsePort(c.Port)
 		if err != nil {
-			log.Fatalf("Error configuring ports: %v\n", err)
+			return nil, errors.New("error configuring ports: " + err.Error())
 		}
 		for _, p := range ports {
 			hostp := strconv.Itoa(p.Host)
@@ -471,6 +699,13 @@ func (c *MachineConfig) Start() error {
 		}
 	}
 
+	// a qemu without coreaudio would only fail once daemonized, with the error lost
+	if c.Audio {
+		if err := CheckAudio(c.Arch); err != nil {
+			return nil, err
+		}
+	}
+
 	qemuCmd := "qemu-system-" + c.Arch
 
 	var qemuArgs []string
@@ -489,7 +724,7 @@ func (c *MachineConfig) Start() error {
 	if hostCPUType == "x86_64_host" {
 		supports, err := utils.SupportsHugePages()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if !supports {
@@ -508,30 +743,25 @@ func (c *MachineConfig) Start() error {
 	highmem := "off"
 	intMem, err := strconv.Atoi(c.Memory)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if intMem > 2000 {
 		highmem = "on"
 	}
 
-	aarch64Args := []string{}
-
-	if c.CloudInit != "" {
-		aarch64Args = append(aarch64Args, []string{
-			"-M", "virt,highmem=" + highmem,
-			"-bios", fmt.Sprintf("/opt/homebrew/share/qemu/edk2-%s-code.fd", c.Arch),
-		}...)
-	} else {
-		aarch64Args = append(aarch64Args, []string{
-			"-M", "virt,highmem=" + highmem,
-			"-bios", filepath.Join(c.Location, "qemu_efi.fd"),
-		}...)
+	var uefiArgs []string
+	if c.HasUEFIVars() {
+		uefiArgs, err = c.uefiArgs()
+		if err != nil {
+			return nil, err
+		}
 	}
+	aarch64Args := append([]string{"-M", "virt,highmem=" + highmem}, uefiArgs...)
 
-	x86Args := []string{
+	x86Args := append([]string{
 		"-global", "PIIX4_PM.disable_s3=1",
 		"-global", "ICH9-LPC.disable_s3=1",
-	}
+	}, uefiArgs...)
 
 	mountArgs := []string{"-fsdev", "local,path=" + c.Mount + ",security_model=mapped-xattr,id=host0",
 		"-device", "virtio-9p-pci,fsdev=host0,mount_tag=host0"}
@@ -545,10 +775,7 @@ func (c *MachineConfig) Start() error {
 		"-cpu", cpu,
 		"-accel", c.GetAccel(),
 		"-smp", "cpus=" + c.CPU + ",sockets=1,cores=" + c.CPU + ",threads=1",
-		"-drive", "if=virtio,file=" + filepath.Join(c.Location, c.Image),
 		"-nographic",
-		"-device", "virtio-net-pci,netdev=net0,mac=" + c.MACAddress,
-		"-netdev", networkDevice,
 		"-pidfile", filepath.Join(c.Location, "alpine.pid"),
 		"-chardev", "socket,id=char-serial,path=" + filepath.Join(c.Location,
 			"alpine.sock") + ",server=on,wait=off,logfile=" + filepath.Join(c.Location, "alpine.log"),
@@ -556,7 +783,6 @@ func (c *MachineConfig) Start() error {
 		"-chardev", "socket,id=char-qmp,path=" + filepath.Join(c.Location, "alpine.qmp") + ",server=on,wait=off",
 		"-qmp", "chardev:char-qmp",
 		"-parallel", "none",
-		"-device", "virtio-rng-pci",
 		"-rtc", "base=utc,clock=host",
 		"-daemonize",
 		"-name", c.Alias}
@@ -568,6 +794,23 @@ func (c *MachineConfig) Start() error {
 		qemuArgs = append(x86Args, commonArgs...)
 	}
 
+	if c.HasNetwork() {
+		qemuArgs = append(qemuArgs,
+			"-device", "virtio-net-pci,netdev=net0,mac="+c.MACAddress,
+			"-netdev", networkDevice)
+	} else {
+		qemuArgs = append(qemuArgs, "-nic", "none")
+	}
+
+	qemuArgs = append(qemuArgs, c.driveArgs()...)
+	qemuArgs = append(qemuArgs, c.dataDriveArgs()...)
+	qemuArgs = append(qemuArgs, c.rngArgs()...)
+	qemuArgs = append(qemuArgs, c.balloonArgs()...)
+	qemuArgs = append(qemuArgs, c.agentArgs()...)
+	qemuArgs = append(qemuArgs, c.tpmArgs()...)
+	qemuArgs = append(qemuArgs, c.usbArgs()...)
+	qemuArgs = append(qemuArgs, c.audioArgs()...)
+
 	if c.Mount != "" {
 		qemuArgs = append(qemuArgs, mountArgs...)
 	}
@@ -577,67 +820,10 @@ func (c *MachineConfig) Start() error {
 		// qemuArgs = append(qemuArgs, "-nic", "vmnet-shared,start-address=192.168.1.1,end-address=192.168.1.20,subnet-mask=255.255.255.0,mac="+c.MACAddress)
 	}
 
-	withCmd := append([]string{qemuCmd}, qemuArgs...)
-
-	cmd := exec.Command("sudo", withCmd...)
-
-	cmd.Stdout = os.Stdout
-
-	// Uncomment to debug qemu messages
-	cmd.Stderr = os.Stderr
-
-	log.Println("booting " + c.Alias)
+	// user supplied arguments go last and are passed through unchecked
+	qemuArgs = append(qemuArgs, c.QEMUArgs...)
 
-	fmt.Println(cmd.String())
-	err = cmd.Run()
-	if err != nil {
-		c.Stop()
-		c.CleanPIDFile()
-		return err
-	}
-
-	if c.Mount != "" {
-		basename := filepath.Base(c.Mount)
-		mntcmd := make([]string, 3)
-		mntcmd[0] = "mkdir -p /mnt/" + basename
-		mntcmd[1] = "chmod 777 /mnt/" + basename
-		mntcmd[2] = "mount -t 9p -o trans=virtio,version=9p2000.L,msize=104857600 host0 /mnt/" + basename
-		if _, err := c.Exec(strings.Join(mntcmd, " && "), true); err != nil {
-			log.Println("error mounting directory: " + err.Error())
-		} else {
-			log.Println("mounted " + c.Mount + " on /mnt/" + basename)
-		}
-	}
-
-	status, pid := c.Status()
-	if status != "Running" {
-		return errors.New("unable to start instance")
-	}
-
-	// err = c.Exec("hwclock -s", true)
-	// if err != nil {
-	// 	c.Stop()
-	// 	c.CleanPIDFile()
-	// 	return err
-	// }
-
-	config, err := yaml.Marshal(&c)
-	if err != nil {
-		c.Stop()
-		c.CleanPIDFile()
-		return err
-	}
-
-	err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
-	if err != nil {
-		c.Stop()
-		c.CleanPIDFile()
-		return err
-	}
-
-	log.Println(c.Alias + " started (" + strconv.Itoa(pid) + ")")
-
-	return nil
+	return append([]string{qemuCmd}, qemuArgs...), nil
 }
 
 // func (c *MachineConfig) GetIPAddressFromMachine() string {
@@ -654,87 +840,70 @@ func (c *MachineConfig) Start() error {
 // 	return ip
 // }
 
-// AssignIP obtains machine IP address from bootpd.plist. Only applicale to machines created on
-// VMNet
-func (c *MachineConfig) GetIPAddressByMac() string {
-	ip := ""
-	mac := ""
-
-	file, err := os.Open("/var/db/dhcpd_leases")
-
-	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
-	}
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-
-		// Process each line in the dhcpd_leases file
-		line := scanner.Text()
-
-		// Check if the line contains an IP address
-		if strings.Contains(line, "ip_address") {
-			ip = strings.Split(strings.Fields(line)[0], "ip_address=")[1]
-		}
-
-		// Check if the line contains a MAC address
-		if strings.Contains(line, "hw_address") {
-			// fmt.Println("line: ", strings.Fields(line))
-			// mac = strings.Split(strings.Fields(line)[0], "hw_address=1,")[1]
-			regex := regexp.MustCompile(`hw_address=(\S+),(\S+)`)
-			matches := regex.FindStringSubmatch(line)
-			if len(matches) == 3 {
-				mac = matches[2]
-			}
-
-			// fmt.Println("mac: ", c.MACAddress, mac, ip)
-		}
-
-		if mac == c.MACAddress {
-			fmt.Println("GOTIT: ", c.MACAddress, mac, ip)
-			return ip
+// checkDownloadedImage verifies an image downloaded from --image-url against its sha256, if known,
+// and checks that it is a qcow2 image
+func checkDownloadedImage(imagePath string, digest string) error {
+	if digest != "" {
+		if err := utils.VerifySHA256(imagePath, digest); err != nil {
+			return err
 		}
-
 	}
-
-	// Check for any errors during scanning
-	if err := scanner.Err(); err != nil {
-		fmt.Println("error scanning /var/db/dhcpd_lease:", err)
+	if _, err := qcow2VirtualSize(imagePath); err != nil {
+		return errors.New("not a qcow2 image, convert it with `qemu-img convert -O qcow2`")
 	}
-	return ""
+	return nil
 }
 
-// Launch macpine downloads a fresh image and creates a VM directory
-func (c *MachineConfig) Launch() error {
+// Launch macpine downloads a fresh image and creates a VM directory. Cancelling ctx stops the
+// download and the wait for the guest to boot.
+func (c *MachineConfig) Launch(ctx context.Context) error {
 
-	userHomeDir, err := os.UserHomeDir()
+	dataDir, err := utils.DataDir()
 	if err != nil {
 		return err
 	}
 
-	cacheDir := filepath.Join(userHomeDir, ".macpine", "cache")
+	cacheDir := filepath.Join(dataDir, "cache")
 	err = os.MkdirAll(cacheDir, os.ModePerm)
 	if err != nil {
 		return err
 	}
 
 	var imageURL string
-	if c.CloudInit != "" {
+	switch {
+	case c.ImageURL != "":
+		imageURL = c.ImageURL
+	case c.CloudInit != "":
 		imageURL = utils.GetImageURLCloud(c.Image)
-	} else {
+	default:
 		imageURL = utils.GetImageURL(c.Image)
 	}
 
-	if _, err := os.Stat(filepath.Join(cacheDir, c.Image)); errors.Is(err, os.ErrNotExist) {
-		err = utils.DownloadFile(filepath.Join(cacheDir, c.Image), imageURL)
+	// images in the shared image directory are used in place, others are downloaded to the cache
+	imagePath, err := utils.ImagePath(c.Image)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(imagePath); errors.Is(err, os.ErrNotExist) {
+		err = utils.DownloadFileContext(ctx, imagePath, imageURL)
 		if err != nil {
 			return errors.New("unable to download " + c.Image + " for " + c.Arch + ": " + err.Error())
 		}
+		if c.ImageURL != "" {
+			if err := checkDownloadedImage(imagePath, c.ImageSHA256); err != nil {
+				os.Remove(imagePath)
+				return errors.New("unable to use " + c.ImageURL + ": " + err.Error())
+			}
+		}
 	}
 
+	efiPath, err := utils.ImagePath("qemu_efi.fd")
+	if err != nil {
+		return err
+	}
 	if c.Arch == "aarch64" {
-		if _, err := os.Stat(filepath.Join(cacheDir, "qemu_efi.fd")); errors.Is(err, os.ErrNotExist) {
-			err = utils.DownloadFile(filepath.Join(cacheDir, "qemu_efi.fd"),
+		if _, err := os.Stat(efiPath); errors.Is(err, os.ErrNotExist) {
+			err = utils.DownloadFileContext(ctx, efiPath,
 				"https://github.com/beringresearch/macpine/releases/download/v.01/qemu_efi.fd")
 			if err != nil {
 				return errors.New("unable to download bios :" + err.Error())
@@ -742,25 +911,47 @@ func (c *MachineConfig) Launch() error {
 		}
 	}
 
-	targetDir := filepath.Join(userHomeDir, ".macpine", c.Alias)
+	c.Emit(PhaseImageResolved, c.Image)
+
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	c.setDefaults()
+	c.ConfigVersion = CurrentConfigVersion
+
+	targetDir := filepath.Join(dataDir, c.Alias)
 	err = os.MkdirAll(targetDir, os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	_, err = utils.CopyFile(filepath.Join(cacheDir, c.Image), filepath.Join(targetDir, c.Image))
-	if err != nil {
-		os.RemoveAll(targetDir)
-		return err
+	if c.GetDiskFormat() == DiskFormatRaw {
+		out, err := command("qemu-img", "convert", "-O", "raw", imagePath, c.DiskPath()).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(targetDir)
+			return errors.New("unable to create raw disk: " + strings.TrimSpace(string(out)))
+		}
+	} else {
+		_, err = utils.CopyFile(imagePath, c.DiskPath())
+		if err != nil {
+			os.RemoveAll(targetDir)
+			return err
+		}
 	}
 
 	if c.Arch == "aarch64" {
-		_, err = utils.CopyFile(filepath.Join(cacheDir, "qemu_efi.fd"), filepath.Join(targetDir, "qemu_efi.fd"))
+		_, err = utils.CopyFile(efiPath, filepath.Join(targetDir, "qemu_efi.fd"))
 		if err != nil {
 			os.RemoveAll(targetDir)
 			return err
 		}
-
+	}
+	if c.HasUEFIVars() {
+		c.UEFIVars = UEFIVarsFile
+		if err := c.createUEFIVars(); err != nil {
+			os.RemoveAll(targetDir)
+			return err
+		}
 	}
 
 	err = c.ResizeQemuDiskImage()
@@ -769,6 +960,16 @@ func (c *MachineConfig) Launch() error {
 		return errors.New("unable to resize disk: " + err.Error())
 	}
 
+	dataDisks := c.DataDisks
+	c.DataDisks = nil
+	for _, d := range dataDisks {
+		_, err = c.AddDataDisk(d)
+		if err != nil {
+			os.RemoveAll(targetDir)
+			return err
+		}
+	}
+
 	config, err := yaml.Marshal(&c)
 
 	if err != nil {
@@ -777,88 +978,125 @@ func (c *MachineConfig) Launch() error {
 	}
 
 	if c.CloudInit != "" {
-		_, err = utils.CopyFile(c.CloudInit, filepath.Join(c.Location, "user-data"))
+		// user-data given on stdin or inline is persisted, so restarts and seed regeneration work
+		if c.UserData != nil {
+			err = utils.WriteFileAtomic(filepath.Join(c.Location, "user-data"), c.UserData, 0644)
+		} else {
+			_, err = utils.CopyFile(c.CloudInit, filepath.Join(c.Location, "user-data"))
+		}
 		if err != nil {
 			os.RemoveAll(targetDir)
 			return err
 		}
+		if c.CloudMetaData != "" {
+			_, err = utils.CopyFile(c.CloudMetaData, filepath.Join(c.Location, "meta-data"))
+			if err != nil {
+				os.RemoveAll(targetDir)
+				return err
+			}
+		}
+		if c.CloudVendorData != "" {
+			_, err = utils.CopyFile(c.CloudVendorData, filepath.Join(c.Location, "vendor-data"))
+			if err != nil {
+				os.RemoveAll(targetDir)
+				return err
+			}
+		}
 	}
 
-	err = os.WriteFile(filepath.Join(c.Location, "config.yaml"), config, 0644)
+	err = utils.WriteFileAtomic(filepath.Join(c.Location, "config.yaml"), config, 0644)
 	if err != nil {
 		os.RemoveAll(targetDir)
 		return err
 	}
 
 	if c.CloudInit != "" {
-
-		metadata := `instance-id: %s
-local-hostname: %s
-`
-
-		network := `version: 2
-ethernets:
-  eth0:
-    dhcp4: true
-    dhcp6: true
-    optional: true
-    nameservers:
-      addresses: [8.8.8.8, 8.8.4.4]
-    dhcp4-overrides:
-      send-hostname: true
-      use-hostname: true
-      use-mtu: true
-    routes:
-      - to: 0.0.0.0/0
-        via: 10.0.2.2
-        metric: 100
-`
-
-		// create meta-data file
-		metaData := fmt.Sprintf(metadata, c.Alias, c.Alias)
-		err = os.WriteFile(filepath.Join(c.Location, "meta-data"), []byte(metaData), 0644)
+		err = c.WriteCloudInitSeed()
 		if err != nil {
-			return errors.New("unable to create meta-data file: " + err.Error())
+			return err
 		}
+	}
 
-		err = os.WriteFile(filepath.Join(c.Location, "network-config"), []byte(network), 0644)
-		if err != nil {
-			return errors.New("unable to create network-config file: " + err.Error())
-		}
+	// --no-start leaves the first boot to alpine start
+	if c.FirstBoot {
+		return nil
+	}
+	return c.boot(ctx)
+}
+
+// Boot starts an instance created with --no-start for the first time, with the setup a launch does
+// after booting, and clears FirstBoot
+func (c *MachineConfig) Boot(ctx context.Context) error {
+	if err := c.boot(ctx); err != nil {
+		return err
+	}
+	c.FirstBoot = false
+	return SaveMachineConfig(*c)
+}
 
-		//mkisofs -output "$vmdir/cidata.iso" -volid cidata -joliet -rock "$vmdir"/{user-data,meta-data,network-config}
-		// mkisofs -output "$vmdir/cidata.iso" -volid cidata -joliet -rock "$vmdir"/{user-data,meta-data,network-config}
+// boot starts a new instance and sets it up over SSH: DNS, hostname, dhclient and the disk resize
+func (c *MachineConfig) boot(ctx context.Context) error {
+	// do not spawn qemu for a launch that has already been cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := c.Start()
+	if err != nil {
+		return errors.New("unable to launch a new machine. " + err.Error())
+	}
+	_, pid := c.Status()
+	c.Emit(PhaseProcessStarted, "pid "+strconv.Itoa(pid))
 
-		args := []string{"-output", filepath.Join(c.Location, "cidata.iso"), "-volid", "cidata", "-joliet", "-rock", filepath.Join(c.Location, "user-data"), filepath.Join(c.Location, "meta-data"), filepath.Join(c.Location, "network-config")}
-		cmd := exec.Command("mkisofs", args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		fmt.Println("Creating cloud-init iso: ", strings.Join(args, " "))
-		err = cmd.Run()
+	// the remaining setup runs over SSH
+	if !c.HasNetwork() {
+		log.Println(c.Alias + " has no network, skipping DNS, hostname and disk setup")
+		return nil
+	}
+
+	// Make sure DNS is set up correctly. cloud-init sets up the network of other distros.
+	if c.GuestDistro() == DistroAlpine {
+		_, err = c.ExecContext(ctx, "echo 'nameserver 8.8.8.8' > /etc/resolv.conf", true)
 		if err != nil {
-			return errors.New("unable to create cloud-init iso: " + err.Error())
+			return errors.New("unable to set up DNS: " + err.Error())
 		}
+	} else if _, err = c.ExecContext(ctx, "true", false); err != nil {
+		return errors.New("unable to reach " + c.Alias + " over SSH: " + err.Error())
+	}
+	c.Emit(PhaseSSHReady, "")
 
-		c.ISO = filepath.Join(c.Location, "cidata.iso")
+	// only wait for cloud-init when someone is watching for it, launches otherwise return as soon as ssh is up
+	if c.CloudInit != "" && c.Events != nil {
+		_, err = c.ExecContext(ctx, "cloud-init status --wait", true)
+		if err != nil {
+			return errors.New("cloud-init did not complete: " + err.Error())
+		}
+		c.Emit(PhaseCloudInitDone, "")
 	}
 
-	err = c.Start()
-	if err != nil {
-		return errors.New("unable to launch a new machine. " + err.Error())
+	// the remaining setup uses apk and OpenRC
+	if c.GuestDistro() != DistroAlpine {
+		return nil
 	}
 
-	// Make sure DNS is set up correctly
-	_, err = c.Exec("echo 'nameserver 8.8.8.8' > /etc/resolv.conf", true)
-	if err != nil {
-		return errors.New("unable to set up DNS: " + err.Error())
+	// cloud-init sets the hostname from meta-data and the timezone from user-data
+	if c.CloudInit == "" {
+		_, err = c.ExecContext(ctx, "echo '"+c.Alias+"' > /etc/hostname && hostname -F /etc/hostname", true)
+		if err != nil {
+			return errors.New("unable to set hostname: " + err.Error())
+		}
+		// a guest left in UTC is still usable, the launch goes on
+		if err := c.setTimezone(ctx); err != nil {
+			log.Errorln(err)
+		}
 	}
 
-	_, err = c.Exec("apk update && apk add --no-cache dhclient", true)
+	_, err = c.ExecContext(ctx, "apk update && apk add --no-cache dhclient", true)
 	if err != nil {
 		return errors.New("unable to install dhclient: " + err.Error())
 	}
 
-	_, err = c.Exec(`cat >/etc/dhcp/dhclient.conf <<EOL
+	_, err = c.ExecContext(ctx, `cat >/etc/dhcp/dhclient.conf <<EOL
 	option rfc3442-classless-static-routes code 121 = array of unsigned integer 8;
 
 	send host-name = gethostname();
@@ -874,32 +1112,40 @@ ethernets:
 		return errors.New("unable to configure dhclient: " + err.Error())
 	}
 
-	_, err = c.Exec("rc-service networking restart", true)
+	_, err = c.ExecContext(ctx, "rc-service networking restart", true)
 	if err != nil {
 		return errors.New("unable to restart networking services: " + err.Error())
 	}
 
+	// cloud-init installs the agent from user-data. The instance works without it, so a failure is not fatal.
+	if c.GuestAgent && c.CloudInit == "" {
+		if err := c.InstallGuestAgent(ctx); err != nil {
+			log.Errorln(err)
+		}
+	}
+
 	// Resize disk on an alpine guest
 	if strings.Split(c.Image, "_")[0] == "alpine" {
 		//TODO add these dependencies into pre-baked macpine image
-		_, err := c.Exec("apk add --no-cache e2fsprogs-extra sfdisk partx", true) // root=true i.e. run as root
+		_, err := c.ExecContext(ctx, "apk add --no-cache e2fsprogs-extra sfdisk partx", true) // root=true i.e. run as root
 		if err != nil {
 			return errors.New("unable to install dependencies: " + err.Error())
 		}
 
 		//send sfdisk command ,+ (<start>,<size>,<type>,<bootable>)
 		//default start (0), size + (all available), default type (linux data), default bootable (false)
-		_, err = c.Exec(`echo ",+" | sfdisk --no-reread --partno 3 /dev/vda && partx -u /dev/vda`, true)
+		disk := c.GuestDiskDevice()
+		_, err = c.ExecContext(ctx, `echo ",+" | sfdisk --no-reread --partno 3 `+disk+` && partx -u `+disk, true)
 		if err != nil {
 			return errors.New("error updating partition table: " + err.Error())
 		}
 
-		_, err = c.Exec("resize2fs /dev/vda3", true)
+		_, err = c.ExecContext(ctx, "resize2fs "+c.GuestDiskPartition(3), true)
 		if err != nil {
 			return errors.New("error expanding filesystem: " + err.Error())
 		}
 
-		_, err = c.Exec("df -h", true)
+		_, err = c.ExecContext(ctx, "df -h", true)
 		if err != nil {
 
 			return err
@@ -915,7 +1161,12 @@ func (c *MachineConfig) CompressQemuDiskImage() error {
 		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
 	}
 
-	cmd := exec.Command("qemu-img", "convert", "-c", "-O", "qcow2", filepath.Join(c.Location, c.Image),
+	// only qcow2 supports compression, raw disks are archived as they are
+	if c.GetDiskFormat() == DiskFormatRaw {
+		return nil
+	}
+
+	cmd := command("qemu-img", "convert", "-c", "-O", "qcow2", filepath.Join(c.Location, c.Image),
 		filepath.Join(c.Location, c.Image+"_compressed.qcow2"))
 
 	err := cmd.Run()
@@ -943,21 +1194,25 @@ func (c *MachineConfig) DecompressQemuDiskImage() error {
 		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
 	}
 
-	cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", "-p", filepath.Join(c.Location, c.Image),
-		filepath.Join(c.Location, c.Image+"_decompressed.qcow2"))
+	// raw disks are never compressed
+	if c.GetDiskFormat() == DiskFormatRaw {
+		return nil
+	}
+
+	cmd := command("qemu-img", "convert", "-O", "qcow2", "-p", c.DiskPath(),
+		c.DiskPath()+"_decompressed")
 
 	err := cmd.Run()
 	if err != nil {
 		return err
 	}
 
-	err = os.Remove(filepath.Join(c.Location, c.Image))
+	err = os.Remove(c.DiskPath())
 	if err != nil {
 		return err
 	}
 
-	err = os.Rename(filepath.Join(c.Location, c.Image+"_decompressed.qcow2"),
-		filepath.Join(c.Location, c.Image))
+	err = os.Rename(c.DiskPath()+"_decompressed", c.DiskPath())
 	if err != nil {
 		return err
 	}
@@ -971,9 +1226,10 @@ func (c *MachineConfig) ResizeQemuDiskImage() error {
 		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
 	}
 
-	cmd := exec.Command("qemu-img",
+	cmd := command("qemu-img",
 		"resize",
-		filepath.Join(c.Location, c.Image),
+		"-f", c.GetDiskFormat(),
+		c.DiskPath(),
 		"+"+c.Disk)
 
 	err := cmd.Run()
@@ -991,7 +1247,7 @@ func (c *MachineConfig) CreateQemuDiskImage(imageName string) error {
 	if !utils.CommandExists("qemu-img") {
 		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
 	}
-	cmd := exec.Command("qemu-img",
+	cmd := command("qemu-img",
 		"create", "-f", "qcow2",
 		"-o", "compression_type=zlib",
 		filepath.Join(c.Location, imageName),
@@ -1006,11 +1262,13 @@ func (c *MachineConfig) CreateQemuDiskImage(imageName string) error {
 	return nil
 }
 
-func (c *MachineConfig) CleanPIDFile() {
+// CleanPIDFile removes the PID file of a stopped instance
+func (c *MachineConfig) CleanPIDFile() error {
 	pidFile := filepath.Join(c.Location, "alpine.pid")
 	if err := os.Remove(pidFile); err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("error deleting pidfile at %s. Manually delete it before proceeding.", pidFile)
+		return errors.New("error deleting pidfile at " + pidFile + ". Manually delete it before proceeding")
 	}
+	return nil
 }
 
 func (c *MachineConfig) GetInstancePID() (int, error) {
@@ -1033,35 +1291,108 @@ func (c *MachineConfig) GetInstancePID() (int, error) {
 	return pid, nil
 }
 
+// GetMachineConfig loads and validates the configuration of an instance. A configuration written by
+// an older release is migrated in memory only, commands that change the instance persist it with
+// LockMachineConfig, so that reading never writes or waits for the instance lock.
 func GetMachineConfig(vmName string) (MachineConfig, error) {
-	machineConfig := MachineConfig{}
+	machineConfig, _, err := loadMachineConfig(vmName)
+	return machineConfig, err
+}
 
-	userHomeDir, err := os.UserHomeDir()
+// GetMachineConfigForStop is GetMachineConfig for stopping and deleting an instance. A configuration
+// that only fails Validate is returned as well, named and located after the instance directory as
+// alpine repair assumes, since its pidfile and disk can still be found.
+func GetMachineConfigForStop(vmName string) (MachineConfig, error) {
+	machineConfig, _, err := loadMachineConfig(vmName)
+	var invalid *ConfigError
+	if !errors.As(err, &invalid) {
+		return machineConfig, err
+	}
+	dataDir, err := utils.DataDir()
 	if err != nil {
 		return machineConfig, err
 	}
+	machineConfig.Alias, machineConfig.Location = vmName, filepath.Join(dataDir, vmName)
+	return machineConfig, nil
+}
+
+// loadMachineConfig is GetMachineConfig, also reporting whether the configuration was migrated
+func loadMachineConfig(vmName string) (MachineConfig, bool, error) {
+	machineConfig := MachineConfig{}
 
-	config, err := os.ReadFile(filepath.Join(userHomeDir, ".macpine", vmName, "config.yaml"))
+	dataDir, err := utils.DataDir()
 	if err != nil {
-		return machineConfig, err
+		return machineConfig, false, err
+	}
+
+	config, err := os.ReadFile(filepath.Join(dataDir, vmName, "config.yaml"))
+	if err != nil {
+		return machineConfig, false, err
 	}
 
 	err = yaml.Unmarshal(config, &machineConfig)
 	if err != nil {
+		return machineConfig, false, err
+	}
+
+	migrated, err := migrateConfig(&machineConfig)
+	if err != nil {
+		return machineConfig, false, err
+	}
+	if err := machineConfig.Validate(); err != nil {
+		return machineConfig, migrated, fmt.Errorf("invalid configuration of %s, %w. fix it with `alpine edit %s`", vmName, err, vmName)
+	}
+	return machineConfig, migrated, nil
+}
+
+// ParseMachineConfig decodes a configuration strictly, rejecting fields MachineConfig does not have
+func ParseMachineConfig(config []byte) (MachineConfig, error) {
+	machineConfig := MachineConfig{}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(config, &doc); err != nil {
 		return machineConfig, err
 	}
-	return machineConfig, nil
+	if len(doc.Content) == 0 {
+		return machineConfig, errors.New("configuration is empty")
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return machineConfig, errors.New("line " + strconv.Itoa(root.Line) + ": configuration must be a mapping of fields")
+	}
+
+	// UnmarshalYAML decodes through a node, which does not honour KnownFields, so check the keys here
+	known := map[string]bool{"vmnet": true}
+	t := reflect.TypeOf(machineConfig)
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]] = true
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		key := root.Content[i]
+		if !known[key.Value] {
+			return machineConfig, errors.New("line " + strconv.Itoa(key.Line) + ": unknown field " + key.Value)
+		}
+	}
+
+	err := root.Decode(&machineConfig)
+	return machineConfig, err
 }
 
+// SaveMachineConfig writes config.yaml under the instance lock, replacing it atomically so that a
+// crash or a concurrent reader never sees a partial file. A configuration that holds the lock, see
+// MachineConfig.Lock, is written under it, others wait for the lock.
 func SaveMachineConfig(machineConfig MachineConfig) error {
 	updatedConfig, err := yaml.Marshal(&machineConfig)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(filepath.Join(machineConfig.Location, "config.yaml"), updatedConfig, 0644)
-	if err != nil {
-		return err
+	if !machineConfig.lock.Held() {
+		lock, err := machineConfig.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
 	}
-	return nil
+
+	return utils.WriteFileAtomic(filepath.Join(machineConfig.Location, "config.yaml"), updatedConfig, 0644)
 }
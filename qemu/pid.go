@@ -0,0 +1,50 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ProcessCommand returns the full command line of a process, or an empty string if it does not exist
+func ProcessCommand(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	out, err := exec.Command("ps", "-ww", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// OwnsProcess reports whether pid is the qemu process of this instance, as opposed to a process
+// that reused the PID of an instance that is long gone
+func (c *MachineConfig) OwnsProcess(pid int) bool {
+	return strings.Contains(ProcessCommand(pid), "file="+c.DiskPath())
+}
+
+// HasPIDFile reports whether qemu left a pidfile in the instance directory. qemu removes it on a
+// clean exit, so a pidfile without a matching process means qemu died.
+func (c *MachineConfig) HasPIDFile() bool {
+	_, err := os.Stat(filepath.Join(c.Location, "alpine.pid"))
+	return err == nil
+}
+
+// CleanRuntimeFiles removes the pidfile and sockets an instance whose qemu process is gone left
+// behind. It does nothing while the instance runs.
+func (c *MachineConfig) CleanRuntimeFiles() {
+	if status, _ := c.Status(); status != "Stopped" {
+		return
+	}
+	for _, name := range []string{"alpine.pid", "alpine.sock", "alpine.qmp", "alpine.qga"} {
+		if err := os.Remove(filepath.Join(c.Location, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	c.stopGvproxy()
+	c.stopSwtpm()
+}
@@ -0,0 +1,126 @@
+package qemu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	log "github.com/beringresearch/macpine/logging"
+	"golang.org/x/crypto/ssh"
+)
+
+const provisionDir = "/tmp/macpine-provision"
+
+// RunProvision uploads each script to the instance over SFTP and runs it as root, in order,
+// prefixing its output with the script name. A failing script stops provisioning unless
+// ignoreErrors is set.
+func (c *MachineConfig) RunProvision(scripts []string, ignoreErrors bool) error {
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	conn, err := c.Dial(true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sftp, err := NewSFTPClient(conn)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	if err := sftp.MkdirAll(provisionDir, 0700); err != nil {
+		return err
+	}
+
+	for i, script := range scripts {
+		name := filepath.Base(script)
+		remote := path.Join(provisionDir, strconv.Itoa(i)+"-"+name)
+
+		f, err := os.Open(script)
+		if err != nil {
+			return errors.New("unable to read provisioning script: " + err.Error())
+		}
+		err = sftp.WriteFile(remote, f, 0700)
+		f.Close()
+		if err != nil {
+			return errors.New("unable to upload " + script + " to " + remote + ": " + err.Error())
+		}
+
+		log.Println("provisioning " + c.Alias + ": " + name)
+		err = runPrefixed(conn, remote, "["+name+"] ")
+		if err != nil {
+			err = fmt.Errorf("provisioning script %s failed: %v", name, err)
+			if !ignoreErrors {
+				return err
+			}
+			log.Errorln(err)
+		}
+	}
+	return nil
+}
+
+// runPrefixed runs a command in a new session, copying its output to the terminal line by line with a prefix
+func runPrefixed(conn *ssh.Client, cmd string, prefix string) error {
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var mu sync.Mutex
+	stdout := &prefixWriter{w: os.Stdout, prefix: prefix, mu: &mu}
+	stderr := &prefixWriter{w: os.Stderr, prefix: prefix, mu: &mu}
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(cmd)
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+// prefixWriter writes complete lines to w, each starting with prefix
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf.Write(b)
+	for {
+		line, err := p.buf.ReadBytes('\n')
+		if err != nil {
+			// keep the incomplete line for the next write
+			p.buf.Reset()
+			p.buf.Write(line)
+			return len(b), nil
+		}
+		p.mu.Lock()
+		_, err = fmt.Fprint(p.w, p.prefix, string(line))
+		p.mu.Unlock()
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Flush writes any trailing output that did not end in a newline
+func (p *prefixWriter) Flush() {
+	if p.buf.Len() > 0 {
+		p.mu.Lock()
+		fmt.Fprintln(p.w, p.prefix+p.buf.String())
+		p.mu.Unlock()
+		p.buf.Reset()
+	}
+}
@@ -0,0 +1,94 @@
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// QMPTimeout bounds each exchange with the QEMU Machine Protocol socket
+var QMPTimeout = 10 * time.Second
+
+// QMPClient is a connection to the QMP socket of a running instance
+type QMPClient struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// QMPPath returns the location of the QMP socket of the instance
+func (c *MachineConfig) QMPPath() string {
+	return filepath.Join(c.Location, "alpine.qmp")
+}
+
+// QMP connects to the QMP socket of the instance and negotiates capabilities
+func (c *MachineConfig) QMP() (*QMPClient, error) {
+	if status, _ := c.Status(); status == "Stopped" {
+		return nil, errors.New(c.Alias + " is not running")
+	}
+
+	conn, err := net.DialTimeout("unix", c.QMPPath(), QMPTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, errors.New("permission denied on " + c.QMPPath() + ", qemu runs as root: restart " + c.Alias + " or run this command with sudo")
+		}
+		return nil, errors.New("unable to connect to the QMP socket of " + c.Alias + ": " + err.Error())
+	}
+
+	q := &QMPClient{conn: conn, dec: json.NewDecoder(conn)}
+
+	// qemu greets with its version and capabilities, commands are accepted after qmp_capabilities
+	var greeting map[string]json.RawMessage
+	conn.SetDeadline(time.Now().Add(QMPTimeout))
+	if err := q.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, errors.New("unable to read QMP greeting of " + c.Alias + ": " + err.Error())
+	}
+	if _, err := q.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Execute runs a QMP command and returns its result, skipping asynchronous events
+func (q *QMPClient) Execute(command string, arguments map[string]interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+
+	q.conn.SetDeadline(time.Now().Add(QMPTimeout))
+	if err := json.NewEncoder(q.conn).Encode(req); err != nil {
+		return nil, err
+	}
+	for {
+		var resp qmpResponse
+		if err := q.dec.Decode(&resp); err != nil {
+			return nil, errors.New("QMP " + command + ": " + err.Error())
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return nil, errors.New("QMP " + command + ": " + resp.Error.Desc)
+		}
+		return resp.Return, nil
+	}
+}
+
+// Close closes the connection
+func (q *QMPClient) Close() error {
+	return q.conn.Close()
+}
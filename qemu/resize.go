@@ -0,0 +1,85 @@
+package qemu
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+var diskSizePattern = regexp.MustCompile(`^\+?[0-9]+[KMGT]?$`)
+
+// ErrGrowToolsMissing is returned by GrowFilesystem when the guest lacks the tools to grow its root filesystem
+var ErrGrowToolsMissing = errors.New("guest is missing the tools to grow its filesystem, install them with `apk add e2fsprogs-extra sfdisk partx` (or cloud-utils-growpart)")
+
+// growFilesystemScript grows the partition holding / to the end of its disk and then the filesystem,
+// exiting with 3 when no suitable tool is installed
+const growFilesystemScript = `set -e
+root=$(awk '$2 == "/" { print $1 }' /proc/mounts | tail -n 1)
+dev=${root#/dev/}
+if [ ! -e /sys/class/block/$dev/partition ]; then
+	echo "unable to locate the partition of $root" >&2
+	exit 1
+fi
+part=$(cat /sys/class/block/$dev/partition)
+disk=/dev/$(basename $(readlink -f /sys/class/block/$dev/..))
+if command -v growpart >/dev/null; then
+	growpart $disk $part || [ $? -eq 1 ]
+elif command -v sfdisk >/dev/null && command -v partx >/dev/null; then
+	echo ",+" | sfdisk --no-reread --partno $part $disk >/dev/null
+	partx -u $disk
+else
+	exit 3
+fi
+fstype=$(awk '$2 == "/" { print $3 }' /proc/mounts | tail -n 1)
+case $fstype in
+	ext*) command -v resize2fs >/dev/null || exit 3; resize2fs $root >/dev/null ;;
+	xfs) command -v xfs_growfs >/dev/null || exit 3; xfs_growfs / >/dev/null ;;
+	btrfs) btrfs filesystem resize max / >/dev/null ;;
+	*) echo "unsupported root filesystem $fstype" >&2; exit 1 ;;
+esac
+df -h /`
+
+// ResizeDisk sets the size of the instance disk image, either absolute (20G) or relative (+5G).
+// The instance must be stopped.
+func (c *MachineConfig) ResizeDisk(size string) error {
+	if !diskSizePattern.MatchString(size) {
+		return errors.New("invalid disk size " + size + ". use a size such as 20G or +5G")
+	}
+	if !utils.CommandExists("qemu-img") {
+		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+	}
+
+	out, err := command("qemu-img", "resize", "-f", c.GetDiskFormat(), c.DiskPath(), size).CombinedOutput()
+	if err != nil {
+		return errors.New("unable to resize disk: " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// GrowFilesystem expands the root partition and filesystem of a running instance to fill its disk,
+// returning the resulting disk usage report
+func (c *MachineConfig) GrowFilesystem() (string, error) {
+	conn, err := c.Dial(true)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput(growFilesystemScript)
+	if err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.ExitStatus() == 3 {
+			return "", ErrGrowToolsMissing
+		}
+		return "", errors.New("unable to grow filesystem: " + strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
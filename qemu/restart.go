@@ -0,0 +1,43 @@
+package qemu
+
+import "errors"
+
+// RestartPolicy decides whether the supervisor brings an instance back after qemu exits
+type RestartPolicy string
+
+const (
+	// RestartNo leaves a stopped instance alone, the default
+	RestartNo RestartPolicy = "no"
+	// RestartOnFailure restarts an instance whose qemu process died without shutting down cleanly
+	RestartOnFailure RestartPolicy = "on-failure"
+	// RestartAlways also restarts an instance that was shut down from inside the guest
+	RestartAlways RestartPolicy = "always"
+)
+
+// DefaultMaxRestarts bounds consecutive restarts when the configuration does not
+const DefaultMaxRestarts = 5
+
+// ParseRestartPolicy validates a restart policy
+func ParseRestartPolicy(policy string) (RestartPolicy, error) {
+	switch RestartPolicy(policy) {
+	case RestartNo, RestartOnFailure, RestartAlways:
+		return RestartPolicy(policy), nil
+	}
+	return "", errors.New("unsupported restart policy " + policy + ". use no, on-failure or always")
+}
+
+// GetRestartPolicy returns the restart policy of the instance, no unless configured otherwise
+func (c *MachineConfig) GetRestartPolicy() RestartPolicy {
+	if c.RestartPolicy == "" {
+		return RestartNo
+	}
+	return c.RestartPolicy
+}
+
+// GetMaxRestarts returns how many consecutive restarts the supervisor attempts before giving up
+func (c *MachineConfig) GetMaxRestarts() int {
+	if c.MaxRestarts <= 0 {
+		return DefaultMaxRestarts
+	}
+	return c.MaxRestarts
+}
@@ -0,0 +1,127 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// hostAlias is the name the guest reaches the host under with --host-alias
+const hostAlias = "host.internal"
+
+// allowTCPForwarding enables the forwards of reverse ports and tunnels, which Alpine's sshd_config
+// disables
+const allowTCPForwarding = "if grep -q '^AllowTcpForwarding no' /etc/ssh/sshd_config; then " +
+	"sed -i 's/^AllowTcpForwarding no/AllowTcpForwarding yes/' /etc/ssh/sshd_config && rc-service sshd reload; fi"
+
+// ReversePort forwards a port of the guest to an address reachable from the host, as ssh -R does
+type ReversePort struct {
+	GuestPort int    `yaml:"guestport" json:"guestport"`
+	Host      string `yaml:"host" json:"host"`
+	HostPort  int    `yaml:"hostport" json:"hostport"`
+}
+
+func (r ReversePort) String() string {
+	return strconv.Itoa(r.GuestPort) + ":" + r.Host + ":" + strconv.Itoa(r.HostPort)
+}
+
+// HostAddress returns the address connections to the guest port are forwarded to
+func (r ReversePort) HostAddress() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.HostPort))
+}
+
+// ParseReversePort parses a guestport:host:hostport specification. PORT and GUESTPORT:HOSTPORT
+// forward to localhost on the host.
+func ParseReversePort(spec string) (ReversePort, error) {
+	invalid := errors.New("invalid reverse port " + spec + ", expected guestport:host:hostport, e.g. 5432:localhost:5432")
+
+	parts := strings.Split(spec, ":")
+	r := ReversePort{Host: "localhost"}
+	var guest, hostPort string
+	switch len(parts) {
+	case 1:
+		guest, hostPort = parts[0], parts[0]
+	case 2:
+		guest, hostPort = parts[0], parts[1]
+	case 3:
+		guest, r.Host, hostPort = parts[0], parts[1], parts[2]
+	default:
+		return ReversePort{}, invalid
+	}
+	if r.Host == "" {
+		return ReversePort{}, invalid
+	}
+
+	var err error
+	for _, p := range []struct {
+		value string
+		port  *int
+	}{{guest, &r.GuestPort}, {hostPort, &r.HostPort}} {
+		*p.port, err = strconv.Atoi(p.value)
+		if err != nil || *p.port < 1 || *p.port > 65535 {
+			return ReversePort{}, invalid
+		}
+	}
+	return r, nil
+}
+
+// EnableTCPForwarding allows the SSH server of the guest to forward TCP connections, in both directions
+func (c *MachineConfig) EnableTCPForwarding() error {
+	if _, err := c.Exec(allowTCPForwarding, true); err != nil {
+		return errors.New("unable to enable TCP forwarding in the SSH server of " + c.Alias + ": " + err.Error())
+	}
+	return nil
+}
+
+// hostGateway returns the address of the host as seen from the guest in user-mode networks, empty
+// when the host is the default gateway of the guest
+func (c *MachineConfig) hostGateway() string {
+	switch {
+	case c.usesSlirp():
+		return "10.0.2.2"
+	case c.usesGvproxy():
+		return "192.168.127.254"
+	}
+	return ""
+}
+
+// AddCloudHostAlias maps host.internal to the host in /etc/hosts from the runcmd of #cloud-config
+// user-data. In the vmnet modes the host is the default gateway of the guest, except with bridged
+// networking where the gateway is the router of the LAN.
+func (c *MachineConfig) AddCloudHostAlias(userData []byte) ([]byte, error) {
+	if !c.HostAlias {
+		return userData, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(userData)), "#cloud-config") {
+		return nil, errors.New("--host-alias requires #cloud-config user-data, add " + hostAlias + " to /etc/hosts from the script instead")
+	}
+
+	cloudConfig := map[string]interface{}{}
+	if err := yaml.Unmarshal(userData, &cloudConfig); err != nil {
+		return nil, errors.New("unable to parse user-data: " + err.Error())
+	}
+	if cloudConfig == nil {
+		cloudConfig = map[string]interface{}{}
+	}
+
+	runcmd, ok := cloudConfig["runcmd"].([]interface{})
+	if !ok && cloudConfig["runcmd"] != nil {
+		return nil, errors.New("runcmd in user-data must be a list")
+	}
+	gateway := c.hostGateway()
+	if gateway == "" {
+		gateway = "$(ip route | awk '/^default/ { print $3; exit }')"
+	}
+	cloudConfig["runcmd"] = append(runcmd,
+		"sed -i '/[[:space:]]"+hostAlias+"$/d' /etc/hosts",
+		"gateway="+gateway+"; [ -n \"$gateway\" ] && echo \"$gateway "+hostAlias+"\" >> /etc/hosts")
+
+	merged, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), merged...), nil
+}
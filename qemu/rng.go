@@ -0,0 +1,14 @@
+package qemu
+
+// rngArgs returns the qemu arguments that add a virtio-rng device fed from the host's /dev/urandom.
+// Without it freshly booted guests can stall generating SSH host keys until the kernel has gathered
+// enough entropy.
+func (c *MachineConfig) rngArgs() []string {
+	if c.NoRNG {
+		return nil
+	}
+	return []string{
+		"-object", "rng-random,id=rng0,filename=/dev/urandom",
+		"-device", "virtio-rng-pci,rng=rng0",
+	}
+}
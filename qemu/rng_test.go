@@ -0,0 +1,37 @@
+package qemu
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRNGDevice(t *testing.T) {
+	rng := "-object rng-random,id=rng0,filename=/dev/urandom -device virtio-rng-pci,rng=rng0"
+	for _, noRNG := range []bool{false, true} {
+		location := t.TempDir()
+		// the firmware an aarch64 Alpine instance boots is copied into its directory on launch
+		if err := os.WriteFile(filepath.Join(location, "qemu_efi.fd"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := MachineConfig{
+			Alias:    "rng",
+			Image:    "alpine_3.20.3-aarch64.qcow2",
+			Arch:     "aarch64",
+			CPU:      "2",
+			Memory:   "2048",
+			Network:  NetworkNone,
+			Location: location,
+			NoRNG:    noRNG,
+		}
+		args, err := c.commandLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commandLine := strings.Join(args, " ")
+		if got := strings.Contains(commandLine, rng); got == noRNG {
+			t.Errorf("qemu command line with norng %v:\n%s\nwant the rng device: %v", noRNG, commandLine, !noRNG)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package qemu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP protocol version 3 (draft-ietf-secsh-filexfer-02), as served by OpenSSH's sftp-server
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpFxfRead  = 0x01
+	sftpFxfWrite = 0x02
+	sftpFxfCreat = 0x08
+	sftpFxfTrunc = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpStatusOK  = 0
+	sftpStatusEOF = 1
+
+	sftpChunkSize = 32 * 1024
+)
+
+// SFTPClient is a minimal SFTP client for copying files to and from an instance
+type SFTPClient struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+// SFTPStatusError is a non-OK status returned by the server
+type SFTPStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *SFTPStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (code %d)", e.Message, e.Code)
+}
+
+// NewSFTPClient starts the sftp subsystem on an SSH connection
+func NewSFTPClient(conn *ssh.Client) (*SFTPClient, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, errors.New("unable to start sftp subsystem, is openssh-sftp-server installed in the instance? " + err.Error())
+	}
+
+	client := &SFTPClient{session: session, w: w, r: r}
+
+	init := []byte{sftpInit, 0, 0, 0, 3}
+	if err := client.writePacket(init); err != nil {
+		client.Close()
+		return nil, err
+	}
+	packet, err := client.readPacket()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if packet[0] != sftpVersion {
+		client.Close()
+		return nil, fmt.Errorf("sftp: unexpected packet type %d during init", packet[0])
+	}
+	return client, nil
+}
+
+// Close ends the sftp session
+func (s *SFTPClient) Close() error {
+	s.w.Close()
+	return s.session.Close()
+}
+
+// MkdirAll creates a directory and any missing parents
+func (s *SFTPClient) MkdirAll(dir string, mode os.FileMode) error {
+	if dir == "" || dir == "/" || dir == "." {
+		return nil
+	}
+	if info, err := s.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return errors.New(dir + " exists and is not a directory")
+		}
+		return nil
+	}
+	if err := s.MkdirAll(path.Dir(dir), mode); err != nil {
+		return err
+	}
+
+	buf := s.request(sftpMkdir)
+	buf = appendString(buf, dir)
+	buf = appendPermissions(buf, mode)
+	if err := s.expectStatus(buf); err != nil {
+		// lost a race with another writer
+		if info, serr := s.Stat(dir); serr == nil && info.IsDir() {
+			return nil
+		}
+		return errors.New("unable to create " + dir + ": " + err.Error())
+	}
+	return nil
+}
+
+// WriteFile creates or truncates a remote file, fills it from r and sets its mode
+func (s *SFTPClient) WriteFile(name string, r io.Reader, mode os.FileMode) error {
+	handle, err := s.open(name, sftpFxfWrite|sftpFxfCreat|sftpFxfTrunc)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, rerr := r.Read(chunk)
+		if n > 0 {
+			buf := s.request(sftpWrite)
+			buf = appendString(buf, handle)
+			buf = binary.BigEndian.AppendUint64(buf, offset)
+			buf = appendString(buf, string(chunk[:n]))
+			if err := s.expectStatus(buf); err != nil {
+				s.closeHandle(handle)
+				return err
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			s.closeHandle(handle)
+			return rerr
+		}
+	}
+
+	if err := s.closeHandle(handle); err != nil {
+		return err
+	}
+	return s.Chmod(name, mode)
+}
+
+// ReadFile copies the contents of a remote file to w
+func (s *SFTPClient) ReadFile(name string, w io.Writer) error {
+	handle, err := s.open(name, sftpFxfRead)
+	if err != nil {
+		return err
+	}
+	defer s.closeHandle(handle)
+
+	var offset uint64
+	for {
+		buf := s.request(sftpRead)
+		buf = appendString(buf, handle)
+		buf = binary.BigEndian.AppendUint64(buf, offset)
+		buf = binary.BigEndian.AppendUint32(buf, sftpChunkSize)
+		packet, err := s.roundTrip(buf)
+		if err != nil {
+			return err
+		}
+		switch packet[0] {
+		case sftpData:
+			data, _, err := readString(packet[5:])
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(data)); err != nil {
+				return err
+			}
+			offset += uint64(len(data))
+		case sftpStatus:
+			serr := parseStatus(packet)
+			if serr.Code == sftpStatusEOF {
+				return nil
+			}
+			return serr
+		default:
+			return fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+		}
+	}
+}
+
+// Chmod sets the permission bits of a remote path
+func (s *SFTPClient) Chmod(name string, mode os.FileMode) error {
+	buf := s.request(sftpSetstat)
+	buf = appendString(buf, name)
+	buf = appendPermissions(buf, mode)
+	return s.expectStatus(buf)
+}
+
+// SFTPFileInfo is the subset of remote file attributes macpine uses
+type SFTPFileInfo struct {
+	Size uint64
+	Mode os.FileMode
+}
+
+// IsDir reports whether the remote path is a directory
+func (i SFTPFileInfo) IsDir() bool {
+	return i.Mode.IsDir()
+}
+
+// Stat returns the attributes of a remote path, following symlinks
+func (s *SFTPClient) Stat(name string) (SFTPFileInfo, error) {
+	buf := s.request(sftpStat)
+	buf = appendString(buf, name)
+	packet, err := s.roundTrip(buf)
+	if err != nil {
+		return SFTPFileInfo{}, err
+	}
+	switch packet[0] {
+	case sftpAttrs:
+		info, _, err := parseAttrs(packet[5:])
+		return info, err
+	case sftpStatus:
+		return SFTPFileInfo{}, parseStatus(packet)
+	}
+	return SFTPFileInfo{}, fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+}
+
+// SFTPDirEntry is an entry of a remote directory
+type SFTPDirEntry struct {
+	Name string
+	Info SFTPFileInfo
+}
+
+// ReadDir lists a remote directory, omitting . and ..
+func (s *SFTPClient) ReadDir(dir string) ([]SFTPDirEntry, error) {
+	buf := s.request(sftpOpendir)
+	buf = appendString(buf, dir)
+	packet, err := s.roundTrip(buf)
+	if err != nil {
+		return nil, err
+	}
+	switch packet[0] {
+	case sftpHandle:
+	case sftpStatus:
+		return nil, fmt.Errorf("unable to open %s: %w", dir, parseStatus(packet))
+	default:
+		return nil, fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+	}
+	handle, _, err := readString(packet[5:])
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeHandle(handle)
+
+	entries := []SFTPDirEntry{}
+	for {
+		buf := s.request(sftpReaddir)
+		buf = appendString(buf, handle)
+		packet, err := s.roundTrip(buf)
+		if err != nil {
+			return nil, err
+		}
+		switch packet[0] {
+		case sftpName:
+		case sftpStatus:
+			serr := parseStatus(packet)
+			if serr.Code == sftpStatusEOF {
+				return entries, nil
+			}
+			return nil, serr
+		default:
+			return nil, fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+		}
+
+		if len(packet) < 9 {
+			return nil, errors.New("sftp: malformed name list")
+		}
+		count := binary.BigEndian.Uint32(packet[5:9])
+		rest := packet[9:]
+		for i := uint32(0); i < count; i++ {
+			var name string
+			name, rest, err = readString(rest)
+			if err != nil {
+				return nil, err
+			}
+			_, rest, err = readString(rest) // long name
+			if err != nil {
+				return nil, err
+			}
+			var info SFTPFileInfo
+			info, rest, err = parseAttrs(rest)
+			if err != nil {
+				return nil, err
+			}
+			if name != "." && name != ".." {
+				entries = append(entries, SFTPDirEntry{Name: name, Info: info})
+			}
+		}
+	}
+}
+
+func (s *SFTPClient) open(name string, flags uint32) (string, error) {
+	buf := s.request(sftpOpen)
+	buf = appendString(buf, name)
+	buf = binary.BigEndian.AppendUint32(buf, flags)
+	buf = binary.BigEndian.AppendUint32(buf, 0) // no attributes
+	packet, err := s.roundTrip(buf)
+	if err != nil {
+		return "", err
+	}
+	switch packet[0] {
+	case sftpHandle:
+		handle, _, err := readString(packet[5:])
+		return handle, err
+	case sftpStatus:
+		return "", fmt.Errorf("unable to open %s: %w", name, parseStatus(packet))
+	}
+	return "", fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+}
+
+func (s *SFTPClient) closeHandle(handle string) error {
+	buf := s.request(sftpClose)
+	buf = appendString(buf, handle)
+	return s.expectStatus(buf)
+}
+
+// request starts a packet of the given type with a fresh request id
+func (s *SFTPClient) request(packetType byte) []byte {
+	s.id++
+	buf := []byte{packetType}
+	return binary.BigEndian.AppendUint32(buf, s.id)
+}
+
+func (s *SFTPClient) expectStatus(buf []byte) error {
+	packet, err := s.roundTrip(buf)
+	if err != nil {
+		return err
+	}
+	if packet[0] != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d", packet[0])
+	}
+	if serr := parseStatus(packet); serr.Code != sftpStatusOK {
+		return serr
+	}
+	return nil
+}
+
+// roundTrip sends a request and waits for its response, requests are never pipelined
+func (s *SFTPClient) roundTrip(buf []byte) ([]byte, error) {
+	if err := s.writePacket(buf); err != nil {
+		return nil, err
+	}
+	packet, err := s.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) < 5 || binary.BigEndian.Uint32(packet[1:5]) != s.id {
+		return nil, errors.New("sftp: response does not match request")
+	}
+	return packet, nil
+}
+
+func (s *SFTPClient) writePacket(buf []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(buf)))
+	_, err := s.w.Write(append(packet, buf...))
+	return err
+}
+
+func (s *SFTPClient) readPacket() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(s.r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size == 0 || size > 256*1024 {
+		return nil, fmt.Errorf("sftp: invalid packet length %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(s.r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func parseStatus(packet []byte) *SFTPStatusError {
+	if len(packet) < 9 {
+		return &SFTPStatusError{Code: 4, Message: "malformed status"}
+	}
+	serr := &SFTPStatusError{Code: binary.BigEndian.Uint32(packet[5:9])}
+	serr.Message, _, _ = readString(packet[9:])
+	if serr.Message == "" {
+		serr.Message = "failure"
+	}
+	return serr
+}
+
+func parseAttrs(buf []byte) (SFTPFileInfo, []byte, error) {
+	info := SFTPFileInfo{}
+	malformed := errors.New("sftp: malformed attributes")
+	if len(buf) < 4 {
+		return info, nil, malformed
+	}
+	flags := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	if flags&sftpAttrSize != 0 {
+		if len(buf) < 8 {
+			return info, nil, malformed
+		}
+		info.Size = binary.BigEndian.Uint64(buf)
+		buf = buf[8:]
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		if len(buf) < 8 {
+			return info, nil, malformed
+		}
+		buf = buf[8:]
+	}
+	if flags&sftpAttrPermissions != 0 {
+		if len(buf) < 4 {
+			return info, nil, malformed
+		}
+		perm := binary.BigEndian.Uint32(buf)
+		info.Mode = os.FileMode(perm & 0777)
+		switch perm & 0170000 {
+		case 0040000:
+			info.Mode |= os.ModeDir
+		case 0120000:
+			info.Mode |= os.ModeSymlink
+		case 0100000:
+		default:
+			info.Mode |= os.ModeIrregular
+		}
+		buf = buf[4:]
+	}
+	if flags&sftpAttrACModTime != 0 {
+		if len(buf) < 8 {
+			return info, nil, malformed
+		}
+		buf = buf[8:]
+	}
+	if flags&sftpAttrExtended != 0 {
+		if len(buf) < 4 {
+			return info, nil, malformed
+		}
+		count := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		for i := uint32(0); i < 2*count; i++ {
+			var err error
+			_, buf, err = readString(buf)
+			if err != nil {
+				return info, nil, err
+			}
+		}
+	}
+	return info, buf, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func appendPermissions(buf []byte, mode os.FileMode) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, sftpAttrPermissions)
+	return binary.BigEndian.AppendUint32(buf, uint32(mode.Perm()))
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	if len(buf) < 4 {
+		return "", nil, errors.New("sftp: malformed string")
+	}
+	size := binary.BigEndian.Uint32(buf)
+	if uint32(len(buf)-4) < size {
+		return "", nil, errors.New("sftp: malformed string")
+	}
+	return string(buf[4 : 4+size]), buf[4+size:], nil
+}
@@ -0,0 +1,52 @@
+package qemu
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// snapshot runs qemu-img snapshot on the instance disk, which must be a qcow2 image of a stopped
+// instance: qemu-img does not coordinate with a running qemu.
+func (c *MachineConfig) snapshot(op string, name string) error {
+	if c.GetDiskFormat() != DiskFormatQcow2 {
+		return errors.New("snapshots require a qcow2 disk, " + c.Alias + " has a " + c.GetDiskFormat() + " disk")
+	}
+	if status, _ := c.Status(); status != "Stopped" {
+		return errors.New(c.Alias + " is " + status + ", snapshots are taken of stopped instances")
+	}
+	if !utils.CommandExists("qemu-img") {
+		return errors.New("qemu-img is not available on $PATH. ensure qemu is installed")
+	}
+
+	out, err := command("qemu-img", "snapshot", op, name, c.DiskPath()).CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CreateSnapshot records the state of the instance disk as an internal qcow2 snapshot
+func (c *MachineConfig) CreateSnapshot(name string) error {
+	if err := c.snapshot("-c", name); err != nil {
+		return errors.New("unable to snapshot " + c.Alias + ": " + err.Error())
+	}
+	return nil
+}
+
+// RevertSnapshot restores the instance disk to a snapshot taken with CreateSnapshot
+func (c *MachineConfig) RevertSnapshot(name string) error {
+	if err := c.snapshot("-a", name); err != nil {
+		return errors.New("unable to revert " + c.Alias + " to snapshot " + name + ": " + err.Error())
+	}
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot from the instance disk
+func (c *MachineConfig) DeleteSnapshot(name string) error {
+	if err := c.snapshot("-d", name); err != nil {
+		return errors.New("unable to delete snapshot " + name + " of " + c.Alias + ": " + err.Error())
+	}
+	return nil
+}
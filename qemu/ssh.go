@@ -0,0 +1,185 @@
+package qemu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// AskpassEnv holds the instance password while ssh runs macpine as its SSH_ASKPASS program
+const AskpassEnv = "MACPINE_SSH_ASKPASS"
+
+// SSHOptions are the ssh(1) features passed through by SSHCommand
+type SSHOptions struct {
+	// Command is run instead of a login shell
+	Command string
+	// WorkDir is the directory the shell or command starts in
+	WorkDir string
+	// ForwardAgent forwards the local SSH agent, as ssh -A
+	ForwardAgent bool
+	// LocalForwards and RemoteForwards are ssh -L and -R specifications
+	LocalForwards  []string
+	RemoteForwards []string
+}
+
+// SSHCommand returns an ssh(1) invocation that logs into the instance as its SSH user, so that
+// ~/.ssh/config, the SSH agent and port forwarding work as with any other host. Password credentials
+// are answered by running the current executable as SSH_ASKPASS.
+func (c *MachineConfig) SSHCommand(opts SSHOptions) (*exec.Cmd, error) {
+	if !c.HasNetwork() {
+		return nil, c.errNoNetwork()
+	}
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, errors.New("ssh is not installed: " + err.Error())
+	}
+	ip, err := c.IPAddress()
+	if err != nil {
+		return nil, err
+	}
+	cred, err := utils.GetCredential(c.SSHPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-p", c.SSHPort,
+		"-l", c.SSHUser,
+	}
+	args = append(args, c.hostKeyOptions()...)
+	args = append(args,
+		"-o", "LogLevel=ERROR",
+		// an instance that has just started may not accept connections yet
+		"-o", "ConnectionAttempts=30",
+	)
+	if opts.ForwardAgent {
+		args = append(args, "-A")
+	}
+	for _, f := range opts.LocalForwards {
+		args = append(args, "-L", f)
+	}
+	for _, f := range opts.RemoteForwards {
+		args = append(args, "-R", f)
+	}
+
+	remote := opts.Command
+	if opts.WorkDir != "" {
+		if remote == "" {
+			remote = "exec ${SHELL:-/bin/sh} -l"
+		}
+		remote = "cd " + shellQuote(opts.WorkDir) + " && " + remote
+	}
+	if remote != "" && opts.Command == "" {
+		// a login shell still needs a terminal when it is started through a command
+		args = append(args, "-t")
+	}
+	args = append(args, ip)
+	if remote != "" {
+		args = append(args, "--", remote)
+	}
+
+	cmd := exec.Command(sshPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	if cred.CRType == utils.PwdCred {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, "SSH_ASKPASS="+self, "SSH_ASKPASS_REQUIRE=force", AskpassEnv+"="+cred.CR)
+	}
+	return cmd, nil
+}
+
+// CheckKeyLogin logs into the instance as its SSH user with ssh(1), offering only identity, a private
+// key or the public key of a key held by ssh-agent, and returns an error unless the login succeeds
+func (c *MachineConfig) CheckKeyLogin(identity string) error {
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return errors.New("ssh is not installed: " + err.Error())
+	}
+	ip, err := c.IPAddress()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-p", c.SSHPort, "-l", c.SSHUser}
+	args = append(args, c.hostKeyOptions()...)
+	args = append(args,
+		"-o", "LogLevel=ERROR",
+		// fail rather than fall back to a password prompt
+		"-o", "BatchMode=yes",
+		"-o", "PreferredAuthentications=publickey",
+		"-o", "IdentitiesOnly=yes",
+		"-i", identity,
+		ip, "true",
+	)
+	if out, err := exec.Command(sshPath, args...).CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New("key login to " + c.Alias + " failed: " + msg)
+	}
+	return nil
+}
+
+// hostKeyOptions returns the ssh(1) options that check the host key of the instance against its own
+// known_hosts. Instances are recreated with new host keys under the same address and port, which
+// would otherwise conflict in ~/.ssh/known_hosts.
+func (c *MachineConfig) hostKeyOptions() []string {
+	return []string{
+		"-o", "HostKeyAlias=" + HostKeyAlias,
+		"-o", "UserKnownHostsFile=" + c.KnownHostsPath(),
+		"-o", "StrictHostKeyChecking=accept-new",
+	}
+}
+
+// SSHConfig returns a Host block of ssh_config(5) that reaches the instance at ip as its SSH user,
+// checking its host key against the known_hosts of the instance
+func (c *MachineConfig) SSHConfig(ip string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s\n", c.Alias)
+	fmt.Fprintf(&b, "  HostName %s\n", ip)
+	fmt.Fprintf(&b, "  Port %s\n", c.SSHPort)
+	fmt.Fprintf(&b, "  User %s\n", c.SSHUser)
+	fmt.Fprintf(&b, "  HostKeyAlias %s\n", HostKeyAlias)
+	fmt.Fprintf(&b, "  UserKnownHostsFile \"%s\"\n", c.KnownHostsPath())
+	fmt.Fprintf(&b, "  StrictHostKeyChecking accept-new\n")
+	return b.String()
+}
+
+// Askpass answers the password prompt of an ssh started by SSHCommand, and reports whether the
+// current process was started for that
+func Askpass() bool {
+	password, ok := os.LookupEnv(AskpassEnv)
+	if !ok || len(os.Args) != 2 {
+		return false
+	}
+	fmt.Println(password)
+	return true
+}
+
+// AuthorizeKey adds an SSH public key to the authorized_keys of the SSH user of the instance, unless
+// it is there already
+func (c *MachineConfig) AuthorizeKey(publicKey string) error {
+	key := shellQuote(strings.TrimSpace(publicKey))
+	cmd := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys && " +
+		"(grep -qxF " + key + " ~/.ssh/authorized_keys || echo " + key + " >> ~/.ssh/authorized_keys)"
+	if _, err := c.Exec(cmd, false); err != nil {
+		return errors.New("unable to authorize SSH key for " + c.SSHUser + ": " + err.Error())
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
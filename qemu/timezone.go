@@ -0,0 +1,146 @@
+package qemu
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// TimezoneUTC is the timezone guests boot in
+const TimezoneUTC = "UTC"
+
+// hostLocaltime is the link to the zoneinfo file of the host timezone
+const hostLocaltime = "/etc/localtime"
+
+// timezoneName matches IANA timezone names such as America/New_York, which are also passed to shell
+// commands of the guest
+var timezoneName = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+// utcAliases are the names of the timezone database for UTC
+var utcAliases = []string{"Etc/UTC", "Etc/UCT", "Etc/Universal", "Etc/Zulu", "UCT", "Universal", "Zulu"}
+
+// ParseTimezone validates a --timezone value against the timezone database of the host. Aliases of
+// UTC are returned as UTC.
+func ParseTimezone(tz string) (string, error) {
+	if !timezoneName.MatchString(tz) {
+		return "", errors.New("invalid timezone " + tz + ", expected a name such as America/New_York or UTC")
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return "", errors.New("unknown timezone " + tz + ", expected a name such as America/New_York or UTC")
+	}
+	for _, alias := range utcAliases {
+		if tz == alias {
+			return TimezoneUTC, nil
+		}
+	}
+	return tz, nil
+}
+
+// HostTimezone returns the timezone of the host, from the zoneinfo file /etc/localtime links to, or
+// UTC when it cannot be told
+func HostTimezone() string {
+	target, err := os.Readlink(hostLocaltime)
+	if err != nil {
+		return TimezoneUTC
+	}
+	i := strings.Index(target, "zoneinfo/")
+	if i < 0 {
+		return TimezoneUTC
+	}
+	tz, err := ParseTimezone(target[i+len("zoneinfo/"):])
+	if err != nil {
+		return TimezoneUTC
+	}
+	return tz
+}
+
+// setTimezone sets the timezone of the guest over SSH. setup-timezone installs tzdata as needed.
+func (c *MachineConfig) setTimezone(ctx context.Context) error {
+	if c.Timezone == "" || c.Timezone == TimezoneUTC {
+		return nil
+	}
+	cmd := "setup-timezone -z " + c.Timezone
+	if c.GuestDistro() != DistroAlpine {
+		cmd = "timedatectl set-timezone " + c.Timezone
+	}
+	if _, err := c.ExecContext(ctx, cmd, true); err != nil {
+		return errors.New("unable to set timezone " + c.Timezone + ": " + err.Error())
+	}
+	return nil
+}
+
+// AddCloudTimezone sets the timezone of the instance with the timezone module of #cloud-config
+// user-data. A timezone already set by the user-data is kept and recorded instead.
+func (c *MachineConfig) AddCloudTimezone(userData []byte) ([]byte, error) {
+	if c.Timezone == "" || c.Timezone == TimezoneUTC {
+		return userData, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(userData)), "#cloud-config") {
+		log.Println("user-data is not #cloud-config, " + c.Alias + " keeps the UTC timezone")
+		c.Timezone = TimezoneUTC
+		return userData, nil
+	}
+
+	cloudConfig := map[string]interface{}{}
+	if err := yaml.Unmarshal(userData, &cloudConfig); err != nil {
+		return nil, errors.New("unable to parse user-data: " + err.Error())
+	}
+	if cloudConfig == nil {
+		cloudConfig = map[string]interface{}{}
+	}
+	if tz, ok := cloudConfig["timezone"].(string); ok {
+		c.Timezone = tz
+		return userData, nil
+	}
+	cloudConfig["timezone"] = c.Timezone
+
+	merged, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("#cloud-config\n"), merged...), nil
+}
+
+// ClockSkew returns how far the clock of the running guest is ahead of the host, to the second. The
+// time the guest takes to answer is not counted.
+func (c *MachineConfig) ClockSkew(ctx context.Context) (time.Duration, error) {
+	var out strings.Builder
+	before := time.Now()
+	if err := c.Run(ctx, "date +%s", false, nil, &out, nil); err != nil {
+		return 0, err
+	}
+	after := time.Now()
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+	if err != nil {
+		return 0, errors.New("unexpected output of date: " + strings.TrimSpace(out.String()))
+	}
+	guest := time.Unix(seconds, 0)
+	switch {
+	case guest.After(after):
+		return guest.Sub(after).Truncate(time.Second), nil
+	case guest.Before(before.Truncate(time.Second)):
+		return guest.Sub(before.Truncate(time.Second)).Truncate(time.Second), nil
+	}
+	return 0, nil
+}
+
+// SetClock sets the clock of the running guest to t over SSH, to the second
+func (c *MachineConfig) SetClock(ctx context.Context, t time.Time) error {
+	cmd := "date -u -s @" + strconv.FormatInt(t.Unix(), 10) + " >/dev/null"
+	var stderr strings.Builder
+	if err := c.Run(ctx, cmd, true, nil, nil, &stderr); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New("unable to set the clock of " + c.Alias + ": " + msg)
+		}
+		return errors.New("unable to set the clock of " + c.Alias + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+)
+
+// TPMStateDir is the directory of the instance that holds the state of its TPM, including the
+// endorsement key that identifies it
+const TPMStateDir = "tpm"
+
+// swtpmPaths are where Homebrew installs swtpm, which is not on $PATH of launch agents
+var swtpmPaths = []string{"/opt/homebrew/bin/swtpm", "/usr/local/bin/swtpm"}
+
+// SwtpmPath returns the swtpm executable, or "" when it is not installed
+func SwtpmPath() string {
+	if path, err := exec.LookPath("swtpm"); err == nil {
+		return path
+	}
+	for _, path := range swtpmPaths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// ErrNoSwtpm is returned for instances with a TPM on hosts without swtpm
+var ErrNoSwtpm = errors.New("swtpm is not installed, it is required for --tpm. install it with `brew install swtpm`")
+
+func (c *MachineConfig) tpmStatePath() string {
+	return filepath.Join(c.Location, TPMStateDir)
+}
+
+func (c *MachineConfig) swtpmSocket() string {
+	return filepath.Join(c.Location, "swtpm.sock")
+}
+
+func (c *MachineConfig) swtpmPIDFile() string {
+	return filepath.Join(c.Location, "swtpm.pid")
+}
+
+// startSwtpm starts the TPM emulator of the instance. It exits by itself when qemu closes its
+// control socket, so the TPM goes down with the instance however qemu exits.
+func (c *MachineConfig) startSwtpm() error {
+	c.stopSwtpm()
+
+	swtpm := SwtpmPath()
+	if swtpm == "" {
+		return ErrNoSwtpm
+	}
+	if err := os.MkdirAll(c.tpmStatePath(), 0700); err != nil {
+		return errors.New("unable to create TPM state directory: " + err.Error())
+	}
+
+	args := []string{"socket", "--tpm2",
+		"--tpmstate", "dir=" + c.tpmStatePath(),
+		"--ctrl", "type=unixio,path=" + c.swtpmSocket(),
+		"--pid", "file=" + c.swtpmPIDFile(),
+		"--log", "file=" + filepath.Join(c.Location, "swtpm.log"),
+		"--terminate",
+	}
+	cmd := command(swtpm, args...)
+	// swtpm outlives this command, like the daemonized qemu it serves
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.New("unable to start swtpm: " + err.Error())
+	}
+	cmd.Process.Release()
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(c.swtpmSocket()); err == nil {
+			return nil
+		}
+		if i == 50 {
+			c.stopSwtpm()
+			return errors.New("swtpm did not start, see " + filepath.Join(c.Location, "swtpm.log"))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopSwtpm stops the TPM emulator of the instance, if any. The TPM state is kept.
+func (c *MachineConfig) stopSwtpm() {
+	data, err := os.ReadFile(c.swtpmPIDFile())
+	if err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+			if p, err := os.FindProcess(pid); err == nil {
+				if err := p.Signal(syscall.SIGTERM); err == nil {
+					log.Debugf("stopped swtpm of %s (%d)", c.Alias, pid)
+				}
+			}
+		}
+	}
+	for _, path := range []string{c.swtpmPIDFile(), c.swtpmSocket()} {
+		os.Remove(path)
+	}
+}
+
+// tpmArgs returns the qemu arguments that connect a TPM 2.0 device to swtpm
+func (c *MachineConfig) tpmArgs() []string {
+	if !c.TPM {
+		return nil
+	}
+	// the virt machine has no ISA bus and takes the sysbus variant of the TIS interface
+	device := "tpm-tis,tpmdev=tpm0"
+	if c.Arch == "aarch64" {
+		device = "tpm-tis-device,tpmdev=tpm0"
+	}
+	return []string{
+		"-chardev", "socket,id=char-tpm,path=" + c.swtpmSocket(),
+		"-tpmdev", "emulator,id=tpm0,chardev=char-tpm",
+		"-device", device,
+	}
+}
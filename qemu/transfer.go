@@ -0,0 +1,146 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// CopyTo copies a host file, or a directory when recursive is set, to the instance as its
+// SSH user, preserving permissions
+func (c *MachineConfig) CopyTo(local string, remote string, recursive bool) error {
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !recursive {
+		return errors.New(local + " is a directory, use -r to copy it")
+	}
+
+	conn, err := c.Dial(false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sftp, err := NewSFTPClient(conn)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	// like cp, copying into an existing directory keeps the source name
+	if remoteInfo, err := sftp.Stat(remote); err == nil && remoteInfo.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+
+	return upload(sftp, local, remote, info)
+}
+
+func upload(sftp *SFTPClient, local string, remote string, info os.FileInfo) error {
+	if !info.IsDir() {
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := sftp.WriteFile(remote, f, info.Mode().Perm()); err != nil {
+			return errors.New("unable to copy " + local + " to " + remote + ": " + err.Error())
+		}
+		return nil
+	}
+
+	if err := sftp.MkdirAll(remote, info.Mode().Perm()); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryInfo, err := os.Stat(filepath.Join(local, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if !entryInfo.IsDir() && !entryInfo.Mode().IsRegular() {
+			continue
+		}
+		if err := upload(sftp, filepath.Join(local, entry.Name()), path.Join(remote, entry.Name()), entryInfo); err != nil {
+			return err
+		}
+	}
+	return sftp.Chmod(remote, info.Mode().Perm())
+}
+
+// CopyFrom copies a file, or a directory when recursive is set, from the instance to the host
+// as its SSH user, preserving permissions
+func (c *MachineConfig) CopyFrom(remote string, local string, recursive bool) error {
+	conn, err := c.Dial(false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sftp, err := NewSFTPClient(conn)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	info, err := sftp.Stat(remote)
+	if err != nil {
+		return errors.New("unable to read " + c.Alias + ":" + remote + ": " + err.Error())
+	}
+	if info.IsDir() && !recursive {
+		return errors.New(c.Alias + ":" + remote + " is a directory, use -r to copy it")
+	}
+
+	if localInfo, err := os.Stat(local); err == nil && localInfo.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	return download(sftp, remote, local, info)
+}
+
+func download(sftp *SFTPClient, remote string, local string, info SFTPFileInfo) error {
+	if !info.IsDir() {
+		f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode.Perm())
+		if err != nil {
+			return err
+		}
+		if err := sftp.ReadFile(remote, f); err != nil {
+			f.Close()
+			return errors.New("unable to copy " + remote + " to " + local + ": " + err.Error())
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chmod(local, info.Mode.Perm())
+	}
+
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	entries, err := sftp.ReadDir(remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryInfo := entry.Info
+		if entryInfo.Mode&os.ModeSymlink != 0 {
+			// readdir reports the link itself, follow it like the top-level stat does
+			entryInfo, err = sftp.Stat(path.Join(remote, entry.Name))
+			if err != nil {
+				continue
+			}
+		}
+		if !entryInfo.IsDir() && !entryInfo.Mode.IsRegular() {
+			continue
+		}
+		if err := download(sftp, path.Join(remote, entry.Name), filepath.Join(local, entry.Name), entryInfo); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(local, info.Mode.Perm())
+}
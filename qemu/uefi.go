@@ -0,0 +1,152 @@
+package qemu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// Firmware an instance boots with
+const (
+	FirmwareBIOS = "bios"
+	FirmwareUEFI = "uefi"
+)
+
+// ParseFirmware validates a --firmware value
+func ParseFirmware(firmware string) (string, error) {
+	if firmware != FirmwareBIOS && firmware != FirmwareUEFI {
+		return "", errors.New("unsupported firmware " + firmware + ". use bios or uefi")
+	}
+	return firmware, nil
+}
+
+// DefaultFirmware returns the firmware instances of arch boot with unless configured otherwise
+func DefaultFirmware(arch string) string {
+	if arch == "aarch64" {
+		return FirmwareUEFI
+	}
+	return FirmwareBIOS
+}
+
+// GetFirmware returns the firmware the instance boots with
+func (c *MachineConfig) GetFirmware() string {
+	if c.Firmware == "" {
+		return DefaultFirmware(c.Arch)
+	}
+	return c.Firmware
+}
+
+// CheckFirmware returns an error unless instances of arch can boot with firmware on this host
+func CheckFirmware(arch string, firmware string) error {
+	if arch == "aarch64" && firmware == FirmwareBIOS {
+		return errors.New("aarch64 instances only boot with UEFI firmware")
+	}
+	if arch == "x86_64" && firmware == FirmwareUEFI {
+		for _, file := range []string{edk2Firmware(arch), edk2VarsTemplate(arch)} {
+			if _, err := os.Stat(file); err != nil {
+				return errors.New("unable to find " + filepath.Base(file) + ", the x86_64 UEFI firmware qemu ships. install qemu with `brew install qemu`")
+			}
+		}
+	}
+	return nil
+}
+
+// pflashSize is the size of each of the two flash devices of the aarch64 virt machine
+const pflashSize = 64 << 20
+
+// UEFIVarsFile is the default UEFI variable store of an instance, kept in its directory so that boot
+// entries and secure boot keys survive restarts
+const UEFIVarsFile = "efivars.fd"
+
+// UEFIVarsPath returns the location of the UEFI variable store of the instance. The configured path
+// is relative to the instance directory unless absolute.
+func (c *MachineConfig) UEFIVarsPath() string {
+	vars := c.UEFIVars
+	if vars == "" {
+		vars = UEFIVarsFile
+	}
+	if filepath.IsAbs(vars) {
+		return vars
+	}
+	return filepath.Join(c.Location, vars)
+}
+
+// HasUEFIVars reports whether the instance boots with UEFI firmware and a variable store
+func (c *MachineConfig) HasUEFIVars() bool {
+	return c.GetFirmware() == FirmwareUEFI
+}
+
+// createUEFIVars creates the variable store of the instance unless it has one, as a copy of the
+// empty store qemu ships with its firmware. Without that template the aarch64 firmware formats a
+// blank store itself, x86_64 OVMF cannot.
+func (c *MachineConfig) createUEFIVars() error {
+	path := c.UEFIVarsPath()
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	template := edk2VarsTemplate(c.Arch)
+	var err error
+	if _, statErr := os.Stat(template); statErr == nil {
+		_, err = utils.CopyFile(template, path)
+	} else if c.Arch == "x86_64" {
+		return errors.New("unable to create UEFI variable store: " + filepath.Base(template) + " not found. install qemu with `brew install qemu`")
+	} else {
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			err = f.Close()
+		}
+	}
+	// aarch64 flash devices must be exactly pflashSize
+	if err == nil && c.Arch == "aarch64" {
+		if info, statErr := os.Stat(path); statErr == nil && info.Size() < pflashSize {
+			err = os.Truncate(path, pflashSize)
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		return errors.New("unable to create UEFI variable store: " + err.Error())
+	}
+	return nil
+}
+
+// ResetUEFIVars replaces the variable store of a stopped instance with an empty one, dropping boot
+// entries and any other settings stored by the firmware
+func (c *MachineConfig) ResetUEFIVars() error {
+	if !c.HasUEFIVars() {
+		return errors.New(c.Alias + " boots with BIOS and has no UEFI variable store")
+	}
+	if err := os.Remove(c.UEFIVarsPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("unable to reset UEFI variable store: " + err.Error())
+	}
+	return c.createUEFIVars()
+}
+
+// uefiArgs returns the flash drives of the UEFI firmware: the read-only code, the edk2 build qemu
+// ships for cloud images and x86_64 or the copy of qemu_efi.fd in the directory of other aarch64
+// instances, and the variable store of the instance
+func (c *MachineConfig) uefiArgs() ([]string, error) {
+	code := edk2Firmware(c.Arch)
+	if c.CloudInit == "" && c.Arch == "aarch64" {
+		code = filepath.Join(c.Location, "qemu_efi.fd")
+		// flash devices must be exactly pflashSize, qemu_efi.fd is padded once
+		info, err := os.Stat(code)
+		if err != nil {
+			return nil, errors.New("unable to find UEFI firmware: " + err.Error())
+		}
+		if info.Size() < pflashSize {
+			if err := os.Truncate(code, pflashSize); err != nil {
+				return nil, errors.New("unable to prepare UEFI firmware: " + err.Error())
+			}
+		}
+	}
+	if err := c.createUEFIVars(); err != nil {
+		return nil, err
+	}
+	return []string{
+		"-drive", "if=pflash,format=raw,readonly=on,file=" + code,
+		"-drive", "if=pflash,format=raw,file=" + c.UEFIVarsPath(),
+	}, nil
+}
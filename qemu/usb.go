@@ -0,0 +1,208 @@
+package qemu
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/beringresearch/macpine/logging"
+)
+
+// USBDevice is a host USB device passed through to the instance, matched by its ids so that it is
+// found again whichever port it is plugged into
+type USBDevice struct {
+	VendorID  string `yaml:"vendorid" json:"vendorId"`
+	ProductID string `yaml:"productid" json:"productId"`
+}
+
+func (d USBDevice) String() string {
+	return d.VendorID + ":" + d.ProductID
+}
+
+// qemuID names the usb-host device of d in qemu, for device_del
+func (d USBDevice) qemuID() string {
+	return "usb-" + d.VendorID + "-" + d.ProductID
+}
+
+var usbDeviceSpec = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{4}$`)
+
+// ParseUSBDevice parses a vendorid:productid specification in hexadecimal, as lsusb and
+// `alpine usb list` print them, e.g. 1a86:7523
+func ParseUSBDevice(spec string) (USBDevice, error) {
+	if !usbDeviceSpec.MatchString(spec) {
+		return USBDevice{}, errors.New("invalid USB device " + spec + ", expected vendorid:productid such as 1a86:7523")
+	}
+	vendor, product, _ := strings.Cut(strings.ToLower(spec), ":")
+	return USBDevice{VendorID: vendor, ProductID: product}, nil
+}
+
+func (c *MachineConfig) usbDeviceIndex(d USBDevice) int {
+	for i, u := range c.USBDevices {
+		if u == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// usbHostProperties returns the usb-host properties that select d
+func usbHostProperties(d USBDevice) (int64, int64) {
+	vendor, _ := strconv.ParseInt(d.VendorID, 16, 32)
+	product, _ := strconv.ParseInt(d.ProductID, 16, 32)
+	return vendor, product
+}
+
+// usbArgs returns the qemu arguments that add a USB controller and pass the USB devices of the
+// instance through. Devices that are not connected are reported and attached by qemu once plugged in.
+func (c *MachineConfig) usbArgs() []string {
+	if len(c.USBDevices) == 0 {
+		return nil
+	}
+
+	connected, err := HostUSBDevices()
+	if err != nil {
+		log.Debugln("unable to list host USB devices: " + err.Error())
+	}
+	args := []string{"-device", "qemu-xhci,id=usb"}
+	for _, d := range c.USBDevices {
+		if err == nil && !hasUSBDevice(connected, d) {
+			log.Errorln("USB device " + d.String() + " is not connected, it is attached to " + c.Alias + " when plugged in")
+		}
+		vendor, product := usbHostProperties(d)
+		args = append(args, "-device", fmt.Sprintf("usb-host,bus=usb.0,vendorid=0x%04x,productid=0x%04x,id=%s", vendor, product, d.qemuID()))
+	}
+	return args
+}
+
+// AttachUSBDevice passes a host USB device through to the instance. The device is recorded so that
+// it is attached again when the instance restarts, and hot-plugged when the instance is running.
+func (c *MachineConfig) AttachUSBDevice(d USBDevice) error {
+	if c.usbDeviceIndex(d) >= 0 {
+		return errors.New("USB device " + d.String() + " is already attached to " + c.Alias)
+	}
+	c.USBDevices = append(c.USBDevices, d)
+
+	if status, _ := c.Status(); status == "Stopped" {
+		return nil
+	}
+	vendor, product := usbHostProperties(d)
+	err := c.qmpDevice("device_add", map[string]interface{}{
+		"driver":    "usb-host",
+		"id":        d.qemuID(),
+		"bus":       "usb.0",
+		"vendorid":  vendor,
+		"productid": product,
+	})
+	if err != nil {
+		// instances started without USB devices have no controller to plug into
+		return errors.New("unable to attach " + d.String() + " to the running instance, it is attached when " +
+			c.Alias + " restarts: " + err.Error())
+	}
+	return nil
+}
+
+// DetachUSBDevice stops passing a host USB device through, unplugging it from a running instance
+func (c *MachineConfig) DetachUSBDevice(d USBDevice) error {
+	i := c.usbDeviceIndex(d)
+	if i < 0 {
+		return errors.New("USB device " + d.String() + " is not attached to " + c.Alias)
+	}
+	c.USBDevices = append(c.USBDevices[:i], c.USBDevices[i+1:]...)
+
+	if status, _ := c.Status(); status == "Stopped" {
+		return nil
+	}
+	if err := c.qmpDevice("device_del", map[string]interface{}{"id": d.qemuID()}); err != nil {
+		return errors.New("unable to detach " + d.String() + " from the running instance, it is detached when " +
+			c.Alias + " restarts: " + err.Error())
+	}
+	return nil
+}
+
+// qmpDevice runs device_add or device_del on the running instance
+func (c *MachineConfig) qmpDevice(command string, arguments map[string]interface{}) error {
+	q, err := c.QMP()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	_, err = q.Execute(command, arguments)
+	return err
+}
+
+// HostUSBDevice is a USB device connected to the host
+type HostUSBDevice struct {
+	USBDevice
+	Name   string `json:"name"`
+	Vendor string `json:"vendor"`
+}
+
+func hasUSBDevice(devices []HostUSBDevice, d USBDevice) bool {
+	for _, h := range devices {
+		if h.USBDevice == d {
+			return true
+		}
+	}
+	return false
+}
+
+var ioregProperty = regexp.MustCompile(`^[\s|]*"([^"]+)" = (.*)$`)
+
+// HostUSBDevices lists the USB devices connected to the host, from the IOUSB plane of the I/O Registry
+func HostUSBDevices() ([]HostUSBDevice, error) {
+	out, err := exec.Command("ioreg", "-p", "IOUSB", "-l", "-w0").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []HostUSBDevice{}
+	var current *HostUSBDevice
+	var vendorID, productID int64 = -1, -1
+	flush := func() {
+		if current != nil && vendorID >= 0 && productID >= 0 {
+			current.VendorID = fmt.Sprintf("%04x", vendorID)
+			current.ProductID = fmt.Sprintf("%04x", productID)
+			devices = append(devices, *current)
+		}
+		current, vendorID, productID = nil, -1, -1
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// each registry entry starts with +-o Name@location  <class ...>
+		if i := strings.Index(line, "+-o "); i >= 0 {
+			flush()
+			name := line[i+4:]
+			if j := strings.Index(name, "  <"); j >= 0 {
+				name = name[:j]
+			}
+			if j := strings.LastIndex(name, "@"); j >= 0 {
+				name = name[:j]
+			}
+			current = &HostUSBDevice{Name: name}
+			continue
+		}
+		m := ioregProperty.FindStringSubmatch(line)
+		if m == nil || current == nil {
+			continue
+		}
+		switch m[1] {
+		case "idVendor":
+			vendorID, _ = strconv.ParseInt(m[2], 10, 32)
+		case "idProduct":
+			productID, _ = strconv.ParseInt(m[2], 10, 32)
+		case "USB Product Name":
+			current.Name = strings.Trim(m[2], `"`)
+		case "USB Vendor Name":
+			current.Vendor = strings.Trim(m[2], `"`)
+		}
+	}
+	flush()
+	return devices, nil
+}
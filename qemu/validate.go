@@ -0,0 +1,115 @@
+package qemu
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/beringresearch/macpine/utils"
+)
+
+// diskSize matches a disk size as qemu-img takes it, e.g. 5G
+var diskSize = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+
+// ConfigError reports an invalid field of an instance configuration
+type ConfigError struct {
+	// Field is the name of the field in config.yaml
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks that the fields every command relies on are present and within range. It returns
+// a *ConfigError naming the first invalid field.
+func (c *MachineConfig) Validate() error {
+	invalid := func(field string, msg string) error {
+		return &ConfigError{Field: field, Err: errors.New(msg)}
+	}
+
+	if c.Alias == "" {
+		return invalid("alias", "missing")
+	}
+	if c.Location == "" {
+		return invalid("location", "missing")
+	}
+	if c.Image == "" {
+		return invalid("image", "missing")
+	}
+	if c.Arch != "aarch64" && c.Arch != "x86_64" {
+		return invalid("arch", "unsupported architecture \""+c.Arch+"\", expected aarch64 or x86_64")
+	}
+	if n, err := strconv.Atoi(c.CPU); err != nil || n < 1 {
+		return invalid("cpu", "\""+c.CPU+"\" is not a positive integer")
+	}
+	if n, err := strconv.Atoi(c.Memory); err != nil || n < 256 {
+		return invalid("memory", "\""+c.Memory+"\" is not an integer of at least 256")
+	}
+	if !diskSize.MatchString(c.Disk) {
+		return invalid("disk", "\""+c.Disk+"\" is not a size, expected an integer optionally followed by K, M, G or T")
+	}
+	if _, err := ParseNetworkMode(string(c.Network)); err != nil {
+		return &ConfigError{Field: "network", Err: err}
+	}
+	if c.HasNetwork() {
+		if n, err := strconv.Atoi(c.SSHPort); err != nil || n < 1 || n > 65535 {
+			return invalid("sshport", "\""+c.SSHPort+"\" is not a port number")
+		}
+	}
+	if _, err := utils.ParsePort(c.Port); err != nil {
+		return &ConfigError{Field: "port", Err: err}
+	}
+	// addresses generated by older releases need not be locally administered, only the syntax is checked
+	if c.MACAddress != "" {
+		if _, err := net.ParseMAC(c.MACAddress); err != nil {
+			return invalid("macaddress", "\""+c.MACAddress+"\" is not a MAC address")
+		}
+	}
+	if c.DiskFormat != "" {
+		if _, err := ParseDiskFormat(c.DiskFormat); err != nil {
+			return &ConfigError{Field: "diskformat", Err: err}
+		}
+	}
+	if c.DiskInterface != "" {
+		if _, err := ParseDiskInterface(c.DiskInterface); err != nil {
+			return &ConfigError{Field: "diskinterface", Err: err}
+		}
+	}
+	if c.RestartPolicy != "" {
+		if _, err := ParseRestartPolicy(string(c.RestartPolicy)); err != nil {
+			return &ConfigError{Field: "restartpolicy", Err: err}
+		}
+	}
+	if c.Firmware != "" {
+		if _, err := ParseFirmware(c.Firmware); err != nil {
+			return &ConfigError{Field: "firmware", Err: err}
+		}
+		if c.Arch == "aarch64" && c.Firmware == FirmwareBIOS {
+			return invalid("firmware", "aarch64 instances only boot with UEFI firmware")
+		}
+	}
+	if c.Timezone != "" && !timezoneName.MatchString(c.Timezone) {
+		return invalid("timezone", "\""+c.Timezone+"\" is not a timezone name such as America/New_York")
+	}
+	if c.Distro != "" && c.Distro != DistroAlpine && c.Distro != DistroUbuntu && c.Distro != DistroDebian {
+		return invalid("distro", "unsupported distro \""+c.Distro+"\", expected alpine, ubuntu or debian")
+	}
+	for _, d := range c.USBDevices {
+		if _, err := ParseUSBDevice(d.String()); err != nil {
+			return &ConfigError{Field: "usbdevices", Err: err}
+		}
+	}
+	for key, value := range c.Labels {
+		if _, _, err := ParseLabel(key + "=" + value); err != nil {
+			return &ConfigError{Field: "labels", Err: err}
+		}
+	}
+	return nil
+}
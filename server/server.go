@@ -0,0 +1,388 @@
+// Package server exposes the client package as a REST API on a unix socket, for tools that manage
+// instances without running the alpine command for every operation. The socket is only accessible to
+// the user running the server, which is the authentication.
+//
+//	GET    /v1/instances               list instances, as alpine info --json
+//	POST   /v1/instances               launch an instance described by a LaunchRequest
+//	GET    /v1/instances/{name}        describe an instance
+//	DELETE /v1/instances/{name}        delete an instance
+//	POST   /v1/instances/{name}/start  start an instance
+//	POST   /v1/instances/{name}/stop   stop an instance, {"graceful": true} powers the guest off first
+//	POST   /v1/instances/{name}/exec   run {"command": "...", "stdin": "..."} and return its output
+//
+// Errors are returned as {"error": "..."} with a 4xx or 5xx status.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beringresearch/macpine/client"
+	"github.com/beringresearch/macpine/host"
+	log "github.com/beringresearch/macpine/logging"
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultImage is launched when a LaunchRequest names no image
+const DefaultImage = "alpine_3.20.3"
+
+// LaunchRequest describes an instance to launch. Unset fields get the defaults of alpine launch.
+type LaunchRequest struct {
+	Name string `json:"name"`
+	// Image is an image version such as alpine_3.20.3, the architecture is appended
+	Image   string   `json:"image"`
+	Arch    string   `json:"arch"`
+	CPU     string   `json:"cpu"`
+	Memory  string   `json:"memory"`
+	Disk    string   `json:"disk"`
+	Mount   string   `json:"mount"`
+	Port    string   `json:"port"`
+	SSHPort string   `json:"sshPort"`
+	Network string   `json:"network"`
+	Tags    []string `json:"tags"`
+}
+
+// StopRequest is the optional body of a stop
+type StopRequest struct {
+	Graceful bool `json:"graceful"`
+}
+
+// ExecRequest is the body of an exec
+type ExecRequest struct {
+	Command string `json:"command"`
+	Stdin   string `json:"stdin"`
+}
+
+// ExecResponse is the result of an exec
+type ExecResponse struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// instanceMus serializes concurrent requests on one instance. The instance lock would fail a request
+// that waits longer than qemu.LockTimeout for another, instead it waits for its turn here.
+var (
+	instanceMusMu sync.Mutex
+	instanceMus   = map[string]*sync.RWMutex{}
+)
+
+// instanceMu returns the mutex of the instance name. Starts, stops, deletes and launches take it
+// exclusively, execs share it.
+func instanceMu(name string) *sync.RWMutex {
+	instanceMusMu.Lock()
+	defer instanceMusMu.Unlock()
+	mu, ok := instanceMus[name]
+	if !ok {
+		mu = &sync.RWMutex{}
+		instanceMus[name] = mu
+	}
+	return mu
+}
+
+// SocketPath returns the default socket, macpine.sock in the data directory
+func SocketPath() (string, error) {
+	dataDir, err := host.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "macpine.sock"), nil
+}
+
+// Handler returns the HTTP handler of the API
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/instances", list)
+	mux.HandleFunc("POST /v1/instances", launch)
+	mux.HandleFunc("GET /v1/instances/{name}", get)
+	mux.HandleFunc("DELETE /v1/instances/{name}", remove)
+	mux.HandleFunc("POST /v1/instances/{name}/start", start)
+	mux.HandleFunc("POST /v1/instances/{name}/stop", stop)
+	mux.HandleFunc("POST /v1/instances/{name}/exec", execute)
+	return mux
+}
+
+// Serve serves the API on a unix socket at path until ctx is done. The socket is created with mode
+// 0600, a stale socket left by a previous server is replaced.
+func Serve(ctx context.Context, path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("another server is listening on " + path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{Handler: Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func list(w http.ResponseWriter, r *http.Request) {
+	infos := []host.InstanceInfo{}
+	for _, vmName := range host.ListVMNames() {
+		info, err := host.GetInfo(vmName)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func get(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !exists(w, name) {
+		return
+	}
+	info, err := host.GetInfo(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func launch(w http.ResponseWriter, r *http.Request) {
+	var req LaunchRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	config, err := req.machineConfig()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody(err))
+		return
+	}
+
+	mu := instanceMu(config.Alias)
+	mu.Lock()
+	defer mu.Unlock()
+	log.Println("launching " + config.Alias)
+	// a client that disconnects cancels the launch, which removes the instance
+	if err := client.Launch(r.Context(), config); err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := host.GetInfo(config.Alias)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func remove(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !exists(w, name) {
+		return
+	}
+	mu := instanceMu(name)
+	mu.Lock()
+	defer mu.Unlock()
+	log.Println("deleting " + name)
+	if err := client.Delete(r.Context(), name); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func start(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !exists(w, name) {
+		return
+	}
+	mu := instanceMu(name)
+	mu.Lock()
+	log.Println("starting " + name)
+	err := client.Start(r.Context(), name)
+	mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	get(w, r)
+}
+
+func stop(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !exists(w, name) {
+		return
+	}
+	var req StopRequest
+	if r.ContentLength != 0 && !decode(w, r, &req) {
+		return
+	}
+	mu := instanceMu(name)
+	mu.Lock()
+	log.Println("stopping " + name)
+	err := client.Stop(r.Context(), name, req.Graceful)
+	mu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	get(w, r)
+}
+
+func execute(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !exists(w, name) {
+		return
+	}
+	var req ExecRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Command == "" {
+		writeJSON(w, http.StatusBadRequest, errorBody(errors.New("missing command")))
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+	mu := instanceMu(name)
+	mu.RLock()
+	err := client.Exec(r.Context(), name, req.Command, strings.NewReader(req.Stdin), &stdout, &stderr)
+	mu.RUnlock()
+	resp := ExecResponse{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		// a failing command is a result, not an API error
+		resp.ExitCode = exitErr.ExitStatus()
+	} else if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// machineConfig builds the configuration of the instance to launch
+func (req LaunchRequest) machineConfig() (qemu.MachineConfig, error) {
+	config := qemu.MachineConfig{
+		Alias:   req.Name,
+		Arch:    req.Arch,
+		CPU:     req.CPU,
+		Memory:  req.Memory,
+		Disk:    req.Disk,
+		Mount:   req.Mount,
+		Port:    req.Port,
+		SSHPort: req.SSHPort,
+		Tags:    req.Tags,
+	}
+	if config.Alias == "" {
+		vmList := host.ListVMNames()
+		config.Alias = utils.GenerateRandomAlias()
+		for utils.StringSliceContains(vmList, config.Alias) {
+			config.Alias = utils.GenerateRandomAlias()
+		}
+	}
+	if err := utils.ValidateName(config.Alias); err != nil {
+		return config, err
+	}
+	if config.Arch == "" {
+		arch, err := utils.HostArch()
+		if err != nil {
+			return config, err
+		}
+		config.Arch = arch
+	}
+	if config.Arch != "aarch64" && config.Arch != "x86_64" {
+		return config, errors.New("unsupported arch " + config.Arch + ". use aarch64 or x86_64")
+	}
+	image := req.Image
+	if image == "" {
+		image = DefaultImage
+	}
+	config.Image = image + "-" + config.Arch + ".qcow2"
+	if req.Network != "" {
+		network, err := qemu.ParseNetworkMode(req.Network)
+		if err != nil {
+			return config, err
+		}
+		config.Network = network
+	}
+	if config.Tags == nil {
+		config.Tags = []string{}
+	}
+	return config, nil
+}
+
+// exists writes a 404 and returns false when there is no instance name
+func exists(w http.ResponseWriter, name string) bool {
+	if utils.StringSliceContains(host.ListVMNames(), name) {
+		return true
+	}
+	writeJSON(w, http.StatusNotFound, errorBody(errors.New("unknown instance "+name)))
+	return false
+}
+
+// decode reads a JSON request body into v, writing a 400 and returning false when it is invalid
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody(errors.New("invalid request: "+err.Error())))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, context.Canceled) {
+		// the client went away, nobody reads the response
+		status = http.StatusServiceUnavailable
+	} else if errors.Is(err, qemu.ErrInstanceExists) {
+		// ReserveInstance found the name taken, the instance directory is created atomically
+		status = http.StatusConflict
+	} else {
+		// errors about the state of the instance rather than a failure
+		for _, conflict := range []string{"is busy", "is not running", "is already running"} {
+			if strings.Contains(err.Error(), conflict) {
+				status = http.StatusConflict
+			}
+		}
+	}
+	writeJSON(w, status, errorBody(err))
+}
+
+func errorBody(err error) map[string]string {
+	return map[string]string{"error": err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/beringresearch/macpine/qemu"
+	"github.com/beringresearch/macpine/utils"
+)
+
+func TestLaunchInvalidName(t *testing.T) {
+	t.Setenv(utils.DataDirEnv, t.TempDir())
+
+	for _, name := range []string{"../escape", "web/1", "Web", "cache"} {
+		body := strings.NewReader(`{"name": "` + name + `"}`)
+		rec := httptest.NewRecorder()
+		Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/instances", body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("launching %q returned %d %s, want 400", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestWriteErrorInstanceExists(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, fmt.Errorf("instance web %w", qemu.ErrInstanceExists))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("writeError(ErrInstanceExists) returned %d, want 409", rec.Code)
+	}
+}
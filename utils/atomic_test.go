@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := WriteFileAtomic(path, []byte("alias: old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("alias: new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "alias: new\n" {
+		t.Errorf("contents = %q, want %q", got, "alias: new\n")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, want 0644", info.Mode().Perm())
+	}
+	assertOnlyFile(t, path)
+}
+
+func TestWriteFileAtomicFailedRename(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("alias: old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rename = func(string, string) error { return errors.New("rename failed") }
+	defer func() { rename = os.Rename }()
+
+	if err := WriteFileAtomic(path, []byte("alias: new\n"), 0644); err == nil {
+		t.Fatal("WriteFileAtomic succeeded, want the rename error")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "alias: old\n" {
+		t.Errorf("contents = %q, want the old contents", got)
+	}
+	assertOnlyFile(t, path)
+}
+
+// TestWriteFileAtomicNoPartialRead checks that a reader racing the writer sees one version or the
+// other, never a mix or a truncated file
+func TestWriteFileAtomicNoPartialRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	versions := [][]byte{bytes.Repeat([]byte("a"), 1<<16), bytes.Repeat([]byte("b"), 1<<17)}
+	if err := WriteFileAtomic(path, versions[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, versions[0]) && !bytes.Equal(got, versions[1]) {
+				t.Errorf("read a partial file of %d bytes", len(got))
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if err := WriteFileAtomic(path, versions[i%2], 0644); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+	assertOnlyFile(t, path)
+}
+
+// assertOnlyFile fails when WriteFileAtomic left temporary files next to path
+func assertOnlyFile(t *testing.T, path string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != filepath.Base(path) {
+			t.Errorf("left %s behind", e.Name())
+		}
+	}
+}
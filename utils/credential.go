@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -18,42 +21,113 @@ type Credential struct {
 	CR     string
 }
 
+// credential schemes, written as "scheme::value"
+const (
+	RawScheme  = "raw"
+	FileScheme = "file"
+	EnvScheme  = "env"
+	SSHScheme  = "ssh"
+)
+
+const schemeSeparator = "::"
+
+// credentialScheme matches anything that looks like a scheme prefix, so that typos are reported
+// rather than silently used as a literal password
+var credentialScheme = regexp.MustCompile(`^([a-z][a-z0-9-]*)::`)
+
+// EncodeCredential builds a credential string for a scheme. Everything after the first "::" is the
+// value, so raw passwords may themselves contain "::".
+func EncodeCredential(scheme string, value string) string {
+	return scheme + schemeSeparator + value
+}
+
+// RawCredential encodes a literal password
+func RawCredential(password string) string {
+	return EncodeCredential(RawScheme, password)
+}
+
+// splitCredential returns the scheme and value of a credential string. Strings without a scheme are
+// legacy literal passwords.
+func splitCredential(config string) (string, string, error) {
+	m := credentialScheme.FindStringSubmatch(config)
+	if m == nil {
+		return RawScheme, config, nil
+	}
+	value := strings.TrimPrefix(config, m[0])
+	switch m[1] {
+	case RawScheme, FileScheme, EnvScheme, SSHScheme:
+		return m[1], value, nil
+	}
+	return "", "", errors.New("unknown credential scheme " + m[1] + schemeSeparator +
+		", expected raw::, file::, env:: or ssh:: (prefix passwords containing \"::\" with raw::)")
+}
+
+// ValidateCredential checks that a credential string is well formed without resolving it, so that
+// configurations can be checked before the referenced file or variable exists
+func ValidateCredential(config string) error {
+	scheme, value, err := splitCredential(config)
+	if err != nil {
+		return err
+	}
+	if value == "" && scheme != RawScheme {
+		return errors.New(scheme + schemeSeparator + " credential is missing its value")
+	}
+	return nil
+}
+
 /*
-credential backends: raw, env, ssh-agent
+credential backends: raw, file, env, ssh-agent
 * if you want to store credentials in the macOS keychain, configure your SSH agent to use the keychain
-* - raw:         "raw::password" (password is a string directly after "raw::" prefix)
-* - env:         "env::PASS_VAR" (password is stored in environment variable $PASS_VAR)
-* - ssh-agent:   "ssh::HOST"     (credential is stored in ssh-agent and configured for use with host HOST in the ssh config)
+* - raw:         "raw::password"  (password is a string directly after "raw::" prefix)
+* - file:        "file::PATH"     (password is the first line of the file at PATH, ~ is expanded)
+* - env:         "env::PASS_VAR"  (password is stored in environment variable $PASS_VAR)
+* - ssh-agent:   "ssh::HOST"      (credential is stored in ssh-agent and configured for use with host HOST in the ssh config)
 
 * `ssh-agent` is the most secure by far, as it allows certificate-based authentication rather than using passwords.
 * If `ssh-agent` is configured and working with certificate-based authentication, `PasswordAuthentication no` can be
 * set in `/etc/ssh/sshd_config` to significantly harden the VM.
 *
-* `env` is more secure than `raw`, and may be useful for automation using macpine on systems where configuring `ssh-agent`
-* is inconvenient.
+* `env` and `file` are more secure than `raw`, and may be useful for automation using macpine on systems where configuring
+* `ssh-agent` is inconvenient.
 */
 func GetCredential(config string) (Credential, error) {
 	var cred Credential
-	var err error = nil
-	if strings.HasPrefix(config, "raw::") {
-		cred.CR = strings.TrimPrefix(config, "raw::")
+
+	if err := ValidateCredential(config); err != nil {
+		return cred, err
+	}
+	scheme, value, _ := splitCredential(config)
+
+	switch scheme {
+	case RawScheme:
+		cred.CR = value
 		cred.CRType = PwdCred
-	} else if strings.HasPrefix(config, "env::") {
-		envvar := strings.TrimPrefix(config, "env::")
-		val, ok := os.LookupEnv(envvar)
-		if ok {
-			cred.CR = val
-			cred.CRType = PwdCred
-		} else {
-			err = fmt.Errorf("config.yaml specifies environment variable credential but variable is not set")
+	case FileScheme:
+		path := value
+		if strings.HasPrefix(path, "~/") {
+			userHomeDir, err := os.UserHomeDir()
+			if err != nil {
+				return cred, err
+			}
+			path = filepath.Join(userHomeDir, path[2:])
 		}
-	} else if strings.HasPrefix(config, "ssh::") {
-		cred.CR = strings.TrimPrefix(config, "ssh::")
-		cred.CRType = HostCred
-	} else {
-		// likely a legacy config file with a raw password and no prefix
-		cred.CR = config
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return cred, fmt.Errorf("config.yaml specifies file credential but %s cannot be read: %v", path, err)
+		}
+		cred.CR = strings.SplitN(string(content), "\n", 2)[0]
+		cred.CR = strings.TrimSuffix(cred.CR, "\r")
 		cred.CRType = PwdCred
+	case EnvScheme:
+		val, ok := os.LookupEnv(value)
+		if !ok {
+			return cred, fmt.Errorf("config.yaml specifies environment variable credential but variable is not set")
+		}
+		cred.CR = val
+		cred.CRType = PwdCred
+	case SSHScheme:
+		cred.CR = value
+		cred.CRType = HostCred
 	}
-	return cred, err
+	return cred, nil
 }
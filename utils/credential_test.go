@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("from-file\r\nsecond line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MACPINE_TEST_PASSWORD", "from::env")
+	t.Setenv("MACPINE_TEST_EMPTY", "")
+
+	tests := []struct {
+		config   string
+		wantType CredentialType
+		want     string
+		wantErr  bool
+	}{
+		{config: "raw::root", wantType: PwdCred, want: "root"},
+		{config: "raw::", wantType: PwdCred, want: ""},
+		{config: "raw::pass::word", wantType: PwdCred, want: "pass::word"},
+		{config: "raw::raw::root", wantType: PwdCred, want: "raw::root"},
+		// legacy configurations store the literal password
+		{config: "root", wantType: PwdCred, want: "root"},
+		{config: "", wantType: PwdCred, want: ""},
+		{config: "Pass::word", wantType: PwdCred, want: "Pass::word"},
+		{config: "file::" + filepath.Join(dir, "password"), wantType: PwdCred, want: "from-file"},
+		{config: "file::~/password", wantType: PwdCred, want: "from-file"},
+		{config: "file::" + filepath.Join(dir, "missing"), wantErr: true},
+		{config: "file::", wantErr: true},
+		{config: "env::MACPINE_TEST_PASSWORD", wantType: PwdCred, want: "from::env"},
+		{config: "env::MACPINE_TEST_EMPTY", wantType: PwdCred, want: ""},
+		{config: "env::MACPINE_TEST_UNSET", wantErr: true},
+		{config: "env::", wantErr: true},
+		{config: "ssh::myvm", wantType: HostCred, want: "myvm"},
+		{config: "ssh::", wantErr: true},
+		{config: "fil::/etc/password", wantErr: true},
+		{config: "keychain::macpine", wantErr: true},
+	}
+	for _, tt := range tests {
+		cred, err := GetCredential(tt.config)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("GetCredential(%q) = %+v, want an error", tt.config, cred)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GetCredential(%q): %v", tt.config, err)
+			continue
+		}
+		if cred.CRType != tt.wantType || cred.CR != tt.want {
+			t.Errorf("GetCredential(%q) = %+v, want {CRType:%v CR:%s}", tt.config, cred, tt.wantType, tt.want)
+		}
+	}
+}
+
+func TestValidateCredentialDoesNotResolve(t *testing.T) {
+	// the file and variable need not exist when a configuration is checked
+	for _, config := range []string{"file::/nonexistent/password", "env::MACPINE_TEST_UNSET"} {
+		if err := ValidateCredential(config); err != nil {
+			t.Errorf("ValidateCredential(%q) = %v, want nil", config, err)
+		}
+	}
+}
+
+func TestEncodeCredential(t *testing.T) {
+	for _, password := range []string{"root", "", "pass::word", "env::NOT_A_VARIABLE"} {
+		cred, err := GetCredential(RawCredential(password))
+		if err != nil {
+			t.Errorf("GetCredential(RawCredential(%q)): %v", password, err)
+			continue
+		}
+		if cred.CR != password {
+			t.Errorf("RawCredential(%q) round-tripped to %q", password, cred.CR)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DataDirEnv is the environment variable that moves the macpine state directory
+const DataDirEnv = "MACPINE_HOME"
+
+// dataDirOverride is set by --data-dir and takes precedence over DataDirEnv
+var dataDirOverride string
+
+// SetDataDir overrides the state directory for this process. The override is exported as
+// DataDirEnv so that processes macpine spawns, such as the supervisor, use the same directory.
+func SetDataDir(dir string) error {
+	dir, err := expandDataDir(dir)
+	if err != nil {
+		return err
+	}
+	dataDirOverride = dir
+	return os.Setenv(DataDirEnv, dir)
+}
+
+// DataDir returns the directory holding instances, the image cache and the global configuration:
+// --data-dir, else $MACPINE_HOME, else ~/.macpine
+func DataDir() (string, error) {
+	if dataDirOverride != "" {
+		return dataDirOverride, nil
+	}
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return expandDataDir(dir)
+	}
+	userHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userHomeDir, ".macpine"), nil
+}
+
+// expandDataDir makes a state directory absolute, since it is recorded in instance configurations
+func expandDataDir(dir string) (string, error) {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		userHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userHomeDir, dir[1:])
+	}
+	return filepath.Abs(dir)
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	env := filepath.Join(home, "env")
+	flag := filepath.Join(home, "flag")
+
+	tests := []struct {
+		env  string
+		flag string
+		want string
+	}{
+		{want: filepath.Join(home, ".macpine")},
+		{env: env, want: env},
+		{env: "~/ssd", want: filepath.Join(home, "ssd")},
+		{flag: flag, want: flag},
+		// the flag wins over the variable
+		{env: env, flag: flag, want: flag},
+		{env: env, flag: "~/flag", want: flag},
+	}
+	for _, tt := range tests {
+		t.Setenv(DataDirEnv, tt.env)
+		dataDirOverride = ""
+		if tt.flag != "" {
+			if err := SetDataDir(tt.flag); err != nil {
+				t.Fatal(err)
+			}
+			// spawned processes see the override
+			if got := os.Getenv(DataDirEnv); got != tt.want {
+				t.Errorf("SetDataDir(%q) exported %s=%q, want %q", tt.flag, DataDirEnv, got, tt.want)
+			}
+		}
+		got, err := DataDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("DataDir() with %s=%q and --data-dir=%q = %s, want %s", DataDirEnv, tt.env, tt.flag, got, tt.want)
+		}
+	}
+	dataDirOverride = ""
+}
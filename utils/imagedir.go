@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ImageDirEnv names a shared directory of images, e.g. on a file server of a team, which is searched
+// before the image cache so that images are not downloaded by every user
+const ImageDirEnv = "MACPINE_IMAGE_DIR"
+
+// imageDirOverride is set by --image-dir and takes precedence over ImageDirEnv
+var imageDirOverride string
+
+// SetImageDir sets the shared image directory for this process. It is exported as ImageDirEnv so that
+// processes macpine spawns use the same directory.
+func SetImageDir(dir string) error {
+	dir, err := expandDataDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := checkImageDir(dir); err != nil {
+		return err
+	}
+	imageDirOverride = dir
+	return os.Setenv(ImageDirEnv, dir)
+}
+
+// ImageDir returns the shared image directory: --image-dir, else $MACPINE_IMAGE_DIR, else "" when
+// there is none
+func ImageDir() (string, error) {
+	if imageDirOverride != "" {
+		return imageDirOverride, nil
+	}
+	dir := os.Getenv(ImageDirEnv)
+	if dir == "" {
+		return "", nil
+	}
+	dir, err := expandDataDir(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, checkImageDir(dir)
+}
+
+// ImagePath returns where an image file is read from: the shared image directory if it holds the
+// image, else the image cache, where a missing image is downloaded to. The shared directory is
+// never written to, so it can be read-only.
+func ImagePath(image string) (string, error) {
+	imageDir, err := ImageDir()
+	if err != nil {
+		return "", err
+	}
+	if imageDir != "" {
+		path := filepath.Join(imageDir, image)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	dataDir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "cache", image), nil
+}
+
+func checkImageDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.New("image directory " + dir + " is not accessible: " + err.Error())
+	}
+	if !info.IsDir() {
+		return errors.New("image directory " + dir + " is not a directory")
+	}
+	return nil
+}
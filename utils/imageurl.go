@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// unsafeImageChars are replaced in the names of images downloaded from a URL
+var unsafeImageChars = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+// CheckImageURL validates the URL of a custom image, which must be an http or https URL of a file
+func CheckImageURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("invalid image URL " + raw + ": " + err.Error())
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("invalid image URL " + raw + ", only http and https are supported")
+	}
+	if u.Host == "" || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		return errors.New("invalid image URL " + raw + ", expected the URL of an image file")
+	}
+	return nil
+}
+
+// CheckSHA256 validates a hex-encoded sha256 digest, as printed by shasum -a 256
+func CheckSHA256(digest string) error {
+	if !sha256Hex.MatchString(digest) {
+		return errors.New("invalid sha256 " + digest + ", expected 64 hex digits")
+	}
+	return nil
+}
+
+// URLImageName returns the name an image downloaded from rawURL is cached under, e.g.
+// url_custom_0123456789ab-x86_64.qcow2. Images with a known digest are cached by digest, so that a
+// new image published under the same URL is downloaded again, others by URL.
+func URLImageName(rawURL string, digest string, arch string) string {
+	base := path.Base(rawURL)
+	if u, err := url.Parse(rawURL); err == nil {
+		base = path.Base(u.Path)
+	}
+	for _, ext := range []string{".qcow2", ".img"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	base = strings.Trim(unsafeImageChars.ReplaceAllString(base, "_"), "_")
+
+	id := digest
+	if id == "" {
+		sum := sha256.Sum256([]byte(rawURL))
+		id = hex.EncodeToString(sum[:])
+	}
+	return "url_" + base + "_" + id[:12] + "-" + arch + ".qcow2"
+}
+
+// VerifySHA256 checks that the file at path has the sha256 digest
+func VerifySHA256(path string, digest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return errors.New("sha256 mismatch: expected " + digest + ", got " + actual)
+	}
+	return nil
+}
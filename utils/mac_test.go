@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// seededMACs returns a generator of the MAC addresses a fixed seed produces, the same sequence on
+// every call to seededMACs
+func seededMACs(seed int64) func() (string, error) {
+	r := rand.New(rand.NewSource(seed))
+	return func() (string, error) {
+		return generateMACAddress(r)
+	}
+}
+
+func TestUniqueMACAddressCollision(t *testing.T) {
+	first, err := seededMACs(1)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first address the seed produces belongs to another instance
+	used := map[string]string{first: "web-1"}
+	mac, err := UniqueMACAddress(used, seededMACs(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac == first {
+		t.Fatalf("UniqueMACAddress returned %s, which web-1 uses", mac)
+	}
+	if _, err := ParseMACAddress(mac); err != nil {
+		t.Errorf("generated %s: %v", mac, err)
+	}
+}
+
+func TestUniqueMACAddressGivesUp(t *testing.T) {
+	stuck := func() (string, error) { return "56:00:00:00:00:01", nil }
+	used := map[string]string{"56:00:00:00:00:01": "web-1"}
+	if mac, err := UniqueMACAddress(used, stuck); err == nil {
+		t.Errorf("UniqueMACAddress = %s, want an error", mac)
+	}
+}
+
+func TestGenerateMACAddress(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		mac, err := GenerateMACAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// UsedMACAddresses keys addresses in this canonical form
+		if hw.String() != mac {
+			t.Errorf("%s is not in canonical form %s", mac, hw.String())
+		}
+		if _, err := ParseMACAddress(mac); err != nil {
+			t.Errorf("generated %s: %v", mac, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxNameLength is the longest instance name, the length limit of a DNS label
+const MaxNameLength = 63
+
+// namePattern is a DNS label: lowercase letters, digits and inner hyphens. Names are used as
+// directory names, hostnames and SSH config host names, so nothing else is safe in all three.
+var namePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// reservedNames are directories under ~/.macpine that are not instances
+var reservedNames = []string{"cache"}
+
+// ValidateName checks that name can be used for a new instance
+func ValidateName(name string) error {
+	if StringSliceContains(reservedNames, name) {
+		return errors.New("'" + name + "' is reserved")
+	}
+	if len(name) > MaxNameLength {
+		return errors.New("invalid name \"" + name + "\", names are at most " + strconv.Itoa(MaxNameLength) + " characters")
+	}
+	if !namePattern.MatchString(name) {
+		return errors.New("invalid name \"" + name + "\", names must match " + namePattern.String() +
+			": lowercase letters, digits and hyphens, starting and ending with a letter or digit")
+	}
+	return nil
+}
+
+// NextIndexedName returns the next name of the form prefix-N among names: one above the highest
+// index in use, or with fillGaps the lowest free index. With web-1 and web-3 taken that is web-4,
+// or web-2 with fillGaps.
+func NextIndexedName(names []string, prefix string, fillGaps bool) string {
+	taken := map[int]bool{}
+	highest := 0
+	for _, name := range names {
+		suffix, ok := strings.CutPrefix(name, prefix+"-")
+		if !ok {
+			continue
+		}
+		// web-01 and web-1a are not indexed names
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 || strconv.Itoa(n) != suffix {
+			continue
+		}
+		taken[n] = true
+		if n > highest {
+			highest = n
+		}
+	}
+
+	next := highest + 1
+	if fillGaps {
+		next = 1
+		for taken[next] {
+			next++
+		}
+	}
+	return prefix + "-" + strconv.Itoa(next)
+}
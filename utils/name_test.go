@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"web", true},
+		{"web-1", true},
+		{"a", true},
+		{"1st", true},
+		{strings.Repeat("a", MaxNameLength), true},
+		{"", false},
+		{"cache", false},
+		{"web/1", false},
+		{"../web", false},
+		{"..", false},
+		{"web 1", false},
+		{"Web", false},
+		{"web_1", false},
+		{"-web", false},
+		{"web-", false},
+		{"web;rm", false},
+		{"web$(id)", false},
+		{strings.Repeat("a", MaxNameLength+1), false},
+	}
+	for _, tt := range tests {
+		err := ValidateName(tt.name)
+		if tt.valid && err != nil {
+			t.Errorf("ValidateName(%q) = %v, want nil", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("ValidateName(%q) = nil, want an error", tt.name)
+		}
+	}
+}
+
+func TestNextIndexedName(t *testing.T) {
+	tests := []struct {
+		names    []string
+		fillGaps bool
+		want     string
+	}{
+		{nil, false, "web-1"},
+		{nil, true, "web-1"},
+		{[]string{"web-1", "web-2"}, false, "web-3"},
+		{[]string{"web-1", "web-3"}, false, "web-4"},
+		{[]string{"web-1", "web-3"}, true, "web-2"},
+		{[]string{"web-2", "web-3"}, true, "web-1"},
+		{[]string{"web-1", "web-2"}, true, "web-3"},
+		// other prefixes and names that only look indexed are ignored
+		{[]string{"webby-7", "api-4", "web-01", "web-1a", "web-0", "web--2", "web"}, false, "web-1"},
+		{[]string{"web-10", "web-9"}, false, "web-11"},
+		{[]string{"cache", "web-1"}, false, "web-2"},
+	}
+	for _, tt := range tests {
+		if got := NextIndexedName(tt.names, "web", tt.fillGaps); got != tt.want {
+			t.Errorf("NextIndexedName(%v, fillGaps=%v) = %s, want %s", tt.names, tt.fillGaps, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProcessStats is a sample of the resource usage of a host process
+type ProcessStats struct {
+	PID        int
+	RSS        uint64        // resident memory in bytes
+	CPUTime    time.Duration // user and system time consumed
+	CPUPercent float64       // share of one CPU, as reported by ps
+	Elapsed    time.Duration // time since the process started
+}
+
+// GetProcessStats samples a process with ps, which behaves the same on macOS and Linux
+func GetProcessStats(pid int) (ProcessStats, error) {
+	stats := ProcessStats{PID: pid}
+	if pid <= 0 {
+		return stats, errors.New("invalid pid " + strconv.Itoa(pid))
+	}
+
+	out, err := exec.Command("ps", "-o", "rss=,time=,%cpu=,etime=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return stats, errors.New("process " + strconv.Itoa(pid) + " is not running")
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 4 {
+		return stats, fmt.Errorf("unexpected ps output %q", strings.TrimSpace(string(out)))
+	}
+
+	rss, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return stats, err
+	}
+	stats.RSS = rss * 1024
+
+	if stats.CPUTime, err = ParsePSDuration(fields[1]); err != nil {
+		return stats, err
+	}
+	if stats.CPUPercent, err = strconv.ParseFloat(strings.ReplaceAll(fields[2], ",", "."), 64); err != nil {
+		return stats, err
+	}
+	if stats.Elapsed, err = ParsePSDuration(fields[3]); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// ParsePSDuration parses the [[dd-]hh:]mm:ss[.cc] durations printed by ps for time and etime
+func ParsePSDuration(s string) (time.Duration, error) {
+	invalid := errors.New("invalid ps duration " + s)
+
+	var days int
+	if d, rest, found := strings.Cut(s, "-"); found {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, invalid
+		}
+		days, s = n, rest
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, invalid
+	}
+
+	seconds, err := strconv.ParseFloat(strings.ReplaceAll(parts[len(parts)-1], ",", "."), 64)
+	if err != nil {
+		return 0, invalid
+	}
+	total := time.Duration(seconds * float64(time.Second))
+
+	units := []time.Duration{time.Minute, time.Hour}
+	for i, unit := range units[:len(parts)-1] {
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil {
+			return 0, invalid
+		}
+		total += time.Duration(n) * unit
+	}
+	return total + time.Duration(days)*24*time.Hour, nil
+}
+
+// FormatBytes renders a byte count with a binary K, M, G or T suffix, as used for disk sizes
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/beringresearch/macpine/logging"
+	"golang.org/x/term"
+)
+
+const (
+	// progressRedraw is how often the progress bar is redrawn on a terminal
+	progressRedraw = 200 * time.Millisecond
+	// progressLogInterval is how often progress is logged when standard error is not a terminal
+	progressLogInterval = 10 * time.Second
+	progressBarWidth    = 25
+)
+
+// downloadProgress reports the progress of a download as a bar on a terminal, or as a log line every
+// progressLogInterval otherwise, e.g. in CI logs or with --log-json. Nothing is reported with --quiet.
+type downloadProgress struct {
+	name    string
+	done    uint64
+	resumed uint64
+	total   uint64 // 0 when the server does not send the size
+	start   time.Time
+	shown   time.Time
+	bar     bool
+}
+
+func newDownloadProgress(name string, resumed uint64, total uint64) *downloadProgress {
+	p := &downloadProgress{
+		name:    name,
+		done:    resumed,
+		resumed: resumed,
+		total:   total,
+		start:   time.Now(),
+		bar:     !log.JSON() && log.Output() == os.Stderr && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+	if log.Enabled(log.LevelInfo) && !p.bar {
+		msg := "retrieving " + name
+		if resumed > 0 {
+			msg += ", resuming at " + FormatBytes(resumed)
+		}
+		log.Println(msg)
+	}
+	p.shown = p.start
+	return p
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.done += uint64(len(b))
+	if !log.Enabled(log.LevelInfo) {
+		return len(b), nil
+	}
+	now := time.Now()
+	if p.bar && now.Sub(p.shown) >= progressRedraw {
+		p.shown = now
+		fmt.Fprint(os.Stderr, "\r\033[K"+p.line(true))
+	} else if !p.bar && now.Sub(p.shown) >= progressLogInterval {
+		p.shown = now
+		log.Println(p.line(false))
+	}
+	return len(b), nil
+}
+
+// Finish reports the end of the download
+func (p *downloadProgress) Finish(complete bool) {
+	if !log.Enabled(log.LevelInfo) {
+		return
+	}
+	if p.bar {
+		fmt.Fprintln(os.Stderr, "\r\033[K"+p.line(true))
+		return
+	}
+	if complete {
+		log.Println("retrieved " + p.name + ", " + FormatBytes(p.done) + " in " + time.Since(p.start).Round(time.Second).String())
+	}
+}
+
+// line renders the progress, e.g. alpine.qcow2 [=====>    ] 45% 115.2M/256.0M 8.1M/s ETA 17s
+func (p *downloadProgress) line(bar bool) string {
+	var parts []string
+	if bar {
+		parts = append(parts, p.name)
+	} else {
+		parts = append(parts, "retrieving "+p.name+":")
+	}
+	if p.total > 0 {
+		done := p.done
+		if done > p.total {
+			done = p.total
+		}
+		if bar {
+			filled := int(done * progressBarWidth / p.total)
+			arrow := ""
+			if filled < progressBarWidth {
+				arrow = ">"
+			}
+			parts = append(parts, "["+strings.Repeat("=", filled)+arrow+strings.Repeat(" ", progressBarWidth-filled-len(arrow))+"]")
+		}
+		parts = append(parts, strconv.FormatUint(done*100/p.total, 10)+"%", FormatBytes(done)+"/"+FormatBytes(p.total))
+	} else {
+		parts = append(parts, FormatBytes(p.done))
+	}
+
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return strings.Join(parts, " ")
+	}
+	speed := float64(p.done-p.resumed) / elapsed
+	parts = append(parts, FormatBytes(uint64(speed))+"/s")
+	if p.total > p.done && speed > 0 {
+		eta := time.Duration(float64(p.total-p.done)/speed) * time.Second
+		parts = append(parts, "ETA "+eta.Round(time.Second).String())
+	}
+	return strings.Join(parts, " ")
+}
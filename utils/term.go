@@ -3,9 +3,11 @@
 package utils
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"golang.org/x/term"
 )
@@ -38,6 +40,33 @@ func readSecret(prompt string) (s []byte, err error) {
 	return
 }
 
+// Confirm asks a yes/no question on the terminal. An empty answer selects def, without a terminal
+// the answer is no.
+func Confirm(prompt string, def bool) bool {
+	answer := false
+	withTerminal(func(in, out *os.File) error {
+		choices := "[y/N]"
+		if def {
+			choices = "[Y/n]"
+		}
+		fmt.Fprintf(out, "%s %s ", prompt, choices)
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			answer = def
+		case "y", "yes":
+			answer = true
+		case "n", "no":
+			answer = false
+		}
+		return nil
+	})
+	return answer
+}
+
 func clearLine(out io.Writer) {
 	const (
 		CUI = "\033["   // Control Sequence Introducer
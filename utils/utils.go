@@ -3,6 +3,9 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha1"
 	"embed"
 	"encoding/binary"
 	"errors"
@@ -13,10 +16,15 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	log "github.com/beringresearch/macpine/logging"
 )
 
 //go:embed *.txt
@@ -32,10 +40,33 @@ func SupportsHugePages() (bool, error) {
 	return supports, nil
 }
 
+// DefaultNetworkInterface returns the host interface carrying the default route
+func DefaultNetworkInterface() (string, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine default network interface: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "interface:" {
+			return fields[1], nil
+		}
+	}
+	return "", errors.New("unable to determine default network interface, no default route found")
+}
+
+// maxMACAttempts bounds UniqueMACAddress, so that a broken generator fails instead of looping forever
+const maxMACAttempts = 100
+
 // GenerateMACAddress
 func GenerateMACAddress() (string, error) {
+	return generateMACAddress(crand.Reader)
+}
+
+// generateMACAddress builds a locally administered MAC address from the bytes of r
+func generateMACAddress(r io.Reader) (string, error) {
 	buf := make([]byte, 6)
-	_, err := rand.Read(buf)
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
 		return "", err
 	}
@@ -46,11 +77,65 @@ func GenerateMACAddress() (string, error) {
 	return mac, nil
 }
 
+// UniqueMACAddress returns the first address from generate that is not a key of used, the MAC
+// addresses of existing instances in canonical form
+func UniqueMACAddress(used map[string]string, generate func() (string, error)) (string, error) {
+	for i := 0; i < maxMACAttempts; i++ {
+		mac, err := generate()
+		if err != nil {
+			return "", err
+		}
+		if _, taken := used[mac]; !taken { // if taken, re-randomize
+			return mac, nil
+		}
+	}
+	return "", errors.New("unable to generate an unused MAC address after " + strconv.Itoa(maxMACAttempts) + " attempts")
+}
+
+// ParseMACAddress validates a MAC address given for an instance and returns it in the lowercase,
+// colon separated form used by GenerateMACAddress. The address must be a locally administered
+// unicast address, so that it cannot collide with real hardware.
+func ParseMACAddress(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", errors.New("invalid MAC address " + mac + ", expected six hex octets such as 52:54:00:12:34:56")
+	}
+	if hw[0]&1 != 0 {
+		return "", errors.New("invalid MAC address " + mac + ", it is a multicast address")
+	}
+	if hw[0]&2 == 0 {
+		return "", errors.New("invalid MAC address " + mac + ", it is not locally administered. set the second lowest bit of the first octet, e.g. 52:...")
+	}
+	return hw.String(), nil
+}
+
+// NameUUID derives a stable UUID from an arbitrary name, so that the same name
+// always maps to the same identifier
+func NameUUID(name string) string {
+	sum := sha1.Sum([]byte(name))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// GenerateUUID returns a random (version 4) UUID
+func GenerateUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := crand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40 // version 4
+	buf[8] = (buf[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16]), nil
+}
+
 // Retry retries a function
 func Retry(attempts int, sleep time.Duration, f func() error) (err error) {
 	for i := 0; i < attempts; i++ {
 		if i > 0 {
-			fmt.Printf("\r%s", strings.Repeat(".", i))
+			if log.Enabled(log.LevelInfo) {
+				fmt.Printf("\r%s", strings.Repeat(".", i))
+			}
 			time.Sleep(sleep)
 		}
 		err = f()
@@ -264,53 +349,68 @@ func CopyFile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
-type WriteCounter struct {
-	Total uint64
-}
-
-func (wc *WriteCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	wc.Total += uint64(n)
-	wc.PrintProgress()
-	return n, nil
+func DownloadFile(filepath string, url string) error {
+	return DownloadFileContext(context.Background(), filepath, url)
 }
 
-func (wc WriteCounter) PrintProgress() {
-	fmt.Printf("\r%s", strings.Repeat(" ", 35))
-	fmt.Printf("\rretrieving image... %3dMB complete", wc.Total/1000000)
-}
+// DownloadFileContext downloads url to filepath, giving up when ctx is done. The data is written to
+// filepath.part, which is kept when the download is interrupted and resumed by the next attempt.
+func DownloadFileContext(ctx context.Context, filepath string, url string) error {
+	part := filepath + ".part"
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
 
-func DownloadFile(filepath string, url string) error {
-	out, err := os.Create(filepath + ".tmp")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-
-	resp, err := http.Get(url)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		out.Close()
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the part file is complete, or no longer matches the remote file
+		os.Remove(part)
+		return DownloadFileContext(ctx, filepath, url)
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
 		return errors.New("requested image download is not supported: StatusCode " + strconv.Itoa(resp.StatusCode))
 	}
 
-	defer resp.Body.Close()
-
-	counter := &WriteCounter{}
-	if _, err = io.Copy(out, io.TeeReader(resp.Body, counter)); err != nil {
-		out.Close()
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
 		return err
 	}
 
-	fmt.Print("\n")
+	var total uint64
+	if resp.ContentLength >= 0 {
+		total = uint64(offset + resp.ContentLength)
+	}
+	progress := newDownloadProgress(path.Base(filepath), uint64(offset), total)
+	_, err = io.Copy(out, io.TeeReader(resp.Body, progress))
 	out.Close()
-
-	if err = os.Rename(filepath+".tmp", filepath); err != nil {
+	progress.Finish(err == nil)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		return err
 	}
-	return nil
+
+	return os.Rename(part, filepath)
 }
 
 func GetImageURL(version string) string {
@@ -340,6 +440,17 @@ func DirExists(path string) (bool, error) {
 	return false, err
 }
 
+// HostArch returns the qemu architecture matching the host, aarch64 or x86_64
+func HostArch() (string, error) {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "aarch64", nil
+	case "amd64":
+		return "x86_64", nil
+	}
+	return "", errors.New("unsupported host architecture: " + runtime.GOARCH)
+}
+
 func CommandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil
@@ -351,10 +462,10 @@ func GenerateRandomAlias() string {
 	var nounsString []string
 
 	adjectives, _ := f.ReadFile("adjectives.txt")
-	adjectivesString = strings.Split(string(adjectives), "\n")
+	adjectivesString = strings.Fields(string(adjectives))
 
 	nouns, _ := f.ReadFile("nouns.txt")
-	nounsString = strings.Split(string(nouns), "\n")
+	nounsString = strings.Fields(string(nouns))
 
 	rand.Seed(time.Now().Unix())
 	n := rand.Int() % len(adjectivesString)
@@ -374,6 +485,28 @@ type CmdResult struct {
 	Err  error
 }
 
+// ForEach calls fn with 0 to n-1, at most parallel calls at a time, and returns once all of them have
+// returned. Callers record results by index, so that they are reported in order whatever finished first.
+func ForEach(n int, parallel int, fn func(i int)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 func PassphrasePromptForDecryption() (string, error) {
 	pass, err := readSecret("enter passphrase:")
 	if err != nil {